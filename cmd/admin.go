@@ -0,0 +1,143 @@
+// cmd/admin.go
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminUsage = `usage: s3-proxy admin [flags] <command> [args]
+
+commands:
+  buckets [-probe]              list buckets and their backends
+  backends                      show backend health and drain state
+  crypto                        show configured crypto layers
+  journal [-bucket name]        show objects with missing replicas
+  drain <backend>               stop routing traffic to a backend
+  enable <backend>              resume routing traffic to a backend
+  repair [-bucket name]         replay the journal to lagging backends
+  scrub [-bucket name] [-deep] [-repair]
+                                compare replicas and optionally fix them
+  jobs [id]                     list jobs or show one
+  reload                        reload the configuration file
+  seal                          show which crypto profiles are sealed
+  unseal <share file|->         submit key shares to unseal crypto profiles
+`
+
+func Admin() error {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	addr := fs.String("addr", "http://127.0.0.1:9090", "admin listener address")
+	token := fs.String("token", os.Getenv("S3_PROXY_ADMIN_TOKEN"), "admin API token (default $S3_PROXY_ADMIN_TOKEN)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), adminUsage, "\nflags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing admin command")
+	}
+
+	command, args := fs.Arg(0), fs.Args()[1:]
+	sub := flag.NewFlagSet(command, flag.ExitOnError)
+	bucket := sub.String("bucket", "", "limit to one bucket")
+	probe := sub.Bool("probe", false, "probe each backend bucket")
+	deep := sub.Bool("deep", false, "download and verify object contents")
+	repair := sub.Bool("repair", false, "fix divergent replicas")
+	sub.Parse(args)
+
+	query := url.Values{}
+	var method, path string
+	var payload io.Reader
+	switch command {
+	case "buckets":
+		method, path = http.MethodGet, "/admin/buckets"
+		if *probe {
+			query.Set("probe", "true")
+		}
+	case "backends":
+		method, path = http.MethodGet, "/admin/backends"
+	case "crypto":
+		method, path = http.MethodGet, "/admin/crypto"
+	case "journal":
+		method, path = http.MethodGet, "/admin/journal"
+	case "drain", "enable":
+		if sub.NArg() != 1 {
+			return fmt.Errorf("usage: s3-proxy admin %s <backend>", command)
+		}
+		method, path = http.MethodPost, "/admin/backends/"+url.PathEscape(sub.Arg(0))+"/"+command
+	case "repair", "scrub":
+		method, path = http.MethodPost, "/admin/jobs/"+command
+		if command == "scrub" {
+			query.Set("deep", strconv.FormatBool(*deep))
+			query.Set("repair", strconv.FormatBool(*repair))
+		}
+	case "jobs":
+		method, path = http.MethodGet, "/admin/jobs"
+		if sub.NArg() > 0 {
+			path += "/" + url.PathEscape(sub.Arg(0))
+		}
+	case "reload":
+		method, path = http.MethodPost, "/admin/reload"
+	case "seal":
+		method, path = http.MethodGet, "/admin/seal"
+	case "unseal":
+		if sub.NArg() == 0 {
+			return fmt.Errorf("usage: s3-proxy admin unseal <share file|->...")
+		}
+		var shares []string
+		for _, name := range sub.Args() {
+			read, err := readShares(name)
+			if err != nil {
+				return err
+			}
+			for _, share := range read {
+				shares = append(shares, share.String())
+			}
+		}
+		method, path = http.MethodPost, "/admin/unseal"
+		payload = strings.NewReader(strings.Join(shares, "\n"))
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown admin command: %s", command)
+	}
+	if *bucket != "" {
+		query.Set("bucket", *bucket)
+	}
+
+	target := strings.TrimSuffix(*addr, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, payload)
+	if err != nil {
+		return fmt.Errorf("cannot build admin request: %v", err)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("admin request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot read admin response: %v", err)
+	}
+	fmt.Print(string(body))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// cmd/config_check.go
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"s3-proxy/internal/config"
+)
+
+// ConfigCheck validates a config file without starting the proxy and exits
+// non-zero if the proxy would refuse it, so it can gate deployments in CI.
+func ConfigCheck() error {
+	cfgPath := flag.String("config", "configs/main.yaml", "path to yaml config")
+	strict := flag.Bool("strict", false, "treat warnings as errors")
+	flag.Parse()
+
+	_, problems, err := config.Check(*cfgPath)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", *cfgPath, p)
+	}
+	var invalid *config.ValidationError
+	if errors.As(problems.Err(), &invalid) {
+		return fmt.Errorf("%s: %d error(s) found", *cfgPath, len(invalid.Problems))
+	}
+	if *strict && len(problems) > 0 {
+		return fmt.Errorf("%s: %d warning(s) found", *cfgPath, len(problems))
+	}
+	fmt.Printf("%s: ok\n", *cfgPath)
+	return nil
+}
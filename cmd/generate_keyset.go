@@ -2,16 +2,12 @@
 package cmd
 
 import (
-	"bytes"
-	"crypto/rand"
-	"encoding/base64"
+	"flag"
 	"fmt"
-	"os"
-	"strings"
+	"s3-proxy/internal/crypto"
+	"s3-proxy/internal/kms"
 
-	"github.com/google/tink/go/aead"
-	"github.com/google/tink/go/insecurecleartextkeyset"
-	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
 )
 
 type Keysets struct {
@@ -20,20 +16,28 @@ type Keysets struct {
 	ChaChaKey  string
 }
 
+// GenerateKeyset replaces the TINK_KEYSET, AES_KEY and CHACHA_KEY variables
+// of .env that the sample config reads. Other lines are left alone. "keys
+// generate" does the same for any config.
 func GenerateKeyset() error {
-	keysets, err := generateAllKeysets()
+	cfgPath := flag.String("config", "configs/main.yaml", "path to yaml config holding the KMS")
+	kmsID := flag.String("kms", "", "encrypt the Tink keyset with this KMS from the config")
+	flag.Parse()
+
+	var master tink.AEAD
+	if *kmsID != "" {
+		k, err := loadKMS(*cfgPath, *kmsID)
+		if err != nil {
+			return err
+		}
+		master = kms.AEAD(k)
+	}
+
+	keysets, err := generateAllKeysets(master)
 	if err != nil {
 		return err
 	}
 
-	// // Print the keysets
-	// fmt.Println("Base64-encoded JSON keyset:")
-	// fmt.Println(keysets.TinkKeyset)
-	// fmt.Println("\n🔐 AES-256-GCM Key (Base64):")
-	// fmt.Println(keysets.AESKey)
-	// fmt.Println("\n🔐 ChaCha20-Poly1305 Key (Base64):")
-	// fmt.Println(keysets.ChaChaKey)
-
 	// Update .env file
 	if err := updateEnvFile(keysets); err != nil {
 		return fmt.Errorf("failed to update .env file: %v", err)
@@ -42,18 +46,18 @@ func GenerateKeyset() error {
 	return nil
 }
 
-func generateAllKeysets() (*Keysets, error) {
-	tinkKeyset, err := generateTinkKeyset()
+func generateAllKeysets(master tink.AEAD) (*Keysets, error) {
+	tinkKeyset, err := crypto.NewTinkKeyset(crypto.DefaultTinkTemplate, master)
 	if err != nil {
 		return nil, fmt.Errorf("Tink keyset generation failed: %v", err)
 	}
 
-	aesKey, err := generateAESKey()
+	aesKey, err := crypto.NewRawKey(32)
 	if err != nil {
 		return nil, fmt.Errorf("AES key generation failed: %v", err)
 	}
 
-	chaChaKey, err := generateChaChaKey()
+	chaChaKey, err := crypto.NewRawKey(32)
 	if err != nil {
 		return nil, fmt.Errorf("ChaCha20-Poly1305 key generation failed: %v", err)
 	}
@@ -65,75 +69,27 @@ func generateAllKeysets() (*Keysets, error) {
 	}, nil
 }
 
-func generateTinkKeyset() (string, error) {
-	handle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
-	if err != nil {
-		return "", fmt.Errorf("failed to generate new keyset handle: %v", err)
-	}
-
-	buf := new(bytes.Buffer)
-	writer := keyset.NewJSONWriter(buf)
-	err = insecurecleartextkeyset.Write(handle, writer)
+func updateEnvFile(keysets *Keysets) error {
+	err := updateEnvValues(".env", map[string]string{
+		"TINK_KEYSET": keysets.TinkKeyset,
+		"AES_KEY":     keysets.AESKey,
+		"CHACHA_KEY":  keysets.ChaChaKey,
+	}, true)
 	if err != nil {
-		return "", fmt.Errorf("failed to write keyset: %v", err)
-	}
-
-	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
-}
-
-func generateAESKey() (string, error) {
-	key := make([]byte, 32)
-	if _, err := rand.Read(key); err != nil {
-		return "", err
+		return err
 	}
-	return base64.StdEncoding.EncodeToString(key), nil
-}
 
-func generateChaChaKey() (string, error) {
-	key := make([]byte, 32)
-	if _, err := rand.Read(key); err != nil {
-		return "", err
-	}
-	return base64.StdEncoding.EncodeToString(key), nil
+	fmt.Println("\n✅ Successfully updated keysets in .env file")
+	return nil
 }
 
-func updateEnvFile(keysets *Keysets) error {
-	envPath := ".env"
-	var existingContent string
-
-	// Read existing .env file if it exists
-	if _, err := os.Stat(envPath); err == nil {
-		content, err := os.ReadFile(envPath)
-		if err != nil {
-			return fmt.Errorf("failed to read existing .env file: %v", err)
-		}
-		existingContent = string(content)
-	}
-
-	// Split content into lines
-	lines := strings.Split(existingContent, "\n")
-	
-	// Create new content with updated keyset lines
-	var newContent strings.Builder
-	
-	// Update first three lines with new keysets
-	newContent.WriteString(fmt.Sprintf("TINK_KEYSET=\"%s\"\n", keysets.TinkKeyset))
-	newContent.WriteString(fmt.Sprintf("AES_KEY=\"%s\"\n", keysets.AESKey))
-	newContent.WriteString(fmt.Sprintf("CHACHA_KEY=\"%s\"\n", keysets.ChaChaKey))
-	
-	// Add the rest of the content if it exists
-	if len(lines) > 3 {
-		newContent.WriteString(strings.Join(lines[3:], "\n"))
-		if !strings.HasSuffix(existingContent, "\n") {
-			newContent.WriteString("\n")
-		}
-	}
-
-	// Write the content to the .env file
-	if err := os.WriteFile(envPath, []byte(newContent.String()), 0644); err != nil {
-		return fmt.Errorf("failed to write .env file: %v", err)
+// loadKMS connects to a KMS defined in the config at path. The rest of the
+// config need not be valid yet, since the keysets it refers to may be the
+// ones being generated.
+func loadKMS(path, id string) (kms.KMS, error) {
+	cfg, err := loadKeyConfig(path)
+	if err != nil {
+		return nil, err
 	}
-
-	fmt.Println("\n✅ Successfully updated keysets in .env file")
-	return nil
+	return kmsFromConfig(cfg, id)
 }
@@ -0,0 +1,546 @@
+// cmd/keys.go
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"s3-proxy/internal/config"
+	"s3-proxy/internal/crypto"
+	"s3-proxy/internal/kms"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/tink/go/tink"
+	"github.com/joho/godotenv"
+)
+
+const keysUsage = `usage: s3-proxy keys <command> [flags]
+
+commands:
+  generate      generate keys for the layers of crypto profiles
+  fingerprint   show fingerprints of the configured keys
+  public        print the public keyset of a hybrid tink layer
+  split         split the keys of a crypto profile into Shamir shares
+  combine       rebuild the keys of a crypto profile from shares
+  derive        set up a layer key derived from a passphrase
+  wrap          encrypt a keyset with a passphrase
+  templates     list the Tink templates a tink layer can use
+
+Run "s3-proxy keys <command> -h" for its flags.
+`
+
+// Keys manages the keys of the crypto profiles in a config.
+func Keys() error {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, keysUsage)
+		return fmt.Errorf("missing keys command")
+	}
+	command, args := os.Args[1], os.Args[2:]
+	switch command {
+	case "generate":
+		return keysGenerate(args)
+	case "fingerprint":
+		return keysFingerprint(args)
+	case "public":
+		return keysPublic(args)
+	case "split":
+		return keysSplit(args)
+	case "combine":
+		return keysCombine(args)
+	case "derive":
+		return keysDerive(args)
+	case "wrap":
+		return keysWrap(args)
+	case "templates":
+		for _, name := range crypto.TinkTemplateNames() {
+			if name == crypto.DefaultTinkTemplate {
+				name += " (default)"
+			}
+			fmt.Println(name)
+		}
+		return nil
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stderr, keysUsage)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, keysUsage)
+	return fmt.Errorf("unknown keys command: %s", command)
+}
+
+// generatedKey is one key written by "keys generate". Layers that share a
+// secret source in the config share the key too.
+type generatedKey struct {
+	CryptoID    string `json:"crypto_id"`
+	Layer       int    `json:"layer"`
+	Algorithm   string `json:"algorithm"`
+	Template    string `json:"template,omitempty"`
+	EnvVar      string `json:"env_var,omitempty"`
+	File        string `json:"file,omitempty"`
+	Keyset      string `json:"keyset"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func keysGenerate(args []string) error {
+	fs := flag.NewFlagSet("keys generate", flag.ExitOnError)
+	cfgPath := fs.String("config", "configs/main.yaml", "path to yaml config")
+	cryptoIDs := fs.String("crypto", "", "comma-separated crypto IDs (default: all)")
+	layer := fs.Int("layer", -1, "only generate the key of this layer index")
+	template := fs.String("template", crypto.DefaultTinkTemplate, `Tink template for tink layers (see "keys templates")`)
+	sink := fs.String("sink", "env", "where to write keys: env, file or json (stdout)")
+	envFile := fs.String("env-file", ".env", "env file written by the env sink")
+	dir := fs.String("dir", "keys", "directory for layers without a file source, with the file sink")
+	force := fs.Bool("force", false, "replace keys that already exist; data encrypted with them becomes unreadable")
+	fs.Parse(args)
+
+	if _, ok := crypto.TinkTemplates[*template]; !ok {
+		return fmt.Errorf("unknown Tink template %q, see \"s3-proxy keys templates\"", *template)
+	}
+	if *sink != "env" && *sink != "file" && *sink != "json" {
+		return fmt.Errorf("unknown sink %q, expected env, file or json", *sink)
+	}
+	cfg, err := loadKeyConfig(*cfgPath)
+	if err != nil {
+		return err
+	}
+	profiles, err := selectProfiles(cfg, *cryptoIDs)
+	if err != nil {
+		return err
+	}
+
+	masters := make(map[string]tink.AEAD)
+	shared := make(map[string]*generatedKey)
+	var keys []*generatedKey
+	for _, profile := range profiles {
+		for i, cfgLayer := range profile.Layers {
+			if *layer >= 0 && i != *layer {
+				continue
+			}
+			if !hasKey(cfgLayer.Algorithm) || cfgLayer.Passphrase.Derived() {
+				continue
+			}
+			key := &generatedKey{CryptoID: profile.ID, Layer: i, Algorithm: cfgLayer.Algorithm}
+			if cfgLayer.Keyset != nil {
+				key.EnvVar, key.File = cfgLayer.Keyset.EnvVar, cfgLayer.Keyset.File
+			}
+			switch *sink {
+			case "env":
+				if key.EnvVar == "" {
+					key.EnvVar = derivedKeyName(profile.ID, i)
+				}
+			case "file":
+				if key.File == "" {
+					key.File = filepath.Join(*dir, fmt.Sprintf("%s-%d.key", profile.ID, i))
+				}
+			}
+			if first, ok := shared[key.source()]; ok {
+				if first.Algorithm != key.Algorithm {
+					return fmt.Errorf("crypto %s layer %d shares %s with crypto %s layer %d, but uses %s instead of %s",
+						key.CryptoID, i, key.source(), first.CryptoID, first.Layer, key.Algorithm, first.Algorithm)
+				}
+				key.Template, key.Keyset, key.Fingerprint = first.Template, first.Keyset, first.Fingerprint
+				keys = append(keys, key)
+				continue
+			}
+
+			switch cfgLayer.Algorithm {
+			case "tink":
+				var master tink.AEAD
+				if cfgLayer.KMS != "" {
+					if master = masters[cfgLayer.KMS]; master == nil {
+						k, err := kmsFromConfig(cfg, cfgLayer.KMS)
+						if err != nil {
+							return err
+						}
+						master = kms.AEAD(k)
+						masters[cfgLayer.KMS] = master
+					}
+				}
+				key.Template = *template
+				key.Keyset, err = crypto.NewTinkKeyset(*template, master)
+			default:
+				key.Keyset, err = crypto.NewRawKey(rawKeySize(cfgLayer))
+			}
+			if err != nil {
+				return fmt.Errorf("crypto %s layer %d: %w", profile.ID, i, err)
+			}
+			key.Fingerprint = crypto.Fingerprint(key.Keyset)
+			if cfgLayer.Passphrase != nil {
+				if key.Keyset, err = wrapWithPassphrase(key.Keyset, cfgLayer.Passphrase); err != nil {
+					return fmt.Errorf("crypto %s layer %d: %w", profile.ID, i, err)
+				}
+			}
+			shared[key.source()] = key
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no layer with a key selected")
+	}
+
+	return storeKeys(keys, *sink, *envFile, *force)
+}
+
+// storeKeys writes keys to a sink, then lists them with their
+// fingerprints.
+func storeKeys(keys []*generatedKey, sink, envFile string, force bool) error {
+	switch sink {
+	case "json":
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		if err := out.Encode(keys); err != nil {
+			return err
+		}
+	case "env":
+		values := make(map[string]string)
+		for _, key := range keys {
+			values[key.EnvVar] = key.Keyset
+		}
+		if err := updateEnvValues(envFile, values, force); err != nil {
+			return err
+		}
+	case "file":
+		if err := writeKeyFiles(keys, force); err != nil {
+			return err
+		}
+	}
+
+	// With the json sink stdout carries the keys, so the summary goes to
+	// stderr.
+	summary := os.Stdout
+	if sink == "json" {
+		summary = os.Stderr
+	}
+	for _, key := range keys {
+		dest := ""
+		switch sink {
+		case "env":
+			dest = " -> " + envFile + ":" + key.EnvVar
+		case "file":
+			dest = " -> " + key.File
+		}
+		fmt.Fprintf(summary, "%s layers[%d] %s %s%s\n", key.CryptoID, key.Layer, key.describe(), key.Fingerprint, dest)
+	}
+	return nil
+}
+
+// source identifies where the config reads the key of a layer from, so
+// layers sharing it get the same key.
+func (k *generatedKey) source() string {
+	switch {
+	case k.EnvVar != "":
+		return "env " + k.EnvVar
+	case k.File != "":
+		return "file " + k.File
+	}
+	return fmt.Sprintf("crypto %s layer %d", k.CryptoID, k.Layer)
+}
+
+func (k *generatedKey) describe() string {
+	if k.Template != "" {
+		return k.Algorithm + "/" + k.Template
+	}
+	return k.Algorithm
+}
+
+func keysFingerprint(args []string) error {
+	fs := flag.NewFlagSet("keys fingerprint", flag.ExitOnError)
+	cfgPath := fs.String("config", "configs/main.yaml", "path to yaml config")
+	cryptoIDs := fs.String("crypto", "", "comma-separated crypto IDs (default: all)")
+	fs.Parse(args)
+
+	cfg, err := loadKeyConfig(*cfgPath)
+	if err != nil {
+		return err
+	}
+	profiles, err := selectProfiles(cfg, *cryptoIDs)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, profile := range profiles {
+		if profile.Sealed {
+			fmt.Printf("%s: sealed, its keys come from key shares\n", profile.ID)
+			continue
+		}
+		for i, cfgLayer := range profile.Layers {
+			if !hasKey(cfgLayer.Algorithm) {
+				fmt.Printf("%s layers[%d] %s: no key\n", profile.ID, i, cfgLayer.Algorithm)
+				continue
+			}
+			key, err := cfgLayer.Key()
+			if err == nil && key == "" {
+				err = fmt.Errorf("keyset is empty")
+			}
+			if err != nil {
+				failed++
+				fmt.Printf("%s layers[%d] %s: %v\n", profile.ID, i, cfgLayer.Algorithm, err)
+				continue
+			}
+			fmt.Printf("%s layers[%d] %s %s\n", profile.ID, i, cfgLayer.Algorithm, crypto.Fingerprint(key))
+			if cfgLayer.Algorithm != "tink" {
+				continue
+			}
+			var master tink.AEAD
+			if cfgLayer.KMS != "" {
+				k, err := kmsFromConfig(cfg, cfgLayer.KMS)
+				if err != nil {
+					fmt.Printf("    cannot open keyset: %v\n", err)
+					continue
+				}
+				master = kms.AEAD(k)
+			}
+			described, err := crypto.DescribeTinkKeyset(key, master)
+			if err != nil {
+				failed++
+				fmt.Printf("    %v\n", err)
+				continue
+			}
+			for _, line := range described {
+				fmt.Printf("    key %s\n", line)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d key(s) could not be read", failed)
+	}
+	return nil
+}
+
+// keysPublic prints the public half of the hybrid keyset of a layer. A
+// write_only proxy configured with it can encrypt but never decrypt.
+func keysPublic(args []string) error {
+	fs := flag.NewFlagSet("keys public", flag.ExitOnError)
+	cfgPath := fs.String("config", "configs/main.yaml", "path to yaml config holding the private keyset")
+	cryptoID := fs.String("crypto", "", "crypto ID of the layer")
+	layer := fs.Int("layer", 0, "layer index")
+	fs.Parse(args)
+
+	cfg, err := loadKeyConfig(*cfgPath)
+	if err != nil {
+		return err
+	}
+	if *cryptoID == "" {
+		return fmt.Errorf("-crypto is required")
+	}
+	profiles, err := selectProfiles(cfg, *cryptoID)
+	if err != nil {
+		return err
+	}
+	if *layer < 0 || *layer >= len(profiles[0].Layers) {
+		return fmt.Errorf("crypto %s has no layer %d", *cryptoID, *layer)
+	}
+	cfgLayer := profiles[0].Layers[*layer]
+	if cfgLayer.Algorithm != "tink" || cfgLayer.Keyset == nil {
+		return fmt.Errorf("crypto %s layer %d is not a tink layer", *cryptoID, *layer)
+	}
+	key, err := cfgLayer.Key()
+	if err != nil {
+		return err
+	}
+	var master tink.AEAD
+	if cfgLayer.KMS != "" {
+		k, err := kmsFromConfig(cfg, cfgLayer.KMS)
+		if err != nil {
+			return err
+		}
+		master = kms.AEAD(k)
+	}
+	public, err := crypto.PublicTinkKeyset(key, master)
+	if err != nil {
+		return fmt.Errorf("crypto %s layer %d: %w", *cryptoID, *layer, err)
+	}
+	fmt.Println(public)
+	return nil
+}
+
+// loadKeyConfig reads a config without requiring it to be valid, since the
+// keys it refers to may not exist yet.
+func loadKeyConfig(path string) (*config.Config, error) {
+	cfg, _, err := config.Check(path)
+	return cfg, err
+}
+
+// selectProfiles returns the crypto profiles named in a comma-separated
+// list, or all of them for an empty one.
+func selectProfiles(cfg *config.Config, ids string) ([]config.ConfigCrypto, error) {
+	if ids == "" {
+		return cfg.Crypto, nil
+	}
+	var profiles []config.ConfigCrypto
+	for _, id := range strings.Split(ids, ",") {
+		found := false
+		for _, profile := range cfg.Crypto {
+			if profile.ID == id {
+				profiles = append(profiles, profile)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown crypto ID: %s", id)
+		}
+	}
+	return profiles, nil
+}
+
+// hasKey reports whether layers of an algorithm take a keyset.
+func hasKey(algorithm string) bool {
+	switch algorithm {
+	case "tink", "aes", "aes-gcm-siv", "chacha20poly1305", "xchacha20poly1305":
+		return true
+	}
+	return false
+}
+
+// rawKeySize is the size of the key generated for a layer without a Tink
+// keyset. AES-CTR+HMAC takes an AES-256 key and an HMAC key.
+func rawKeySize(cfgLayer config.ConfigCryptoLayer) int {
+	if cfgLayer.Algorithm == "aes" && cfgLayer.Params["mode"] == "ctr-hmac" {
+		return 64
+	}
+	return 32
+}
+
+// derivedKeyName names the environment variable of a layer that has none
+// in the config.
+func derivedKeyName(cryptoID string, layer int) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, cryptoID)
+	return name + "_LAYER" + strconv.Itoa(layer) + "_KEY"
+}
+
+// updateEnvValues sets variables in an env file, replacing their lines in
+// place and appending the new ones. Every other line is kept as is. A
+// variable that already holds a value is only replaced with force.
+func updateEnvValues(path string, values map[string]string, force bool) error {
+	var lines []string
+	mode := os.FileMode(0o600)
+	content, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		if len(content) == 0 {
+			lines = nil
+		}
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	if !force {
+		existing, err := godotenv.Unmarshal(string(content))
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		var taken []string
+		for name := range values {
+			if existing[name] != "" {
+				taken = append(taken, fmt.Sprintf("%s (%s)", name, crypto.Fingerprint(existing[name])))
+			}
+		}
+		if len(taken) > 0 {
+			sort.Strings(taken)
+			return fmt.Errorf("%s already sets %s; use -force to replace them, data encrypted with the old keys becomes unreadable",
+				path, strings.Join(taken, ", "))
+		}
+	}
+
+	done := make(map[string]bool)
+	for i, line := range lines {
+		m := envAssignment.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if value, ok := values[m[2]]; ok {
+			lines[i] = fmt.Sprintf("%s%s=%q", m[1], m[2], value)
+			done[m[2]] = true
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if !done[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s=%q", name, values[name]))
+	}
+	return writeFileAtomic(path, []byte(strings.Join(lines, "\n")+"\n"), mode)
+}
+
+// envAssignment matches a variable assignment in an env file, with an
+// optional export prefix.
+var envAssignment = regexp.MustCompile(`^(\s*(?:export\s+)?)([A-Za-z_][A-Za-z0-9_.]*)\s*=`)
+
+// writeKeyFiles writes each key to its own file, readable only by the
+// owner. Existing non-empty files are only replaced with force.
+func writeKeyFiles(keys []*generatedKey, force bool) error {
+	written := make(map[string]bool)
+	for _, key := range keys {
+		if written[key.File] {
+			continue
+		}
+		if !force {
+			if old, err := os.ReadFile(key.File); err == nil && len(strings.TrimSpace(string(old))) > 0 {
+				return fmt.Errorf("%s already holds a key (%s); use -force to replace it, data encrypted with the old key becomes unreadable",
+					key.File, crypto.Fingerprint(strings.TrimSpace(string(old))))
+			}
+		}
+	}
+	for _, key := range keys {
+		if written[key.File] {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(key.File), 0o700); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(key.File, []byte(key.Keyset), 0o600); err != nil {
+			return err
+		}
+		written[key.File] = true
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func kmsFromConfig(cfg *config.Config, id string) (kms.KMS, error) {
+	for _, cfgKMS := range cfg.KMS {
+		if cfgKMS.ID == id {
+			return kms.New(cfgKMS)
+		}
+	}
+	return nil, fmt.Errorf("unknown KMS ID: %s", id)
+}
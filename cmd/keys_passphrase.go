@@ -0,0 +1,129 @@
+// cmd/keys_passphrase.go
+package cmd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"s3-proxy/internal/config"
+	"s3-proxy/internal/crypto"
+	"strings"
+)
+
+// argon2Flags registers the Argon2id cost flags of a keys command.
+func argon2Flags(fs *flag.FlagSet) func() crypto.Argon2Params {
+	def := crypto.DefaultArgon2Params
+	t := fs.Uint("time", uint(def.Time), "argon2id passes")
+	m := fs.Uint("memory", uint(def.Memory), "argon2id memory in KiB")
+	p := fs.Uint("threads", uint(def.Threads), "argon2id threads")
+	return func() crypto.Argon2Params {
+		return crypto.Argon2Params{Time: uint32(*t), Memory: uint32(*m), Threads: uint8(min(*p, 255))}
+	}
+}
+
+// readPassphrase reads the passphrase from an environment variable or,
+// when it is unset and stdin is free, from the first line of stdin.
+func readPassphrase(envVar string, stdinFree bool) (string, error) {
+	if passphrase := os.Getenv(envVar); passphrase != "" {
+		return passphrase, nil
+	}
+	if !stdinFree {
+		return "", fmt.Errorf("set %s to the passphrase", envVar)
+	}
+	fmt.Fprintf(os.Stderr, "passphrase (or set %s): ", envVar)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase is empty")
+	}
+	return passphrase, nil
+}
+
+// keysDerive picks a salt for a layer whose key is derived from a
+// passphrase and prints the passphrase block of its config.
+func keysDerive(args []string) error {
+	fs := flag.NewFlagSet("keys derive", flag.ExitOnError)
+	envVar := fs.String("passphrase-env", "S3_PROXY_PASSPHRASE", "environment variable holding the passphrase, also written to the config")
+	params := argon2Flags(fs)
+	fs.Parse(args)
+
+	passphrase, err := readPassphrase(*envVar, true)
+	if err != nil {
+		return err
+	}
+	p := params()
+	salt, check, key, err := crypto.NewDerivedKey(passphrase, p)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(`passphrase:
+  secret:
+    env_var: %s
+  salt: %s
+  check: %s
+  time: %d
+  memory: %d
+  threads: %d
+`, *envVar, base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(check), p.Time, p.Memory, p.Threads)
+	fmt.Fprintf(os.Stderr, "derived key %s; add the block to a layer that takes a 32-byte key, without a keyset\n", crypto.Fingerprint(key))
+	return nil
+}
+
+// keysWrap encrypts a keyset with a passphrase, for a layer that sets
+// passphrase without a salt.
+func keysWrap(args []string) error {
+	fs := flag.NewFlagSet("keys wrap", flag.ExitOnError)
+	in := fs.String("in", "-", "file holding the keyset to wrap, - for stdin")
+	out := fs.String("out", "", "file to write the wrapped keyset to (default: stdout)")
+	envVar := fs.String("passphrase-env", "S3_PROXY_PASSPHRASE", "environment variable holding the passphrase")
+	params := argon2Flags(fs)
+	fs.Parse(args)
+
+	passphrase, err := readPassphrase(*envVar, *in != "-")
+	if err != nil {
+		return err
+	}
+	var keyset []byte
+	if *in == "-" {
+		keyset, err = io.ReadAll(os.Stdin)
+	} else {
+		keyset, err = os.ReadFile(*in)
+	}
+	if err != nil {
+		return err
+	}
+	key := strings.TrimSpace(string(keyset))
+	if key == "" {
+		return fmt.Errorf("keyset is empty")
+	}
+	wrapped, err := crypto.WrapKeyset(key, passphrase, params())
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		fmt.Println(wrapped)
+	} else if err := writeFileAtomic(*out, []byte(wrapped), 0o600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrapped keyset %s\n", crypto.Fingerprint(key))
+	return nil
+}
+
+// wrapWithPassphrase wraps a generated key for a layer that reads its
+// keyset wrapped, with the layer's own passphrase.
+func wrapWithPassphrase(key string, pp *config.ConfigPassphrase) (string, error) {
+	passphrase, err := pp.Secret.Get()
+	if err != nil {
+		return "", fmt.Errorf("passphrase: %w", err)
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase is empty")
+	}
+	return crypto.WrapKeyset(key, passphrase, crypto.DefaultArgon2Params)
+}
@@ -0,0 +1,186 @@
+// cmd/keys_shares.go
+package cmd
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"s3-proxy/internal/crypto"
+	"s3-proxy/internal/escrow"
+	"strings"
+)
+
+// keysSplit splits the keys of a crypto profile into Shamir shares for
+// escrow. The shares are handed to different people; any threshold of
+// them rebuild the keys with "keys combine" or unseal a proxy.
+func keysSplit(args []string) error {
+	fs := flag.NewFlagSet("keys split", flag.ExitOnError)
+	cfgPath := fs.String("config", "configs/main.yaml", "path to yaml config holding the keys")
+	cryptoID := fs.String("crypto", "", "crypto ID whose keys to split")
+	n := fs.Int("shares", 5, "number of shares")
+	threshold := fs.Int("threshold", 3, "shares needed to rebuild the keys")
+	out := fs.String("out", "", "write each share to its own file in this directory instead of stdout")
+	fs.Parse(args)
+
+	if *cryptoID == "" {
+		return fmt.Errorf("-crypto is required")
+	}
+	cfg, err := loadKeyConfig(*cfgPath)
+	if err != nil {
+		return err
+	}
+	profiles, err := selectProfiles(cfg, *cryptoID)
+	if err != nil {
+		return err
+	}
+	bundle := &escrow.Bundle{CryptoID: *cryptoID}
+	for i, cfgLayer := range profiles[0].Layers {
+		if !hasKey(cfgLayer.Algorithm) {
+			continue
+		}
+		if cfgLayer.Passphrase.Derived() {
+			return fmt.Errorf("crypto %s layer %d derives its key from a passphrase; escrow the passphrase instead", *cryptoID, i)
+		}
+		if cfgLayer.Keyset == nil {
+			return fmt.Errorf("crypto %s layer %d has no keyset", *cryptoID, i)
+		}
+		key, err := cfgLayer.Keyset.Get()
+		if err == nil && key == "" {
+			err = fmt.Errorf("keyset is empty")
+		}
+		if err != nil {
+			return fmt.Errorf("crypto %s layer %d: %w", *cryptoID, i, err)
+		}
+		bundle.Keys = append(bundle.Keys, escrow.Key{
+			Layer:     i,
+			Algorithm: cfgLayer.Algorithm,
+			KMS:       cfgLayer.KMS,
+			EnvVar:    cfgLayer.Keyset.EnvVar,
+			File:      cfgLayer.Keyset.File,
+			Keyset:    key,
+		})
+	}
+	if len(bundle.Keys) == 0 {
+		return fmt.Errorf("crypto %s has no layer with a key", *cryptoID)
+	}
+
+	shares, err := escrow.Split(bundle, *n, *threshold)
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		if err := os.MkdirAll(*out, 0o700); err != nil {
+			return err
+		}
+	}
+	for i, share := range shares {
+		if *out == "" {
+			fmt.Printf("# share %d of %d\n%s\n", i+1, *n, share)
+			continue
+		}
+		name := filepath.Join(*out, fmt.Sprintf("%s-share-%d-of-%d.txt", *cryptoID, i+1, *n))
+		if err := writeFileAtomic(name, []byte(share.String()+"\n"), 0o600); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "wrote", name)
+	}
+	fmt.Fprintf(os.Stderr, "split %s: %d shares, %d needed to rebuild\n", shares[0].ID(), *n, *threshold)
+	for _, key := range bundle.Keys {
+		fmt.Fprintf(os.Stderr, "%s layers[%d] %s %s\n", *cryptoID, key.Layer, key.Algorithm, crypto.Fingerprint(key.Keyset))
+	}
+	return nil
+}
+
+// keysCombine rebuilds the keys of a crypto profile from shares and stores
+// them like "keys generate" does.
+func keysCombine(args []string) error {
+	fs := flag.NewFlagSet("keys combine", flag.ExitOnError)
+	sink := fs.String("sink", "json", "where to write keys: env, file or json (stdout)")
+	envFile := fs.String("env-file", ".env", "env file written by the env sink")
+	dir := fs.String("dir", "keys", "directory for layers without a file source, with the file sink")
+	force := fs.Bool("force", false, "replace keys that already exist")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: s3-proxy keys combine [flags] <share file|->...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *sink != "env" && *sink != "file" && *sink != "json" {
+		return fmt.Errorf("unknown sink %q, expected env, file or json", *sink)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no share files given")
+	}
+	var shares []*escrow.Share
+	for _, name := range fs.Args() {
+		read, err := readShares(name)
+		if err != nil {
+			return err
+		}
+		shares = append(shares, read...)
+	}
+	bundle, err := escrow.Combine(shares)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*generatedKey, 0, len(bundle.Keys))
+	for _, k := range bundle.Keys {
+		key := &generatedKey{
+			CryptoID:    bundle.CryptoID,
+			Layer:       k.Layer,
+			Algorithm:   k.Algorithm,
+			EnvVar:      k.EnvVar,
+			File:        k.File,
+			Keyset:      k.Keyset,
+			Fingerprint: crypto.Fingerprint(k.Keyset),
+		}
+		if *sink == "env" && key.EnvVar == "" {
+			key.EnvVar = derivedKeyName(key.CryptoID, key.Layer)
+		}
+		if *sink == "file" && key.File == "" {
+			key.File = filepath.Join(*dir, fmt.Sprintf("%s-%d.key", key.CryptoID, key.Layer))
+		}
+		keys = append(keys, key)
+	}
+	return storeKeys(keys, *sink, *envFile, *force)
+}
+
+// readShares reads the shares in a file, or standard input for "-", one per
+// line. Other lines are ignored.
+func readShares(name string) ([]*escrow.Share, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var shares []*escrow.Share
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(text, "s3proxy-share") {
+			continue
+		}
+		share, err := escrow.ParseShare(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		shares = append(shares, share)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("%s: no key shares found", name)
+	}
+	return shares, nil
+}
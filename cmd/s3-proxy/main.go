@@ -21,6 +21,10 @@ func main() {
 		"s3-read":         cmd.S3Read,
 		"cryption-keyset": cmd.GenerateKeyset,
 		"debug":           cmd.DebugServer,
+		"admin":           cmd.Admin,
+		"config-check":    cmd.ConfigCheck,
+		"decrypt":         cmd.Decrypt,
+		"keys":            cmd.Keys,
 	}
 
 	for indx, arg := range os.Args {
@@ -2,28 +2,66 @@
 package cmd
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
-	"net/http"
+	"log/slog"
+	"os"
+	"os/signal"
 	"s3-proxy/internal/api"
 	"s3-proxy/internal/config"
+	"s3-proxy/internal/logging"
+	"s3-proxy/internal/server"
+	"s3-proxy/internal/tracing"
+	"syscall"
 )
 
 func S3Proxy() error {
 	cfgPath := flag.String("config", "configs/main.yaml", "path to yaml config")
 	flag.Parse()
 
-	cfg, err := config.Load(*cfgPath)
+	reloader, err := api.NewReloader(*cfgPath, func(cfg *config.Config) error {
+		if err := logging.Setup(cfg.Logging); err != nil {
+			return fmt.Errorf("cannot set up logging: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("cannot load config: %w", err)
+		return err
 	}
+	cfg := reloader.Config()
 
-	prx, err := api.New(cfg)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
 	if err != nil {
-		return fmt.Errorf("cannot create proxy: %w", err)
+		return fmt.Errorf("cannot set up tracing: %w", err)
 	}
+	defer shutdownTracing(context.Background())
 
-	log.Printf("listening on %s", cfg.ListenAddr)
-	return http.ListenAndServe(cfg.ListenAddr, prx)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("received SIGHUP, reloading configuration")
+			reloader.Reload()
+		}
+	}()
+	if cfg.Reload.Watch {
+		go reloader.Watch(ctx, cfg.Reload.Interval)
+	}
+	if cfg.Reload.Secrets > 0 {
+		go reloader.RefreshSecrets(ctx, cfg.Reload.Secrets)
+	}
+
+	sites := []server.Site{{Name: "data", Listeners: cfg.ListenAddr, Handler: reloader}}
+	if len(cfg.Admin.ListenAddr) > 0 {
+		sites = append(sites, server.Site{Name: "admin", Listeners: cfg.Admin.ListenAddr, Handler: reloader.AdminHandler()})
+	} else {
+		slog.Warn("no admin listener configured: /healthz and /metrics are served on the data port and the admin API is not served")
+	}
+	err = server.Run(ctx, cfg.Server, sites...)
+	reloader.Close()
+	return err
 }
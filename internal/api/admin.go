@@ -0,0 +1,299 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"s3-proxy/internal/metrics"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// probeTimeout bounds each backend probe made by the admin API.
+const probeTimeout = 5 * time.Second
+
+// AdminHandler serves the health check and metrics endpoints and, when an
+// admin token is configured, the admin API under /admin/.
+func (p *Proxy) AdminHandler() http.Handler {
+	return p.admin
+}
+
+func (p *Proxy) newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	mux.HandleFunc("GET /admin/buckets", p.requireAdmin(p.adminBuckets))
+	mux.HandleFunc("GET /admin/backends", p.requireAdmin(p.adminBackends))
+	mux.HandleFunc("POST /admin/backends/{id}/drain", p.requireAdmin(p.adminDrain))
+	mux.HandleFunc("POST /admin/backends/{id}/enable", p.requireAdmin(p.adminEnable))
+	mux.HandleFunc("GET /admin/crypto", p.requireAdmin(p.adminCrypto))
+	mux.HandleFunc("GET /admin/journal", p.requireAdmin(p.adminJournal))
+	mux.HandleFunc("GET /admin/jobs", p.requireAdmin(p.adminJobs))
+	mux.HandleFunc("GET /admin/jobs/{id}", p.requireAdmin(p.adminJob))
+	mux.HandleFunc("POST /admin/jobs/{kind}", p.requireAdmin(p.adminStartJob))
+	mux.HandleFunc("GET /admin/seal", p.requireAdmin(p.adminSeal))
+	mux.HandleFunc("POST /admin/unseal", p.requireAdmin(p.adminUnseal))
+	return mux
+}
+
+// requireAdmin checks the bearer token of an admin API request. Without a
+// configured token the admin API is disabled.
+func (p *Proxy) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.adminToken == "" {
+			writeJSONError(w, http.StatusForbidden, errors.New("admin API disabled: no admin token configured"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(p.adminToken)) != 1 {
+			slog.WarnContext(r.Context(), "admin API authentication failed", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, errors.New("invalid or missing admin token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+type backendHealthView struct {
+	Status string `json:"status"`
+	healthState
+	Probe string `json:"probe,omitempty"`
+}
+
+type bucketBackendView struct {
+	Client       string            `json:"client"`
+	Endpoint     string            `json:"endpoint"`
+	TargetBucket string            `json:"target_bucket"`
+	CryptoID     string            `json:"crypto_id,omitempty"`
+	CryptoLayers []string          `json:"crypto_layers,omitempty"`
+	Drained      bool              `json:"drained"`
+	Health       backendHealthView `json:"health"`
+}
+
+type bucketView struct {
+	Name          string              `json:"name"`
+	MaxObjectSize int64               `json:"max_object_size,omitempty"`
+	Backends      []bucketBackendView `json:"backends"`
+}
+
+func (p *Proxy) healthView(clientID string) backendHealthView {
+	status, state := p.health.status(clientID)
+	return backendHealthView{Status: status, healthState: state}
+}
+
+// adminBuckets lists the virtual buckets and their backends. With
+// ?probe=true every target bucket is checked with a HeadBucket call first.
+func (p *Proxy) adminBuckets(w http.ResponseWriter, r *http.Request) {
+	buckets, _ := p.bucketsFor("")
+	probe := r.URL.Query().Get("probe") == "true"
+	views := make([]bucketView, 0, len(buckets))
+	for _, bucket := range buckets {
+		view := bucketView{Name: bucket.name, MaxObjectSize: bucket.maxObjectSize}
+		for _, backend := range bucket.backends {
+			var probeResult string
+			if probe {
+				probeResult = p.probe(r.Context(), backend)
+			}
+			health := p.healthView(backend.clientID)
+			health.Probe = probeResult
+			view.Backends = append(view.Backends, bucketBackendView{
+				Client:       backend.clientID,
+				Endpoint:     backend.s3Client.Endpoint,
+				TargetBucket: backend.targetBucketName,
+				CryptoID:     backend.cryptoID,
+				CryptoLayers: p.cryptoLayers[backend.cryptoID],
+				Drained:      p.drains.isDrained(backend.clientID),
+				Health:       health,
+			})
+		}
+		views = append(views, view)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// probe checks that a backend's target bucket is reachable. The call also
+// feeds the backend's health state.
+func (p *Proxy) probe(ctx context.Context, backend *s3Backend) string {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	_, err := backend.s3Client.Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &backend.targetBucketName})
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+type backendView struct {
+	ID           string            `json:"id"`
+	Endpoint     string            `json:"endpoint"`
+	Region       string            `json:"region"`
+	Drained      bool              `json:"drained"`
+	DrainedSince *time.Time        `json:"drained_since,omitempty"`
+	Buckets      []string          `json:"buckets"`
+	Health       backendHealthView `json:"health"`
+}
+
+func (p *Proxy) backendView(id string) backendView {
+	c := p.clients[id]
+	view := backendView{
+		ID:       id,
+		Endpoint: c.Endpoint,
+		Region:   c.Config.Region,
+		Buckets:  []string{},
+		Health:   p.healthView(id),
+	}
+	if since, ok := p.drains.since(id); ok {
+		view.Drained = true
+		view.DrainedSince = &since
+	}
+	buckets, _ := p.bucketsFor("")
+	for _, bucket := range buckets {
+		if bucket.backend(id) != nil {
+			view.Buckets = append(view.Buckets, bucket.name)
+		}
+	}
+	return view
+}
+
+func (p *Proxy) adminBackends(w http.ResponseWriter, r *http.Request) {
+	ids := make([]string, 0, len(p.clients))
+	for id := range p.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	views := make([]backendView, len(ids))
+	for i, id := range ids {
+		views[i] = p.backendView(id)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (p *Proxy) adminDrain(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if p.clients[id] == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("unknown backend: "+id))
+		return
+	}
+	p.drains.drain(id)
+	slog.WarnContext(r.Context(), "backend drained", "backend", id)
+	writeJSON(w, http.StatusOK, p.backendView(id))
+}
+
+func (p *Proxy) adminEnable(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if p.clients[id] == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("unknown backend: "+id))
+		return
+	}
+	p.drains.enable(id)
+	slog.InfoContext(r.Context(), "backend enabled", "backend", id)
+	writeJSON(w, http.StatusOK, p.backendView(id))
+}
+
+type cryptoView struct {
+	ID     string   `json:"id"`
+	Layers []string `json:"layers"`
+}
+
+func (p *Proxy) adminCrypto(w http.ResponseWriter, r *http.Request) {
+	views := make([]cryptoView, 0, len(p.cryptoLayers))
+	for id, layers := range p.cryptoLayers {
+		views = append(views, cryptoView{ID: id, Layers: layers})
+	}
+	sort.Slice(views, func(a, b int) bool { return views[a].ID < views[b].ID })
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (p *Proxy) adminJournal(w http.ResponseWriter, r *http.Request) {
+	entries := p.journal.list()
+	if bucket := r.URL.Query().Get("bucket"); bucket != "" {
+		filtered := entries[:0]
+		for _, entry := range entries {
+			if entry.Bucket == bucket {
+				filtered = append(filtered, entry)
+			}
+		}
+		entries = filtered
+	}
+	// Persisted is false when the entries are lost on restart, in which
+	// case a scrub is the only way to find the divergences again.
+	writeJSON(w, http.StatusOK, struct {
+		Persisted bool           `json:"persisted"`
+		Entries   []journalEntry `json:"entries"`
+	}{p.journal.persisted(), entries})
+}
+
+func (p *Proxy) adminJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, p.jobs.list())
+}
+
+func (p *Proxy) adminJob(w http.ResponseWriter, r *http.Request) {
+	status, ok := p.jobs.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errors.New("unknown job: "+r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// adminStartJob starts a repair or scrub job. Query parameters: bucket
+// (default all), and for scrub deep=true and repair=true.
+func (p *Proxy) adminStartJob(w http.ResponseWriter, r *http.Request) {
+	if p.isSealed() {
+		writeJSONError(w, http.StatusServiceUnavailable, errors.New("the proxy is sealed"))
+		return
+	}
+	query := r.URL.Query()
+	params := jobStatus{
+		Kind:   r.PathValue("kind"),
+		Bucket: query.Get("bucket"),
+		Deep:   query.Get("deep") == "true",
+		Repair: query.Get("repair") == "true",
+	}
+	if _, err := p.bucketsFor(params.Bucket); err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	var run func(context.Context, *job) error
+	switch params.Kind {
+	case "repair":
+		run = func(ctx context.Context, j *job) error { return p.runRepair(ctx, j, params.Bucket) }
+	case "scrub":
+		run = func(ctx context.Context, j *job) error {
+			return p.runScrub(ctx, j, params.Bucket, params.Deep, params.Repair)
+		}
+	default:
+		writeJSONError(w, http.StatusNotFound, errors.New("unknown job kind: "+params.Kind))
+		return
+	}
+	status, err := p.jobs.start(params, run)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]any{"error": err.Error(), "job": status})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, status)
+}
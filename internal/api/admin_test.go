@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"s3-proxy/internal/config"
+)
+
+func TestHealthAndMetricsOnDataPortWithoutAdminListener(t *testing.T) {
+	p := newTestProxy(t, testConfig(t, newFakeS3(t)))
+	if w := serve(p, http.MethodGet, "/healthz", nil, nil); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("healthz: %d %s", w.Code, w.Body)
+	}
+	if w := serve(p, http.MethodGet, "/metrics", nil, nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "s3proxy_") {
+		t.Fatalf("metrics: %d", w.Code)
+	}
+	// The admin API needs the admin listener.
+	header := http.Header{"Authorization": {"Bearer token"}}
+	if w := serve(p, http.MethodGet, "/admin/journal", nil, header); w.Code == http.StatusOK {
+		t.Fatal("admin API served on the data port")
+	}
+}
+
+func TestAdminListenerTakesAdminRoutes(t *testing.T) {
+	cfg := testConfig(t, newFakeS3(t))
+	cfg.Admin.ListenAddr = config.ConfigListeners{{Address: "127.0.0.1:0"}}
+	cfg.Admin.Token = config.MultiSourceString{Data: "token"}
+	p := newTestProxy(t, cfg)
+	for _, path := range []string{"/healthz", "/metrics"} {
+		// On the data port these are S3 requests like any other.
+		if w := serve(p, http.MethodGet, path, nil, nil); w.Body.String() == "ok" || strings.Contains(w.Body.String(), "# HELP") {
+			t.Fatalf("%s served on the data port", path)
+		}
+		if w := serve(p.AdminHandler(), http.MethodGet, path, nil, nil); w.Code != http.StatusOK {
+			t.Fatalf("%s on the admin listener: %d", path, w.Code)
+		}
+	}
+
+	admin := p.AdminHandler()
+	if w := serve(admin, http.MethodGet, "/admin/journal", nil, http.Header{"Authorization": {"Bearer wrong"}}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %d", w.Code)
+	}
+	if w := serve(admin, http.MethodGet, "/admin/journal", nil, http.Header{"Authorization": {"Bearer token"}}); w.Code != http.StatusOK {
+		t.Fatalf("admin API: %d %s", w.Code, w.Body)
+	}
+}
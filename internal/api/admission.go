@@ -0,0 +1,97 @@
+package api
+
+import (
+	"errors"
+	"sync"
+
+	"s3-proxy/internal/metrics"
+)
+
+// Defaults for memory admission control.
+const (
+	defaultMemoryBudget = 1 << 30
+)
+
+// errMemoryBudget is returned by background and best-effort work that was
+// skipped because the memory budget was exhausted.
+var errMemoryBudget = errors.New("memory budget exhausted")
+
+// memoryBudget is a byte-weighted semaphore over the payload memory held by
+// in-flight requests. Requests that would exceed it are turned away with
+// SlowDown rather than queued, so clients back off instead of piling up.
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		limit = defaultMemoryBudget
+	}
+	metrics.MemoryBudget.Set(float64(limit))
+	return &memoryBudget{limit: limit}
+}
+
+// setLimit changes the budget without touching reservations already held,
+// so a reloaded configuration can take over a running budget.
+func (b *memoryBudget) setLimit(limit int64) {
+	if limit <= 0 {
+		limit = defaultMemoryBudget
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+	metrics.MemoryBudget.Set(float64(limit))
+}
+
+// tryAcquire reserves n bytes and reports whether there was room. A single
+// request larger than the whole budget is still admitted when nothing else
+// is in flight, so it can never be starved outright.
+func (b *memoryBudget) tryAcquire(n int64, operation string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit && b.used > 0 {
+		metrics.MemoryRejections.WithLabelValues(operation).Inc()
+		return false
+	}
+	b.used += n
+	metrics.MemoryInUse.Add(float64(n))
+	return true
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	metrics.MemoryInUse.Sub(float64(n))
+}
+
+// putCost estimates the memory a streaming PUT of size bytes (-1 if unknown)
+// holds at its peak: the shared window of chunks plus, per backend, an
+// encrypted segment and the multipart part being assembled.
+func (o uploadOptions) putCost(size int64, backends int) int64 {
+	window := int64(o.window)
+	perBackend := o.partSize + 2*int64(o.segmentSize)
+	if size >= 0 {
+		window = min(window, size)
+		perBackend = min(perBackend, 2*size+int64(o.segmentSize))
+	}
+	return window + int64(backends)*perBackend
+}
+
+// readCost estimates the memory needed to decode one backend object.
+// Stream-format and unencrypted objects are decoded segment by segment;
+// legacy objects are held in full, as ciphertext and as plaintext.
+func (p *Proxy) readCost(backend *s3Backend, contentLength *int64, meta map[string]string) int64 {
+	if meta[metaFormat] == formatStream {
+		return 2 * int64(p.upload.segmentSize)
+	}
+	if id := meta[metaCrypto]; id == cryptoNone || (id == "" && backend.crypto == nil) {
+		return uploadChunkSize
+	}
+	if contentLength == nil {
+		return 0
+	}
+	return 2 * *contentLength
+}
@@ -1,14 +1,18 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
+
+	"s3-proxy/internal/logging"
 )
 
 func AuthenticateRequest(p *Proxy, r *http.Request) error {
-	log.Printf("Checking Authorization header for request: %s %s", r.Method, r.RequestURI)
+	slog.DebugContext(r.Context(), "checking authorization header")
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return fmt.Errorf("missing Authorization header")
@@ -36,10 +40,22 @@ func AuthenticateRequest(p *Proxy, r *http.Request) error {
 	accessKey := credential[0]
 	// log.Printf("Extracted access key: %s", accessKey)
 
-	if !p.auth[accessKey] {
+	user, ok := p.auth[accessKey]
+	if !ok {
 		return fmt.Errorf("invalid access key")
 	}
-	// log.Printf("Access key validated successfully: %s", accessKey)
+	logging.SetUser(r.Context(), user)
 
 	return nil
-}
\ No newline at end of file
+}
+
+// userLabel is how a user appears in logs. Access keys are the only
+// credential the proxy checks, so they are never logged; users without a
+// configured name are identified by a short hash of their key instead.
+func userLabel(name, accessKey string) string {
+	if name != "" {
+		return name
+	}
+	sum := sha256.Sum256([]byte(accessKey))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"s3-proxy/internal/crypto"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type backfillItem struct {
+	backend *s3Backend
+	key     string
+}
+
+// enqueueBackfill schedules an object without proxy metadata to have it
+// recorded. It never blocks; if the queue is full the object is left for the
+// next full scan.
+func (p *Proxy) enqueueBackfill(backend *s3Backend, key string) {
+	select {
+	case p.backfill <- backfillItem{backend: backend, key: key}:
+	default:
+	}
+}
+
+// StartBackfill records plaintext size, checksums and crypto profile on
+// objects written before the proxy stored them. It scans every backend once
+// at start and then every interval (never again if interval is zero), and
+// handles objects queued by HEAD in between. It returns when ctx is done.
+func (p *Proxy) StartBackfill(ctx context.Context, interval time.Duration) {
+	p.startBackfill(ctx, interval, true)
+}
+
+// startBackfill is StartBackfill with the initial scan optional, so a proxy
+// built by a config reload does not rescan every backend.
+func (p *Proxy) startBackfill(ctx context.Context, interval time.Duration, scanNow bool) {
+	go func() {
+		if scanNow {
+			p.backfillAll(ctx)
+		}
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case item := <-p.backfill:
+				if err := p.backfillObject(ctx, item.backend, item.key); err != nil {
+					slog.Warn("backfill failed", "backend", item.backend.clientID, "key", item.key, "error", err)
+				}
+			case <-tick:
+				p.backfillAll(ctx)
+			}
+		}
+	}()
+}
+
+func (p *Proxy) backfillAll(ctx context.Context) {
+	if p.isSealed() {
+		slog.Info("backfill scan skipped while the proxy is sealed")
+		return
+	}
+	for _, bucket := range p.buckets {
+		for _, backend := range bucket.backends {
+			slog.Info("backfill scanning backend", "backend", backend.clientID, "target_bucket", backend.targetBucketName)
+			updated, failed := 0, 0
+			paginator := s3.NewListObjectsV2Paginator(backend.s3Client.Client, &s3.ListObjectsV2Input{
+				Bucket: &backend.targetBucketName,
+			})
+			for paginator.HasMorePages() {
+				page, err := paginator.NextPage(ctx)
+				if err != nil {
+					slog.Warn("backfill failed listing backend", "backend", backend.clientID, "error", err)
+					break
+				}
+				for _, obj := range page.Contents {
+					if backend.isSidecar(*obj.Key) {
+						continue
+					}
+					if err := p.backfillObject(ctx, backend, *obj.Key); err != nil {
+						slog.Warn("backfill failed", "backend", backend.clientID, "key", *obj.Key, "error", err)
+						failed++
+						continue
+					}
+					updated++
+				}
+			}
+			slog.Info("backfill finished backend", "backend", backend.clientID, "checked", updated, "failed", failed)
+		}
+	}
+}
+
+// backfillObject reads an object that has no or incomplete proxy metadata
+// and records it.
+func (p *Proxy) backfillObject(ctx context.Context, backend *s3Backend, key string) error {
+	head, err := backend.s3Client.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &backend.targetBucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	meta, err := openInfo(ctx, backend, key, head.Metadata)
+	if err != nil {
+		return err
+	}
+	if info, ok := parseObjectInfo(meta); ok && info.complete() {
+		return nil
+	}
+	if meta[metaCustomerKey] != "" {
+		return backfillCustomerObject(ctx, backend, key, meta, aws.ToInt64(head.ContentLength))
+	}
+	// Objects with an info sidecar get it rewritten, at any size.
+	_, sidecar := meta[metaInfoSidecar]
+	if size := aws.ToInt64(head.ContentLength); size > maxCopySize && !sidecar {
+		slog.InfoContext(ctx, "object too large to record metadata on, skipping", "backend", backend.clientID, "key", key, "size", size)
+		return nil
+	}
+
+	obj, err := backend.s3Client.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &backend.targetBucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+	cost := p.readCost(backend, obj.ContentLength, obj.Metadata)
+	if !p.memory.tryAcquire(cost, "backfill") {
+		return errMemoryBudget
+	}
+	defer p.memory.release(cost)
+	body, _, err := decodeBody(ctx, backend, obj)
+	if err != nil {
+		return err
+	}
+	hasher := newInfoHasher()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return err
+	}
+	info := hasher.info().forBackend(backend)
+	if sidecar {
+		// The nonce of the body that was read, not of a newer one.
+		return writeInfoSidecar(ctx, backend, key, obj.Metadata, info)
+	}
+	return updateObjectInfo(ctx, backend, key, info)
+}
+
+// backfillCustomerObject records the size of an object under an SSE-C key,
+// which the proxy cannot decrypt without the client. Its checksums are left
+// out, so it only needs the size; an object sealed with nothing but the
+// customer key is sized from its stream framing.
+func backfillCustomerObject(ctx context.Context, backend *s3Backend, key string, meta map[string]string, storedSize int64) error {
+	if _, ok := parseObjectInfo(meta); ok {
+		return nil
+	}
+	profile, err := backend.forObject(meta)
+	if err != nil {
+		return err
+	}
+	if profile.crypto != nil || meta[metaFormat] != formatStream {
+		slog.InfoContext(ctx, "cannot size object under a customer key, skipping", "backend", backend.clientID, "key", key)
+		return nil
+	}
+	obj, err := backend.s3Client.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &backend.targetBucketName,
+		Key:    &key,
+		Range:  s("bytes=0-63"),
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+	header, err := io.ReadAll(io.LimitReader(obj.Body, 64))
+	if err != nil {
+		return err
+	}
+	size, err := crypto.StreamPlaintextSize(header, storedSize, crypto.AESOverhead)
+	if err != nil {
+		return err
+	}
+	info := objectInfo{Size: size, CryptoID: meta[metaCrypto], CustomerKey: meta[metaCustomerKey]}
+	if _, sidecar := meta[metaInfoSidecar]; sidecar {
+		return writeInfoSidecar(ctx, backend, key, obj.Metadata, info)
+	}
+	return updateObjectInfo(ctx, backend, key, info)
+}
+
+// updateObjectInfo records info on a stored object by copying it onto itself
+// with its other metadata and headers unchanged.
+func updateObjectInfo(ctx context.Context, backend *s3Backend, key string, info objectInfo) error {
+	head, err := backend.s3Client.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &backend.targetBucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	return writeObjectInfo(ctx, backend, key, headersFromHead(head), aws.ToInt64(head.ContentLength), info)
+}
+
+// maxCopySize is the largest object CopyObject accepts.
+const maxCopySize = 5 << 30
+
+// writeObjectInfo copies the stored object onto itself with info added to
+// its metadata. The copy only goes ahead while the object still has
+// stored.ETag, so info computed from one body never lands on a newer one.
+// Objects too large for CopyObject are left as they are.
+func writeObjectInfo(ctx context.Context, backend *s3Backend, key string, stored objectHeaders, size int64, info objectInfo) error {
+	if size > maxCopySize {
+		slog.InfoContext(ctx, "object too large to record metadata on, skipping", "backend", backend.clientID, "key", key, "size", size)
+		return nil
+	}
+	meta := make(map[string]string, len(stored.Metadata)+4)
+	for k, v := range stored.Metadata {
+		meta[k] = v
+	}
+	info.apply(meta)
+	if err := sealInfo(ctx, backend, key, meta); err != nil {
+		return err
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:             &backend.targetBucketName,
+		Key:                &key,
+		CopySource:         s(copySource(backend.targetBucketName, key)),
+		CopySourceIfMatch:  stored.ETag,
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		Metadata:           meta,
+		ContentType:        stored.ContentType,
+		ContentEncoding:    stored.ContentEncoding,
+		ContentDisposition: stored.ContentDisposition,
+		ContentLanguage:    stored.ContentLanguage,
+		CacheControl:       stored.CacheControl,
+	}
+	if stored.Expires != nil {
+		if t, err := http.ParseTime(*stored.Expires); err == nil {
+			input.Expires = &t
+		}
+	}
+	if _, err := backend.s3Client.Client.CopyObject(ctx, input); err != nil {
+		if backendStatus(err) == http.StatusPreconditionFailed {
+			slog.DebugContext(ctx, "object changed before its metadata was recorded", "backend", backend.clientID, "key", key)
+			return nil
+		}
+		return err
+	}
+	slog.DebugContext(ctx, "recorded object metadata", "backend", backend.clientID, "key", key)
+	return nil
+}
+
+// copySource builds the URL-encoded x-amz-copy-source value for an object.
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
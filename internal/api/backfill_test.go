@@ -0,0 +1,61 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBackfillCustomerObjectRecordsSize(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := testConfig(t, fake)
+	cfg.S3Buckets[0].Backends[0].CryptoID = ""
+	p := newTestProxy(t, cfg)
+	backend := p.buckets["vb"].backends[0]
+	var mu sync.Mutex
+	var ranges []string
+	fake.hook = func(r *http.Request, op string) int {
+		if op == "GetObject" && !strings.Contains(r.URL.Path, infoSidecarPrefix) {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		return 0
+	}
+
+	data := randomBody(t, 3*uploadChunkSize)
+	header := customerKeyHeaders(bytes.Repeat([]byte{1}, 32))
+	for _, key := range []string{"sidecar", "legacy"} {
+		if w := serve(p, http.MethodPut, "https://proxy/vb/"+key, data, header); w.Code != http.StatusOK {
+			t.Fatalf("put: %d %s", w.Code, w.Body)
+		}
+		// Written before the size was recorded.
+		obj := fake.object("data", key)
+		delete(obj.meta, metaSize)
+		fake.remove("data", infoSidecarKey(key))
+	}
+	delete(fake.object("data", "legacy").meta, metaInfoSidecar)
+
+	for _, key := range []string{"sidecar", "legacy"} {
+		ranges = nil
+		for i := 0; i < 2; i++ {
+			if err := p.backfillObject(context.Background(), backend, key); err != nil {
+				t.Fatalf("%s: %v", key, err)
+			}
+		}
+		if len(ranges) != 1 || ranges[0] == "" {
+			t.Fatalf("%s: backfill read %q, want the stream header once", key, ranges)
+		}
+		meta, err := openInfo(context.Background(), backend, key, fake.object("data", key).meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta[metaSize] != strconv.Itoa(len(data)) || meta[metaSHA256] != "" {
+			t.Fatalf("%s: recorded %v", key, meta)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/xml"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"s3-proxy/internal/logging"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// s3Error is the XML error body S3 clients expect. SDKs look at the code to
+// decide whether to retry, so overload and size errors use it rather than
+// plain text.
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId,omitempty"`
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	body, err := xml.Marshal(s3Error{
+		Code:      code,
+		Message:   message,
+		Resource:  r.URL.Path,
+		RequestID: logging.RequestID(r.Context()),
+	})
+	if err != nil {
+		slog.WarnContext(r.Context(), "failed to encode S3 error", "error", err)
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+func writeSlowDown(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	writeS3Error(w, r, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+}
+
+// backendStatus returns the HTTP status of a failed backend call, or 0 when
+// the call failed before the backend answered.
+func backendStatus(err error) int {
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		return re.HTTPStatusCode()
+	}
+	return 0
+}
@@ -0,0 +1,491 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"s3-proxy/internal/config"
+)
+
+// fakeS3 is an in-memory S3 backend serving the calls the proxy makes:
+// object PUT, GET, HEAD, DELETE and copy, multipart uploads and ListObjects.
+// Every bucket exists.
+type fakeS3 struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects map[string]*fakeObject // "bucket/key"
+	uploads map[string]map[int][]byte
+	calls   map[string]int
+	// hook, if set, runs before every request; a non-zero status fails it.
+	hook func(r *http.Request, op string) int
+}
+
+type fakeObject struct {
+	data     []byte
+	meta     map[string]string
+	headers  http.Header
+	etag     string
+	modified time.Time
+}
+
+var fakeStoredHeaders = []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language", "Cache-Control", "Expires"}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]map[int][]byte),
+		calls:   make(map[string]int),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// count returns how often an operation ("PutObject", "CopyObject", ...) was
+// called.
+func (f *fakeS3) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// object returns a stored object, or nil.
+func (f *fakeS3) object(bucket, key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[bucket+"/"+key]
+}
+
+// keys returns the keys stored in a bucket, sorted.
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for name := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) put(bucket, key string, obj *fakeObject) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+key] = obj
+}
+
+func (f *fakeS3) remove(bucket, key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, bucket+"/"+key)
+}
+
+func fakeETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func fakeOperation(r *http.Request, key string) string {
+	q := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		return "ListObjects"
+	case key == "" && r.Method == http.MethodHead:
+		return "HeadBucket"
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		return "CreateMultipartUpload"
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		return "CompleteMultipartUpload"
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		return "UploadPart"
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		return "AbortMultipartUpload"
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		return "CopyObject"
+	case r.Method == http.MethodPut:
+		return "PutObject"
+	case r.Method == http.MethodGet:
+		return "GetObject"
+	case r.Method == http.MethodHead:
+		return "HeadObject"
+	case r.Method == http.MethodDelete:
+		return "DeleteObject"
+	}
+	return r.Method
+}
+
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	op := fakeOperation(r, key)
+	f.mu.Lock()
+	f.calls[op]++
+	hook := f.hook
+	f.mu.Unlock()
+	if hook != nil {
+		if status := hook(r, op); status != 0 {
+			io.Copy(io.Discard, r.Body)
+			fakeError(w, status, http.StatusText(status))
+			return
+		}
+	}
+	name := bucket + "/" + key
+	q := r.URL.Query()
+
+	switch op {
+	case "HeadBucket":
+		w.WriteHeader(http.StatusOK)
+	case "ListObjects":
+		f.list(w, bucket, q)
+	case "CreateMultipartUpload":
+		id := strconv.FormatInt(time.Now().UnixNano(), 36)
+		f.mu.Lock()
+		f.uploads[id] = map[int][]byte{}
+		f.mu.Unlock()
+		// The headers of the object travel with the upload.
+		f.put(bucket, ".uploads/"+id, &fakeObject{meta: fakeMeta(r.Header), headers: fakeHeaders(r.Header)})
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, id)
+	case "UploadPart":
+		data, err := readFakeBody(r)
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.mu.Lock()
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if ok {
+			parts[n] = data
+		}
+		f.mu.Unlock()
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		w.Header().Set("ETag", fakeETag(data))
+	case "CompleteMultipartUpload":
+		io.Copy(io.Discard, r.Body)
+		id := q.Get("uploadId")
+		f.mu.Lock()
+		parts := f.uploads[id]
+		delete(f.uploads, id)
+		pending := f.objects[bucket+"/.uploads/"+id]
+		delete(f.objects, bucket+"/.uploads/"+id)
+		f.mu.Unlock()
+		if pending == nil {
+			fakeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		obj := &fakeObject{data: data, meta: pending.meta, headers: pending.headers, etag: fakeETag(data), modified: time.Now()}
+		f.put(bucket, key, obj)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>", key, obj.etag)
+	case "AbortMultipartUpload":
+		f.mu.Lock()
+		delete(f.uploads, q.Get("uploadId"))
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case "PutObject":
+		data, err := readFakeBody(r)
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		obj := &fakeObject{data: data, meta: fakeMeta(r.Header), headers: fakeHeaders(r.Header), etag: fakeETag(data), modified: time.Now()}
+		f.put(bucket, key, obj)
+		w.Header().Set("ETag", obj.etag)
+	case "CopyObject":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		f.mu.Lock()
+		src := f.objects[strings.TrimPrefix(source, "/")]
+		f.mu.Unlock()
+		if src == nil {
+			fakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && match != src.etag {
+			fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		obj := &fakeObject{data: src.data, meta: src.meta, headers: src.headers, etag: src.etag, modified: time.Now()}
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			obj.meta, obj.headers = fakeMeta(r.Header), fakeHeaders(r.Header)
+		}
+		f.put(bucket, key, obj)
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>", obj.etag, obj.modified.UTC().Format(time.RFC3339))
+	case "GetObject", "HeadObject":
+		f.mu.Lock()
+		obj := f.objects[name]
+		f.mu.Unlock()
+		if obj == nil {
+			if op == "HeadObject" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range obj.headers {
+			w.Header()[name] = values
+		}
+		for name, value := range obj.meta {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Accept-Ranges", "bytes")
+		data, status := obj.data, http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, end, ok := fakeRange(rng, int64(len(data)))
+			if !ok {
+				fakeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data, status = data[start:end+1], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if op == "GetObject" {
+			w.Write(data)
+		}
+	case "DeleteObject":
+		f.mu.Lock()
+		delete(f.objects, name)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, q url.Values) {
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	after := q.Get("start-after")
+	if token := q.Get("continuation-token"); token != "" {
+		after = token
+	}
+	if marker := q.Get("marker"); marker != "" {
+		after = marker
+	}
+	maxKeys := 1000
+	if n, err := strconv.Atoi(q.Get("max-keys")); err == nil {
+		maxKeys = n
+	}
+	var out bytes.Buffer
+	out.WriteString("<ListBucketResult>")
+	fmt.Fprintf(&out, "<Name>%s</Name><Prefix>%s</Prefix>", bucket, xmlText(prefix))
+	count, truncated, last := 0, false, ""
+	seen := map[string]bool{}
+	for _, key := range f.keys(bucket) {
+		if strings.HasPrefix(key, ".uploads/") || !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		if count == maxKeys {
+			truncated = true
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					fmt.Fprintf(&out, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", xmlText(common))
+					count++
+				}
+				last = key
+				continue
+			}
+		}
+		obj := f.object(bucket, key)
+		fmt.Fprintf(&out, "<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size></Contents>",
+			xmlText(key), obj.modified.UTC().Format(time.RFC3339), xmlText(obj.etag), len(obj.data))
+		count++
+		last = key
+	}
+	fmt.Fprintf(&out, "<KeyCount>%d</KeyCount><MaxKeys>%d</MaxKeys><IsTruncated>%t</IsTruncated>", count, maxKeys, truncated)
+	if truncated {
+		fmt.Fprintf(&out, "<NextContinuationToken>%s</NextContinuationToken><NextMarker>%s</NextMarker>", xmlText(last), xmlText(last))
+	}
+	out.WriteString("</ListBucketResult>")
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(out.Bytes())
+}
+
+func xmlText(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func fakeMeta(header http.Header) map[string]string {
+	meta := make(map[string]string)
+	for name, values := range header {
+		if rest, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+			meta[rest] = values[0]
+		}
+	}
+	return meta
+}
+
+func fakeHeaders(header http.Header) http.Header {
+	stored := http.Header{}
+	for _, name := range fakeStoredHeaders {
+		if value := header.Get(name); value != "" && value != "aws-chunked" {
+			stored.Set(name, strings.TrimPrefix(value, "aws-chunked,"))
+		}
+	}
+	return stored
+}
+
+func fakeRange(header string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	from, to, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if to != "" {
+		if end, err = strconv.ParseInt(to, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+// readFakeBody reads a request body, decoding aws-chunked uploads.
+func readFakeBody(r *http.Request) ([]byte, error) {
+	chunked := strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") ||
+		strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-")
+	if !chunked {
+		return io.ReadAll(r.Body)
+	}
+	br := bufio.NewReader(r.Body)
+	var data []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			io.Copy(io.Discard, br)
+			return data, nil
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// testAuthorization is accepted by proxies built with testConfig.
+const testAuthorization = "AWS4-HMAC-SHA256 Credential=AK/20250101/us-east-1/s3/aws4_request"
+
+func testKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// testConfig returns a configuration with the crypto profile "aes" and the
+// bucket "vb", stored encrypted in bucket "data" of each backend.
+func testConfig(t *testing.T, backends ...*fakeS3) *config.Config {
+	t.Helper()
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	cfg := &config.Config{
+		Crypto: []config.ConfigCrypto{{ID: "aes", Layers: []config.ConfigCryptoLayer{{
+			Algorithm: "aes",
+			Keyset:    &config.MultiSourceString{Data: testKey(t)},
+			Params:    map[string]string{"mode": "gcm"},
+		}}}},
+		S3Buckets: []config.ConfigS3Bucket{{BucketName: "vb"}},
+		Auth: config.ConfigAuth{
+			HeaderFormat: config.MultiSourceString{Data: "AWS4-HMAC-SHA256"},
+			Users:        []config.ConfigUser{{AccessKey: config.MultiSourceString{Data: "AK"}}},
+		},
+	}
+	for i, backend := range backends {
+		id := fmt.Sprintf("s3-%d", i)
+		cfg.S3Clients = append(cfg.S3Clients, config.ConfigS3Client{
+			ID: id, Endpoint: backend.URL, Region: "us-east-1",
+			AccessKey: config.MultiSourceString{Data: "access"},
+			SecretKey: config.MultiSourceString{Data: "secret"},
+		})
+		cfg.S3Buckets[0].Backends = append(cfg.S3Buckets[0].Backends, config.ConfigS3BucketBackend{
+			S3ClientID: id, S3BucketName: "data", CryptoID: "aes",
+		})
+	}
+	return cfg
+}
+
+func newTestProxy(t *testing.T, cfg *config.Config) *Proxy {
+	t.Helper()
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// serve sends an authenticated request to h and returns the response.
+func serve(h http.Handler, method, target string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	if r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", testAuthorization)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
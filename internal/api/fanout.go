@@ -0,0 +1,404 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"s3-proxy/internal/config"
+	"s3-proxy/internal/crypto"
+	"s3-proxy/internal/metrics"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Defaults for the streaming PUT pipeline.
+const (
+	defaultUploadWindow       = 8 << 20
+	defaultUploadStallTimeout = 30 * time.Second
+	defaultUploadPartSize     = manager.DefaultUploadPartSize
+	uploadChunkSize           = 64 << 10
+)
+
+// uploadOptions controls how a PUT body is streamed to the backends.
+//
+// The body is read in chunks that are shared by every backend. Each backend
+// may fall up to window bytes behind the fastest one; past that the reader
+// waits at most stallTimeout for it before dropping it, so one slow or dead
+// backend cannot hold up the others for longer than that.
+type uploadOptions struct {
+	segmentSize  int
+	window       int
+	stallTimeout time.Duration
+	partSize     int64
+}
+
+func newUploadOptions(cfg config.ConfigUpload) uploadOptions {
+	opts := uploadOptions{
+		segmentSize:  cfg.SegmentSize,
+		window:       cfg.Window,
+		stallTimeout: cfg.StallTimeout,
+		partSize:     cfg.PartSize,
+	}
+	if opts.segmentSize <= 0 {
+		opts.segmentSize = crypto.DefaultSegmentSize
+	}
+	if opts.window <= 0 {
+		opts.window = defaultUploadWindow
+	}
+	if opts.stallTimeout <= 0 {
+		opts.stallTimeout = defaultUploadStallTimeout
+	}
+	if opts.partSize < manager.MinUploadPartSize {
+		opts.partSize = defaultUploadPartSize
+	}
+	return opts
+}
+
+// errBadDigest is returned when the body does not match the length or
+// checksums the client declared.
+var errBadDigest = errors.New("request body does not match declared length or checksum")
+
+// errAllBackendsFailed is returned when every backend dropped out of an
+// upload before the body was read to the end.
+var errAllBackendsFailed = errors.New("every backend failed during the upload")
+
+// errEntityTooLarge is returned when a body without a declared length grows
+// past the bucket's maximum object size.
+var errEntityTooLarge = errors.New("request body exceeds the maximum object size")
+
+// putTarget is the per-backend half of a streaming PUT.
+type putTarget struct {
+	ctx      context.Context
+	backend  *s3Backend
+	chunks   chan []byte
+	failed   chan struct{}
+	failOnce sync.Once
+	err      error
+	cancel   context.CancelFunc
+	// stored describes the object once it has been uploaded.
+	stored objectHeaders
+}
+
+func (t *putTarget) fail(err error) {
+	t.failOnce.Do(func() {
+		t.err = err
+		close(t.failed)
+		t.cancel()
+	})
+}
+
+func (t *putTarget) isFailed() bool {
+	select {
+	case <-t.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+// trySend hands a chunk to the backend if it has room for it. It reports
+// false if the backend is still running and its queue is full.
+func (t *putTarget) trySend(chunk []byte) bool {
+	select {
+	case t.chunks <- chunk:
+		return true
+	case <-t.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+// send hands a chunk to the backend, dropping the backend if it has not made
+// room by the time stalled is closed.
+func (t *putTarget) send(chunk []byte, stalled <-chan struct{}, stall time.Duration) {
+	if t.trySend(chunk) {
+		return
+	}
+	select {
+	case t.chunks <- chunk:
+	case <-t.failed:
+	case <-stalled:
+		slog.WarnContext(t.ctx, "backend stalled, dropping it from upload", "backend", t.backend.clientID, "stall_timeout", stall)
+		t.fail(fmt.Errorf("backend stalled for more than %s", stall))
+	}
+}
+
+// sendAll hands a chunk to every backend. The backends that are full are
+// waited for at once, so a chunk is held up by at most one stall timeout
+// however many backends are slow.
+func sendAll(chunk []byte, targets []*putTarget, stall time.Duration) {
+	var full []*putTarget
+	for _, t := range targets {
+		if !t.trySend(chunk) {
+			full = append(full, t)
+		}
+	}
+	if len(full) == 0 {
+		return
+	}
+	stalled := make(chan struct{})
+	timer := time.AfterFunc(stall, func() { close(stalled) })
+	defer timer.Stop()
+	var wg sync.WaitGroup
+	for _, t := range full {
+		wg.Add(1)
+		go func(t *putTarget) {
+			defer wg.Done()
+			t.send(chunk, stalled, stall)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// declaredObjectInfo collects what the client told us about the body up
+// front, so it can be recorded before the upload starts.
+func declaredObjectInfo(r *http.Request) objectInfo {
+	info := objectInfo{Size: r.ContentLength}
+	if sum := strings.ToLower(r.Header.Get("X-Amz-Content-Sha256")); len(sum) == 64 {
+		if _, err := hex.DecodeString(sum); err == nil {
+			info.SHA256 = sum
+		}
+	}
+	info.CRC32C = r.Header.Get("X-Amz-Checksum-Crc32c")
+	if customer, err := parseCustomerKey(r); err == nil && customer != nil {
+		info.CustomerKey = customer.fingerprint
+	}
+	return info
+}
+
+// matches reports whether the computed info agrees with every declared field.
+func (i objectInfo) matches(computed objectInfo) bool {
+	return (i.Size < 0 || i.Size == computed.Size) &&
+		(i.SHA256 == "" || i.SHA256 == computed.SHA256) &&
+		(i.CRC32C == "" || i.CRC32C == computed.CRC32C)
+}
+
+// putStream streams the request body to the given backends of the bucket at
+// once. It returns one error per backend (nil on success) and an error for
+// the request body itself, in which case every upload has been aborted.
+func (p *Proxy) putStream(ctx context.Context, bucket *s3Bucket, backends []*s3Backend, objectKey, objectName string, r *http.Request) ([]error, error) {
+	declared := declaredObjectInfo(r)
+	declared.Name = objectName
+
+	// A body that fits in one chunk is read before the upload starts, so
+	// its checksums go into the object's own metadata.
+	var body io.Reader = r.Body
+	if !declared.complete() {
+		first, err := readChunk(r.Body)
+		switch {
+		case err == io.EOF:
+			computed := newObjectInfo(first)
+			if !declared.matches(computed) {
+				return nil, errBadDigest
+			}
+			declared.Size, declared.SHA256, declared.CRC32C = computed.Size, computed.SHA256, computed.CRC32C
+			body = bytes.NewReader(first)
+		case err != nil:
+			return nil, fmt.Errorf("error reading request body: %w", err)
+		default:
+			body = io.MultiReader(bytes.NewReader(first), r.Body)
+		}
+	}
+	if !declared.complete() {
+		// What is only known once the body has been read goes into an
+		// info sidecar.
+		declared.Sidecar = newNonce()
+	}
+
+	targets := make([]*putTarget, len(backends))
+	capacity := p.upload.window / uploadChunkSize
+	if capacity < 1 {
+		capacity = 1
+	}
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		targetCtx, cancel := context.WithCancel(ctx)
+		targets[i] = &putTarget{
+			ctx:     targetCtx,
+			backend: backend,
+			chunks:  make(chan []byte, capacity),
+			failed:  make(chan struct{}),
+			cancel:  cancel,
+		}
+		wg.Add(1)
+		go func(t *putTarget) {
+			defer wg.Done()
+			defer t.cancel()
+			p.uploadTarget(targetCtx, t, objectKey, r.Header, declared)
+		}(targets[i])
+	}
+
+	hasher := newInfoHasher()
+	bodyErr := p.teeBody(body, targets, hasher, bucket.maxObjectSize)
+	computed := hasher.info()
+	metrics.BytesReceived.WithLabelValues(bucket.name).Add(float64(computed.Size))
+	if bodyErr == nil && !declared.matches(computed) {
+		bodyErr = errBadDigest
+	}
+	if bodyErr != nil {
+		for _, t := range targets {
+			t.fail(bodyErr)
+		}
+	}
+	for _, t := range targets {
+		close(t.chunks)
+	}
+	wg.Wait()
+
+	errs := make([]error, len(targets))
+	for i, t := range targets {
+		errs[i] = t.err
+		if t.err == nil && declared.Sidecar != "" {
+			if err := writeInfoSidecar(ctx, t.backend, objectKey, t.stored.Metadata, computed); err != nil {
+				slog.WarnContext(ctx, "failed to record object info", "backend", t.backend.clientID, "key", objectKey, "error", err)
+			}
+		}
+	}
+	return errs, bodyErr
+}
+
+// teeBody reads the request body and hands every chunk to each backend that
+// is still running.
+func (p *Proxy) teeBody(body io.Reader, targets []*putTarget, hasher *infoHasher, maxSize int64) error {
+	for {
+		chunk, err := readChunk(body)
+		if len(chunk) > 0 {
+			hasher.Write(chunk)
+			if maxSize > 0 && hasher.size > maxSize {
+				return errEntityTooLarge
+			}
+			sendAll(chunk, targets, p.upload.stallTimeout)
+			alive := 0
+			for _, t := range targets {
+				if !t.isFailed() {
+					alive++
+				}
+			}
+			if alive == 0 {
+				return errAllBackendsFailed
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading request body: %w", err)
+		}
+	}
+}
+
+// readChunk reads up to uploadChunkSize bytes. Unlike io.ReadFull it only
+// treats a clean io.EOF as the end of the body, so a client that disconnects
+// mid-upload is reported as an error.
+func readChunk(r io.Reader) ([]byte, error) {
+	chunk := make([]byte, uploadChunkSize)
+	n := 0
+	for n < len(chunk) {
+		m, err := r.Read(chunk[n:])
+		n += m
+		if err != nil {
+			return chunk[:n], err
+		}
+	}
+	return chunk, nil
+}
+
+// uploadTarget encrypts the chunks it receives and streams them to one
+// backend. On return t.err is nil if and only if the object was stored.
+func (p *Proxy) uploadTarget(ctx context.Context, t *putTarget, objectKey string, header http.Header, declared objectInfo) {
+	backend := t.backend
+	pr, pw := io.Pipe()
+	var sink io.Writer = pw
+	var stream *crypto.StreamWriter
+	if c := backend.writeCrypto(); c != nil {
+		stream = crypto.NewStreamWriterContext(ctx, c, pw, p.upload.segmentSize)
+		sink = stream
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: &backend.targetBucketName,
+		Key:    &objectKey,
+		Body:   pr,
+	}
+	putObjectHeaders(input, header, declared.forBackend(backend))
+	if stream != nil {
+		input.Metadata[metaFormat] = formatStream
+	}
+	if err := sealInfo(ctx, backend, objectKey, input.Metadata); err != nil {
+		t.fail(err)
+	}
+	if backend.sealMetadata && backend.writeCrypto() != nil {
+		if err := sealMetadata(ctx, backend, objectKey, input.Metadata); err != nil {
+			t.fail(err)
+		}
+	}
+
+	uploader := manager.NewUploader(backend.s3Client.Client, func(u *manager.Uploader) {
+		u.PartSize = p.upload.partSize
+		u.Concurrency = 1
+	})
+	done := make(chan error, 1)
+	go func() {
+		slog.DebugContext(ctx, "uploading to backend", "backend", backend.clientID, "target_bucket", backend.targetBucketName, "key", objectKey)
+		out, err := uploader.Upload(ctx, input)
+		// Unblock the writer if the upload stopped reading early
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+			t.stored = storedHeaders(input, out.ETag)
+		}
+		done <- err
+	}()
+
+	for chunk := range t.chunks {
+		if t.isFailed() {
+			continue
+		}
+		if _, err := sink.Write(chunk); err != nil {
+			t.fail(err)
+		}
+	}
+	if !t.isFailed() && stream != nil {
+		if err := stream.Close(); err != nil {
+			t.fail(err)
+		}
+	}
+	if t.isFailed() {
+		pw.CloseWithError(t.err)
+	} else {
+		pw.Close()
+	}
+
+	if err := <-done; err != nil {
+		t.fail(err)
+	}
+}
+
+// storedHeaders describes an object as a PUT stored it, as HeadObject would.
+func storedHeaders(input *s3.PutObjectInput, etag *string) objectHeaders {
+	h := objectHeaders{
+		ContentType:        input.ContentType,
+		ContentEncoding:    input.ContentEncoding,
+		ContentDisposition: input.ContentDisposition,
+		ContentLanguage:    input.ContentLanguage,
+		CacheControl:       input.CacheControl,
+		ETag:               etag,
+		Metadata:           input.Metadata,
+	}
+	if input.Expires != nil {
+		h.Expires = s(input.Expires.UTC().Format(http.TimeFormat))
+	}
+	return h
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func randomBody(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPutRecordsInfoWithoutCopy(t *testing.T) {
+	a, b := newFakeS3(t), newFakeS3(t)
+	cfg := testConfig(t, a, b)
+	// The second backend stores plaintext.
+	cfg.S3Buckets[0].Backends[1].CryptoID = ""
+	p := newTestProxy(t, cfg)
+
+	// Longer than one chunk and without a declared checksum, so the
+	// checksums are only known once the body has been uploaded.
+	data := randomBody(t, 3*uploadChunkSize+10)
+	if w := serve(p, http.MethodPut, "/vb/big", data, nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d %s", w.Code, w.Body)
+	}
+	for _, fake := range []*fakeS3{a, b} {
+		if n := fake.count("CopyObject"); n != 0 {
+			t.Fatalf("object copied %d times", n)
+		}
+		if fake.object("data", infoSidecarKey("big")) == nil {
+			t.Fatal("no info sidecar")
+		}
+	}
+	if sidecar := a.object("data", infoSidecarKey("big")); bytes.Contains(sidecar.data, []byte(`"sha256"`)) {
+		t.Fatal("checksums of an encrypted object stored in the clear")
+	}
+
+	backend := p.buckets["vb"].backends[0]
+	head := a.object("data", "big")
+	meta, err := openInfo(context.Background(), backend, "big", head.meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := parseObjectInfo(meta)
+	if want := newObjectInfo(data); !ok || info.Size != want.Size || info.SHA256 != want.SHA256 || info.CRC32C != want.CRC32C {
+		t.Fatalf("recorded %+v, want %+v", info, want)
+	}
+
+	// HEAD answers from the sidecar without reading the object.
+	gets := a.count("GetObject")
+	w := serve(p, http.MethodHead, "/vb/big", nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(len(data)) {
+		t.Fatalf("head: %d %v", w.Code, w.Header())
+	}
+	if n := a.count("GetObject") - gets; n != 1 {
+		t.Fatalf("HEAD made %d GETs, want one of the sidecar", n)
+	}
+	if w := serve(p, http.MethodGet, "/vb/big", nil, nil); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("get: %d, %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+func TestInfoSidecarBoundToItsWrite(t *testing.T) {
+	fake := newFakeS3(t)
+	p := newTestProxy(t, testConfig(t, fake))
+	backend := p.buckets["vb"].backends[0]
+	first := randomBody(t, 2*uploadChunkSize)
+	if w := serve(p, http.MethodPut, "/vb/k", first, nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d", w.Code)
+	}
+	stale := fake.object("data", infoSidecarKey("k"))
+	if w := serve(p, http.MethodPut, "/vb/k", randomBody(t, 2*uploadChunkSize+1), nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d", w.Code)
+	}
+	// The first write's sidecar lands after the second's.
+	fake.put("data", infoSidecarKey("k"), stale)
+	meta, err := openInfo(context.Background(), backend, "k", fake.object("data", "k").meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := parseObjectInfo(meta); info.SHA256 != "" {
+		t.Fatal("took the checksums of another write")
+	}
+
+	// Backfill rewrites the sidecar of the current object.
+	if err := p.backfillObject(context.Background(), backend, "k"); err != nil {
+		t.Fatal(err)
+	}
+	meta, err = openInfo(context.Background(), backend, "k", fake.object("data", "k").meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := parseObjectInfo(meta); !ok || !info.complete() || info.Size != 2*uploadChunkSize+1 {
+		t.Fatalf("after backfill %+v", info)
+	}
+	if fake.count("CopyObject") != 0 {
+		t.Fatal("backfill copied an object with a sidecar")
+	}
+}
+
+func TestSidecarsHiddenAndReserved(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := testConfig(t, fake)
+	cfg.S3Buckets[0].Backends[0].CryptoID = ""
+	p := newTestProxy(t, cfg)
+	if w := serve(p, http.MethodPut, "/vb/k", randomBody(t, 2*uploadChunkSize), nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d", w.Code)
+	}
+	if fake.object("data", infoSidecarKey("k")) == nil {
+		t.Fatal("no info sidecar on a plaintext backend")
+	}
+
+	w := serve(p, http.MethodGet, "/vb?list-type=2", nil, nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), infoSidecarPrefix) || !strings.Contains(w.Body.String(), "<Key>k</Key>") {
+		t.Fatalf("listing: %d %s", w.Code, w.Body)
+	}
+	w = serve(p, http.MethodGet, "/vb?list-type=2&delimiter=/", nil, nil)
+	if strings.Contains(w.Body.String(), infoSidecarPrefix) {
+		t.Fatalf("listing shows the sidecar prefix: %s", w.Body)
+	}
+	if w := serve(p, http.MethodPut, "/vb/"+infoSidecarKey("k"), []byte("x"), nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("write below the sidecar prefix: %d", w.Code)
+	}
+
+	if w := serve(p, http.MethodDelete, "/vb/k", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", w.Code)
+	}
+	if keys := fake.keys("data"); len(keys) != 0 {
+		t.Fatalf("left behind %v", keys)
+	}
+}
+
+func TestPutAllBackendsFailed(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.hook = func(r *http.Request, op string) int {
+		// Refused rather than failed, so the SDK does not retry.
+		if op == "PutObject" {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	p := newTestProxy(t, testConfig(t, fake))
+	for _, size := range []int{10, 3 * uploadChunkSize} {
+		w := serve(p, http.MethodPut, "/vb/k", randomBody(t, size), nil)
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "<Code>ServiceUnavailable</Code>") {
+			t.Fatalf("%d bytes: %d %s", size, w.Code, w.Body)
+		}
+	}
+}
+
+func TestSendAllStallsOnce(t *testing.T) {
+	targets := make([]*putTarget, 4)
+	for i := range targets {
+		ctx, cancel := context.WithCancel(context.Background())
+		targets[i] = &putTarget{
+			ctx:     ctx,
+			backend: &s3Backend{clientID: strconv.Itoa(i)},
+			chunks:  make(chan []byte, 1),
+			failed:  make(chan struct{}),
+			cancel:  cancel,
+		}
+	}
+	// The first backend keeps reading; the others are stuck.
+	go func() {
+		for range targets[0].chunks {
+		}
+	}()
+	stall := 100 * time.Millisecond
+	sendAll([]byte("a"), targets, stall)
+	start := time.Now()
+	sendAll([]byte("b"), targets, stall)
+	if elapsed := time.Since(start); elapsed > 2*stall {
+		t.Fatalf("three stalled backends held a chunk for %s", elapsed)
+	}
+	if targets[0].isFailed() {
+		t.Fatal("dropped the backend that kept up")
+	}
+	for _, target := range targets[1:] {
+		if !target.isFailed() {
+			t.Fatalf("stalled backend %s kept", target.backend.clientID)
+		}
+	}
+	close(targets[0].chunks)
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// objectHeaders holds the standard and user metadata headers of a stored
+// object, independent of whether it came from a GetObject or HeadObject call.
+type objectHeaders struct {
+	ContentType        *string
+	ContentEncoding    *string
+	ContentDisposition *string
+	ContentLanguage    *string
+	CacheControl       *string
+	Expires            *string
+	LastModified       *time.Time
+	ETag               *string
+	Metadata           map[string]string
+}
+
+// responseOverrides maps the response-* query parameters S3 accepts on GET
+// and HEAD to the response header they replace.
+var responseOverrides = map[string]string{
+	"response-content-type":        "Content-Type",
+	"response-content-language":    "Content-Language",
+	"response-expires":             "Expires",
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+}
+
+func headersFromGet(obj *s3.GetObjectOutput) objectHeaders {
+	return objectHeaders{
+		ContentType:        obj.ContentType,
+		ContentEncoding:    obj.ContentEncoding,
+		ContentDisposition: obj.ContentDisposition,
+		ContentLanguage:    obj.ContentLanguage,
+		CacheControl:       obj.CacheControl,
+		Expires:            obj.ExpiresString,
+		LastModified:       obj.LastModified,
+		ETag:               obj.ETag,
+		Metadata:           obj.Metadata,
+	}
+}
+
+func headersFromHead(obj *s3.HeadObjectOutput) objectHeaders {
+	return objectHeaders{
+		ContentType:        obj.ContentType,
+		ContentEncoding:    obj.ContentEncoding,
+		ContentDisposition: obj.ContentDisposition,
+		ContentLanguage:    obj.ContentLanguage,
+		CacheControl:       obj.CacheControl,
+		Expires:            obj.ExpiresString,
+		LastModified:       obj.LastModified,
+		ETag:               obj.ETag,
+		Metadata:           obj.Metadata,
+	}
+}
+
+// write sets the stored headers on the response, then applies any
+// response-* query overrides from the original request.
+func (h objectHeaders) write(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	if h.ContentType != nil && *h.ContentType != "" {
+		header.Set("Content-Type", *h.ContentType)
+	} else {
+		header.Set("Content-Type", "application/octet-stream")
+	}
+	setIfPresent(header, "Content-Encoding", h.ContentEncoding)
+	setIfPresent(header, "Content-Disposition", h.ContentDisposition)
+	setIfPresent(header, "Content-Language", h.ContentLanguage)
+	setIfPresent(header, "Cache-Control", h.CacheControl)
+	setIfPresent(header, "Expires", h.Expires)
+
+	if h.LastModified != nil {
+		header.Set("Last-Modified", h.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if h.ETag != nil {
+		header.Set("ETag", "\""+strings.Trim(*h.ETag, "\"")+"\"")
+	}
+	for name, value := range h.Metadata {
+		if isReservedMeta(name) {
+			continue
+		}
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+
+	query := r.URL.Query()
+	for param, name := range responseOverrides {
+		if value := query.Get(param); value != "" {
+			header.Set(name, value)
+		}
+	}
+}
+
+func setIfPresent(header http.Header, name string, value *string) {
+	if value != nil && *value != "" {
+		header.Set(name, *value)
+	}
+}
+
+var errInvalidExpires = &requestError{http.StatusBadRequest, "InvalidArgument",
+	"The Expires header is not a valid HTTP date."}
+
+// checkPutHeaders rejects standard headers of a PUT that cannot be stored
+// as given, before any backend is written.
+func checkPutHeaders(header http.Header) error {
+	if expires := header.Get("Expires"); expires != "" {
+		if _, err := http.ParseTime(expires); err != nil {
+			return errInvalidExpires
+		}
+	}
+	return nil
+}
+
+// putObjectHeaders copies the standard headers of an incoming PUT onto the
+// backend request so they can be returned on GET and HEAD, and records the
+// plaintext info alongside the user metadata. The headers have passed
+// checkPutHeaders.
+func putObjectHeaders(input *s3.PutObjectInput, header http.Header, info objectInfo) {
+	input.ContentType = s(header.Get("Content-Type"))
+	input.ContentEncoding = s(header.Get("Content-Encoding"))
+	input.ContentDisposition = s(header.Get("Content-Disposition"))
+	input.ContentLanguage = s(header.Get("Content-Language"))
+	input.CacheControl = s(header.Get("Cache-Control"))
+	if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			input.Expires = &t
+		}
+	}
+	input.Metadata = getMetadataHeaders(header)
+	info.apply(input.Metadata)
+}
+
+// requestHeader turns stored headers back into the request headers a PUT
+// would have carried, so an object can be copied to another backend with
+// putObjectHeaders.
+func (h objectHeaders) requestHeader() http.Header {
+	header := http.Header{}
+	for name, value := range map[string]*string{
+		"Content-Type":        h.ContentType,
+		"Content-Encoding":    h.ContentEncoding,
+		"Content-Disposition": h.ContentDisposition,
+		"Content-Language":    h.ContentLanguage,
+		"Cache-Control":       h.CacheControl,
+		"Expires":             h.Expires,
+	} {
+		setIfPresent(header, name, value)
+	}
+	for name, value := range h.Metadata {
+		if !isReservedMeta(name) {
+			header.Set("X-Amz-Meta-"+name, value)
+		}
+	}
+	return header
+}
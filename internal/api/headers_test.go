@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestCheckPutHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		expires string
+		want    error
+	}{
+		{"", nil},
+		{"Wed, 21 Oct 2026 07:28:00 GMT", nil},
+		{"Wednesday, 21-Oct-26 07:28:00 GMT", nil},
+		{"Wed Oct 21 07:28:00 2026", nil},
+		{"0", errInvalidExpires},
+		{"2026-10-21T07:28:00Z", errInvalidExpires},
+		{"tomorrow", errInvalidExpires},
+	} {
+		header := http.Header{}
+		if tc.expires != "" {
+			header.Set("Expires", tc.expires)
+		}
+		if err := checkPutHeaders(header); err != tc.want {
+			t.Errorf("Expires %q: got %v, want %v", tc.expires, err, tc.want)
+		}
+	}
+}
+
+func TestPutObjectHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Expires", "Wed, 21 Oct 2026 07:28:00 GMT")
+	header.Set("X-Amz-Meta-Color", "blue")
+
+	var input s3.PutObjectInput
+	putObjectHeaders(&input, header, objectInfo{})
+	if *input.ContentType != "text/plain" || *input.CacheControl != "no-cache" {
+		t.Fatalf("headers %v %v", *input.ContentType, *input.CacheControl)
+	}
+	if want := time.Date(2026, 10, 21, 7, 28, 0, 0, time.UTC); input.Expires == nil || !input.Expires.Equal(want) {
+		t.Fatalf("expires %v", input.Expires)
+	}
+	if input.ContentEncoding != nil || input.Metadata["color"] != "blue" {
+		t.Fatalf("encoding %v, metadata %v", input.ContentEncoding, input.Metadata)
+	}
+}
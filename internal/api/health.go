@@ -0,0 +1,129 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// backendHealth tracks the outcome of recent SDK calls per S3 client. It is
+// passive: it only sees the traffic the proxy sends anyway, plus explicit
+// probes from the admin API.
+type backendHealth struct {
+	mu      sync.Mutex
+	clients map[string]*healthState
+}
+
+type healthState struct {
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// unhealthyAfter is the number of failed calls in a row after which a
+// backend is reported unhealthy rather than degraded.
+const unhealthyAfter = 3
+
+func newBackendHealth() *backendHealth {
+	return &backendHealth{clients: make(map[string]*healthState)}
+}
+
+func (h *backendHealth) observe(client string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := h.clients[client]
+	if state == nil {
+		state = &healthState{}
+		h.clients[client] = state
+	}
+	now := time.Now()
+	if err != nil {
+		state.ConsecutiveFailures++
+		state.LastFailure = &now
+		state.LastError = err.Error()
+		return
+	}
+	state.ConsecutiveFailures = 0
+	state.LastSuccess = &now
+}
+
+// status returns a summary ("unknown", "healthy", "degraded" or "unhealthy")
+// and a snapshot of the client's state.
+func (h *backendHealth) status(client string) (string, healthState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := h.clients[client]
+	switch {
+	case state == nil:
+		return "unknown", healthState{}
+	case state.ConsecutiveFailures == 0:
+		return "healthy", *state
+	case state.ConsecutiveFailures < unhealthyAfter:
+		return "degraded", *state
+	default:
+		return "unhealthy", *state
+	}
+}
+
+// drainSet holds the S3 clients an operator has taken out of rotation.
+// Drained backends are not read from while another backend can serve the
+// request, and are skipped by writes, which journal them for repair once
+// they are enabled again.
+type drainSet struct {
+	mu      sync.Mutex
+	clients map[string]time.Time
+}
+
+func newDrainSet() *drainSet {
+	return &drainSet{clients: make(map[string]time.Time)}
+}
+
+func (d *drainSet) drain(client string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.clients[client]; !ok {
+		d.clients[client] = time.Now()
+	}
+}
+
+func (d *drainSet) enable(client string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.clients, client)
+}
+
+// since reports when a client was drained, or false if it is in rotation.
+func (d *drainSet) since(client string) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.clients[client]
+	return t, ok
+}
+
+func (d *drainSet) isDrained(client string) bool {
+	_, ok := d.since(client)
+	return ok
+}
+
+// split separates backends that are in rotation from drained ones.
+func (d *drainSet) split(backends []*s3Backend) (active, drained []*s3Backend) {
+	for _, backend := range backends {
+		if d.isDrained(backend.clientID) {
+			drained = append(drained, backend)
+		} else {
+			active = append(active, backend)
+		}
+	}
+	return active, drained
+}
+
+// readable returns the backends reads should use: those in rotation, or all
+// of them if every one is drained, since serving from a drained backend is
+// better than failing.
+func (d *drainSet) readable(backends []*s3Backend) []*s3Backend {
+	active, _ := d.split(backends)
+	if len(active) == 0 {
+		return backends
+	}
+	return active
+}
@@ -1,58 +1,112 @@
 package api
 
 import (
+	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
 	"s3-proxy/internal/client"
 	"s3-proxy/internal/config"
 	"s3-proxy/internal/crypto"
+	"s3-proxy/internal/kms"
+	"s3-proxy/internal/tracing"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type s3Bucket struct {
-	name     string
-	backends []*s3Backend
+	name          string
+	backends      []*s3Backend
+	maxObjectSize int64
+	// keys translates object keys, nil when they are stored as is.
+	keys *keyCodec
+	// cryptoRules choose the profile of new objects, in order.
+	cryptoRules []cryptoRule
+}
+
+// reservesKey reports whether a backend key is kept for the sidecar objects
+// of any of the bucket's backends.
+func (b *s3Bucket) reservesKey(key string) bool {
+	for _, backend := range b.backends {
+		if backend.isSidecar(key) {
+			return true
+		}
+	}
+	return strings.HasPrefix(key, infoSidecarPrefix)
 }
 
 type s3Backend struct {
 	targetBucketName string
 	s3Client         *client.S3
 	crypto           crypto.Crypt
+	cryptoID         string
+	clientID         string
+	// sealMetadata stores user metadata encrypted with crypto.
+	sealMetadata bool
+	// profiles holds every crypto profile, for objects written with
+	// another one than crypto.
+	profiles map[string]crypto.Crypt
+	// customer is the SSE-C layer of the current request, if any.
+	customer crypto.Crypt
 }
 
 func New(cfg *config.Config) (*Proxy, error) {
-	cryptos := make(map[string]crypto.Crypt)
-	for _, cfgCrypto := range cfg.Crypto {
-		layers := make([]crypto.Crypt, 0, len(cfgCrypto.Layers))
-		for _, cfgLayer := range cfgCrypto.Layers {
-			var layer crypto.Crypt
-			var err error
-			switch cfgLayer.Algorithm {
-			case "tink":
-				layer, err = crypto.NewTinkCrypt(cfgLayer.Keyset.Get())
-			case "aes":
-				mode := cfgLayer.Params["mode"]
-				if mode != "gcm" {
-					return nil, fmt.Errorf("unsupported AES mode: %s", mode)
-				}
-				layer, err = crypto.NewAESCrypt(cfgLayer.Keyset.Get())
-			case "chacha20poly1305":
-				layer, err = crypto.NewChaChaCrypt(cfgLayer.Keyset.Get())
-			default:
-				return nil, fmt.Errorf("unsupported crypto algorithm: %s", cfgLayer.Algorithm)
-			}
+	kmses := make(map[string]kms.KMS)
+	dataKeyTTLs := make(map[string]time.Duration)
+	for _, cfgKMS := range cfg.KMS {
+		k, err := kms.New(cfgKMS)
+		if err != nil {
+			return nil, err
+		}
+		kmses[cfgKMS.ID] = k
+		dataKeyTTLs[cfgKMS.ID] = cfgKMS.DataKeyTTL
+	}
 
+	newProfile := func(cfgCrypto config.ConfigCrypto) (*crypto.MultiLayerCrypt, error) {
+		layers := make([]crypto.Crypt, 0, len(cfgCrypto.Layers))
+		for i, cfgLayer := range cfgCrypto.Layers {
+			layer, err := newCryptoLayer(cfgLayer, kmses, dataKeyTTLs)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("crypto %s layer %d: %w", cfgCrypto.ID, i, err)
 			}
-			layers = append(layers, layer)
+			layers = append(layers, timedCrypt{Crypt: layer, algorithm: cfgLayer.Algorithm})
 		}
+		return crypto.NewMultiLayerCrypt(layers...), nil
+	}
 
-		cryptos[cfgCrypto.ID] = crypto.NewMultiLayerCrypt(layers...)
+	cryptos := make(map[string]crypto.Crypt)
+	cryptoLayers := make(map[string][]string)
+	sealed := make(map[string]*sealedCrypt)
+	for _, cfgCrypto := range cfg.Crypto {
+		for _, cfgLayer := range cfgCrypto.Layers {
+			cryptoLayers[cfgCrypto.ID] = append(cryptoLayers[cfgCrypto.ID], cfgLayer.Algorithm)
+		}
+		if cfgCrypto.Sealed {
+			sealed[cfgCrypto.ID] = &sealedCrypt{cfg: cfgCrypto, build: newProfile}
+			cryptos[cfgCrypto.ID] = sealed[cfgCrypto.ID]
+			continue
+		}
+		c, err := newProfile(cfgCrypto)
+		if err != nil {
+			return nil, err
+		}
+		cryptos[cfgCrypto.ID] = c
 	}
 
+	health := newBackendHealth()
 	s3Clients := make(map[string]*client.S3)
 	for _, cfgClient := range cfg.S3Clients {
-		client, err := client.NewS3(cfgClient.Endpoint, cfgClient.Region, cfgClient.AccessKey.Get(), cfgClient.SecretKey.Get())
+		accessKey, err := cfgClient.AccessKey.Get()
+		if err != nil {
+			return nil, fmt.Errorf("S3 client %s access key: %w", cfgClient.ID, err)
+		}
+		secretKey, err := cfgClient.SecretKey.Get()
+		if err != nil {
+			return nil, fmt.Errorf("S3 client %s secret key: %w", cfgClient.ID, err)
+		}
+		client, err := client.NewS3(cfgClient.Endpoint, cfgClient.Region, accessKey, secretKey,
+			client.WithCallObserver(observeBackend(cfgClient.ID, health)),
+			client.WithTracer(tracing.Tracer(), cfgClient.ID))
 		if err != nil {
 			return nil, err
 		}
@@ -62,8 +116,31 @@ func New(cfg *config.Config) (*Proxy, error) {
 	buckets := make(map[string]*s3Bucket)
 	for _, cfgBucket := range cfg.S3Buckets {
 		bucket := &s3Bucket{
-			name:     cfgBucket.BucketName,
-			backends: make([]*s3Backend, 0, len(cfgBucket.Backends)),
+			name:          cfgBucket.BucketName,
+			backends:      make([]*s3Backend, 0, len(cfgBucket.Backends)),
+			maxObjectSize: cfgBucket.MaxObjectSize,
+		}
+		if bucket.maxObjectSize == 0 {
+			bucket.maxObjectSize = cfg.Limits.MaxObjectSize
+		}
+		for _, cfgRule := range cfgBucket.CryptoRules {
+			if _, ok := cryptos[cfgRule.CryptoID]; !ok && cfgRule.CryptoID != cryptoNone {
+				return nil, fmt.Errorf("bucket %s: unknown crypto ID in rule: %s", cfgBucket.BucketName, cfgRule.CryptoID)
+			}
+			bucket.cryptoRules = append(bucket.cryptoRules, newCryptoRule(cfgRule))
+		}
+		if ke := cfgBucket.KeyEncryption; ke != nil {
+			key, err := ke.Key.Get()
+			if err != nil {
+				return nil, fmt.Errorf("bucket %s key encryption key: %w", cfgBucket.BucketName, err)
+			}
+			raw, err := base64.StdEncoding.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("bucket %s key encryption key: %w", cfgBucket.BucketName, err)
+			}
+			if bucket.keys, err = newKeyCodec(ke.Mode, raw); err != nil {
+				return nil, fmt.Errorf("bucket %s: %w", cfgBucket.BucketName, err)
+			}
 		}
 
 		for _, cfgBucketBackend := range cfgBucket.Backends {
@@ -83,34 +160,152 @@ func New(cfg *config.Config) (*Proxy, error) {
 				targetBucketName: cfgBucketBackend.S3BucketName,
 				s3Client:         s3Client,
 				crypto:           crypto,
+				cryptoID:         cfgBucketBackend.CryptoID,
+				clientID:         cfgBucketBackend.S3ClientID,
+				sealMetadata:     cfgBucket.SealMetadata,
+				profiles:         cryptos,
 			})
 		}
 
 		buckets[cfgBucket.BucketName] = bucket
 	}
 
-	auth := make(map[string]bool)
-	log.Printf("Loading access keys from configuration")
-	for _, user := range cfg.Auth.Users {
-		accessKey := user.AccessKey.Get()
+	auth := make(map[string]string)
+	for i, user := range cfg.Auth.Users {
+		accessKey, err := user.AccessKey.Get()
+		if err != nil {
+			return nil, fmt.Errorf("auth user %d access key: %w", i, err)
+		}
 		if accessKey != "" {
-			log.Printf("Loaded access key: %s", accessKey)
-			auth[accessKey] = true
+			auth[accessKey] = userLabel(user.Name, accessKey)
 		} else {
-			log.Printf("Warning: Empty access key found in configuration")
+			slog.Warn("empty access key in configuration", "user_index", i, "name", user.Name)
 		}
 	}
-	log.Printf("Total access keys loaded: %d", len(auth))
+	slog.Info("loaded access keys", "count", len(auth))
 
-	headerFormat := cfg.Auth.HeaderFormat.Get()
+	headerFormat, err := cfg.Auth.HeaderFormat.Get()
+	if err != nil {
+		return nil, fmt.Errorf("auth header format: %w", err)
+	}
+	// The admin API is optional, so an unreadable token only disables it.
+	adminToken, err := cfg.Admin.Token.Get()
+	if err != nil {
+		slog.Warn("cannot read admin token, admin API disabled", "error", err)
+	}
 	if headerFormat == "" {
-		log.Printf("Warning: No authorization header format specified, authentication will fail")
+		slog.Warn("no authorization header format specified, authentication will fail")
+	}
+	slog.Debug("loaded authorization header format", "format", headerFormat)
+
+	journal, err := newJournal(cfg.Journal.File)
+	if err != nil {
+		return nil, fmt.Errorf("repair journal: %w", err)
 	}
-	log.Printf("Loaded authorization header format: %s", headerFormat)
 
-	return &Proxy{
+	p := &Proxy{
 		buckets:      buckets,
 		auth:         auth,
 		headerFormat: headerFormat,
-	}, nil
-}
\ No newline at end of file
+		backfill:     make(chan backfillItem, 1024),
+		upload:       newUploadOptions(cfg.Upload),
+		memory:       newMemoryBudget(cfg.Limits.MemoryBudget),
+		journal:      journal,
+		serveAdmin:   len(cfg.Admin.ListenAddr) == 0,
+		adminToken:   adminToken,
+		health:       health,
+		drains:       newDrainSet(),
+		jobs:         newJobRegistry(),
+		cryptoLayers: cryptoLayers,
+		cryptos:      cryptos,
+		clients:      s3Clients,
+		writeOnly:    cfg.WriteOnly,
+		trustProto:   cfg.Server.TrustForwardedProto,
+		sealed:       sealed,
+		keyShares:    newKeyShares(),
+		sizes:        newSizeCache(),
+	}
+	p.admin = p.newAdminHandler()
+	return p, nil
+}
+
+func newCryptoLayer(cfgLayer config.ConfigCryptoLayer, kmses map[string]kms.KMS, dataKeyTTLs map[string]time.Duration) (crypto.Crypt, error) {
+	var master kms.KMS
+	if cfgLayer.KMS != "" {
+		var ok bool
+		if master, ok = kmses[cfgLayer.KMS]; !ok {
+			return nil, fmt.Errorf("unknown KMS ID: %s", cfgLayer.KMS)
+		}
+	}
+	if cfgLayer.Algorithm == "kms" {
+		if master == nil {
+			return nil, fmt.Errorf("the kms algorithm needs a kms ID")
+		}
+		return crypto.NewEnvelopeCrypt(master, dataKeyTTLs[cfgLayer.KMS]), nil
+	}
+
+	if cfgLayer.Algorithm == "gzip" || cfgLayer.Algorithm == "zstd" {
+		level, err := intParam(cfgLayer.Params, "level")
+		if err != nil {
+			return nil, err
+		}
+		minSize, err := intParam(cfgLayer.Params, "min_size")
+		if err != nil {
+			return nil, err
+		}
+		return crypto.NewCompressCrypt(cfgLayer.Algorithm, level, minSize)
+	}
+
+	if cfgLayer.Algorithm == "pad" {
+		blockSize, err := intParam(cfgLayer.Params, "block_size")
+		if err != nil {
+			return nil, err
+		}
+		padding, err := crypto.NewPadding(cfgLayer.Params["scheme"], blockSize)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.NewPadCrypt(padding), nil
+	}
+
+	keyset, err := cfgLayer.Key()
+	if err != nil {
+		return nil, err
+	}
+	switch cfgLayer.Algorithm {
+	case "tink":
+		if master != nil {
+			return crypto.NewEncryptedTinkCrypt(keyset, kms.AEAD(master))
+		}
+		return crypto.NewTinkCrypt(keyset)
+	case "aes":
+		switch mode := cfgLayer.Params["mode"]; mode {
+		case "gcm":
+			return crypto.NewAESCrypt(keyset)
+		case "ctr-hmac":
+			return crypto.NewAESCTRHMACCrypt(keyset)
+		default:
+			return nil, fmt.Errorf("unsupported AES mode: %s", mode)
+		}
+	case "aes-gcm-siv":
+		return crypto.NewAESGCMSIVCrypt(keyset)
+	case "chacha20poly1305":
+		return crypto.NewChaChaCrypt(keyset)
+	case "xchacha20poly1305":
+		return crypto.NewXChaChaCrypt(keyset)
+	}
+	return nil, fmt.Errorf("unsupported crypto algorithm: %s", cfgLayer.Algorithm)
+}
+
+// intParam reads an optional integer layer parameter, 0 when unset.
+func intParam(params map[string]string, name string) (int, error) {
+	value, ok := params[name]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return n, nil
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"s3-proxy/internal/crypto"
+	"s3-proxy/internal/metrics"
+	"s3-proxy/internal/tracing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// operationName classifies a request for metrics the same way ServeHTTP
+// routes it.
+func operationName(r *http.Request) string {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if parts := strings.SplitN(path, "/", 2); len(parts) == 2 && parts[1] != "" {
+		switch r.Method {
+		case http.MethodPut, http.MethodPost:
+			return "put"
+		case http.MethodGet:
+			return "get"
+		case http.MethodHead:
+			return "head"
+		case http.MethodDelete:
+			return "delete"
+		}
+		return "proxy"
+	}
+	if r.Method == http.MethodGet {
+		return "list"
+	}
+	return "proxy"
+}
+
+func observeRequest(operation string, status int, start time.Time) {
+	code := strconv.Itoa(status)
+	metrics.Requests.WithLabelValues(operation, code).Inc()
+	metrics.RequestDuration.WithLabelValues(operation, code).Observe(time.Since(start).Seconds())
+}
+
+// observeBackend returns a client.WithCallObserver callback that records
+// call latency and errors for one backend and feeds its health state.
+func observeBackend(backend string, health *backendHealth) func(operation string, d time.Duration, err error) {
+	return func(operation string, d time.Duration, err error) {
+		metrics.BackendDuration.WithLabelValues(backend, operation).Observe(d.Seconds())
+		if err != nil {
+			metrics.BackendErrors.WithLabelValues(backend, operation).Inc()
+		}
+		health.observe(backend, healthError(err))
+	}
+}
+
+// healthError filters out errors that say nothing about the backend's
+// health, such as a missing key or a failed precondition.
+func healthError(err error) error {
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		switch re.HTTPStatusCode() {
+		case http.StatusNotFound, http.StatusNotModified, http.StatusPreconditionFailed, http.StatusRequestedRangeNotSatisfiable:
+			return nil
+		}
+	}
+	return err
+}
+
+// timedCrypt records how long each call to a single crypto layer takes and,
+// when the caller is traced, adds its calls to the request's layer spans.
+type timedCrypt struct {
+	crypto.Crypt
+	algorithm string
+}
+
+func (t timedCrypt) Encrypt(data []byte) ([]byte, error) {
+	return t.EncryptContext(context.Background(), data)
+}
+
+func (t timedCrypt) Decrypt(data []byte) ([]byte, error) {
+	return t.DecryptContext(context.Background(), data)
+}
+
+func (t timedCrypt) EncryptContext(ctx context.Context, data []byte) ([]byte, error) {
+	return t.observe(ctx, "encrypt", data, crypto.EncryptContext)
+}
+
+func (t timedCrypt) DecryptContext(ctx context.Context, data []byte) ([]byte, error) {
+	return t.observe(ctx, "decrypt", data, crypto.DecryptContext)
+}
+
+func (t timedCrypt) Padding() *crypto.Padding {
+	return crypto.PaddingOf(t.Crypt)
+}
+
+func (t timedCrypt) observe(ctx context.Context, operation string, data []byte, fn func(context.Context, crypto.Crypt, []byte) ([]byte, error)) ([]byte, error) {
+	start := time.Now()
+	out, err := fn(ctx, t.Crypt, data)
+	end := time.Now()
+	metrics.CryptoDuration.WithLabelValues(t.algorithm, operation).Observe(end.Sub(start).Seconds())
+	// Background work such as backfill has no request and no spans.
+	if spans, ok := ctx.Value(cryptoSpansKey{}).(*cryptoSpans); ok {
+		spans.add(cryptoLayerKey{t.algorithm, operation}, len(data), start, end, err)
+	}
+	return out, err
+}
+
+type cryptoSpansKey struct{}
+
+type cryptoLayerKey struct {
+	algorithm, operation string
+}
+
+// cryptoLayerStats sums up the calls one layer made for one request.
+type cryptoLayerStats struct {
+	start, end time.Time
+	calls      int
+	bytes      int64
+	busy       time.Duration
+	err        error
+}
+
+// cryptoSpans collects the crypto calls of a request, so a streamed object
+// gets one span per layer and direction rather than one per segment.
+type cryptoSpans struct {
+	mu     sync.Mutex
+	layers map[cryptoLayerKey]*cryptoLayerStats
+	order  []cryptoLayerKey
+}
+
+func (s *cryptoSpans) add(key cryptoLayerKey, n int, start, end time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.layers[key]
+	if stats == nil {
+		stats = &cryptoLayerStats{start: start}
+		s.layers[key] = stats
+		s.order = append(s.order, key)
+	}
+	stats.end = end
+	stats.calls++
+	stats.bytes += int64(n)
+	stats.busy += end.Sub(start)
+	if stats.err == nil {
+		stats.err = err
+	}
+}
+
+// end records one span per layer under the request span in ctx, spanning
+// the layer's first call to its last.
+func (s *cryptoSpans) end(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.order {
+		stats := s.layers[key]
+		_, span := tracing.Tracer().Start(ctx, "crypto."+key.operation,
+			trace.WithTimestamp(stats.start),
+			trace.WithAttributes(
+				attribute.String("s3proxy.crypto.algorithm", key.algorithm),
+				attribute.Int("s3proxy.crypto.segments", stats.calls),
+				attribute.Int64("s3proxy.crypto.input_bytes", stats.bytes),
+				attribute.Float64("s3proxy.crypto.busy_seconds", stats.busy.Seconds()),
+			))
+		if stats.err != nil {
+			span.RecordError(stats.err)
+			span.SetStatus(codes.Error, stats.err.Error())
+		}
+		span.End(trace.WithTimestamp(stats.end))
+	}
+}
+
+// startRequestSpan continues the caller's trace, if any, and returns the
+// request with the server span in its context.
+func startRequestSpan(r *http.Request, operation string) (*http.Request, trace.Span) {
+	ctx := tracing.Propagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	// The path holds the object key, which is recorded once the bucket's
+	// key encryption is known.
+	ctx, span := tracing.Tracer().Start(ctx, "s3proxy."+operation,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.request.method", r.Method)))
+	if span.IsRecording() {
+		ctx = context.WithValue(ctx, cryptoSpansKey{}, &cryptoSpans{layers: make(map[cryptoLayerKey]*cryptoLayerStats)})
+	}
+	return r.WithContext(ctx), span
+}
+
+// traceObject records the bucket and key of a request. key is the backend
+// key, so with key encryption the trace only holds its encrypted or HMAC
+// name.
+func traceObject(span trace.Span, bucket, key string) {
+	span.SetAttributes(
+		attribute.String("s3proxy.bucket", bucket),
+		attribute.String("s3proxy.key", key),
+		attribute.String("url.path", "/"+bucket+"/"+key),
+	)
+}
+
+func endRequestSpan(ctx context.Context, span trace.Span, status int) {
+	if spans, ok := ctx.Value(cryptoSpansKey{}).(*cryptoSpans); ok {
+		spans.end(ctx)
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
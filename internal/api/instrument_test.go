@@ -0,0 +1,64 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"s3-proxy/internal/crypto"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestCryptoSpansPerLayer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	layer := timedCrypt{Crypt: crypto.NewMultiLayerCrypt(), algorithm: "none"}
+	r, span := startRequestSpan(httptest.NewRequest(http.MethodPut, "/b/secret-name", nil), "put")
+	for i := 0; i < 100; i++ {
+		if _, err := layer.EncryptContext(r.Context(), bytes.Repeat([]byte("x"), 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	layer.DecryptContext(r.Context(), []byte("y"))
+	// Background calls have no request and record nothing.
+	layer.EncryptContext(context.Background(), []byte("z"))
+	traceObject(span, "b", "encrypted-name")
+	endRequestSpan(r.Context(), span, http.StatusOK)
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want a request span and one per layer and direction", len(spans))
+	}
+	attrs := func(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+		m := make(map[attribute.Key]attribute.Value)
+		for _, kv := range s.Attributes() {
+			m[kv.Key] = kv.Value
+		}
+		return m
+	}
+	encrypt := attrs(spans[0])
+	if spans[0].Name() != "crypto.encrypt" || encrypt["s3proxy.crypto.segments"].AsInt64() != 100 ||
+		encrypt["s3proxy.crypto.input_bytes"].AsInt64() != 1000 {
+		t.Fatalf("encrypt span %s %v", spans[0].Name(), encrypt)
+	}
+	if spans[0].Parent().SpanID() != spans[2].SpanContext().SpanID() {
+		t.Fatal("crypto span is not a child of the request span")
+	}
+	if spans[1].Name() != "crypto.decrypt" || attrs(spans[1])["s3proxy.crypto.segments"].AsInt64() != 1 {
+		t.Fatalf("decrypt span %s %v", spans[1].Name(), attrs(spans[1]))
+	}
+	request := attrs(spans[2])
+	if request["s3proxy.key"].AsString() != "encrypted-name" || request["url.path"].AsString() != "/b/encrypted-name" {
+		t.Fatalf("request span %v", request)
+	}
+}
@@ -0,0 +1,600 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxJobHistory is how many finished jobs the registry remembers.
+const maxJobHistory = 100
+
+var errJobRunning = errors.New("a job of this kind is already running for this bucket")
+
+// jobStatus is the externally visible state of a repair or scrub job.
+type jobStatus struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"`
+	Bucket   string     `json:"bucket,omitempty"`
+	Deep     bool       `json:"deep,omitempty"`
+	Repair   bool       `json:"repair,omitempty"`
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Checked  int        `json:"checked"`
+	Diverged int        `json:"diverged"`
+	Repaired int        `json:"repaired"`
+	Failed   int        `json:"failed"`
+	// Skipped counts objects with a replica that could not be checked,
+	// for instance because its backend did not answer.
+	Skipped int    `json:"skipped"`
+	Error   string `json:"error,omitempty"`
+}
+
+type job struct {
+	mu     sync.Mutex
+	status jobStatus
+}
+
+func (j *job) update(fn func(*jobStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.status)
+}
+
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// jobRegistry runs repair and scrub jobs in the background and remembers
+// recent ones for the admin API.
+type jobRegistry struct {
+	mu   sync.Mutex
+	next int
+	jobs []*job
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{}
+}
+
+// start runs fn as a new job unless one of the same kind is already running
+// for the same bucket.
+func (r *jobRegistry) start(params jobStatus, fn func(context.Context, *job) error) (jobStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, j := range r.jobs {
+		s := j.snapshot()
+		if s.Status == "running" && s.Kind == params.Kind && (s.Bucket == "" || params.Bucket == "" || s.Bucket == params.Bucket) {
+			return s, errJobRunning
+		}
+	}
+	r.next++
+	params.ID = strconv.Itoa(r.next)
+	params.Status = "running"
+	params.Started = time.Now()
+	j := &job{status: params}
+	r.jobs = append(r.jobs, j)
+	r.trim()
+
+	go func() {
+		slog.Info("job started", "job", params.ID, "kind", params.Kind, "bucket", params.Bucket)
+		err := fn(context.Background(), j)
+		j.update(func(s *jobStatus) {
+			now := time.Now()
+			s.Finished = &now
+			s.Status = "done"
+			if err != nil {
+				s.Status = "failed"
+				s.Error = err.Error()
+			}
+		})
+		s := j.snapshot()
+		slog.Info("job finished", "job", s.ID, "kind", s.Kind, "status", s.Status, "checked", s.Checked,
+			"diverged", s.Diverged, "repaired", s.Repaired, "failed", s.Failed, "error", s.Error)
+	}()
+	return j.snapshot(), nil
+}
+
+// trim drops the oldest finished jobs beyond maxJobHistory.
+func (r *jobRegistry) trim() {
+	for len(r.jobs) > maxJobHistory {
+		dropped := false
+		for i, j := range r.jobs {
+			if j.snapshot().Status != "running" {
+				r.jobs = append(r.jobs[:i], r.jobs[i+1:]...)
+				dropped = true
+				break
+			}
+		}
+		if !dropped {
+			return
+		}
+	}
+}
+
+func (r *jobRegistry) list() []jobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]jobStatus, len(r.jobs))
+	for i, j := range r.jobs {
+		result[i] = j.snapshot()
+	}
+	return result
+}
+
+func (r *jobRegistry) get(id string) (jobStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, j := range r.jobs {
+		if j.status.ID == id {
+			return j.snapshot(), true
+		}
+	}
+	return jobStatus{}, false
+}
+
+// backend returns the bucket's backend on the given S3 client.
+func (b *s3Bucket) backend(clientID string) *s3Backend {
+	for _, backend := range b.backends {
+		if backend.clientID == clientID {
+			return backend
+		}
+	}
+	return nil
+}
+
+// bucketsFor returns the named bucket, or every bucket in name order when
+// name is empty.
+func (p *Proxy) bucketsFor(name string) ([]*s3Bucket, error) {
+	if name != "" {
+		bucket := p.buckets[name]
+		if bucket == nil {
+			return nil, fmt.Errorf("unknown bucket: %s", name)
+		}
+		return []*s3Bucket{bucket}, nil
+	}
+	names := make([]string, 0, len(p.buckets))
+	for name := range p.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buckets := make([]*s3Bucket, len(names))
+	for i, name := range names {
+		buckets[i] = p.buckets[name]
+	}
+	return buckets, nil
+}
+
+// runRepair works through the journal, bringing diverged replicas back in
+// line with the others.
+func (p *Proxy) runRepair(ctx context.Context, j *job, bucket string) error {
+	for _, entry := range p.journal.list() {
+		if bucket != "" && entry.Bucket != bucket {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fixed, err := p.repairEntry(ctx, entry)
+		j.update(func(s *jobStatus) {
+			s.Checked++
+			if fixed {
+				s.Repaired++
+			} else {
+				s.Failed++
+			}
+		})
+		if err != nil {
+			slog.Warn("repair failed", "bucket", entry.Bucket, "key", entry.Key, "error", err)
+		}
+	}
+	return nil
+}
+
+// repairEntry replays a journaled operation on the backends that missed it.
+// Drained backends are left in the journal until they are enabled again.
+func (p *Proxy) repairEntry(ctx context.Context, entry journalEntry) (bool, error) {
+	bucket := p.buckets[entry.Bucket]
+	if bucket == nil {
+		return false, fmt.Errorf("bucket %s is not configured", entry.Bucket)
+	}
+	var remaining []string
+	var errs []error
+	for _, id := range entry.Backends {
+		target := bucket.backend(id)
+		if target == nil {
+			// The backend was removed from the bucket; nothing to repair.
+			continue
+		}
+		if p.drains.isDrained(id) {
+			remaining = append(remaining, id)
+			continue
+		}
+		var err error
+		if entry.Operation == "delete" {
+			_, err = target.s3Client.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &target.targetBucketName,
+				Key:    &entry.Key,
+			})
+		} else {
+			err = p.replicateTo(ctx, bucket, entry, target)
+		}
+		if err != nil {
+			remaining = append(remaining, id)
+			errs = append(errs, fmt.Errorf("backend %s: %w", id, err))
+			continue
+		}
+		slog.Info("repaired replica", "bucket", entry.Bucket, "key", entry.Key, "backend", id, "operation", entry.Operation)
+	}
+	p.journal.settle(entry, remaining)
+	return len(remaining) == 0, errors.Join(errs...)
+}
+
+// replicateTo copies an object to target from the first backend of the
+// bucket that holds a good copy.
+func (p *Proxy) replicateTo(ctx context.Context, bucket *s3Bucket, entry journalEntry, target *s3Backend) error {
+	var errs []error
+	for _, source := range bucket.backends {
+		if source == target || p.drains.isDrained(source.clientID) || containsString(entry.Backends, source.clientID) {
+			continue
+		}
+		err := p.replicate(ctx, source, target, entry.Key)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("from %s: %w", source.clientID, err))
+	}
+	if len(errs) == 0 {
+		return errors.New("no healthy replica to copy from")
+	}
+	return errors.Join(errs...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// replicate copies one object between backends, decrypting it with the
+// source's crypto profile and encrypting it with the target's.
+func (p *Proxy) replicate(ctx context.Context, source, target *s3Backend, key string) error {
+	obj, err := source.s3Client.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &source.targetBucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	if obj.Metadata[metaCustomerKey] != "" {
+		return errCustomerKeyRequired
+	}
+	if obj.Metadata, err = openInfo(ctx, source, key, obj.Metadata); err != nil {
+		return err
+	}
+	declared, ok := parseObjectInfo(obj.Metadata)
+	if !ok {
+		declared = objectInfo{Size: -1}
+	}
+	if !declared.complete() {
+		declared.Sidecar = newNonce()
+	}
+	// An object a crypto rule moved off the source's own profile keeps
+	// that profile on the target too.
+	if ok && declared.CryptoID != source.cryptoID && !(declared.CryptoID == cryptoNone && source.cryptoID == "") {
+		if target, err = target.withProfile(declared.CryptoID); err != nil {
+			return err
+		}
+	}
+	cost := p.readCost(source, obj.ContentLength, obj.Metadata) + p.upload.putCost(declared.Size, 1)
+	if !p.memory.tryAcquire(cost, "repair") {
+		return errMemoryBudget
+	}
+	defer p.memory.release(cost)
+
+	body, _, err := decodeBody(ctx, source, obj)
+	if err != nil {
+		return err
+	}
+	if obj.Metadata, err = openMetadata(ctx, source, key, obj.Metadata); err != nil {
+		return err
+	}
+
+	targetCtx, cancel := context.WithCancel(ctx)
+	t := &putTarget{
+		ctx:     targetCtx,
+		backend: target,
+		chunks:  make(chan []byte, max(1, p.upload.window/uploadChunkSize)),
+		failed:  make(chan struct{}),
+		cancel:  cancel,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer t.cancel()
+		p.uploadTarget(targetCtx, t, key, headersFromGet(obj).requestHeader(), declared)
+	}()
+
+	hasher := newInfoHasher()
+	for !t.isFailed() {
+		chunk, err := readChunk(body)
+		if len(chunk) > 0 {
+			hasher.Write(chunk)
+			sendAll(chunk, []*putTarget{t}, p.upload.stallTimeout)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.fail(err)
+		}
+	}
+	close(t.chunks)
+	<-done
+	if t.err != nil {
+		return t.err
+	}
+	if declared.Sidecar != "" {
+		return writeInfoSidecar(ctx, target, key, t.stored.Metadata, hasher.info())
+	}
+	return nil
+}
+
+// runScrub compares the replicas of every object in the selected buckets
+// and journals the ones that differ. With deep set every replica is also
+// downloaded and checked against its recorded checksum; with repair set
+// divergences are fixed as they are found.
+func (p *Proxy) runScrub(ctx context.Context, j *job, bucketName string, deep, repair bool) error {
+	buckets, err := p.bucketsFor(bucketName)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if err := p.scrubBucket(ctx, j, bucket, deep, repair); err != nil {
+			return fmt.Errorf("bucket %s: %w", bucket.name, err)
+		}
+	}
+	return nil
+}
+
+// replicaState is what a scrub learned about one replica of an object.
+type replicaState struct {
+	backend      *s3Backend
+	sha256       string
+	lastModified time.Time
+	bad          bool
+}
+
+func (p *Proxy) scrubBucket(ctx context.Context, j *job, bucket *s3Bucket, deep, repair bool) error {
+	backends, _ := p.drains.split(bucket.backends)
+	if len(backends) == 0 {
+		return nil
+	}
+	present := make(map[string][]bool)
+	for i, backend := range backends {
+		paginator := s3.NewListObjectsV2Paginator(backend.s3Client.Client, &s3.ListObjectsV2Input{
+			Bucket: &backend.targetBucketName,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("listing backend %s: %w", backend.clientID, err)
+			}
+			for _, obj := range page.Contents {
+				if backend.isSidecar(*obj.Key) {
+					continue
+				}
+				if present[*obj.Key] == nil {
+					present[*obj.Key] = make([]bool, len(backends))
+				}
+				present[*obj.Key][i] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(present))
+	for key := range present {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		j.update(func(s *jobStatus) { s.Checked++ })
+		if _, tracked := p.journal.get(bucket.name, key); tracked {
+			// Already known to differ; repair will handle it.
+			continue
+		}
+		bad, skipped := p.scrubObject(ctx, bucket, backends, key, present[key], deep)
+		if len(skipped) > 0 {
+			slog.Warn("scrub skipped replicas it could not check", "bucket", bucket.name, "key", key, "backends", skipped)
+			j.update(func(s *jobStatus) { s.Skipped++ })
+		}
+		if len(bad) == 0 {
+			continue
+		}
+		j.update(func(s *jobStatus) { s.Diverged++ })
+		if len(bad) == len(backends) {
+			slog.Error("scrub found no good replica", "bucket", bucket.name, "key", key)
+			j.update(func(s *jobStatus) { s.Failed++ })
+			continue
+		}
+		slog.Warn("scrub found diverged replicas", "bucket", bucket.name, "key", key, "backends", bad)
+		p.journal.record(bucket.name, key, "put", bad)
+		if !repair {
+			continue
+		}
+		entry, _ := p.journal.get(bucket.name, key)
+		fixed, err := p.repairEntry(ctx, entry)
+		if err != nil {
+			slog.Warn("repair failed", "bucket", bucket.name, "key", key, "error", err)
+		}
+		j.update(func(s *jobStatus) {
+			if fixed {
+				s.Repaired++
+			} else {
+				s.Failed++
+			}
+		})
+	}
+	return nil
+}
+
+// scrubObject returns the client IDs of the backends whose replica of key is
+// missing, corrupt or disagrees with the majority, and of those whose
+// replica could not be checked. Only a missing replica or one that fails
+// to decrypt or match its checksum counts as diverged: a backend that is
+// briefly unreachable must not have its replica overwritten.
+func (p *Proxy) scrubObject(ctx context.Context, bucket *s3Bucket, backends []*s3Backend, key string, present []bool, deep bool) (bad, skipped []string) {
+	var replicas []*replicaState
+	for i, backend := range backends {
+		if !present[i] {
+			bad = append(bad, backend.clientID)
+			continue
+		}
+		head, err := backend.s3Client.Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &backend.targetBucketName,
+			Key:    &key,
+		})
+		if err != nil {
+			if backendStatus(err) == http.StatusNotFound {
+				bad = append(bad, backend.clientID)
+			} else {
+				slog.Warn("scrub could not read replica metadata", "bucket", bucket.name, "key", key, "backend", backend.clientID, "error", err)
+				skipped = append(skipped, backend.clientID)
+			}
+			continue
+		}
+		meta, err := openInfo(ctx, backend, key, head.Metadata)
+		if err != nil {
+			slog.Warn("scrub could not open replica metadata", "bucket", bucket.name, "key", key, "backend", backend.clientID, "error", err)
+			skipped = append(skipped, backend.clientID)
+			continue
+		}
+		replica := &replicaState{backend: backend, sha256: meta[metaSHA256]}
+		if head.LastModified != nil {
+			replica.lastModified = *head.LastModified
+		}
+		// Replicas under a customer key can only be compared by checksum.
+		if deep && head.Metadata[metaCustomerKey] == "" {
+			err := p.verifyReplica(ctx, backend, key)
+			var corrupt *corruptReplicaError
+			switch {
+			case err == nil:
+			case errors.As(err, &corrupt) || backendStatus(err) == http.StatusNotFound:
+				slog.Warn("scrub found unreadable replica", "bucket", bucket.name, "key", key, "backend", backend.clientID, "error", err)
+				replica.bad = true
+			default:
+				slog.Warn("scrub could not read replica", "bucket", bucket.name, "key", key, "backend", backend.clientID, "error", err)
+				skipped = append(skipped, backend.clientID)
+				continue
+			}
+		}
+		replicas = append(replicas, replica)
+	}
+
+	// Replicas with a recorded checksum vote; the checksum held by most of
+	// them wins, and the most recently written one breaks ties.
+	votes := make(map[string]int)
+	newest := make(map[string]time.Time)
+	for _, r := range replicas {
+		if r.bad || r.sha256 == "" {
+			continue
+		}
+		votes[r.sha256]++
+		if r.lastModified.After(newest[r.sha256]) {
+			newest[r.sha256] = r.lastModified
+		}
+	}
+	winner := ""
+	for sum, n := range votes {
+		if winner == "" || n > votes[winner] || (n == votes[winner] && newest[sum].After(newest[winner])) {
+			winner = sum
+		}
+	}
+	for _, r := range replicas {
+		if r.bad || (winner != "" && r.sha256 != "" && r.sha256 != winner) {
+			bad = append(bad, r.backend.clientID)
+		}
+	}
+	return bad, skipped
+}
+
+// corruptReplicaError reports a replica that was read in full but failed
+// to decrypt or to match its checksum.
+type corruptReplicaError struct {
+	err error
+}
+
+func (e *corruptReplicaError) Error() string { return e.err.Error() }
+func (e *corruptReplicaError) Unwrap() error { return e.err }
+
+// verifyReplica reads and decodes a whole replica, which checks both its
+// encryption and its recorded checksum. Failures of the replica itself are
+// returned as a *corruptReplicaError; anything else, such as a dropped
+// connection or an exhausted memory budget, says nothing about it.
+func (p *Proxy) verifyReplica(ctx context.Context, backend *s3Backend, key string) error {
+	obj, err := backend.s3Client.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &backend.targetBucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+	if obj.Metadata, err = openInfo(ctx, backend, key, obj.Metadata); err != nil {
+		return err
+	}
+	if _, err := backend.readCrypto(obj.Metadata); err != nil {
+		return err
+	}
+	cost := p.readCost(backend, obj.ContentLength, obj.Metadata)
+	if !p.memory.tryAcquire(cost, "scrub") {
+		return errMemoryBudget
+	}
+	defer p.memory.release(cost)
+
+	raw := &errorTracker{r: obj.Body}
+	obj.Body = io.NopCloser(raw)
+	body, _, err := decodeBody(ctx, backend, obj)
+	if err == nil {
+		_, err = io.Copy(io.Discard, body)
+	}
+	if err != nil && raw.err == nil && ctx.Err() == nil {
+		return &corruptReplicaError{err: err}
+	}
+	return err
+}
+
+// errorTracker remembers the first error of a reader other than io.EOF, so
+// a failed download can be told apart from a failed decode.
+type errorTracker struct {
+	r   io.Reader
+	err error
+}
+
+func (t *errorTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// refuse makes fake answer op with 403 while the returned flag is set.
+func refuse(fake *fakeS3, op string) *atomic.Bool {
+	var on atomic.Bool
+	fake.hook = func(r *http.Request, got string) int {
+		if on.Load() && got == op {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+	return &on
+}
+
+func TestPartialPutJournaledAndRepaired(t *testing.T) {
+	a, b := newFakeS3(t), newFakeS3(t)
+	cfg := testConfig(t, a, b)
+	// The replica is re-encrypted for the target's profile.
+	cfg.S3Buckets[0].Backends[1].CryptoID = ""
+	p := newTestProxy(t, cfg)
+	failing := refuse(b, "PutObject")
+	failing.Store(true)
+
+	data := randomBody(t, 100)
+	if w := serve(p, http.MethodPut, "/vb/k", data, nil); w.Code != http.StatusOK {
+		t.Fatalf("partial put: %d", w.Code)
+	}
+	entry, ok := p.journal.get("vb", "k")
+	if !ok || entry.Operation != "put" || len(entry.Backends) != 1 || entry.Backends[0] != "s3-1" {
+		t.Fatalf("journal entry %+v, %v", entry, ok)
+	}
+
+	// Still failing: the entry stays.
+	j := &job{}
+	if err := p.runRepair(context.Background(), j, ""); err != nil {
+		t.Fatal(err)
+	}
+	if s := j.snapshot(); s.Checked != 1 || s.Failed != 1 {
+		t.Fatalf("failed repair reported %+v", s)
+	}
+	if _, ok := p.journal.get("vb", "k"); !ok {
+		t.Fatal("failed repair cleared the journal")
+	}
+
+	failing.Store(false)
+	j = &job{}
+	if err := p.runRepair(context.Background(), j, ""); err != nil {
+		t.Fatal(err)
+	}
+	if s := j.snapshot(); s.Repaired != 1 {
+		t.Fatalf("repair reported %+v", s)
+	}
+	if _, ok := p.journal.get("vb", "k"); ok {
+		t.Fatal("repaired object still journaled")
+	}
+	if got := b.object("data", "k"); got == nil || !bytes.Equal(got.data, data) {
+		t.Fatal("replica not copied in the target's profile")
+	}
+}
+
+func TestPartialDeleteRepaired(t *testing.T) {
+	a, b := newFakeS3(t), newFakeS3(t)
+	p := newTestProxy(t, testConfig(t, a, b))
+	if w := serve(p, http.MethodPut, "/vb/k", randomBody(t, 100), nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d", w.Code)
+	}
+	failing := refuse(b, "DeleteObject")
+	failing.Store(true)
+	if w := serve(p, http.MethodDelete, "/vb/k", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("partial delete: %d", w.Code)
+	}
+	if entry, ok := p.journal.get("vb", "k"); !ok || entry.Operation != "delete" {
+		t.Fatalf("journal entry %+v, %v", entry, ok)
+	}
+	failing.Store(false)
+	if err := p.runRepair(context.Background(), &job{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if b.object("data", "k") != nil {
+		t.Fatal("delete not replayed")
+	}
+	if _, ok := p.journal.get("vb", "k"); ok {
+		t.Fatal("repaired delete still journaled")
+	}
+}
+
+func TestRepairWaitsForDrainedBackend(t *testing.T) {
+	a, b := newFakeS3(t), newFakeS3(t)
+	p := newTestProxy(t, testConfig(t, a, b))
+	p.drains.drain("s3-1")
+	if w := serve(p, http.MethodPut, "/vb/k", randomBody(t, 100), nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d", w.Code)
+	}
+	if b.object("data", "k") != nil {
+		t.Fatal("written to a drained backend")
+	}
+	if err := p.runRepair(context.Background(), &job{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.journal.get("vb", "k"); !ok || b.object("data", "k") != nil {
+		t.Fatal("repaired a drained backend")
+	}
+	p.drains.enable("s3-1")
+	if err := p.runRepair(context.Background(), &job{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.journal.get("vb", "k"); ok || b.object("data", "k") == nil {
+		t.Fatal("enabled backend not repaired")
+	}
+}
+
+func TestScrubFindsDivergedReplicas(t *testing.T) {
+	a, b := newFakeS3(t), newFakeS3(t)
+	p := newTestProxy(t, testConfig(t, a, b))
+	for _, key := range []string{"missing", "corrupt", "good"} {
+		if w := serve(p, http.MethodPut, "/vb/"+key, randomBody(t, 2*uploadChunkSize), nil); w.Code != http.StatusOK {
+			t.Fatalf("put: %d", w.Code)
+		}
+	}
+	b.remove("data", "missing")
+	b.object("data", "corrupt").data[100] ^= 1
+
+	// A shallow scrub only sees the missing replica.
+	j := &job{}
+	if err := p.runScrub(context.Background(), j, "", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if s := j.snapshot(); s.Checked != 3 || s.Diverged != 1 {
+		t.Fatalf("shallow scrub %+v", s)
+	}
+	if entry, ok := p.journal.get("vb", "missing"); !ok || len(entry.Backends) != 1 || entry.Backends[0] != "s3-1" {
+		t.Fatalf("missing replica journaled as %+v, %v", entry, ok)
+	}
+
+	// A deep one reads the corrupt replica and repairs both.
+	j = &job{}
+	if err := p.runScrub(context.Background(), j, "vb", true, true); err != nil {
+		t.Fatal(err)
+	}
+	if s := j.snapshot(); s.Diverged != 1 || s.Repaired != 1 {
+		t.Fatalf("deep scrub %+v", s)
+	}
+	if err := p.runRepair(context.Background(), &job{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if entries := p.journal.list(); len(entries) != 0 {
+		t.Fatalf("left in the journal: %+v", entries)
+	}
+	for _, key := range []string{"missing", "corrupt"} {
+		if err := p.verifyReplica(context.Background(), p.buckets["vb"].backends[1], key); err != nil {
+			t.Fatalf("%s not repaired: %v", key, err)
+		}
+	}
+}
+
+func TestScrubSkipsUnreachableReplica(t *testing.T) {
+	a, b := newFakeS3(t), newFakeS3(t)
+	p := newTestProxy(t, testConfig(t, a, b))
+	if w := serve(p, http.MethodPut, "/vb/k", randomBody(t, 100), nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d", w.Code)
+	}
+	refuse(b, "HeadObject").Store(true)
+	j := &job{}
+	if err := p.runScrub(context.Background(), j, "", false, true); err != nil {
+		t.Fatal(err)
+	}
+	if s := j.snapshot(); s.Skipped != 1 || s.Diverged != 0 {
+		t.Fatalf("scrub %+v", s)
+	}
+	if _, ok := p.journal.get("vb", "k"); ok {
+		t.Fatal("journaled a replica that could not be checked")
+	}
+}
+
+func TestJobRegistryRunsOneJobPerKindAndBucket(t *testing.T) {
+	r := newJobRegistry()
+	release := make(chan struct{})
+	blocked := func(ctx context.Context, j *job) error {
+		<-release
+		return nil
+	}
+	first, err := r.start(jobStatus{Kind: "scrub", Bucket: "a"}, blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.start(jobStatus{Kind: "scrub", Bucket: "a"}, blocked); err != errJobRunning {
+		t.Fatalf("second scrub of a bucket: %v", err)
+	}
+	if _, err := r.start(jobStatus{Kind: "scrub"}, blocked); err != errJobRunning {
+		t.Fatalf("scrub of every bucket next to one of a: %v", err)
+	}
+	if _, err := r.start(jobStatus{Kind: "scrub", Bucket: "b"}, blocked); err != nil {
+		t.Fatalf("scrub of another bucket: %v", err)
+	}
+	if _, err := r.start(jobStatus{Kind: "repair", Bucket: "a"}, blocked); err != nil {
+		t.Fatalf("repair next to a scrub: %v", err)
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, ok := r.get(first.ID)
+		if ok && s.Status == "done" && s.Finished != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %+v did not finish", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(r.list()) != 3 {
+		t.Fatalf("registry holds %d jobs", len(r.list()))
+	}
+}
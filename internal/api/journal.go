@@ -0,0 +1,354 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"s3-proxy/internal/metrics"
+)
+
+// journalEntry is an object whose replicas are known to differ because a
+// write or delete did not reach every backend of its bucket.
+type journalEntry struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Operation string    `json:"operation"`
+	Backends  []string  `json:"backends"`
+	Since     time.Time `json:"since"`
+	// seq identifies this version of the entry, so a repair only clears
+	// the divergence it actually fixed.
+	seq uint64
+}
+
+type journalKey struct {
+	bucket string
+	key    string
+}
+
+// journalRecord is one line of the journal file: an entry as it now stands,
+// or its removal.
+type journalRecord struct {
+	journalEntry
+	Resolved bool `json:"resolved,omitempty"`
+}
+
+// journalCompactAfter is how many records the file may hold before it is
+// rewritten with only the current entries, once most of them are stale.
+const journalCompactAfter = 1024
+
+// journal tracks diverged replicas. Its size is the replication backlog
+// exported as a metric. With a file every change is appended to it in the
+// background, so the backlog survives a restart; without one it is lost.
+type journal struct {
+	mu      sync.Mutex
+	entries map[journalKey]*journalEntry
+	seq     uint64
+	file    string
+	// pending holds the changes not yet in the file. One writer at a time
+	// appends them in batches, so callers never wait for the disk.
+	pending []journalRecord
+	writing bool
+	idle    *sync.Cond
+	// log and logged belong to the writer: the open file, nil until the
+	// first write compacts it, and how many records it holds.
+	log    *os.File
+	logged int
+}
+
+// newJournal returns a journal kept in file, loading the entries already
+// there, or an in-memory journal if file is empty. The file is only written
+// once the journal changes.
+func newJournal(file string) (*journal, error) {
+	j := &journal{entries: make(map[journalKey]*journalEntry), file: file}
+	j.idle = sync.NewCond(&j.mu)
+	if file == "" {
+		return j, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return nil, err
+		}
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-1 {
+				// A write cut short by a crash. The next write compacts
+				// the file, which drops it.
+				slog.Warn("ignoring incomplete last record of the repair journal", "file", file)
+				break
+			}
+			return nil, fmt.Errorf("%s: line %d: %w", file, i+1, err)
+		}
+		k := journalKey{record.Bucket, record.Key}
+		if record.Resolved {
+			delete(j.entries, k)
+			continue
+		}
+		j.seq++
+		entry := record.journalEntry
+		entry.seq = j.seq
+		j.entries[k] = &entry
+	}
+	j.updateMetrics()
+	if len(j.entries) > 0 {
+		slog.Info("loaded repair journal", "file", file, "entries", len(j.entries))
+	}
+	return j, nil
+}
+
+// persisted reports whether the journal survives a restart.
+func (j *journal) persisted() bool {
+	return j.file != ""
+}
+
+// record notes that an operation on an object failed on the given backends.
+// A newer operation on the same object replaces the older entry, since it
+// decides what the replicas should now contain.
+func (j *journal) record(bucket, key, operation string, backends []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	since := time.Now()
+	if prev, ok := j.entries[journalKey{bucket, key}]; ok {
+		since = prev.Since
+	}
+	j.seq++
+	entry := &journalEntry{
+		Bucket:    bucket,
+		Key:       key,
+		Operation: operation,
+		Backends:  backends,
+		Since:     since,
+		seq:       j.seq,
+	}
+	j.entries[journalKey{bucket, key}] = entry
+	j.changed(journalRecord{journalEntry: *entry})
+}
+
+// resolve clears an object once every replica agrees again.
+func (j *journal) resolve(bucket, key string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.entries[journalKey{bucket, key}]; !ok {
+		return
+	}
+	delete(j.entries, journalKey{bucket, key})
+	j.changed(resolvedRecord(bucket, key))
+}
+
+// get returns the entry for an object, if there is one.
+func (j *journal) get(bucket, key string) (journalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry, ok := j.entries[journalKey{bucket, key}]
+	if !ok {
+		return journalEntry{}, false
+	}
+	return *entry, true
+}
+
+// settle updates an entry after a repair attempt: it is cleared if no
+// backends remain and narrowed to the remaining ones otherwise. Nothing
+// changes if the object was written again since the entry was read.
+func (j *journal) settle(entry journalEntry, remaining []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	current, ok := j.entries[journalKey{entry.Bucket, entry.Key}]
+	if !ok || current.seq != entry.seq {
+		return
+	}
+	if len(remaining) == 0 {
+		delete(j.entries, journalKey{entry.Bucket, entry.Key})
+		j.changed(resolvedRecord(entry.Bucket, entry.Key))
+		return
+	}
+	current.Backends = remaining
+	j.changed(journalRecord{journalEntry: *current})
+}
+
+// list returns a snapshot of the journal, oldest first.
+func (j *journal) list() []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.sorted()
+}
+
+func (j *journal) sorted() []journalEntry {
+	result := make([]journalEntry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].Since.Before(result[b].Since)
+	})
+	return result
+}
+
+func resolvedRecord(bucket, key string) journalRecord {
+	return journalRecord{journalEntry: journalEntry{Bucket: bucket, Key: key}, Resolved: true}
+}
+
+// changed updates the metrics and queues record for the file. It is called
+// with j.mu held.
+func (j *journal) changed(record journalRecord) {
+	j.updateMetrics()
+	if j.file == "" {
+		return
+	}
+	j.pending = append(j.pending, record)
+	if !j.writing {
+		j.writing = true
+		go j.write()
+	}
+}
+
+// write appends pending records to the file until none are left. A failed
+// write is logged and the file is rewritten whole with the next change; the
+// entries in memory stay authoritative.
+func (j *journal) write() {
+	j.mu.Lock()
+	for len(j.pending) > 0 {
+		batch := j.pending
+		j.pending = nil
+		var snapshot []journalEntry
+		compact := j.log == nil || (j.logged > journalCompactAfter && j.logged > 4*len(j.entries))
+		if compact {
+			// The snapshot already holds the batch.
+			snapshot = j.sorted()
+		}
+		j.mu.Unlock()
+
+		var err error
+		if compact {
+			err = j.compact(snapshot)
+		} else {
+			err = j.append(batch)
+		}
+		if err != nil {
+			metrics.JournalWriteErrors.Inc()
+			slog.Error("cannot write repair journal", "file", j.file, "error", err)
+			if j.log != nil {
+				j.log.Close()
+				j.log = nil
+			}
+		}
+		j.mu.Lock()
+	}
+	j.writing = false
+	j.idle.Broadcast()
+	j.mu.Unlock()
+}
+
+// append writes records to the end of the file and syncs it.
+func (j *journal) append(records []journalRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	if _, err := j.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := j.log.Sync(); err != nil {
+		return err
+	}
+	j.logged += len(records)
+	return nil
+}
+
+// compact replaces the file with entries, through a rename so a crash
+// leaves either the old or the new journal, and opens it for appending.
+func (j *journal) compact(entries []journalEntry) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := enc.Encode(journalRecord{journalEntry: entry}); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(j.file), filepath.Base(j.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.file); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(j.file, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if j.log != nil {
+		j.log.Close()
+	}
+	j.log, j.logged = log, len(entries)
+	return nil
+}
+
+// flush waits until every change so far is in the file.
+func (j *journal) flush() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.writing {
+		j.idle.Wait()
+	}
+}
+
+// close flushes the journal and closes its file.
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.writing {
+		j.idle.Wait()
+	}
+	if j.log != nil {
+		j.log.Close()
+		j.log = nil
+	}
+}
+
+func (j *journal) updateMetrics() {
+	metrics.ReplicationBacklog.Set(float64(len(j.entries)))
+	var oldest time.Time
+	for _, entry := range j.entries {
+		if oldest.IsZero() || entry.Since.Before(oldest) {
+			oldest = entry.Since
+		}
+	}
+	if oldest.IsZero() {
+		metrics.ReplicationBacklogOldest.Set(0)
+	} else {
+		metrics.ReplicationBacklogOldest.Set(float64(oldest.Unix()))
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJournalPersists(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal.json")
+	j, err := newJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.persisted() || len(j.list()) != 0 {
+		t.Fatal("new journal file is not empty")
+	}
+	j.record("b", "one", "put", []string{"x", "y"})
+	j.record("b", "two", "delete", []string{"y"})
+	j.record("c", "three", "put", []string{"x"})
+	j.resolve("c", "three")
+	entry, _ := j.get("b", "one")
+	j.settle(entry, []string{"y"})
+	j.flush()
+
+	reopened, err := newJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, want := reopened.list(), j.list()
+	if len(got) != 2 || len(got) != len(want) {
+		t.Fatalf("reopened journal holds %d entries, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].Bucket != want[i].Bucket || got[i].Key != want[i].Key || got[i].Operation != want[i].Operation ||
+			!reflect.DeepEqual(got[i].Backends, want[i].Backends) || !got[i].Since.Equal(want[i].Since) {
+			t.Errorf("entry %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// Reloaded entries are settled like new ones.
+	entry, _ = reopened.get("b", "two")
+	reopened.settle(entry, nil)
+	reopened.flush()
+	if _, ok := reopened.get("b", "two"); ok {
+		t.Fatal("reloaded entry not settled")
+	}
+	again, err := newJournal(file)
+	if err != nil || len(again.list()) != 1 {
+		t.Fatalf("journal after settle: %v, %v", again.list(), err)
+	}
+	matches, _ := filepath.Glob(file + ".*")
+	if len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestJournalSettleKeepsNewerEntry(t *testing.T) {
+	j, _ := newJournal("")
+	if j.persisted() {
+		t.Fatal("journal without a file is persisted")
+	}
+	j.record("b", "k", "put", []string{"x"})
+	old, _ := j.get("b", "k")
+	j.record("b", "k", "delete", []string{"x", "y"})
+	j.settle(old, nil)
+	current, ok := j.get("b", "k")
+	if !ok || current.Operation != "delete" || len(current.Backends) != 2 || !current.Since.Equal(old.Since) {
+		t.Fatalf("newer entry changed by a stale repair: %+v", current)
+	}
+}
+
+func TestJournalRejectsCorruptFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal.json")
+	if err := os.WriteFile(file, []byte("{not json\n{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newJournal(file); err == nil {
+		t.Fatal("loaded a corrupt journal")
+	}
+}
+
+func TestJournalCreatesDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state", "journal.json")
+	j, err := newJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.record("b", "k", "put", []string{"x"})
+	j.close()
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalDropsTornRecord(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal.json")
+	j, _ := newJournal(file)
+	j.record("b", "one", "put", []string{"x"})
+	j.close()
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash in the middle of an append.
+	f.WriteString(`{"bucket":"b","key":"tw`)
+	f.Close()
+
+	reopened, err := newJournal(file)
+	if err != nil || len(reopened.list()) != 1 {
+		t.Fatalf("journal with a torn record: %v, %v", reopened.list(), err)
+	}
+	reopened.record("b", "two", "put", []string{"x"})
+	reopened.close()
+	again, err := newJournal(file)
+	if err != nil || len(again.list()) != 2 {
+		t.Fatalf("journal written after a torn record: %v, %v", again.list(), err)
+	}
+}
+
+func TestJournalAppendsAndCompacts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal.json")
+	j, _ := newJournal(file)
+	j.record("b", "kept", "put", []string{"x"})
+	for i := 0; i < 3*journalCompactAfter; i++ {
+		j.record("b", "churn", "put", []string{"x"})
+		j.resolve("b", "churn")
+		if i%100 == 0 {
+			// Let the writer catch up now and then, so records are
+			// appended in more than one batch.
+			j.flush()
+		}
+	}
+	j.close()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > journalCompactAfter+250 {
+		t.Fatalf("journal file holds %d records for one entry", lines)
+	}
+	reopened, err := newJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := reopened.list(); len(entries) != 1 || entries[0].Key != "kept" {
+		t.Fatalf("after compaction %+v", entries)
+	}
+}
@@ -0,0 +1,495 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/tink/go/daead/subtle"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	keyModeSIV  = "siv"
+	keyModeHMAC = "hmac"
+
+	// maxKeyLength is the longest object key S3 accepts.
+	maxKeyLength = 1024
+	// hmacSegmentSize is how much of the HMAC names a segment.
+	hmacSegmentSize = 16
+	// maxNameCacheEntries bounds the cache of resolved HMAC names.
+	maxNameCacheEntries = 100000
+)
+
+var (
+	errKeyTooLong           = errors.New("encrypted key exceeds the S3 key length limit")
+	errUnsupportedDelimiter = errors.New("only the \"/\" delimiter is supported with key encryption")
+)
+
+// keyCodec translates object keys between the names clients use and the
+// names stored on the backends. Keys are translated segment by segment,
+// each segment bound to the plaintext segments before it, so a prefix
+// ending in "/" maps to exactly one backend prefix and delimiter listings
+// keep working. Empty segments stay empty.
+type keyCodec struct {
+	mode string
+	// siv encrypts segments in siv mode and seals names in hmac mode.
+	siv *subtle.AESSIV
+	mac []byte
+	// names caches backend keys and prefixes resolved in hmac mode.
+	names *nameCache
+}
+
+// newKeyCodec returns a codec for mode keyed with a 64 byte key. In hmac
+// mode the HMAC and sealing keys are derived from it.
+func newKeyCodec(mode string, key []byte) (*keyCodec, error) {
+	if len(key) != subtle.AESSIVKeySize {
+		return nil, fmt.Errorf("key encryption key must be %d bytes, got %d", subtle.AESSIVKeySize, len(key))
+	}
+	c := &keyCodec{mode: mode}
+	switch mode {
+	case keyModeSIV:
+	case keyModeHMAC:
+		c.mac = deriveKey(key, "s3-proxy object key hmac", sha256.Size)
+		key = deriveKey(key, "s3-proxy object key seal", subtle.AESSIVKeySize)
+		c.names = newNameCache()
+	default:
+		return nil, fmt.Errorf("unsupported key encryption mode: %s", mode)
+	}
+	siv, err := subtle.NewAESSIV(key)
+	if err != nil {
+		return nil, err
+	}
+	c.siv = siv
+	return c, nil
+}
+
+func deriveKey(secret []byte, info string, size int) []byte {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(info)), key); err != nil {
+		panic(err) // only fails when asking for more than 255 hashes
+	}
+	return key
+}
+
+// encode returns the backend key of a client key.
+func (c *keyCodec) encode(key string) (string, error) {
+	segments := strings.Split(key, "/")
+	parent := make([]byte, 0, len(key))
+	for i, segment := range segments {
+		if segment != "" {
+			segments[i] = c.segment(parent, segment)
+		}
+		parent = append(parent, segment...)
+		parent = append(parent, '/')
+	}
+	encoded := strings.Join(segments, "/")
+	if len(encoded) > maxKeyLength {
+		return "", errKeyTooLong
+	}
+	return encoded, nil
+}
+
+func (c *keyCodec) segment(parent []byte, segment string) string {
+	if c.mode == keyModeHMAC {
+		m := hmac.New(sha256.New, c.mac)
+		m.Write(parent)
+		m.Write([]byte(segment))
+		return base64.RawURLEncoding.EncodeToString(m.Sum(nil)[:hmacSegmentSize])
+	}
+	ciphertext, err := c.siv.EncryptDeterministically([]byte(segment), parent)
+	if err != nil {
+		panic(err) // AES-SIV encryption cannot fail
+	}
+	return base64.RawURLEncoding.EncodeToString(ciphertext)
+}
+
+// decode returns the client key of a backend key in siv mode.
+func (c *keyCodec) decode(encoded string) (string, error) {
+	segments := strings.Split(encoded, "/")
+	parent := make([]byte, 0, len(encoded))
+	for i, segment := range segments {
+		if segment != "" {
+			ciphertext, err := base64.RawURLEncoding.DecodeString(segment)
+			if err != nil {
+				return "", err
+			}
+			plaintext, err := c.siv.DecryptDeterministically(ciphertext, parent)
+			if err != nil {
+				return "", err
+			}
+			segments[i] = string(plaintext)
+		}
+		parent = append(parent, segments[i]...)
+		parent = append(parent, '/')
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// sealName returns the client key sealed for the object metadata in hmac
+// mode, and "" in siv mode where the backend key itself can be decrypted.
+func (c *keyCodec) sealName(key string) string {
+	if c.mode != keyModeHMAC {
+		return ""
+	}
+	sealed, err := c.siv.EncryptDeterministically([]byte(key), []byte(metaName))
+	if err != nil {
+		panic(err) // AES-SIV encryption cannot fail
+	}
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+func (c *keyCodec) unsealName(sealed string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	key, err := c.siv.DecryptDeterministically(raw, []byte(metaName))
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// nameCache remembers the client keys of HMAC-named objects and prefixes.
+// HMAC names never change meaning, so entries need no validation.
+type nameCache struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+func newNameCache() *nameCache {
+	return &nameCache{entries: make(map[string]string)}
+}
+
+func (c *nameCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name, ok := c.entries[key]
+	return name, ok
+}
+
+func (c *nameCache) put(key, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxNameCacheEntries {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = name
+}
+
+// keyEncryptionSupported reports whether r can be served on a bucket with
+// key encryption. Object reads and writes and listings are translated;
+// anything else, such as multi-object deletes or version and upload
+// listings, would pass plaintext keys to the backend or return backend keys.
+func keyEncryptionSupported(r *http.Request, key string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if key != "" {
+			return true
+		}
+		query := r.URL.Query()
+		return !query.Has("versions") && !query.Has("uploads")
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		return key != ""
+	}
+	return false
+}
+
+// listTranslation remembers what a client listed, so the backend listing
+// can be put back in the client's terms.
+type listTranslation struct {
+	prefix        string
+	backendPrefix string
+	marker        string
+	startAfter    string
+	encoded       bool
+}
+
+// translateListRequest rewrites the key parameters of a listing. A prefix
+// that ends inside a segment lists the enclosing "directory" and the rest
+// is filtered out of the response. Continuation tokens are opaque and
+// passed through.
+func (c *keyCodec) translateListRequest(query url.Values) (listTranslation, error) {
+	if d := query.Get("delimiter"); d != "" && d != "/" {
+		return listTranslation{}, errUnsupportedDelimiter
+	}
+	t := listTranslation{
+		prefix:     query.Get("prefix"),
+		marker:     query.Get("marker"),
+		startAfter: query.Get("start-after"),
+		encoded:    query.Get("encoding-type") == "url",
+	}
+	complete := t.prefix[:strings.LastIndex(t.prefix, "/")+1]
+	var err error
+	if t.backendPrefix, err = c.encode(complete); err != nil {
+		return t, err
+	}
+	if t.backendPrefix != "" {
+		query.Set("prefix", t.backendPrefix)
+	} else {
+		query.Del("prefix")
+	}
+	for _, name := range []string{"marker", "start-after"} {
+		if value := query.Get(name); value != "" {
+			encoded, err := c.encode(value)
+			if err != nil {
+				return t, err
+			}
+			query.Set(name, encoded)
+		}
+	}
+	return t, nil
+}
+
+// eachElement calls fn with the content of every <name> element of body and
+// replaces the content with the result. A nil result drops the element.
+func eachElement(body []byte, name string, fn func(content []byte) []byte) []byte {
+	open, end := []byte("<"+name+">"), []byte("</"+name+">")
+	var out bytes.Buffer
+	out.Grow(len(body))
+	last := 0
+	for offset := 0; ; {
+		i := bytes.Index(body[offset:], open)
+		if i < 0 {
+			break
+		}
+		start := offset + i
+		j := bytes.Index(body[start:], end)
+		if j < 0 {
+			break
+		}
+		stop := start + j + len(end)
+		out.Write(body[last:start])
+		if content := fn(body[start+len(open) : start+j]); content != nil {
+			out.Write(open)
+			out.Write(content)
+			out.Write(end)
+		}
+		last, offset = stop, stop
+	}
+	out.Write(body[last:])
+	return out.Bytes()
+}
+
+// elementText returns the unescaped text of the first <name> element.
+func elementText(body []byte, name string, encoded bool) (string, bool) {
+	found := false
+	var text string
+	eachElement(body, name, func(content []byte) []byte {
+		if !found {
+			found = true
+			text = unescapeKey(content, encoded)
+		}
+		return content
+	})
+	return text, found
+}
+
+func unescapeKey(content []byte, encoded bool) string {
+	var text string
+	doc := append(append([]byte("<v>"), content...), "</v>"...)
+	if err := xml.Unmarshal(doc, &text); err != nil {
+		text = string(content)
+	}
+	if encoded {
+		if k, err := url.QueryUnescape(text); err == nil {
+			text = k
+		}
+	}
+	return text
+}
+
+func escapeKey(key string, encoded bool) []byte {
+	if encoded {
+		key = url.QueryEscape(key)
+	}
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(key))
+	// Never nil, which would drop the element.
+	return append([]byte{}, buf.Bytes()...)
+}
+
+// translateListing rewrites the backend keys of a ListObjects response to
+// client keys. Entries that cannot be translated, such as objects stored
+// before key encryption was enabled, and entries outside a partial prefix
+// are left out, so a page may hold fewer than max-keys entries. Entries
+// come in backend order, which is not the order of the client keys.
+func (p *Proxy) translateListing(ctx context.Context, codec *keyCodec, backend *s3Backend, t listTranslation, body []byte) []byte {
+	// Collect every backend name first, so hmac mode can resolve them in
+	// parallel.
+	var keys, prefixes []string
+	eachElement(body, "Contents", func(content []byte) []byte {
+		if key, ok := elementText(content, "Key", t.encoded); ok {
+			keys = append(keys, key)
+		}
+		return content
+	})
+	eachElement(body, "CommonPrefixes", func(content []byte) []byte {
+		if prefix, ok := elementText(content, "Prefix", t.encoded); ok {
+			prefixes = append(prefixes, prefix)
+		}
+		return content
+	})
+	nextMarker, hasNextMarker := elementText(body, "NextMarker", t.encoded)
+	names := p.resolveNames(ctx, codec, backend, keys, prefixes)
+
+	translate := func(name string) ([]byte, bool) {
+		plain, ok := names[name]
+		if !ok || !strings.HasPrefix(plain, t.prefix) {
+			return nil, false
+		}
+		return escapeKey(plain, t.encoded), true
+	}
+
+	// The echoed prefix is the only <Prefix> equal to the backend prefix;
+	// common prefixes are always longer.
+	body = eachElement(body, "Prefix", func(content []byte) []byte {
+		if unescapeKey(content, t.encoded) == t.backendPrefix {
+			return escapeKey(t.prefix, t.encoded)
+		}
+		return content
+	})
+	count := 0
+	for _, element := range []struct{ block, name string }{{"Contents", "Key"}, {"CommonPrefixes", "Prefix"}} {
+		body = eachElement(body, element.block, func(content []byte) []byte {
+			name, ok := elementText(content, element.name, t.encoded)
+			if !ok {
+				return nil
+			}
+			plain, ok := translate(name)
+			if !ok {
+				return nil
+			}
+			count++
+			return eachElement(content, element.name, func([]byte) []byte { return plain })
+		})
+	}
+	body = eachElement(body, "Marker", func([]byte) []byte { return escapeKey(t.marker, t.encoded) })
+	body = eachElement(body, "StartAfter", func([]byte) []byte { return escapeKey(t.startAfter, t.encoded) })
+	if hasNextMarker {
+		body = eachElement(body, "NextMarker", func(content []byte) []byte {
+			if plain, ok := names[nextMarker]; ok {
+				return escapeKey(plain, t.encoded)
+			}
+			// The next page starts after this backend key either way, so
+			// an untranslatable marker is still a valid one.
+			return content
+		})
+	}
+	return eachElement(body, "KeyCount", func([]byte) []byte { return []byte(strconv.Itoa(count)) })
+}
+
+// resolveNames maps backend keys and prefixes to client keys. In siv mode
+// they are decrypted; in hmac mode objects are looked up by HEAD and
+// prefixes by listing one object below them.
+func (p *Proxy) resolveNames(ctx context.Context, codec *keyCodec, backend *s3Backend, keys, prefixes []string) map[string]string {
+	names := make(map[string]string, len(keys)+len(prefixes))
+	if codec.mode == keyModeSIV {
+		for _, name := range append(keys, prefixes...) {
+			if plain, err := codec.decode(name); err == nil {
+				names[name] = plain
+			} else {
+				slog.DebugContext(ctx, "cannot decrypt listed key", "key", name, "error", err)
+			}
+		}
+		return names
+	}
+
+	var mu sync.Mutex
+	sem := make(chan struct{}, listingHeadConcurrency)
+	var wg sync.WaitGroup
+	lookup := func(name string, resolve func() (string, error)) {
+		if plain, ok := codec.names.get(name); ok {
+			mu.Lock()
+			names[name] = plain
+			mu.Unlock()
+			return
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			plain, err := resolve()
+			if err != nil {
+				slog.DebugContext(ctx, "cannot resolve listed key", "key", name, "backend", backend.clientID, "error", err)
+				return
+			}
+			codec.names.put(name, plain)
+			mu.Lock()
+			names[name] = plain
+			mu.Unlock()
+		}()
+	}
+	for _, key := range keys {
+		lookup(key, func() (string, error) { return p.objectName(ctx, codec, backend, key) })
+	}
+	for _, prefix := range prefixes {
+		lookup(prefix, func() (string, error) {
+			out, err := backend.s3Client.Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+				Bucket:  &backend.targetBucketName,
+				Prefix:  aws.String(prefix),
+				MaxKeys: aws.Int32(1),
+			})
+			if err != nil {
+				return "", err
+			}
+			if len(out.Contents) == 0 || out.Contents[0].Key == nil {
+				return "", errors.New("prefix is empty")
+			}
+			name, err := p.objectName(ctx, codec, backend, *out.Contents[0].Key)
+			if err != nil {
+				return "", err
+			}
+			depth := strings.Count(prefix, "/")
+			segments := strings.SplitN(name, "/", depth+1)
+			if len(segments) <= depth {
+				return "", errors.New("object name is shorter than its prefix")
+			}
+			return strings.Join(segments[:depth], "/") + "/", nil
+		})
+	}
+	wg.Wait()
+	return names
+}
+
+// objectName reads the sealed client key of an HMAC-named object.
+func (p *Proxy) objectName(ctx context.Context, codec *keyCodec, backend *s3Backend, key string) (string, error) {
+	if plain, ok := codec.names.get(key); ok {
+		return plain, nil
+	}
+	head, err := backend.s3Client.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &backend.targetBucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", err
+	}
+	sealed, ok := head.Metadata[metaName]
+	if !ok {
+		return "", errors.New("object has no sealed name")
+	}
+	plain, err := codec.unsealName(sealed)
+	if err != nil {
+		return "", err
+	}
+	codec.names.put(key, plain)
+	return plain, nil
+}
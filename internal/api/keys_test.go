@@ -0,0 +1,241 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func testCodec(t *testing.T, mode string) *keyCodec {
+	t.Helper()
+	key := bytes.Repeat([]byte{7}, 64)
+	c, err := newKeyCodec(mode, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func mustEncode(t *testing.T, c *keyCodec, key string) string {
+	t.Helper()
+	encoded, err := c.encode(key)
+	if err != nil {
+		t.Fatalf("encode %q: %v", key, err)
+	}
+	return encoded
+}
+
+func TestKeyCodecRoundTrip(t *testing.T) {
+	c := testCodec(t, keyModeSIV)
+	for _, key := range []string{
+		"a",
+		"photos/2024/cat.jpg",
+		"dir/",
+		"/leading",
+		"a//b",
+		"ünïcödé/ключ",
+		"with space/and+plus",
+	} {
+		encoded := mustEncode(t, c, key)
+		if strings.Count(encoded, "/") != strings.Count(key, "/") {
+			t.Errorf("%q encoded to %q with a different depth", key, encoded)
+		}
+		if got, err := c.decode(encoded); err != nil || got != key {
+			t.Errorf("decode(encode(%q)) = %q, %v", key, got, err)
+		}
+	}
+}
+
+func TestKeyCodecPrefixes(t *testing.T) {
+	for _, mode := range []string{keyModeSIV, keyModeHMAC} {
+		c := testCodec(t, mode)
+		if mustEncode(t, c, "a/b") != mustEncode(t, c, "a/b") {
+			t.Fatalf("%s: encoding is not deterministic", mode)
+		}
+		// Keys below a prefix start with the prefix's backend name.
+		prefix := mustEncode(t, c, "photos/2024/")
+		for _, key := range []string{"photos/2024/cat.jpg", "photos/2024/x/y"} {
+			if encoded := mustEncode(t, c, key); !strings.HasPrefix(encoded, prefix) {
+				t.Errorf("%s: %q encoded to %q, outside %q", mode, key, encoded, prefix)
+			}
+		}
+		// A segment is bound to its parents.
+		a, b := mustEncode(t, c, "a/x"), mustEncode(t, c, "b/x")
+		if a[strings.Index(a, "/"):] == b[strings.Index(b, "/"):] {
+			t.Errorf("%s: segment x encoded the same under a/ and b/", mode)
+		}
+		if mustEncode(t, c, "") != "" {
+			t.Errorf("%s: empty key not kept empty", mode)
+		}
+	}
+
+	siv, hmac := testCodec(t, keyModeSIV), testCodec(t, keyModeHMAC)
+	if mustEncode(t, siv, "a/b") == mustEncode(t, hmac, "a/b") {
+		t.Fatal("siv and hmac encode alike")
+	}
+	long := strings.Repeat("k", 800)
+	if _, err := hmac.encode(long); err != nil {
+		t.Fatalf("hmac mode rejected a long key: %v", err)
+	}
+	if _, err := siv.encode(long); err != errKeyTooLong {
+		t.Fatalf("encrypted key over the limit: %v", err)
+	}
+}
+
+func TestKeyCodecDecodeRejects(t *testing.T) {
+	c := testCodec(t, keyModeSIV)
+	encoded := mustEncode(t, c, "a/b")
+	parent, child, _ := strings.Cut(encoded, "/")
+	for _, tc := range []struct {
+		name    string
+		encoded string
+	}{
+		{"plaintext key", "a/b"},
+		{"not base64", "%%%"},
+		{"moved segment", mustEncode(t, c, "c") + "/" + child},
+		{"other key", mustEncode(t, testCodec(t, keyModeHMAC), "a/b")},
+		{"truncated segment", parent[:len(parent)-2]},
+	} {
+		if got, err := c.decode(tc.encoded); err == nil {
+			t.Errorf("%s: decoded to %q", tc.name, got)
+		}
+	}
+}
+
+func TestSealName(t *testing.T) {
+	if testCodec(t, keyModeSIV).sealName("a/b") != "" {
+		t.Fatal("siv mode seals names")
+	}
+	c := testCodec(t, keyModeHMAC)
+	sealed := c.sealName("photos/cat.jpg")
+	if got, err := c.unsealName(sealed); err != nil || got != "photos/cat.jpg" {
+		t.Fatalf("unseal = %q, %v", got, err)
+	}
+	other, err := newKeyCodec(keyModeHMAC, bytes.Repeat([]byte{8}, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.unsealName(sealed); err == nil {
+		t.Fatal("unsealed with another key")
+	}
+}
+
+func TestNewKeyCodecRejects(t *testing.T) {
+	if _, err := newKeyCodec("rot13", make([]byte, 64)); err == nil {
+		t.Error("accepted an unknown mode")
+	}
+	if _, err := newKeyCodec(keyModeSIV, make([]byte, 32)); err == nil {
+		t.Error("accepted a 32 byte key")
+	}
+}
+
+func TestKeyEncryptionSupported(t *testing.T) {
+	for _, tc := range []struct {
+		method, target, key string
+		ok                  bool
+	}{
+		{"GET", "/b/k", "k", true},
+		{"HEAD", "/b/k", "k", true},
+		{"PUT", "/b/k", "k", true},
+		{"DELETE", "/b/k", "k", true},
+		{"POST", "/b/k?uploads", "k", true},
+		{"GET", "/b?list-type=2", "", true},
+		{"GET", "/b?versions", "", false},
+		{"GET", "/b?uploads", "", false},
+		{"POST", "/b?delete", "", false},
+		{"PUT", "/b", "", false},
+		{"OPTIONS", "/b/k", "k", false},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		if got := keyEncryptionSupported(r, tc.key); got != tc.ok {
+			t.Errorf("%s %s: got %v", tc.method, tc.target, got)
+		}
+	}
+}
+
+func TestTranslateListRequest(t *testing.T) {
+	c := testCodec(t, keyModeSIV)
+	query := url.Values{
+		"prefix":      {"photos/20"},
+		"start-after": {"photos/2024/a.jpg"},
+		"delimiter":   {"/"},
+	}
+	tr, err := c.translateListRequest(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A partial segment lists the enclosing directory.
+	if want := mustEncode(t, c, "photos/"); tr.backendPrefix != want || query.Get("prefix") != want {
+		t.Fatalf("backend prefix %q, query %q, want %q", tr.backendPrefix, query.Get("prefix"), want)
+	}
+	if tr.prefix != "photos/20" || tr.startAfter != "photos/2024/a.jpg" {
+		t.Fatalf("translation %+v", tr)
+	}
+	if query.Get("start-after") != mustEncode(t, c, "photos/2024/a.jpg") {
+		t.Fatal("start-after not encoded")
+	}
+
+	query = url.Values{"prefix": {"top"}}
+	if _, err := c.translateListRequest(query); err != nil || query.Has("prefix") {
+		t.Fatalf("prefix without a directory: %v, %v", query, err)
+	}
+	if _, err := c.translateListRequest(url.Values{"delimiter": {"-"}}); err != errUnsupportedDelimiter {
+		t.Fatalf("delimiter -: %v", err)
+	}
+}
+
+func TestTranslateListing(t *testing.T) {
+	c := testCodec(t, keyModeSIV)
+	query := url.Values{"prefix": {"docs/re"}, "delimiter": {"/"}}
+	tr, err := c.translateListRequest(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := func(key string) string { return mustEncode(t, c, key) }
+	body := "<ListBucketResult>" +
+		"<Prefix>" + tr.backendPrefix + "</Prefix>" +
+		"<KeyCount>5</KeyCount>" +
+		"<Contents><Key>" + backend("docs/report & plan.txt") + "</Key><Size>3</Size></Contents>" +
+		"<Contents><Key>" + backend("docs/readme") + "</Key><Size>4</Size></Contents>" +
+		"<Contents><Key>" + backend("docs/other") + "</Key><Size>5</Size></Contents>" +
+		"<Contents><Key>docs/stored-before-encryption</Key></Contents>" +
+		"<CommonPrefixes><Prefix>" + backend("docs/reviews/") + "</Prefix></CommonPrefixes>" +
+		"</ListBucketResult>"
+
+	got := string((&Proxy{}).translateListing(context.Background(), c, nil, tr, []byte(body)))
+	for _, want := range []string{
+		"<Prefix>docs/re</Prefix>",
+		"<Key>docs/report &amp; plan.txt</Key><Size>3</Size>",
+		"<Key>docs/readme</Key>",
+		"<Prefix>docs/reviews/</Prefix>",
+		"<KeyCount>3</KeyCount>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("listing lacks %s:\n%s", want, got)
+		}
+	}
+	for _, unwanted := range []string{"docs/other", "stored-before-encryption", backend("docs/readme")} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("listing holds %s:\n%s", unwanted, got)
+		}
+	}
+}
+
+func TestEachElement(t *testing.T) {
+	body := []byte("<a><k>1</k><k>2</k><k>3</k><m>x</m></a>")
+	got := eachElement(body, "k", func(content []byte) []byte {
+		if string(content) == "2" {
+			return nil
+		}
+		return append([]byte("n"), content...)
+	})
+	if string(got) != "<a><k>n1</k><k>n3</k><m>x</m></a>" {
+		t.Fatalf("got %s", got)
+	}
+	if got := eachElement([]byte("<k>open"), "k", func([]byte) []byte { return nil }); string(got) != "<k>open" {
+		t.Fatalf("unterminated element: %s", got)
+	}
+}
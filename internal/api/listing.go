@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// listingHeadConcurrency bounds the HEAD requests made to find the
+	// plaintext sizes of one listing page.
+	listingHeadConcurrency = 16
+	// maxListingSize bounds the listing response read into memory.
+	maxListingSize = 32 << 20
+	// maxSizeCacheEntries bounds the plaintext size cache.
+	maxSizeCacheEntries = 100000
+)
+
+// listParams are the query parameters of ListObjects and ListObjectsV2. A
+// bucket GET with any other parameter addresses a subresource.
+var listParams = map[string]bool{
+	"list-type":          true,
+	"prefix":             true,
+	"delimiter":          true,
+	"marker":             true,
+	"max-keys":           true,
+	"continuation-token": true,
+	"start-after":        true,
+	"encoding-type":      true,
+	"fetch-owner":        true,
+}
+
+// isListRequest reports whether r lists the objects of a bucket.
+func isListRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	for name := range r.URL.Query() {
+		if !listParams[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// sizeCache remembers the plaintext size of stored objects by ETag, so
+// repeated listings do not HEAD every object again.
+type sizeCache struct {
+	mu      sync.Mutex
+	entries map[string]sizeEntry
+}
+
+type sizeEntry struct {
+	etag string
+	size int64
+}
+
+func newSizeCache() *sizeCache {
+	return &sizeCache{entries: make(map[string]sizeEntry)}
+}
+
+func (c *sizeCache) get(key, etag string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.etag != etag {
+		return 0, false
+	}
+	return e.size, true
+}
+
+func (c *sizeCache) put(key, etag string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxSizeCacheEntries {
+		// Dropping an arbitrary entry only costs one extra HEAD later.
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = sizeEntry{etag: etag, size: size}
+}
+
+type listedObject struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+var (
+	contentsOpen  = []byte("<Contents>")
+	contentsClose = []byte("</Contents>")
+	sizeOpen      = []byte("<Size>")
+	sizeClose     = []byte("</Size>")
+)
+
+// fixListingSizes replaces the stored sizes in a ListObjects response with
+// plaintext sizes. Encryption, compression and padding all change the
+// stored size, and clients such as s3fs rely on listed sizes. Objects whose
+// plaintext size is unknown keep their stored size and are queued for
+// backfill. The rest of the document is passed through untouched.
+func (p *Proxy) fixListingSizes(ctx context.Context, backend *s3Backend, body []byte) []byte {
+	type block struct {
+		start, end int // of the <Contents> element
+		obj        listedObject
+	}
+	var blocks []block
+	for offset := 0; ; {
+		i := bytes.Index(body[offset:], contentsOpen)
+		if i < 0 {
+			break
+		}
+		start := offset + i
+		j := bytes.Index(body[start:], contentsClose)
+		if j < 0 {
+			break
+		}
+		end := start + j + len(contentsClose)
+		var obj listedObject
+		if err := xml.Unmarshal(body[start:end], &obj); err == nil {
+			blocks = append(blocks, block{start: start, end: end, obj: obj})
+		}
+		offset = end
+	}
+	if len(blocks) == 0 {
+		return body
+	}
+
+	// encoding-type=url returns URL-encoded keys.
+	encoded := bytes.Contains(body, []byte("<EncodingType>url</EncodingType>"))
+	sizes := make([]int64, len(blocks))
+	sem := make(chan struct{}, listingHeadConcurrency)
+	var wg sync.WaitGroup
+	for i := range blocks {
+		sizes[i] = -1
+		key := blocks[i].obj.Key
+		if encoded {
+			if k, err := url.QueryUnescape(key); err == nil {
+				key = k
+			}
+		}
+		cacheKey := backend.clientID + "/" + backend.targetBucketName + "/" + key
+		if size, ok := p.sizes.get(cacheKey, blocks[i].obj.ETag); ok {
+			sizes[i] = size
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, key, cacheKey string) {
+			defer func() { <-sem; wg.Done() }()
+			obj, err := backend.s3Client.Client.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: &backend.targetBucketName,
+				Key:    &key,
+			})
+			if err != nil {
+				slog.DebugContext(ctx, "listing size lookup failed", "key", key, "backend", backend.clientID, "error", err)
+				return
+			}
+			meta, err := openInfo(ctx, backend, key, obj.Metadata)
+			if err != nil {
+				slog.DebugContext(ctx, "listing size lookup failed", "key", key, "backend", backend.clientID, "error", err)
+				return
+			}
+			info, ok := parseObjectInfo(meta)
+			if !ok {
+				p.enqueueBackfill(backend, key)
+				return
+			}
+			sizes[i] = info.Size
+			if obj.ETag != nil {
+				p.sizes.put(cacheKey, *obj.ETag, info.Size)
+			}
+		}(i, key, cacheKey)
+	}
+	wg.Wait()
+
+	var out bytes.Buffer
+	out.Grow(len(body))
+	last := 0
+	for i, b := range blocks {
+		if sizes[i] < 0 {
+			continue
+		}
+		element := body[b.start:b.end]
+		s := bytes.Index(element, sizeOpen)
+		e := bytes.Index(element, sizeClose)
+		if s < 0 || e < s {
+			continue
+		}
+		out.Write(body[last : b.start+s+len(sizeOpen)])
+		out.WriteString(strconv.FormatInt(sizes[i], 10))
+		last = b.start + e
+	}
+	out.Write(body[last:])
+	return out.Bytes()
+}
@@ -0,0 +1,395 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"s3-proxy/internal/crypto"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Backend metadata keys the proxy reserves for itself. Clients cannot set
+// them and they are never returned as x-amz-meta-* headers.
+const (
+	metaPrefix = "s3proxy-"
+	metaSize   = metaPrefix + "size"
+	metaSHA256 = metaPrefix + "sha256"
+	metaCRC32C = metaPrefix + "crc32c"
+	metaCrypto = metaPrefix + "crypto"
+	metaFormat = metaPrefix + "format"
+	metaName   = metaPrefix + "name"
+	// metaInfo holds the checksums of encrypted objects, and their size
+	// when the crypto pads, encrypted with the object's profile.
+	metaInfo = metaPrefix + "info"
+	// metaInfoSidecar holds the nonce of the info sidecar of an object whose
+	// size or checksums were only known once it had been uploaded.
+	metaInfoSidecar = metaPrefix + "info-sidecar"
+)
+
+// infoSidecarPrefix is where info sidecars are stored on the backend.
+// Clients cannot write below it and listings hide it.
+const infoSidecarPrefix = ".s3proxy-info/"
+
+// formatStream marks objects written with crypto.StreamWriter. Objects
+// without it were encrypted as a single blob.
+const formatStream = "stream"
+
+// cryptoNone is recorded as the crypto profile of objects stored without
+// encryption.
+const cryptoNone = "none"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// objectInfo describes the plaintext of a stored object. It is recorded in
+// backend metadata on PUT so HEAD can answer without reading the object.
+type objectInfo struct {
+	Size     int64
+	SHA256   string
+	CRC32C   string
+	CryptoID string
+	// Name is the sealed client key of an HMAC-named object.
+	Name string
+	// CustomerKey is the fingerprint of the SSE-C key of the object.
+	CustomerKey string
+	// Sidecar is the nonce of the info sidecar the rest of the info is
+	// written to after the upload.
+	Sidecar string
+}
+
+func newObjectInfo(data []byte) objectInfo {
+	h := newInfoHasher()
+	h.Write(data)
+	return h.info()
+}
+
+// infoHasher computes an objectInfo over data written to it, so streams can
+// be described without buffering them.
+type infoHasher struct {
+	size   int64
+	sha256 hash.Hash
+	crc32c hash.Hash32
+}
+
+func newInfoHasher() *infoHasher {
+	return &infoHasher{
+		sha256: sha256.New(),
+		crc32c: crc32.New(crc32cTable),
+	}
+}
+
+func (h *infoHasher) Write(p []byte) (int, error) {
+	h.size += int64(len(p))
+	h.sha256.Write(p)
+	h.crc32c.Write(p)
+	return len(p), nil
+}
+
+func (h *infoHasher) info() objectInfo {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, h.crc32c.Sum32())
+	return objectInfo{
+		Size:   h.size,
+		SHA256: hex.EncodeToString(h.sha256.Sum(nil)),
+		CRC32C: base64.StdEncoding.EncodeToString(crc),
+	}
+}
+
+// forBackend returns a copy of the info tagged with the backend's crypto
+// profile.
+func (i objectInfo) forBackend(backend *s3Backend) objectInfo {
+	i.CryptoID = backend.cryptoID
+	if i.CryptoID == "" {
+		i.CryptoID = cryptoNone
+	}
+	return i
+}
+
+// parseObjectInfo reads the proxy metadata of an object. It reports false
+// for objects written before the proxy recorded it.
+func parseObjectInfo(meta map[string]string) (objectInfo, bool) {
+	size, err := strconv.ParseInt(meta[metaSize], 10, 64)
+	if err != nil {
+		return objectInfo{}, false
+	}
+	return objectInfo{
+		Size:        size,
+		SHA256:      meta[metaSHA256],
+		CRC32C:      meta[metaCRC32C],
+		CryptoID:    meta[metaCrypto],
+		Name:        meta[metaName],
+		CustomerKey: meta[metaCustomerKey],
+	}, true
+}
+
+// apply records the info in backend metadata. Fields that are not known yet
+// (a negative size, empty checksums) are left out.
+func (i objectInfo) apply(meta map[string]string) {
+	if i.Size >= 0 {
+		meta[metaSize] = strconv.FormatInt(i.Size, 10)
+	}
+	if i.SHA256 != "" {
+		meta[metaSHA256] = i.SHA256
+	}
+	if i.CRC32C != "" {
+		meta[metaCRC32C] = i.CRC32C
+	}
+	meta[metaCrypto] = i.CryptoID
+	if i.Name != "" {
+		meta[metaName] = i.Name
+	}
+	if i.CustomerKey != "" {
+		meta[metaCustomerKey] = i.CustomerKey
+	}
+	if i.Sidecar != "" {
+		meta[metaInfoSidecar] = i.Sidecar
+	}
+}
+
+// complete reports whether every field is known.
+func (i objectInfo) complete() bool {
+	return i.Size >= 0 && i.SHA256 != "" && i.CRC32C != ""
+}
+
+// verify reports whether data matches the recorded checksum.
+func (i objectInfo) verify(data []byte) bool {
+	if i.SHA256 == "" {
+		return true
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == i.SHA256
+}
+
+// sealedInfo is the plaintext of a metaInfo entry or an info sidecar. The
+// key binds it to its object, and in a sidecar the nonce to one write of
+// it. The size has a fixed width so that the entry's length does not hint
+// at it.
+type sealedInfo struct {
+	Key    string `json:"key"`
+	Nonce  string `json:"nonce,omitempty"`
+	Size   string `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// merge adds the fields of the info to meta.
+func (info sealedInfo) merge(meta map[string]string) error {
+	if info.Size != "" {
+		n, err := strconv.ParseInt(info.Size, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid sealed size %q", info.Size)
+		}
+		meta[metaSize] = strconv.FormatInt(n, 10)
+	}
+	if info.SHA256 != "" {
+		meta[metaSHA256] = info.SHA256
+	}
+	if info.CRC32C != "" {
+		meta[metaCRC32C] = info.CRC32C
+	}
+	return nil
+}
+
+// sealInfo moves the checksums of an encrypted object into a metaInfo
+// entry: in the clear they would let the backend confirm a guessed
+// plaintext. The size moves too when the crypto pads, as it would give away
+// the length padding hides. It uses the profile without the SSE-C layer, so
+// listings can still show sizes; an object encrypted with nothing but an
+// SSE-C key has nothing else to seal with and keeps no checksums.
+func sealInfo(ctx context.Context, backend *s3Backend, key string, meta map[string]string) error {
+	profile, err := backend.forObject(meta)
+	if err != nil {
+		return err
+	}
+	if profile.crypto == nil {
+		if meta[metaCustomerKey] != "" {
+			delete(meta, metaSHA256)
+			delete(meta, metaCRC32C)
+		}
+		return nil
+	}
+	info := sealedInfo{Key: key, SHA256: meta[metaSHA256], CRC32C: meta[metaCRC32C]}
+	if size, ok := meta[metaSize]; ok && crypto.PaddingOf(profile.crypto) != nil {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid size metadata %q", size)
+		}
+		info.Size = fmt.Sprintf("%020d", n)
+		delete(meta, metaSize)
+	}
+	delete(meta, metaSHA256)
+	delete(meta, metaCRC32C)
+	delete(meta, metaInfo)
+	if info.Size == "" && info.SHA256 == "" && info.CRC32C == "" {
+		return nil
+	}
+	plaintext, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	sealed, err := crypto.EncryptContext(crypto.WithoutPadding(ctx), profile.crypto, plaintext)
+	if err != nil {
+		return fmt.Errorf("sealing object info: %w", err)
+	}
+	meta[metaInfo] = base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// openInfo returns meta with a metaInfo entry decrypted back into the size
+// and checksums, and those of an info sidecar added. Objects with neither
+// are returned as is.
+func openInfo(ctx context.Context, backend *s3Backend, key string, meta map[string]string) (map[string]string, error) {
+	value, sealed := meta[metaInfo]
+	nonce := meta[metaInfoSidecar]
+	if !sealed && nonce == "" {
+		return meta, nil
+	}
+	profile, err := backend.forObject(meta)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(meta)+2)
+	for name, value := range meta {
+		if name != metaInfo {
+			result[name] = value
+		}
+	}
+
+	if sealed {
+		if profile.crypto == nil {
+			return nil, errors.New("sealed object info on an unencrypted object")
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("decoding sealed object info: %w", err)
+		}
+		info, err := openSealedInfo(ctx, profile, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		if info.Key != key {
+			return nil, errors.New("sealed object info belongs to another object")
+		}
+		if err := info.merge(result); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without its sidecar the object is described as far as its metadata
+	// goes, as it is while the upload is still being answered.
+	if nonce != "" && backend.s3Client != nil {
+		info, err := readInfoSidecar(ctx, profile, key)
+		switch {
+		case err != nil:
+			if backendStatus(err) != http.StatusNotFound {
+				slog.WarnContext(ctx, "cannot read object info sidecar", "backend", backend.clientID, "key", key, "error", err)
+			}
+		case info.Key != key || info.Nonce != nonce:
+			slog.DebugContext(ctx, "object info sidecar belongs to another write", "backend", backend.clientID, "key", key)
+		default:
+			if err := info.merge(result); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func openSealedInfo(ctx context.Context, profile *s3Backend, ciphertext []byte) (sealedInfo, error) {
+	var info sealedInfo
+	plaintext, err := crypto.DecryptContext(ctx, profile.crypto, ciphertext)
+	if err != nil {
+		return info, fmt.Errorf("opening sealed object info: %w", err)
+	}
+	if err := json.Unmarshal(plaintext, &info); err != nil {
+		return info, fmt.Errorf("decoding sealed object info: %w", err)
+	}
+	return info, nil
+}
+
+func infoSidecarKey(objectKey string) string {
+	return infoSidecarPrefix + objectKey
+}
+
+// writeInfoSidecar records info in the info sidecar of an object stored
+// with meta, which names the sidecar's nonce. The size is always recorded;
+// the checksums only where sealInfo would keep them. Unlike rewriting the
+// object's metadata this needs no copy of the object, so it works at any
+// size.
+func writeInfoSidecar(ctx context.Context, backend *s3Backend, key string, meta map[string]string, info objectInfo) error {
+	nonce := meta[metaInfoSidecar]
+	if nonce == "" {
+		return errors.New("object has no info sidecar")
+	}
+	profile, err := backend.forObject(meta)
+	if err != nil {
+		return err
+	}
+	sidecar := sealedInfo{Key: key, Nonce: nonce, Size: fmt.Sprintf("%020d", info.Size), SHA256: info.SHA256, CRC32C: info.CRC32C}
+	if profile.crypto == nil && meta[metaCustomerKey] != "" {
+		sidecar.SHA256, sidecar.CRC32C = "", ""
+	}
+	body, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+	if profile.crypto != nil {
+		if body, err = crypto.EncryptContext(crypto.WithoutPadding(ctx), profile.crypto, body); err != nil {
+			return fmt.Errorf("sealing object info: %w", err)
+		}
+	}
+	_, err = backend.s3Client.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &backend.targetBucketName,
+		Key:           s(infoSidecarKey(key)),
+		Body:          bytes.NewReader(body),
+		ContentLength: aws.Int64(int64(len(body))),
+	})
+	if err != nil {
+		return fmt.Errorf("writing object info sidecar: %w", err)
+	}
+	slog.DebugContext(ctx, "recorded object info", "backend", backend.clientID, "key", key)
+	return nil
+}
+
+// readInfoSidecar reads the info sidecar of an object read with profile.
+func readInfoSidecar(ctx context.Context, profile *s3Backend, key string) (sealedInfo, error) {
+	obj, err := profile.s3Client.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &profile.targetBucketName,
+		Key:    s(infoSidecarKey(key)),
+	})
+	if err != nil {
+		return sealedInfo{}, err
+	}
+	defer obj.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(obj.Body, maxListingSize))
+	if err != nil {
+		return sealedInfo{}, err
+	}
+	if profile.crypto != nil {
+		return openSealedInfo(ctx, profile, body)
+	}
+	var info sealedInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return info, fmt.Errorf("decoding object info sidecar: %w", err)
+	}
+	return info, nil
+}
+
+func isReservedMeta(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), metaPrefix)
+}
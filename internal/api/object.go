@@ -0,0 +1,114 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"s3-proxy/internal/crypto"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// decodeBody turns a backend object into its plaintext. Stream-format and
+// unencrypted objects are decoded as they are read; legacy single-blob
+// objects are decrypted and verified in memory. The returned size is -1 when
+// the plaintext length is not known up front.
+//
+// The object is read with the crypto profile recorded in its metadata, which
+// need not be the backend's current one.
+//
+// Errors returned here happen before any plaintext is produced, so the caller
+// can still fail over to another backend. Errors while reading the returned
+// reader mean the object was corrupted or tampered with mid-stream.
+func decodeBody(ctx context.Context, backend *s3Backend, obj *s3.GetObjectOutput) (io.Reader, int64, error) {
+	info, hasInfo := parseObjectInfo(obj.Metadata)
+	size := int64(-1)
+	if hasInfo {
+		size = info.Size
+	}
+
+	c, err := backend.readCrypto(obj.Metadata)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c == nil {
+		if size < 0 && obj.ContentLength != nil {
+			size = *obj.ContentLength
+		}
+		return verifyReader(obj.Body, info.SHA256), size, nil
+	}
+
+	if obj.Metadata[metaFormat] == formatStream {
+		reader, err := crypto.NewStreamReaderContext(ctx, c, obj.Body)
+		if err != nil {
+			return nil, 0, fmt.Errorf("decryption error: %w", err)
+		}
+		return verifyReader(reader, info.SHA256), size, nil
+	}
+
+	encData, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading object body: %w", err)
+	}
+	decData, err := crypto.DecryptContext(ctx, c, encData)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decryption error: %w", err)
+	}
+	if !info.verify(decData) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	return bytes.NewReader(decData), int64(len(decData)), nil
+}
+
+// verifyReader checks the SHA-256 of everything read against want once the
+// underlying reader is exhausted. An empty want disables the check.
+func verifyReader(r io.Reader, want string) io.Reader {
+	if want == "" {
+		return r
+	}
+	return &verifyingReader{r: r, hash: sha256.New(), want: want}
+}
+
+type verifyingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.want {
+		return n, errors.New("checksum mismatch")
+	}
+	return n, err
+}
+
+// plaintextSize downloads and decodes an object to find its plaintext size.
+// It is only needed for objects without recorded proxy metadata.
+func (p *Proxy) plaintextSize(ctx context.Context, backend *s3Backend, key string) (int64, error) {
+	obj, err := backend.s3Client.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &backend.targetBucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Body.Close()
+	cost := p.readCost(backend, obj.ContentLength, obj.Metadata)
+	if !p.memory.tryAcquire(cost, "head") {
+		return 0, errMemoryBudget
+	}
+	defer p.memory.release(cost)
+	body, size, err := decodeBody(ctx, backend, obj)
+	if err != nil || size >= 0 {
+		return size, err
+	}
+	return io.Copy(io.Discard, body)
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"s3-proxy/internal/config"
+	"s3-proxy/internal/crypto"
+)
+
+// cryptoRule picks the crypto profile of new objects that match it.
+type cryptoRule struct {
+	prefix      string
+	suffix      string
+	minSize     int64
+	maxSize     int64
+	contentType string
+	cryptoID    string
+}
+
+func newCryptoRule(cfg config.ConfigCryptoRule) cryptoRule {
+	return cryptoRule{
+		prefix:      cfg.Prefix,
+		suffix:      cfg.Suffix,
+		minSize:     cfg.MinSize,
+		maxSize:     cfg.MaxSize,
+		contentType: strings.ToLower(cfg.ContentType),
+		cryptoID:    cfg.CryptoID,
+	}
+}
+
+// matches reports whether an object is covered by the rule. size is -1
+// when the upload does not declare it, which no size condition matches.
+func (r cryptoRule) matches(key string, size int64, contentType string) bool {
+	if !strings.HasPrefix(key, r.prefix) || !strings.HasSuffix(key, r.suffix) {
+		return false
+	}
+	if (r.minSize > 0 || r.maxSize > 0) && size < 0 {
+		return false
+	}
+	if r.minSize > 0 && size < r.minSize {
+		return false
+	}
+	if r.maxSize > 0 && size > r.maxSize {
+		return false
+	}
+	if r.contentType != "" {
+		mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+		mediaType = strings.TrimSpace(mediaType)
+		if group, ok := strings.CutSuffix(r.contentType, "/*"); ok {
+			return strings.HasPrefix(mediaType, group+"/")
+		}
+		return mediaType == r.contentType
+	}
+	return true
+}
+
+// route returns the rule choosing the profile of a new object, or nil if
+// the backends' own profiles apply.
+func (b *s3Bucket) route(key string, size int64, contentType string) *cryptoRule {
+	for i := range b.cryptoRules {
+		if b.cryptoRules[i].matches(key, size, contentType) {
+			return &b.cryptoRules[i]
+		}
+	}
+	return nil
+}
+
+// withProfile returns a copy of the backend that writes with the crypto
+// profile id, cryptoNone meaning unencrypted.
+func (b *s3Backend) withProfile(id string) (*s3Backend, error) {
+	if id == b.cryptoID || (id == cryptoNone && b.cryptoID == "") {
+		return b, nil
+	}
+	c := *b
+	if id == cryptoNone {
+		c.crypto, c.cryptoID = nil, ""
+		return &c, nil
+	}
+	profile, ok := b.profiles[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown crypto profile %q", id)
+	}
+	c.crypto, c.cryptoID = profile, id
+	return &c, nil
+}
+
+// forObject returns a copy of the backend that reads an object with the
+// profile recorded in its metadata, so objects stay readable after the
+// rules or the backend's crypto_id change. Objects from before the
+// profile was recorded use the backend's own.
+func (b *s3Backend) forObject(meta map[string]string) (*s3Backend, error) {
+	id := meta[metaCrypto]
+	if id == "" {
+		return b, nil
+	}
+	return b.withProfile(id)
+}
+
+// writeCrypto returns the crypto new objects are written with, including
+// the per-request SSE-C layer.
+func (b *s3Backend) writeCrypto() crypto.Crypt {
+	return withCustomerLayer(b.crypto, b.customer)
+}
+
+// readCrypto returns the crypto an object with the given metadata is read
+// with, including the per-request SSE-C layer.
+func (b *s3Backend) readCrypto(meta map[string]string) (crypto.Crypt, error) {
+	backend, err := b.forObject(meta)
+	if err != nil {
+		return nil, err
+	}
+	return withCustomerLayer(backend.crypto, b.customer), nil
+}
+
+func withCustomerLayer(c, customer crypto.Crypt) crypto.Crypt {
+	switch {
+	case customer == nil:
+		return c
+	case c == nil:
+		return customer
+	}
+	return crypto.NewMultiLayerCrypt(c, customer)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"s3-proxy/internal/config"
+)
+
+func TestCryptoRuleMatches(t *testing.T) {
+	for _, tc := range []struct {
+		rule        config.ConfigCryptoRule
+		key         string
+		size        int64
+		contentType string
+		want        bool
+	}{
+		{config.ConfigCryptoRule{}, "any", -1, "", true},
+		{config.ConfigCryptoRule{Prefix: "logs/"}, "logs/a", 1, "", true},
+		{config.ConfigCryptoRule{Prefix: "logs/"}, "data/logs/a", 1, "", false},
+		{config.ConfigCryptoRule{Suffix: ".gz"}, "a.tar.gz", 1, "", true},
+		{config.ConfigCryptoRule{Prefix: "logs/", Suffix: ".gz"}, "logs/a.txt", 1, "", false},
+		{config.ConfigCryptoRule{MinSize: 10}, "k", 10, "", true},
+		{config.ConfigCryptoRule{MinSize: 10}, "k", 9, "", false},
+		{config.ConfigCryptoRule{MaxSize: 10}, "k", 10, "", true},
+		{config.ConfigCryptoRule{MaxSize: 10}, "k", 11, "", false},
+		// An undeclared size matches no size condition.
+		{config.ConfigCryptoRule{MaxSize: 10}, "k", -1, "", false},
+		{config.ConfigCryptoRule{ContentType: "image/*"}, "k", 1, "image/png", true},
+		{config.ConfigCryptoRule{ContentType: "image/*"}, "k", 1, "imagex/png", false},
+		{config.ConfigCryptoRule{ContentType: "Text/Plain"}, "k", 1, "text/plain; charset=utf-8", true},
+		{config.ConfigCryptoRule{ContentType: "text/plain"}, "k", 1, "text/html", false},
+		{config.ConfigCryptoRule{ContentType: "text/plain"}, "k", 1, "", false},
+	} {
+		if got := newCryptoRule(tc.rule).matches(tc.key, tc.size, tc.contentType); got != tc.want {
+			t.Errorf("%+v on %q (%d, %q) = %v", tc.rule, tc.key, tc.size, tc.contentType, got)
+		}
+	}
+}
+
+func TestCryptoRulesRouteObjects(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := testConfig(t, fake)
+	bulk := cfg.Crypto[0]
+	bulk.ID = "bulk"
+	bulk.Layers = []config.ConfigCryptoLayer{{
+		Algorithm: "chacha20poly1305",
+		Keyset:    &config.MultiSourceString{Data: testKey(t)},
+	}}
+	cfg.Crypto = append(cfg.Crypto, bulk)
+	cfg.S3Buckets[0].CryptoRules = []config.ConfigCryptoRule{
+		{Prefix: "public/", CryptoID: cryptoNone},
+		{Suffix: ".iso", MinSize: 1000, CryptoID: "bulk"},
+		{ContentType: "video/*", CryptoID: "bulk"},
+		// Never reached for public/ objects: the first match wins.
+		{Prefix: "public/", CryptoID: "bulk"},
+	}
+	p := newTestProxy(t, cfg)
+
+	objects := map[string]struct {
+		size        int
+		contentType string
+		profile     string
+	}{
+		"public/readme": {100, "", cryptoNone},
+		"public/movie":  {100, "video/mp4", cryptoNone},
+		"disk.iso":      {2000, "", "bulk"},
+		"small.iso":     {100, "", "aes"},
+		"movie":         {100, "video/mp4", "bulk"},
+		"other":         {2000, "text/plain", "aes"},
+	}
+	bodies := make(map[string][]byte)
+	for key, o := range objects {
+		bodies[key] = randomBody(t, o.size)
+		header := http.Header{"Content-Type": {o.contentType}}
+		if w := serve(p, http.MethodPut, "/vb/"+key, bodies[key], header); w.Code != http.StatusOK {
+			t.Fatalf("put %s: %d", key, w.Code)
+		}
+	}
+	for key, o := range objects {
+		stored := fake.object("data", key)
+		if o.profile == cryptoNone {
+			if !bytes.Equal(stored.data, bodies[key]) {
+				t.Errorf("%s: not stored as plaintext", key)
+			}
+		} else if bytes.Contains(stored.data, bodies[key][:32]) {
+			t.Errorf("%s: stored as plaintext", key)
+		}
+		if got := stored.meta[metaCrypto]; got != o.profile && !(o.profile == "aes" && got == "") {
+			t.Errorf("%s: recorded profile %q, want %q", key, got, o.profile)
+		}
+	}
+
+	// Objects are read with the profile they were written with, after the
+	// rules are gone too.
+	cfg.S3Buckets[0].CryptoRules = nil
+	for _, proxy := range []*Proxy{p, newTestProxy(t, cfg)} {
+		for key := range objects {
+			if w := serve(proxy, http.MethodGet, "/vb/"+key, nil, nil); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), bodies[key]) {
+				t.Fatalf("get %s: %d", key, w.Code)
+			}
+		}
+	}
+}
@@ -1,45 +1,75 @@
 package api
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"s3-proxy/internal/client"
+	"s3-proxy/internal/crypto"
+	"s3-proxy/internal/logging"
+	"s3-proxy/internal/metrics"
+	"s3-proxy/internal/tracing"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Proxy struct {
 	buckets      map[string]*s3Bucket
-	auth         map[string]bool
+	auth         map[string]string // access key -> user label for logs
 	headerFormat string
+	backfill     chan backfillItem
+	upload       uploadOptions
+	memory       *memoryBudget
+	journal      *journal
+	serveAdmin   bool
+	adminToken   string
+	health       *backendHealth
+	drains       *drainSet
+	jobs         *jobRegistry
+	cryptoLayers map[string][]string // crypto ID -> layer algorithms
+	cryptos      map[string]crypto.Crypt
+	clients      map[string]*client.S3
+	admin        http.Handler
+	sizes        *sizeCache
+	writeOnly    bool
+	trustProto   bool // X-Forwarded-Proto tells whether a request used TLS
+	sealed       map[string]*sealedCrypt
+	keyShares    *keyShares
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" && r.URL.Path == "/healthz" {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
+	// Without a separate admin listener the health check and metrics stay
+	// on the data port, as before. The admin API is never served there.
+	if p.serveAdmin && r.Method == "GET" && (r.URL.Path == "/healthz" || r.URL.Path == "/metrics") {
+		p.admin.ServeHTTP(w, r)
 		return
 	}
 
-	log.Printf("Received request: %s %s", r.Method, r.RequestURI)
-	log.Printf("Request headers: %v", r.Header)
-	log.Printf("Request host: %s", r.Host)
-	log.Printf("Request URL: %s", r.URL.String())
-
-	if err := AuthenticateRequest(p, r); err != nil {
-		log.Printf("Authentication failed: %v", err)
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-	}
-	log.Printf("Authentication successful for request: %s %s", r.Method, r.RequestURI)
+	start := time.Now()
+	operation := operationName(r)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	r, span := startRequestSpan(r, operation)
+	defer func() {
+		observeRequest(operation, rec.status, start)
+		endRequestSpan(r.Context(), span, rec.status)
+	}()
+	w = rec
+
+	requestID := logging.NewRequestID()
+	r = r.WithContext(logging.WithRequest(r.Context(), requestID))
+	w.Header().Set("X-Amz-Request-Id", requestID)
+	ctx := r.Context()
 
 	strBucket, strKey := "", ""
 	path := strings.TrimPrefix(r.URL.Path, "/")
@@ -49,41 +79,77 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else if len(parts) == 1 {
 		strBucket = parts[0]
 	}
+	logging.SetBucket(ctx, strBucket)
+	defer func() {
+		slog.InfoContext(ctx, "request completed", "method", r.Method, "operation", operation,
+			"key", strKey, "status", rec.status, "duration", time.Since(start))
+	}()
+
+	if err := AuthenticateRequest(p, r); err != nil {
+		slog.WarnContext(ctx, "authentication failed", "method", r.Method, "url", r.URL, "remote_addr", r.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	slog.DebugContext(ctx, "received request", "method", r.Method, "url", r.URL, "host", r.Host, "headers", r.Header)
 
-	log.Printf("Path parsing - Original path: '%s', Trimmed path: '%s', Parts: %v", r.URL.Path, path, parts)
-	log.Printf("Parsed - Bucket: '%s', Key: '%s'", strBucket, strKey)
+	if p.isSealed() {
+		writeS3Error(w, r, http.StatusServiceUnavailable, "ServiceUnavailable", "The proxy is sealed until enough key shares are submitted.")
+		return
+	}
+
+	// A write-only proxy still answers bucket HEADs, which clients use to
+	// check a bucket exists before uploading.
+	if p.writeOnly && (r.Method == http.MethodGet || (r.Method == http.MethodHead && strKey != "")) {
+		writeS3Error(w, r, http.StatusForbidden, "AccessDenied", "This proxy is write-only and does not serve reads.")
+		return
+	}
 
 	bucket := p.buckets[strBucket]
-	if bucket != nil {
-		log.Printf("Found bucket configuration for: %s", strBucket)
-	} else {
-		log.Printf("No bucket configuration found for: %s", strBucket)
-		log.Printf("Available buckets: %v", func() []string {
-			buckets := make([]string, 0, len(p.buckets))
-			for k := range p.buckets {
-				buckets = append(buckets, k)
+	if bucket == nil {
+		slog.DebugContext(ctx, "no bucket configuration found, proxying as-is")
+	}
+
+	// With key encryption the handlers only ever see backend keys, and
+	// requests that would pass plaintext keys through are refused.
+	objectKey, objectName := strKey, ""
+	if bucket != nil && bucket.keys != nil {
+		if !keyEncryptionSupported(r, strKey) {
+			writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", "This operation is not supported on buckets with key encryption.")
+			return
+		}
+		if strKey != "" {
+			var err error
+			if objectKey, err = bucket.keys.encode(strKey); err != nil {
+				writeS3Error(w, r, http.StatusBadRequest, "KeyTooLongError", "Your key is too long.")
+				return
 			}
-			return buckets
-		}())
+			objectName = bucket.keys.sealName(strKey)
+		}
+	}
+	traceObject(span, strBucket, objectKey)
+
+	if bucket != nil && bucket.reservesKey(objectKey) {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Keys below "+infoSidecarPrefix+" and "+sidecarPrefix+" are reserved for sidecar objects.")
+		return
 	}
 
 	if bucket != nil && strKey != "" {
 		if r.Method == http.MethodPut || r.Method == http.MethodPost {
-			p.handlePut(bucket, strKey, w, r)
+			p.handlePut(bucket, strKey, objectKey, objectName, w, r)
 			return
 		} else if r.Method == http.MethodGet {
-			p.handleGet(bucket, strKey, w, r)
+			p.handleGet(bucket, objectKey, w, r)
 			return
 		} else if r.Method == http.MethodHead {
-			p.handleHead(bucket, strKey, w, r)
+			p.handleHead(bucket, objectKey, w, r)
 			return
 		} else if r.Method == http.MethodDelete {
-			p.handleDelete(bucket, strKey, w, r)
+			p.handleDelete(bucket, objectKey, w, r)
 			return
 		}
 	} else if bucket != nil && strKey == "" {
 		// Handle bucket-level operations (like listing)
-		log.Printf("Bucket-level operation: %s for bucket: %s", r.Method, bucket.name)
+		slog.DebugContext(ctx, "bucket-level operation", "method", r.Method)
 		p.handleProxy(bucket, w, r)
 		return
 	}
@@ -91,103 +157,153 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	p.handleProxy(bucket, w, r)
 }
 
-func (p *Proxy) handlePut(bucket *s3Bucket, objectKey string, w http.ResponseWriter, r *http.Request) {
-	log.Printf("Starting PUT operation for bucket: %s, key: %s", bucket.name, objectKey)
-	data, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("PUT failed: error reading request body: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// handlePut stores an object on every backend of the bucket. clientKey is
+// the key as the client sent it, objectKey the key on the backends and
+// objectName the sealed client key of an HMAC-named object, or "".
+func (p *Proxy) handlePut(bucket *s3Bucket, clientKey, objectKey, objectName string, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	slog.DebugContext(ctx, "starting PUT", "key", objectKey, "content_length", r.ContentLength)
+	if bucket.maxObjectSize > 0 && r.ContentLength > bucket.maxObjectSize {
+		slog.InfoContext(ctx, "PUT rejected: object too large", "key", objectKey, "size", r.ContentLength, "limit", bucket.maxObjectSize)
+		writeS3Error(w, r, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.")
 		return
 	}
 
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(bucket.backends))
-	successCount := 0
-	var mu sync.Mutex                       // Mutex for thread-safe logging
-	successfulBackends := make([]string, 0) // Track successful backends
-
-	for _, backend := range bucket.backends {
-		wg.Add(1)
-		go func(backend *s3Backend) {
-			defer wg.Done()
-			log.Printf("Encrypting data for backend: %s", backend.targetBucketName)
-			encData := data
-			if backend.crypto != nil {
-				encData, err = backend.crypto.Encrypt(data)
-				if err != nil {
-					log.Printf("PUT failed: encryption error for backend %s: %v", backend.targetBucketName, err)
-					errCh <- err
-					return
-				}
+	backends, drained := p.drains.split(bucket.backends)
+	if len(backends) == 0 {
+		slog.WarnContext(ctx, "PUT rejected: every backend is drained", "key", objectKey)
+		writeS3Error(w, r, http.StatusServiceUnavailable, "ServiceUnavailable", "Every backend of this bucket is drained.")
+		return
+	}
+	if err := checkPutHeaders(r.Header); err != nil {
+		slog.InfoContext(ctx, "PUT rejected: invalid headers", "key", objectKey, "error", err)
+		err.(*requestError).write(w, r)
+		return
+	}
+	customer, err := p.customerKey(r)
+	if err != nil {
+		slog.InfoContext(ctx, "PUT rejected: invalid SSE-C parameters", "key", objectKey, "error", err)
+		err.(*requestError).write(w, r)
+		return
+	}
+	rule := bucket.route(clientKey, r.ContentLength, r.Header.Get("Content-Type"))
+	for i, backend := range backends {
+		if rule != nil {
+			if backend, err = backend.withProfile(rule.cryptoID); err != nil {
+				slog.ErrorContext(ctx, "PUT failed: crypto rule", "key", objectKey, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
+		}
+		backends[i] = customer.apply(backend)
+	}
+	if rule != nil {
+		slog.DebugContext(ctx, "crypto rule matched", "key", objectKey, "crypto_id", rule.cryptoID)
+	}
 
-			reader := bytes.NewReader(encData)
-			log.Printf("Uploading to backend: %s, bucket: %s, key: %s", backend.targetBucketName, bucket.name, objectKey)
-			_, err = backend.s3Client.Client.PutObject(context.Background(), &s3.PutObjectInput{
-				Bucket:      &backend.targetBucketName,
-				Key:         &objectKey,
-				Body:        reader,
-				ContentType: s(r.Header.Get("Content-Type")),
-				Metadata:    getMetadataHeaders(r.Header),
-			})
-			if err != nil {
-				log.Printf("PUT failed: upload error for backend %s: %v", backend.targetBucketName, err)
-			} else {
-				mu.Lock()
-				successCount++
-				successfulBackends = append(successfulBackends, fmt.Sprintf("%s (endpoint: %s)", backend.targetBucketName, backend.s3Client.Endpoint))
-				log.Printf("PUT successful for backend bucket: %s at endpoint: %s", backend.targetBucketName, backend.s3Client.Endpoint)
-				mu.Unlock()
+	cost := p.upload.putCost(r.ContentLength, len(backends))
+	if !p.memory.tryAcquire(cost, "put") {
+		slog.WarnContext(ctx, "PUT rejected: memory budget exhausted", "key", objectKey, "cost", cost)
+		writeSlowDown(w, r)
+		return
+	}
+	defer p.memory.release(cost)
+
+	errs, bodyErr := p.putStream(ctx, bucket, backends, objectKey, objectName, r)
+	if bodyErr != nil {
+		slog.WarnContext(ctx, "PUT failed", "key", objectKey, "error", bodyErr)
+		switch bodyErr {
+		case errEntityTooLarge:
+			writeS3Error(w, r, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.")
+		case errBadDigest:
+			writeS3Error(w, r, http.StatusBadRequest, "BadDigest", bodyErr.Error())
+		case errAllBackendsFailed:
+			for i, err := range errs {
+				slog.WarnContext(ctx, "PUT failed on backend", "key", objectKey, "backend", backends[i].clientID, "error", err)
 			}
-			errCh <- err
-		}(backend)
+			writeS3Error(w, r, http.StatusServiceUnavailable, "ServiceUnavailable", "Every backend failed while storing the object.")
+		default:
+			http.Error(w, bodyErr.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	successCount := 0
+	successfulBackends := make([]string, 0) // Track successful backends
+	failedBackends := make([]string, 0)
+	for i, err := range errs {
+		backend := backends[i]
+		if err != nil {
+			slog.WarnContext(ctx, "PUT failed on backend", "key", objectKey, "backend", backend.clientID, "error", err)
+			failedBackends = append(failedBackends, backend.clientID)
+			continue
+		}
+		successCount++
+		successfulBackends = append(successfulBackends, fmt.Sprintf("%s (endpoint: %s)", backend.targetBucketName, backend.s3Client.Endpoint))
+		slog.DebugContext(ctx, "PUT stored on backend", "key", objectKey, "backend", backend.clientID, "endpoint", backend.s3Client.Endpoint)
+	}
+	// Drained backends miss this write; the journal brings them up to date
+	// once they are enabled and repaired.
+	for _, backend := range drained {
+		failedBackends = append(failedBackends, backend.clientID)
 	}
-	wg.Wait()
-	close(errCh)
 
 	// Check if any backends succeeded
 	if successCount > 0 {
 		if successCount < len(bucket.backends) {
 			// Some backends succeeded, some failed - still consider it successful for s3fs compatibility
-			log.Printf("PUT operation partially successful: %d/%d backends succeeded", successCount, len(bucket.backends))
-			log.Printf("Successfully uploaded to the following backends: %s", strings.Join(successfulBackends, ", "))
+			slog.WarnContext(ctx, "PUT partially successful", "key", objectKey, "succeeded", successCount,
+				"backends", len(bucket.backends), "stored_on", successfulBackends, "failed", failedBackends)
+			metrics.PartialWrites.WithLabelValues(bucket.name).Inc()
+			p.journal.record(bucket.name, objectKey, "put", failedBackends)
 			// Return 200 OK instead of 206 Partial Content for better s3fs compatibility
 			// The data is safely stored in at least one backend
+			customer.writeHeaders(w)
 			w.WriteHeader(http.StatusOK)
 		} else {
 			// All backends succeeded
-			log.Printf("PUT operation completed successfully for bucket: %s, key: %s", bucket.name, objectKey)
-			log.Printf("Successfully uploaded to all backends: %s", strings.Join(successfulBackends, ", "))
+			slog.InfoContext(ctx, "PUT completed", "key", objectKey, "stored_on", successfulBackends)
+			p.journal.resolve(bucket.name, objectKey)
+			customer.writeHeaders(w)
 			w.WriteHeader(http.StatusOK)
 		}
 		return
 	}
 
 	// All backends failed
-	log.Printf("PUT operation failed: all backends failed")
-	http.Error(w, "all backends failed", http.StatusBadGateway)
+	slog.ErrorContext(ctx, "PUT failed on all backends", "key", objectKey)
+	writeS3Error(w, r, http.StatusServiceUnavailable, "ServiceUnavailable", "Every backend failed while storing the object.")
 }
 
 func (p *Proxy) handleGet(bucket *s3Bucket, objectKey string, w http.ResponseWriter, r *http.Request) {
-	log.Printf("Starting GET operation for bucket: %s, key: %s", bucket.name, objectKey)
+	ctx := r.Context()
+	slog.DebugContext(ctx, "starting GET", "key", objectKey)
 	if len(bucket.backends) == 0 {
-		log.Printf("GET failed: no backend configured")
+		slog.ErrorContext(ctx, "GET failed: no backend configured")
 		http.Error(w, "no backend configured", http.StatusInternalServerError)
 		return
 	}
 
+	customer, err := p.customerKey(r)
+	if err != nil {
+		slog.InfoContext(ctx, "GET rejected: invalid SSE-C parameters", "key", objectKey, "error", err)
+		err.(*requestError).write(w, r)
+		return
+	}
+
 	var backendErrors []string
 	var notFoundCount int
-	for _, backend := range bucket.backends {
-		log.Printf("Attempting to fetch from backend: %s, target bucket: %s", backend.s3Client.Endpoint, backend.targetBucketName)
-		obj, err := backend.s3Client.Client.GetObject(context.Background(), &s3.GetObjectInput{
+	backends := p.drains.readable(bucket.backends)
+	for _, backend := range backends {
+		slog.DebugContext(ctx, "fetching from backend", "key", objectKey, "backend", backend.clientID, "target_bucket", backend.targetBucketName)
+		obj, err := backend.s3Client.Client.GetObject(ctx, &s3.GetObjectInput{
 			Bucket: &backend.targetBucketName,
 			Key:    &objectKey,
 		})
 
 		if err != nil {
 			errorMsg := fmt.Sprintf("backend %s: %v", backend.targetBucketName, err)
-			log.Printf("GET attempt failed: %s", errorMsg)
+			slog.DebugContext(ctx, "GET attempt failed", "key", objectKey, "backend", backend.clientID, "error", err)
 			backendErrors = append(backendErrors, errorMsg)
 			// Count as not found if NoSuchKey or NoSuchBucket
 			errStr := strings.ToLower(err.Error())
@@ -199,74 +315,104 @@ func (p *Proxy) handleGet(bucket *s3Bucket, objectKey string, w http.ResponseWri
 
 		// If successful, process the object and return
 		defer obj.Body.Close()
-		log.Printf("Successfully fetched object from backend: %s", backend.targetBucketName)
+		slog.DebugContext(ctx, "fetched object from backend", "key", objectKey, "backend", backend.clientID)
 
-		encData, err := io.ReadAll(obj.Body)
-		if err != nil {
-			errorMsg := fmt.Sprintf("backend %s: error reading object body: %v", backend.targetBucketName, err)
-			log.Printf("GET failed: %s", errorMsg)
-			backendErrors = append(backendErrors, errorMsg)
+		if err := customer.check(obj.Metadata); err != nil {
+			slog.InfoContext(ctx, "GET rejected: SSE-C parameters do not match", "key", objectKey, "error", err)
+			err.(*requestError).write(w, r)
+			return
+		}
+		backend = customer.apply(backend)
+		if obj.Metadata, err = openInfo(ctx, backend, objectKey, obj.Metadata); err != nil {
+			slog.WarnContext(ctx, "GET failed to open object info", "key", objectKey, "backend", backend.clientID, "error", err)
+			backendErrors = append(backendErrors, fmt.Sprintf("backend %s: %v", backend.targetBucketName, err))
 			continue
 		}
 
-		decData := encData
-		if backend.crypto != nil {
-			log.Printf("Decrypting data from backend: %s", backend.targetBucketName)
-			decData, err = backend.crypto.Decrypt(encData)
-			if err != nil {
-				errorMsg := fmt.Sprintf("backend %s: decryption error: %v", backend.targetBucketName, err)
-				log.Printf("GET failed: %s", errorMsg)
-				backendErrors = append(backendErrors, errorMsg)
-				continue
-			}
+		cost := p.readCost(backend, obj.ContentLength, obj.Metadata)
+		if !p.memory.tryAcquire(cost, "get") {
+			slog.WarnContext(ctx, "GET rejected: memory budget exhausted", "key", objectKey, "cost", cost)
+			writeSlowDown(w, r)
+			return
+		}
+		defer p.memory.release(cost)
+
+		body, size, err := decodeBody(ctx, backend, obj)
+		if err == nil {
+			obj.Metadata, err = openMetadata(ctx, backend, objectKey, obj.Metadata)
+		}
+		if err != nil {
+			errorMsg := fmt.Sprintf("backend %s: %v", backend.targetBucketName, err)
+			slog.WarnContext(ctx, "GET failed to decode object", "key", objectKey, "backend", backend.clientID, "error", err)
+			backendErrors = append(backendErrors, errorMsg)
+			continue
 		}
-		log.Printf("GET operation completed successfully from backend: %s for bucket: %s, key: %s", backend.targetBucketName, bucket.name, objectKey)
 
 		// Set proper headers for the response
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(decData)))
+		headersFromGet(obj).write(w, r)
+		customer.writeHeaders(w)
+		if size >= 0 {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+		}
 		w.WriteHeader(http.StatusOK)
-		w.Write(decData)
+		n, err := io.Copy(w, body)
+		metrics.BytesSent.WithLabelValues(bucket.name).Add(float64(n))
+		if err != nil {
+			// Headers are already sent, so the client only sees a short body
+			slog.WarnContext(ctx, "GET aborted mid-stream", "key", objectKey, "backend", backend.clientID, "bytes_sent", n, "error", err)
+			return
+		}
+		slog.DebugContext(ctx, "GET completed", "key", objectKey, "backend", backend.clientID, "bytes_sent", n)
 		return // Success!
 	}
 
 	// If all backends failed
 	errorSummary := fmt.Sprintf("Failed to get object from all backends. Errors: %s", strings.Join(backendErrors, "; "))
-	log.Printf("GET failed: %s", errorSummary)
 
 	// Return 404 if all backends returned not found errors
 	statusCode := http.StatusBadGateway
-	if notFoundCount == len(bucket.backends) {
+	if notFoundCount == len(backends) {
 		statusCode = http.StatusNotFound
-		log.Printf("All backends returned not found errors, returning 404")
+		slog.DebugContext(ctx, "GET: object not found on any backend", "key", objectKey)
+	} else {
+		slog.ErrorContext(ctx, "GET failed on all backends", "key", objectKey, "errors", backendErrors)
 	}
 	http.Error(w, errorSummary, statusCode)
 }
 
 func (p *Proxy) handleHead(bucket *s3Bucket, objectKey string, w http.ResponseWriter, r *http.Request) {
-	log.Printf("Starting HEAD operation for bucket: %s, key: %s", bucket.name, objectKey)
+	ctx := r.Context()
+	slog.DebugContext(ctx, "starting HEAD", "key", objectKey)
 	if len(bucket.backends) == 0 {
-		log.Printf("HEAD failed: no backend configured")
+		slog.ErrorContext(ctx, "HEAD failed: no backend configured")
 		http.Error(w, "no backend configured", http.StatusInternalServerError)
 		return
 	}
 
+	customer, err := p.customerKey(r)
+	if err != nil {
+		slog.InfoContext(ctx, "HEAD rejected: invalid SSE-C parameters", "key", objectKey, "error", err)
+		err.(*requestError).write(w, r)
+		return
+	}
+
 	var backendErrors []string
 	var notFoundCount int
 	
 	// Try to get metadata from each backend until one succeeds
-	for _, backend := range bucket.backends {
-		log.Printf("Attempting to head from backend: %s, target bucket: %s", backend.s3Client.Endpoint, backend.targetBucketName)
+	backends := p.drains.readable(bucket.backends)
+	for _, backend := range backends {
+		slog.DebugContext(ctx, "heading from backend", "key", objectKey, "backend", backend.clientID, "target_bucket", backend.targetBucketName)
 		
 		// First try HeadObject for basic metadata
-		obj, err := backend.s3Client.Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		obj, err := backend.s3Client.Client.HeadObject(ctx, &s3.HeadObjectInput{
 			Bucket: &backend.targetBucketName,
 			Key:    &objectKey,
 		})
 
 		if err != nil {
 			errorMsg := fmt.Sprintf("backend %s: %v", backend.targetBucketName, err)
-			log.Printf("HEAD attempt failed: %s", errorMsg)
+			slog.DebugContext(ctx, "HEAD attempt failed", "key", objectKey, "backend", backend.clientID, "error", err)
 			backendErrors = append(backendErrors, errorMsg)
 			// Count as not found if NoSuchKey or NoSuchBucket
 			errStr := strings.ToLower(err.Error())
@@ -277,120 +423,127 @@ func (p *Proxy) handleHead(bucket *s3Bucket, objectKey string, w http.ResponseWr
 		}
 
 		// If successful, we need to determine the actual decrypted content length
-		log.Printf("Successfully fetched object metadata from backend: %s", backend.targetBucketName)
+		slog.DebugContext(ctx, "fetched object metadata from backend", "key", objectKey, "backend", backend.clientID)
+		if err := customer.check(obj.Metadata); err != nil {
+			slog.InfoContext(ctx, "HEAD rejected: SSE-C parameters do not match", "key", objectKey, "error", err)
+			err.(*requestError).write(w, r)
+			return
+		}
+		backend = customer.apply(backend)
 		
 		contentLength := obj.ContentLength
-		actualContentType := "application/octet-stream"
-		
-		// For encrypted objects, we need to get the actual decrypted size
-		// We'll do this more efficiently by reading just enough to determine size
-		if backend.crypto != nil && contentLength != nil {
-			// Get the object to determine decrypted size
-			getObj, getErr := backend.s3Client.Client.GetObject(context.Background(), &s3.GetObjectInput{
-				Bucket: &backend.targetBucketName,
-				Key:    &objectKey,
-			})
-			if getErr == nil {
-				encData, readErr := io.ReadAll(getObj.Body)
-				getObj.Body.Close()
-				if readErr == nil {
-					decData, decErr := backend.crypto.Decrypt(encData)
-					if decErr == nil {
-						contentLength = aws.Int64(int64(len(decData)))
-						// Determine content type from decrypted data if possible
-						if len(decData) > 0 {
-							// Simple content type detection based on file extension or content
-							if strings.HasSuffix(objectKey, ".txt") {
-								actualContentType = "text/plain"
-							} else if strings.HasSuffix(objectKey, ".json") {
-								actualContentType = "application/json"
-							} else if strings.HasSuffix(objectKey, ".xml") {
-								actualContentType = "application/xml"
-							} else if strings.HasSuffix(objectKey, ".html") {
-								actualContentType = "text/html"
-							}
-						}
-					} else {
-						log.Printf("HEAD: Failed to decrypt for size calculation from backend %s: %v", backend.targetBucketName, decErr)
-						// Continue with encrypted size as fallback
-					}
-				}
-			}
-		}
 
-		// Set response headers
-		if obj.ContentType != nil && *obj.ContentType != "" {
-			w.Header().Set("Content-Type", *obj.ContentType)
-		} else {
-			w.Header().Set("Content-Type", actualContentType)
+		if obj.Metadata, err = openInfo(ctx, backend, objectKey, obj.Metadata); err != nil {
+			slog.WarnContext(ctx, "HEAD failed to open object info", "key", objectKey, "backend", backend.clientID, "error", err)
+			backendErrors = append(backendErrors, fmt.Sprintf("backend %s: %v", backend.targetBucketName, err))
+			continue
 		}
 
-		if contentLength != nil {
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", *contentLength))
+		// Objects written by the proxy record their plaintext size, so only
+		// legacy encrypted objects need to be downloaded to find it
+		if info, ok := parseObjectInfo(obj.Metadata); ok {
+			contentLength = aws.Int64(info.Size)
+		} else if backend.crypto != nil {
+			p.enqueueBackfill(backend, objectKey)
+			if size, err := p.plaintextSize(ctx, backend, objectKey); err == nil {
+				contentLength = aws.Int64(size)
+			} else {
+				slog.WarnContext(ctx, "HEAD failed to decrypt for size calculation", "key", objectKey, "backend", backend.clientID, "error", err)
+				// Continue with encrypted size as fallback
+			}
 		}
 
-		if obj.LastModified != nil {
-			w.Header().Set("Last-Modified", obj.LastModified.Format(http.TimeFormat))
+		meta, err := openMetadata(ctx, backend, objectKey, obj.Metadata)
+		if err != nil {
+			slog.WarnContext(ctx, "HEAD failed to open sealed metadata", "key", objectKey, "backend", backend.clientID, "error", err)
+			backendErrors = append(backendErrors, fmt.Sprintf("backend %s: %v", backend.targetBucketName, err))
+			continue
 		}
+		obj.Metadata = meta
 
-		// For ETag, use a consistent approach across backends
-		if obj.ETag != nil {
-			etag := *obj.ETag
-			// Remove quotes if present and create a consistent ETag
-			etag = strings.Trim(etag, "\"")
-			// Create a deterministic ETag based on object key and backend
-			// This ensures consistency for s3fs while maintaining uniqueness
-			w.Header().Set("ETag", fmt.Sprintf("\"%s\"", etag))
+		// Set response headers
+		headersFromHead(obj).write(w, r)
+		customer.writeHeaders(w)
+		if contentLength != nil {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", *contentLength))
 		}
-
-		// Add cache control headers for better s3fs performance
 		w.Header().Set("Accept-Ranges", "bytes")
-		w.Header().Set("Cache-Control", "max-age=3600")
 
-		log.Printf("HEAD operation completed successfully from backend: %s for bucket: %s, key: %s", backend.targetBucketName, bucket.name, objectKey)
+		slog.DebugContext(ctx, "HEAD completed", "key", objectKey, "backend", backend.clientID)
 		w.WriteHeader(http.StatusOK)
 		return // Success!
 	}
 
 	// If all backends failed
 	errorSummary := fmt.Sprintf("Failed to head object from all backends. Errors: %s", strings.Join(backendErrors, "; "))
-	log.Printf("HEAD failed: %s", errorSummary)
 
 	// Return 404 if all backends returned not found errors
 	statusCode := http.StatusBadGateway
-	if notFoundCount == len(bucket.backends) {
+	if notFoundCount == len(backends) {
 		statusCode = http.StatusNotFound
-		log.Printf("All backends returned not found errors, returning 404")
+		slog.DebugContext(ctx, "HEAD: object not found on any backend", "key", objectKey)
+	} else {
+		slog.ErrorContext(ctx, "HEAD failed on all backends", "key", objectKey, "errors", backendErrors)
 	}
 	http.Error(w, errorSummary, statusCode)
 }
 
 func (p *Proxy) handleDelete(bucket *s3Bucket, objectKey string, w http.ResponseWriter, r *http.Request) {
-	log.Printf("Starting DELETE operation for bucket: %s, key: %s", bucket.name, objectKey)
+	slog.DebugContext(r.Context(), "starting DELETE", "key", objectKey)
+	backends, drained := p.drains.split(bucket.backends)
+	if len(backends) == 0 {
+		slog.WarnContext(r.Context(), "DELETE rejected: every backend is drained", "key", objectKey)
+		writeS3Error(w, r, http.StatusServiceUnavailable, "ServiceUnavailable", "Every backend of this bucket is drained.")
+		return
+	}
 	var wg sync.WaitGroup
 	errCh := make(chan error, len(bucket.backends))
 	successCount := 0
 	var mu sync.Mutex
-	
-	for _, backend := range bucket.backends {
+	var failedBackends []string
+	for _, backend := range drained {
+		failedBackends = append(failedBackends, backend.clientID)
+	}
+	// Finish the delete on every backend even if the client goes away, so
+	// the replicas do not drift apart.
+	ctx := context.WithoutCancel(r.Context())
+
+	for _, backend := range backends {
 		wg.Add(1)
 		go func(backend *s3Backend) {
 			defer wg.Done()
-			log.Printf("Deleting from backend: %s", backend.targetBucketName)
-			_, err := backend.s3Client.Client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+			slog.DebugContext(ctx, "deleting from backend", "key", objectKey, "backend", backend.clientID)
+			_, err := backend.s3Client.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
 				Bucket: &backend.targetBucketName,
 				Key:    &objectKey,
 			})
 			if err != nil {
-				log.Printf("DELETE failed for backend %s: %v", backend.targetBucketName, err)
 				// Don't treat NoSuchKey as a critical error - object might already be deleted
 				if !strings.Contains(err.Error(), "NoSuchKey") {
+					slog.WarnContext(ctx, "DELETE failed on backend", "key", objectKey, "backend", backend.clientID, "error", err)
+					mu.Lock()
+					failedBackends = append(failedBackends, backend.clientID)
+					mu.Unlock()
 					errCh <- err
 					return
 				}
-				log.Printf("DELETE: Object already deleted from backend %s", backend.targetBucketName)
+				slog.DebugContext(ctx, "DELETE: object already absent on backend", "key", objectKey, "backend", backend.clientID)
 			} else {
-				log.Printf("DELETE successful for backend: %s", backend.targetBucketName)
+				slog.DebugContext(ctx, "DELETE succeeded on backend", "key", objectKey, "backend", backend.clientID)
+			}
+			// The object may have sidecars; deleting a missing one
+			// succeeds.
+			sidecars := []string{infoSidecarKey(objectKey)}
+			if backend.sealMetadata {
+				sidecars = append(sidecars, sidecarKey(objectKey))
+			}
+			for _, sidecar := range sidecars {
+				if _, err := backend.s3Client.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket: &backend.targetBucketName,
+					Key:    s(sidecar),
+				}); err != nil {
+					slog.WarnContext(ctx, "DELETE failed to remove sidecar", "key", objectKey, "sidecar", sidecar, "backend", backend.clientID, "error", err)
+				}
 			}
 			
 			mu.Lock()
@@ -412,18 +565,28 @@ func (p *Proxy) handleDelete(bucket *s3Bucket, objectKey string, w http.Response
 
 	// If we had some success or only NoSuchKey errors, consider it successful
 	if len(realErrors) == 0 || successCount > 0 {
-		log.Printf("DELETE operation completed successfully for bucket: %s, key: %s (successes: %d)", bucket.name, objectKey, successCount)
+		if len(failedBackends) > 0 {
+			metrics.PartialWrites.WithLabelValues(bucket.name).Inc()
+			p.journal.record(bucket.name, objectKey, "delete", failedBackends)
+		} else {
+			p.journal.resolve(bucket.name, objectKey)
+		}
+		slog.InfoContext(ctx, "DELETE completed", "key", objectKey, "succeeded", successCount, "failed", failedBackends)
 		w.WriteHeader(http.StatusNoContent) // 204 is more appropriate for DELETE
 		return
 	}
 
 	// Only fail if we had real errors and no successes
-	log.Printf("DELETE operation failed: all backends failed with real errors")
+	slog.ErrorContext(ctx, "DELETE failed on all backends", "key", objectKey, "error", realErrors[0])
 	http.Error(w, fmt.Sprintf("delete failed: %v", realErrors[0]), http.StatusBadGateway)
 }
 
 func (p *Proxy) handleProxy(bucket *s3Bucket, w http.ResponseWriter, r *http.Request) {
-	log.Printf("Starting PROXY operation for request: %s %s", r.Method, r.RequestURI)
+	slog.DebugContext(r.Context(), "starting PROXY", "method", r.Method, "url", r.URL)
+	var keys *keyCodec
+	if bucket != nil {
+		keys = bucket.keys
+	}
 	if bucket == nil {
 		for _, b := range p.buckets {
 			bucket = b
@@ -432,53 +595,89 @@ func (p *Proxy) handleProxy(bucket *s3Bucket, w http.ResponseWriter, r *http.Req
 	}
 
 	if len(bucket.backends) == 0 {
-		log.Printf("PROXY failed: no backend configured")
+		slog.ErrorContext(r.Context(), "PROXY failed: no backend configured")
 		http.Error(w, "no backend configured", http.StatusInternalServerError)
 		return
 	}
 
-	backend := bucket.backends[0]
-	log.Printf("Proxying to backend: %s", backend.targetBucketName)
+	backend := p.drains.readable(bucket.backends)[0]
+	slog.DebugContext(r.Context(), "proxying to backend", "backend", backend.clientID, "target_bucket", backend.targetBucketName)
 	newReq := p.repackage(r, backend)
 	newReq.URL.Path = strings.ReplaceAll(newReq.URL.Path, bucket.name, backend.targetBucketName)
+	var listing listTranslation
+	if isListRequest(r) {
+		// Listings may be rewritten, so they must arrive uncompressed.
+		newReq.Header.Del("Accept-Encoding")
+		if keys != nil {
+			query := newReq.URL.Query()
+			var err error
+			if listing, err = keys.translateListRequest(query); err != nil {
+				slog.InfoContext(r.Context(), "PROXY rejected listing", "error", err)
+				writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", err.Error())
+				return
+			}
+			newReq.URL.RawQuery = query.Encode()
+		}
+	}
 
-	creds, err := backend.s3Client.Config.Credentials.Retrieve(context.TODO())
+	creds, err := backend.s3Client.Config.Credentials.Retrieve(r.Context())
 	if err != nil {
-		log.Printf("PROXY failed: error retrieving credentials: %v", err)
+		slog.ErrorContext(r.Context(), "PROXY failed retrieving credentials", "backend", backend.clientID, "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	signer := v4.NewSigner()
-	err = signer.SignHTTP(context.Background(), creds, newReq, newReq.Header.Get("X-Amz-Content-Sha256"), "s3", backend.s3Client.Config.Region, time.Now())
+	err = signer.SignHTTP(r.Context(), creds, newReq, newReq.Header.Get("X-Amz-Content-Sha256"), "s3", backend.s3Client.Config.Region, time.Now())
 	if err != nil {
-		log.Printf("PROXY failed: error signing request: %v", err)
+		slog.ErrorContext(r.Context(), "PROXY failed signing request", "backend", backend.clientID, "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	resp, err := http.DefaultClient.Do(newReq)
+	ctx, span := tracing.Tracer().Start(r.Context(), "s3.Proxy", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("s3proxy.backend", backend.clientID)))
+	defer span.End()
+	resp, err := http.DefaultClient.Do(newReq.WithContext(ctx))
 	if err != nil {
-		log.Printf("PROXY failed: error executing request: %v", err)
+		span.RecordError(err)
+		slog.WarnContext(r.Context(), "PROXY request to backend failed", "backend", backend.clientID, "error", err)
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
-	log.Printf("PROXY response received: status %d", resp.StatusCode)
-	body, _ := io.ReadAll(resp.Body)
+	slog.DebugContext(r.Context(), "PROXY response received", "backend", backend.clientID, "status", resp.StatusCode)
 	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	encrypts := backend.crypto != nil || len(bucket.cryptoRules) > 0
+	// Info sidecars can be in any bucket, so every listing is filtered.
+	if resp.StatusCode == http.StatusOK && isListRequest(r) {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxListingSize+1))
+		if err != nil || len(body) > maxListingSize {
+			slog.WarnContext(r.Context(), "PROXY failed reading listing", "backend", backend.clientID, "error", err, "size", len(body))
+			http.Error(w, "cannot read listing from backend", http.StatusBadGateway)
+			return
+		}
+		body = hideSidecars(body, backend.sidecarPrefixes())
+		if encrypts {
+			body = p.fixListingSizes(r.Context(), backend, body)
+		}
+		if keys != nil {
+			body = p.translateListing(r.Context(), keys, backend, listing, body)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
 	w.WriteHeader(resp.StatusCode)
-	_, err = w.Write(body)
+	_, err = io.Copy(w, resp.Body)
 	if err != nil {
-		log.Printf("PROXY failed: error writing response: %v", err)
-		return
+		slog.WarnContext(r.Context(), "PROXY failed writing response", "backend", backend.clientID, "error", err)
 	}
-	log.Printf("PROXY operation completed successfully")
 }
 
 func (p *Proxy) repackage(r *http.Request, backend *s3Backend) *http.Request {
-	log.Printf("Repackaging request for backend: %s", backend.targetBucketName)
 	req := r.Clone(r.Context())
 	req.RequestURI = ""
 
@@ -505,7 +704,6 @@ func (p *Proxy) repackage(r *http.Request, backend *s3Backend) *http.Request {
 		req.Header.Del(header)
 	}
 
-	log.Printf("Request repackaged successfully")
 	return req
 }
 
@@ -522,6 +720,9 @@ func getMetadataHeaders(header http.Header) map[string]string {
 		key = strings.ToLower(key)
 		if strings.HasPrefix(key, "x-amz-meta-") {
 			name := strings.TrimPrefix(key, "x-amz-meta-")
+			if isReservedMeta(name) {
+				continue
+			}
 			result[name] = strings.Join(header.Values(key), ",")
 		}
 	}
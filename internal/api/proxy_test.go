@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriteOnlyRefusesReads(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := testConfig(t, fake)
+	cfg.WriteOnly = true
+	p := newTestProxy(t, cfg)
+
+	if w := serve(p, http.MethodPut, "/vb/k", randomBody(t, 100), nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d", w.Code)
+	}
+	reads := fake.count("GetObject") + fake.count("HeadObject") + fake.count("ListObjects")
+	for _, req := range []struct{ method, target string }{
+		{http.MethodGet, "/vb/k"},
+		{http.MethodHead, "/vb/k"},
+		{http.MethodGet, "/vb/missing"},
+		{http.MethodGet, "/vb?list-type=2"},
+		{http.MethodGet, "/vb"},
+		{http.MethodGet, "/vb/k?uploadId=1"},
+	} {
+		w := serve(p, req.method, req.target, nil, nil)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("%s %s: %d", req.method, req.target, w.Code)
+		}
+		if req.method == http.MethodGet && !strings.Contains(w.Body.String(), "<Code>AccessDenied</Code>") {
+			t.Fatalf("%s %s: %s", req.method, req.target, w.Body)
+		}
+	}
+	if n := fake.count("GetObject") + fake.count("HeadObject") + fake.count("ListObjects") - reads; n != 0 {
+		t.Fatalf("refused reads reached the backend %d times", n)
+	}
+
+	// Clients check a bucket exists before uploading, and may delete.
+	if w := serve(p, http.MethodHead, "/vb", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("bucket HEAD: %d", w.Code)
+	}
+	if w := serve(p, http.MethodDelete, "/vb/k", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", w.Code)
+	}
+}
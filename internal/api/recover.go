@@ -0,0 +1,315 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"s3-proxy/internal/config"
+	"s3-proxy/internal/crypto"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// RecoverResult reports the outcome for one object or file.
+type RecoverResult struct {
+	Source   string
+	Target   string
+	CryptoID string
+	// Verified is set when the plaintext matched a recorded checksum, not
+	// only the authentication of the ciphertext.
+	Verified bool
+	Err      error
+}
+
+// Recoverer turns ciphertext read straight from a backend back into
+// plaintext without a running proxy, for disaster recovery.
+type Recoverer struct {
+	p      *Proxy
+	outDir string
+	// cryptoID forces a crypto profile instead of the recorded or
+	// detected one.
+	cryptoID string
+}
+
+// NewRecoverer builds what recovery needs from cfg: the crypto profiles and
+// their KMSes, and for a bucket its key codec and backend clients. Files
+// are recovered with the forced profile, or all of them. Nothing else in cfg
+// has to resolve, so with only the crypto keys at hand files can still be
+// decrypted. Plaintext is written below outDir.
+func NewRecoverer(cfg *config.Config, outDir, cryptoID, bucket string) (*Recoverer, error) {
+	needed, err := recoveryConfig(cfg, cryptoID, bucket)
+	if err != nil {
+		return nil, err
+	}
+	p, err := New(needed)
+	if err != nil {
+		return nil, err
+	}
+	return &Recoverer{p: p, outDir: outDir, cryptoID: cryptoID}, nil
+}
+
+// recoveryConfig returns the part of cfg NewRecoverer builds.
+func recoveryConfig(cfg *config.Config, cryptoID, bucket string) (*config.Config, error) {
+	needed := &config.Config{Limits: cfg.Limits, Upload: cfg.Upload}
+	for _, profile := range cfg.Crypto {
+		// Objects in a bucket record their profile, so all are kept.
+		if bucket != "" || cryptoID == "" || profile.ID == cryptoID {
+			needed.Crypto = append(needed.Crypto, profile)
+		}
+	}
+	if cryptoID != "" && cryptoID != cryptoNone && len(needed.Crypto) == 0 {
+		return nil, fmt.Errorf("unknown crypto ID: %s", cryptoID)
+	}
+	kmses := make(map[string]bool)
+	for _, profile := range needed.Crypto {
+		for _, layer := range profile.Layers {
+			kmses[layer.KMS] = true
+		}
+	}
+	for _, k := range cfg.KMS {
+		if kmses[k.ID] {
+			needed.KMS = append(needed.KMS, k)
+		}
+	}
+	if bucket == "" {
+		return needed, nil
+	}
+
+	clients := make(map[string]bool)
+	for _, b := range cfg.S3Buckets {
+		if b.BucketName == bucket {
+			needed.S3Buckets = append(needed.S3Buckets, b)
+			for _, backend := range b.Backends {
+				clients[backend.S3ClientID] = true
+			}
+		}
+	}
+	if len(needed.S3Buckets) == 0 {
+		return nil, fmt.Errorf("unknown bucket: %s", bucket)
+	}
+	for _, c := range cfg.S3Clients {
+		if clients[c.ID] {
+			needed.S3Clients = append(needed.S3Clients, c)
+		}
+	}
+	return needed, nil
+}
+
+// Files decrypts local files and directories of downloaded objects. Files
+// carry no metadata, so without a forced profile every profile is tried
+// and the first one that authenticates the ciphertext wins.
+func (rc *Recoverer) Files(ctx context.Context, paths []string, report func(RecoverResult)) {
+	var candidates []string
+	if rc.cryptoID != "" {
+		candidates = []string{rc.cryptoID}
+	} else {
+		for id := range rc.p.cryptos {
+			candidates = append(candidates, id)
+		}
+		sort.Strings(candidates)
+	}
+	backend := &s3Backend{profiles: rc.p.cryptos}
+
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			report(RecoverResult{Source: root, Err: err})
+			continue
+		}
+		if !info.IsDir() {
+			report(rc.file(ctx, backend, candidates, root, filepath.Base(root)))
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				report(RecoverResult{Source: path, Err: err})
+				return nil
+			}
+			if d.IsDir() {
+				if name := d.Name() + "/"; name == sidecarPrefix || name == infoSidecarPrefix {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			report(rc.file(ctx, backend, candidates, path, filepath.ToSlash(rel)))
+			return nil
+		})
+		if err != nil {
+			report(RecoverResult{Source: root, Err: err})
+		}
+	}
+}
+
+func (rc *Recoverer) file(ctx context.Context, backend *s3Backend, candidates []string, path, name string) RecoverResult {
+	result := RecoverResult{Source: path}
+	var errs []error
+	for _, id := range candidates {
+		err := func() error {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			br := bufio.NewReader(f)
+			meta := map[string]string{metaCrypto: id}
+			if head, _ := br.Peek(len(crypto.StreamMagic)); crypto.IsStream(head) {
+				meta[metaFormat] = formatStream
+			}
+			body, _, err := decodeBody(ctx, backend, &s3.GetObjectOutput{Body: io.NopCloser(br), Metadata: meta})
+			if err != nil {
+				return err
+			}
+			result.Target, err = rc.write(name, body)
+			return err
+		}()
+		if err == nil {
+			result.CryptoID = id
+			return result
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", id, err))
+	}
+	if len(errs) == 0 {
+		errs = append(errs, errors.New("no crypto profile configured"))
+	}
+	result.Err = errors.Join(errs...)
+	return result
+}
+
+// Bucket decrypts every object of a virtual bucket as stored on one of its
+// backends, the first one unless backendID is set. Keys are translated back
+// to client keys and only those starting with prefix are recovered.
+func (rc *Recoverer) Bucket(ctx context.Context, bucketName, backendID, prefix string, report func(RecoverResult)) error {
+	bucket := rc.p.buckets[bucketName]
+	if bucket == nil {
+		return fmt.Errorf("unknown bucket: %s", bucketName)
+	}
+	var backend *s3Backend
+	for _, b := range bucket.backends {
+		if backendID == "" || b.clientID == backendID {
+			backend = b
+			break
+		}
+	}
+	if backend == nil {
+		return fmt.Errorf("bucket %s has no backend %s", bucketName, backendID)
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(backend.s3Client.Client, &s3.ListObjectsV2Input{
+		Bucket: &backend.targetBucketName,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing backend %s: %w", backend.clientID, err)
+		}
+		for _, obj := range page.Contents {
+			key := *obj.Key
+			if backend.isSidecar(key) {
+				continue
+			}
+			name, err := rc.clientKey(ctx, bucket, backend, key)
+			if err != nil {
+				report(RecoverResult{Source: key, Err: fmt.Errorf("cannot recover key: %w", err)})
+				continue
+			}
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			report(rc.object(ctx, backend, key, name))
+		}
+	}
+	return nil
+}
+
+func (rc *Recoverer) clientKey(ctx context.Context, bucket *s3Bucket, backend *s3Backend, key string) (string, error) {
+	switch {
+	case bucket.keys == nil:
+		return key, nil
+	case bucket.keys.mode == keyModeSIV:
+		return bucket.keys.decode(key)
+	}
+	return rc.p.objectName(ctx, bucket.keys, backend, key)
+}
+
+func (rc *Recoverer) object(ctx context.Context, backend *s3Backend, key, name string) RecoverResult {
+	result := RecoverResult{Source: backend.clientID + ":" + backend.targetBucketName + "/" + key}
+	obj, err := backend.s3Client.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &backend.targetBucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer obj.Body.Close()
+	if obj.Metadata[metaCustomerKey] != "" {
+		result.Err = errCustomerKeyRequired
+		return result
+	}
+	if obj.Metadata == nil {
+		obj.Metadata = make(map[string]string)
+	}
+	if rc.cryptoID != "" {
+		obj.Metadata[metaCrypto] = rc.cryptoID
+	}
+	result.CryptoID = obj.Metadata[metaCrypto]
+	if result.CryptoID == "" {
+		result.CryptoID = backend.cryptoID
+	}
+	if obj.Metadata, err = openInfo(ctx, backend, key, obj.Metadata); err != nil {
+		result.Err = err
+		return result
+	}
+	body, _, err := decodeBody(ctx, backend, obj)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Target, result.Err = rc.write(name, body)
+	if info, ok := parseObjectInfo(obj.Metadata); ok && info.SHA256 != "" && result.Err == nil {
+		result.Verified = true
+	}
+	return result
+}
+
+// write stores the plaintext of name below the output directory. The file
+// only appears once the whole body has been read and authenticated.
+func (rc *Recoverer) write(name string, body io.Reader) (string, error) {
+	target := filepath.Join(rc.outDir, filepath.FromSlash(strings.TrimLeft(name, "/")))
+	rel, err := filepath.Rel(rc.outDir, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("key %q does not map to a file below the output directory", name)
+	}
+	if strings.HasSuffix(name, "/") {
+		// A directory marker.
+		return target, os.MkdirAll(target, 0o755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return target, os.Rename(tmp.Name(), target)
+}
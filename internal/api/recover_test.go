@@ -0,0 +1,102 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"s3-proxy/internal/config"
+)
+
+// chdir changes into dir for the rest of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+func TestRecoverWriteStaysBelowOutDir(t *testing.T) {
+	chdir(t, t.TempDir())
+	for _, outDir := range []string{".", "out", "./out/"} {
+		rc := &Recoverer{outDir: outDir}
+		target, err := rc.write("a/b.txt", bytes.NewReader([]byte("data")))
+		if err != nil {
+			t.Fatalf("out %q: %v", outDir, err)
+		}
+		if got, err := os.ReadFile(target); err != nil || string(got) != "data" {
+			t.Fatalf("out %q: wrote %q, %v", outDir, got, err)
+		}
+		if _, err := rc.write("dir/", nil); err != nil {
+			t.Fatalf("out %q: directory marker: %v", outDir, err)
+		}
+		for _, name := range []string{"", "/", "..", "../x", "a/../../x", "/../x"} {
+			if target, err := rc.write(name, bytes.NewReader(nil)); err == nil {
+				t.Errorf("out %q: %q written to %s", outDir, name, target)
+			}
+		}
+	}
+}
+
+func TestRecoverFilesWithPartialConfig(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := testConfig(t, fake)
+	p := newTestProxy(t, cfg)
+	data := randomBody(t, 3*uploadChunkSize)
+	if w := serve(p, http.MethodPut, "/vb/docs/a.bin", data, nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d", w.Code)
+	}
+	dump := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dump, "docs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dump, "docs", "a.bin"), fake.object("data", "docs/a.bin").data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the crypto keys are at hand: backend credentials, the auth
+	// secrets and the journal directory cannot be used.
+	missing := filepath.Join(t.TempDir(), "missing")
+	cfg.S3Clients[0].AccessKey = config.MultiSourceString{File: missing}
+	cfg.Auth.HeaderFormat = config.MultiSourceString{File: missing}
+	cfg.Admin.Token = config.MultiSourceString{File: missing}
+	// Below a file, so the journal directory cannot be created.
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Journal.File = filepath.Join(notDir, "journal.json")
+	if _, err := New(cfg); err == nil {
+		t.Fatal("the partial config builds a proxy")
+	}
+
+	out := t.TempDir()
+	chdir(t, out)
+	rc, err := NewRecoverer(cfg, ".", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []RecoverResult
+	rc.Files(context.Background(), []string{dump}, func(r RecoverResult) { results = append(results, r) })
+	if len(results) != 1 || results[0].Err != nil || results[0].CryptoID != "aes" {
+		t.Fatalf("results %+v", results)
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "docs", "a.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("recovered %d bytes, %v", len(got), err)
+	}
+
+	if _, err := NewRecoverer(cfg, ".", "other", ""); err == nil {
+		t.Fatal("accepted an unknown crypto ID")
+	}
+	if _, err := NewRecoverer(cfg, ".", "", "vb"); err == nil {
+		t.Fatal("recovered a bucket without its backend credentials")
+	}
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"s3-proxy/internal/config"
+	"s3-proxy/internal/metrics"
+)
+
+const defaultReloadInterval = 5 * time.Second
+
+// Reloader serves requests with the Proxy built from the most recently
+// loaded configuration. A reload builds a complete new Proxy and only swaps
+// it in once that succeeded; requests already running keep the Proxy they
+// started on until they finish.
+type Reloader struct {
+	path   string
+	onLoad func(*config.Config) error
+
+	current atomic.Pointer[generation]
+	mu      sync.Mutex // serialises reloads
+	modTime time.Time
+}
+
+// generation is one loaded configuration and the background work that
+// belongs to it.
+type generation struct {
+	proxy  *Proxy
+	cfg    *config.Config
+	cancel context.CancelFunc
+	// active is read-locked by every request, so taking the write lock
+	// waits for the generation to drain.
+	active sync.RWMutex
+}
+
+// NewReloader loads path and starts serving it. onLoad, if set, is called
+// with every configuration that is about to go live, including the first,
+// and may veto it by returning an error.
+func NewReloader(path string, onLoad func(*config.Config) error) (*Reloader, error) {
+	r := &Reloader{path: path, onLoad: onLoad}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close waits for the repair journal to reach its file. Call it once the
+// servers have stopped.
+func (r *Reloader) Close() {
+	r.current.Load().proxy.journal.close()
+}
+
+// Config returns the configuration currently being served.
+func (r *Reloader) Config() *config.Config {
+	return r.current.Load().cfg
+}
+
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	gen := r.current.Load()
+	gen.active.RLock()
+	defer gen.active.RUnlock()
+	gen.proxy.ServeHTTP(w, req)
+}
+
+// AdminHandler serves the admin endpoints of the current configuration,
+// plus POST /admin/reload.
+func (r *Reloader) AdminHandler() http.Handler {
+	current := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.current.Load().proxy.AdminHandler().ServeHTTP(w, req)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", current)
+	mux.HandleFunc("POST /admin/reload", func(w http.ResponseWriter, req *http.Request) {
+		r.current.Load().proxy.requireAdmin(func(w http.ResponseWriter, req *http.Request) {
+			if err := r.Reload(); err != nil {
+				writeJSONError(w, http.StatusUnprocessableEntity, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+		})(w, req)
+	})
+	return mux
+}
+
+// Reload loads the configuration file again and swaps it in. On error the
+// running configuration is left untouched.
+func (r *Reloader) Reload() error {
+	err := r.load()
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		metrics.ConfigLastReloadSuccess.Set(0)
+		slog.Error("configuration reload failed, keeping the running configuration", "path", r.path, "error", err)
+		return err
+	}
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+	slog.Info("configuration reloaded", "path", r.path)
+	return nil
+}
+
+func (r *Reloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stat, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("cannot read config: %w", err)
+	}
+	cfg, err := config.Load(r.path)
+	if err != nil {
+		return fmt.Errorf("cannot load config: %w", err)
+	}
+	prx, err := New(cfg)
+	if err != nil {
+		return fmt.Errorf("cannot create proxy: %w", err)
+	}
+
+	if r.onLoad != nil {
+		if err := r.onLoad(cfg); err != nil {
+			return err
+		}
+	}
+	old := r.current.Load()
+	if old != nil {
+		if !slices.Equal(cfg.ListenAddr, old.cfg.ListenAddr) || !slices.Equal(cfg.Admin.ListenAddr, old.cfg.Admin.ListenAddr) {
+			slog.Warn("listeners changed; they take effect after a restart",
+				"running", old.cfg.ListenAddr, "configured", cfg.ListenAddr)
+		}
+		if cfg.Journal.File != old.cfg.Journal.File {
+			slog.Warn("journal file changed; it takes effect after a restart",
+				"running", old.cfg.Journal.File, "configured", cfg.Journal.File)
+		}
+		// State that outlives a single configuration is carried over.
+		prx.journal = old.proxy.journal
+		prx.drains = old.proxy.drains
+		prx.jobs = old.proxy.jobs
+		prx.sizes = old.proxy.sizes
+		prx.keyShares = old.proxy.keyShares
+		prx.unsealRecovered()
+		old.proxy.memory.setLimit(cfg.Limits.MemoryBudget)
+		prx.memory = old.proxy.memory
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if cfg.Backfill.Enabled {
+		prx.startBackfill(ctx, cfg.Backfill.Interval, old == nil)
+	}
+	r.current.Store(&generation{proxy: prx, cfg: cfg, cancel: cancel})
+	r.modTime = stat.ModTime()
+	metrics.ConfigLastReloadSuccess.Set(1)
+	metrics.ConfigLastReloadTimestamp.SetToCurrentTime()
+
+	if old != nil {
+		go func() {
+			old.active.Lock()
+			old.cancel()
+			old.active.Unlock()
+			slog.Info("previous configuration drained")
+		}()
+	}
+	return nil
+}
+
+// Watch polls the configuration file every interval and reloads it when its
+// modification time changes. It returns when ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stat, err := os.Stat(r.path)
+		if err != nil {
+			slog.Warn("cannot stat config file", "path", r.path, "error", err)
+			continue
+		}
+		r.mu.Lock()
+		changed := !stat.ModTime().Equal(r.modTime)
+		r.mu.Unlock()
+		if changed {
+			slog.Info("config file changed, reloading", "path", r.path)
+			if err := r.Reload(); err != nil {
+				// Do not retry a broken file until it changes again.
+				r.mu.Lock()
+				r.modTime = stat.ModTime()
+				r.mu.Unlock()
+			}
+		}
+	}
+}
+
+// RefreshSecrets reloads the configuration every interval, re-reading
+// secrets whose cache TTL has run out. It returns when ctx is done.
+func (r *Reloader) RefreshSecrets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		slog.Info("refreshing secrets", "path", r.path)
+		r.Reload()
+	}
+}
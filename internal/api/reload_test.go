@@ -0,0 +1,155 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"s3-proxy/internal/config"
+)
+
+const reloadConfig = `
+listen_addr: "127.0.0.1:0"
+s3_clients:
+  - id: s3-0
+    endpoint: "ENDPOINT"
+    region: us-east-1
+    access_key: {data: access}
+    secret_key: {data: secret}
+s3_buckets:
+  - bucket_name: vb
+    backends:
+      - s3_client_id: s3-0
+        s3_bucket_name: data
+auth:
+  header_format: {data: "AWS4-HMAC-SHA256"}
+  users:
+    - access_key: {data: "USER"}
+`
+
+// reloadFixture writes a config for one fake backend to a file and returns
+// a function that rewrites it with another user access key.
+func reloadFixture(t *testing.T) (path string, write func(user string)) {
+	t.Helper()
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	fake := newFakeS3(t)
+	path = filepath.Join(t.TempDir(), "config.yaml")
+	write = func(user string) {
+		cfg := strings.NewReplacer("ENDPOINT", fake.URL, "USER", user).Replace(reloadConfig)
+		if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path, write
+}
+
+func TestReloadSwapsGenerations(t *testing.T) {
+	path, write := reloadFixture(t)
+	write("OTHER")
+	r, err := NewReloader(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(r, http.MethodPut, "/vb/k", []byte("x"), nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("put with an unknown key: %d", w.Code)
+	}
+	first := r.current.Load()
+
+	write("AK")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second := r.current.Load()
+	if second == first {
+		t.Fatal("reload kept the generation")
+	}
+	if w := serve(r, http.MethodPut, "/vb/k", []byte("x"), nil); w.Code != http.StatusOK {
+		t.Fatalf("put after reload: %d %s", w.Code, w.Body)
+	}
+	// State that outlives a configuration is carried over.
+	if second.proxy.journal != first.proxy.journal || second.proxy.drains != first.proxy.drains ||
+		second.proxy.jobs != first.proxy.jobs || second.proxy.memory != first.proxy.memory {
+		t.Fatal("reload dropped state of the previous generation")
+	}
+}
+
+func TestReloadRollsBackBrokenConfig(t *testing.T) {
+	path, write := reloadFixture(t)
+	write("AK")
+	var vetoed bool
+	r, err := NewReloader(path, func(cfg *config.Config) error {
+		if vetoed {
+			return errors.New("vetoed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(r, http.MethodPut, "/vb/k", []byte("x"), nil); w.Code != http.StatusOK {
+		t.Fatalf("put: %d", w.Code)
+	}
+	running := r.current.Load()
+
+	broken := []string{
+		"listen_addr: \"127.0.0.1:0\"\ns3_buckets: [{bucket_name: vb, backends: [{s3_client_id: missing}]}]",
+		"s3_buckets: [",
+	}
+	for _, cfg := range broken {
+		if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Reload(); err == nil {
+			t.Fatalf("reloaded %q", cfg)
+		}
+	}
+	os.Remove(path)
+	if err := r.Reload(); err == nil {
+		t.Fatal("reloaded a missing file")
+	}
+	write("OTHER")
+	vetoed = true
+	if err := r.Reload(); err == nil {
+		t.Fatal("reloaded a vetoed config")
+	}
+
+	if r.current.Load() != running {
+		t.Fatal("a failed reload replaced the running generation")
+	}
+	if w := serve(r, http.MethodGet, "/vb/k", nil, nil); w.Code != http.StatusOK || w.Body.String() != "x" {
+		t.Fatalf("get after failed reloads: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestReloadDrainsPreviousGeneration(t *testing.T) {
+	path, write := reloadFixture(t)
+	write("AK")
+	r, err := NewReloader(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := r.current.Load()
+	canceled := make(chan struct{})
+	old.cancel = func() { close(canceled) }
+
+	// A request still running on the old generation.
+	old.active.RLock()
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-canceled:
+		t.Fatal("previous generation stopped while a request was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	old.active.RUnlock()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("previous generation not stopped after draining")
+	}
+}
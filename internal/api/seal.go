@@ -0,0 +1,221 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"s3-proxy/internal/config"
+	"s3-proxy/internal/crypto"
+	"s3-proxy/internal/escrow"
+)
+
+// errSealed is returned by a sealed crypto profile until it is unsealed.
+var errSealed = errors.New("crypto profile is sealed")
+
+// sealedCrypt stands in for a crypto profile whose keys are not in the
+// config. Backends hold it like any other profile; it starts working once
+// unseal has built the real layers from key shares.
+type sealedCrypt struct {
+	cfg   config.ConfigCrypto
+	build func(config.ConfigCrypto) (*crypto.MultiLayerCrypt, error)
+	inner atomic.Pointer[crypto.MultiLayerCrypt]
+}
+
+func (c *sealedCrypt) Encrypt(data []byte) ([]byte, error) {
+	return c.EncryptContext(context.Background(), data)
+}
+
+func (c *sealedCrypt) Decrypt(data []byte) ([]byte, error) {
+	return c.DecryptContext(context.Background(), data)
+}
+
+func (c *sealedCrypt) EncryptContext(ctx context.Context, data []byte) ([]byte, error) {
+	inner := c.inner.Load()
+	if inner == nil {
+		return nil, errSealed
+	}
+	return inner.EncryptContext(ctx, data)
+}
+
+func (c *sealedCrypt) DecryptContext(ctx context.Context, data []byte) ([]byte, error) {
+	inner := c.inner.Load()
+	if inner == nil {
+		return nil, errSealed
+	}
+	return inner.DecryptContext(ctx, data)
+}
+
+func (c *sealedCrypt) Padding() *crypto.Padding {
+	if inner := c.inner.Load(); inner != nil {
+		return inner.Padding()
+	}
+	return nil
+}
+
+func (c *sealedCrypt) sealed() bool {
+	return c.inner.Load() == nil
+}
+
+// unseal builds the profile's layers with the keys of bundle, which must
+// have one for every layer that takes a keyset.
+func (c *sealedCrypt) unseal(bundle *escrow.Bundle) error {
+	keys := make(map[int]escrow.Key, len(bundle.Keys))
+	for _, key := range bundle.Keys {
+		keys[key.Layer] = key
+	}
+	cfg := c.cfg
+	cfg.Layers = append([]config.ConfigCryptoLayer(nil), c.cfg.Layers...)
+	for i, layer := range cfg.Layers {
+		key, ok := keys[i]
+		if !ok {
+			continue
+		}
+		if key.Algorithm != layer.Algorithm {
+			return fmt.Errorf("key shares hold a key for %s in layer %d, which is %s", key.Algorithm, i, layer.Algorithm)
+		}
+		cfg.Layers[i].Keyset = &config.MultiSourceString{Data: key.Keyset}
+		delete(keys, i)
+	}
+	if len(keys) > 0 {
+		return errors.New("key shares hold keys for layers the crypto does not have")
+	}
+	inner, err := c.build(cfg)
+	if err != nil {
+		return err
+	}
+	c.inner.Store(inner)
+	return nil
+}
+
+// keyShares collects shares submitted to unseal crypto profiles. It
+// outlives configuration reloads, so the keys it recovered unseal the
+// profiles of every later configuration too.
+type keyShares struct {
+	collector *escrow.Collector
+
+	mu      sync.Mutex
+	bundles map[string]*escrow.Bundle // crypto ID -> recovered keys
+}
+
+func newKeyShares() *keyShares {
+	return &keyShares{collector: escrow.NewCollector(), bundles: make(map[string]*escrow.Bundle)}
+}
+
+// isSealed reports whether any crypto profile still waits for its keys.
+func (p *Proxy) isSealed() bool {
+	for _, c := range p.sealed {
+		if c.sealed() {
+			return true
+		}
+	}
+	return false
+}
+
+// unsealRecovered unseals the profiles whose keys were recovered under an
+// earlier configuration.
+func (p *Proxy) unsealRecovered() {
+	p.keyShares.mu.Lock()
+	defer p.keyShares.mu.Unlock()
+	for id, bundle := range p.keyShares.bundles {
+		c := p.sealed[id]
+		if c == nil {
+			continue
+		}
+		if err := c.unseal(bundle); err != nil {
+			slog.Error("cannot unseal crypto with the keys recovered earlier, submit its shares again", "crypto_id", id, "error", err)
+			delete(p.keyShares.bundles, id)
+		}
+	}
+}
+
+// submitShare adds a share and unseals its profile once the share
+// completes a split. It returns the crypto ID it unsealed, if any.
+func (p *Proxy) submitShare(share *escrow.Share) (string, error) {
+	bundle, status, err := p.keyShares.collector.Add(share)
+	if err != nil {
+		return "", fmt.Errorf("split %s: %w", status.ID, err)
+	}
+	if bundle == nil {
+		return "", nil
+	}
+	c := p.sealed[bundle.CryptoID]
+	if c == nil {
+		return "", fmt.Errorf("split %s holds the keys of crypto %q, which is not sealed", status.ID, bundle.CryptoID)
+	}
+	if err := c.unseal(bundle); err != nil {
+		return "", fmt.Errorf("crypto %s: %w", bundle.CryptoID, err)
+	}
+	p.keyShares.mu.Lock()
+	p.keyShares.bundles[bundle.CryptoID] = bundle
+	p.keyShares.mu.Unlock()
+	slog.Info("crypto unsealed", "crypto_id", bundle.CryptoID, "split", status.ID, "sealed", p.isSealed())
+	return bundle.CryptoID, nil
+}
+
+type sealView struct {
+	Sealed   bool                 `json:"sealed"`
+	Crypto   map[string]bool      `json:"crypto"` // crypto ID -> still sealed
+	Pending  []escrow.SplitStatus `json:"pending"`
+	Unsealed []string             `json:"unsealed,omitempty"`
+}
+
+func (p *Proxy) sealStatus() sealView {
+	view := sealView{Sealed: p.isSealed(), Crypto: make(map[string]bool), Pending: p.keyShares.collector.Pending()}
+	for id, c := range p.sealed {
+		view.Crypto[id] = c.sealed()
+	}
+	sort.Slice(view.Pending, func(a, b int) bool { return view.Pending[a].ID < view.Pending[b].ID })
+	return view
+}
+
+func (p *Proxy) adminSeal(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, p.sealStatus())
+}
+
+// adminUnseal takes key shares, one per line of the request body.
+func (p *Proxy) adminUnseal(w http.ResponseWriter, r *http.Request) {
+	var shares []*escrow.Share
+	scanner := bufio.NewScanner(io.LimitReader(r.Body, 1<<20))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		share, err := escrow.ParseShare(line)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		shares = append(shares, share)
+	}
+	if len(shares) == 0 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("no key shares in the request body"))
+		return
+	}
+
+	var unsealed []string
+	for _, share := range shares {
+		id, err := p.submitShare(share)
+		if err != nil {
+			slog.WarnContext(r.Context(), "unseal failed", "error", err)
+			writeJSONError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if id != "" {
+			unsealed = append(unsealed, id)
+		}
+	}
+	view := p.sealStatus()
+	view.Unsealed = unsealed
+	writeJSON(w, http.StatusOK, view)
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"s3-proxy/internal/crypto"
+)
+
+// SSE-C request and response headers.
+const (
+	sseCustomerAlgorithm = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	sseCustomerKey       = "X-Amz-Server-Side-Encryption-Customer-Key"
+	sseCustomerKeyMD5    = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+)
+
+// metaCustomerKey records the fingerprint of the SSE-C key an object was
+// written with.
+const metaCustomerKey = metaPrefix + "ssec"
+
+// errCustomerKeyRequired is returned by background jobs for objects they
+// cannot read because only the client holds the key.
+var errCustomerKeyRequired = errors.New("object is encrypted with a customer-provided key")
+
+// requestError is a client error with the S3 code to report it with.
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string { return e.message }
+
+func (e *requestError) write(w http.ResponseWriter, r *http.Request) {
+	writeS3Error(w, r, e.status, e.code, e.message)
+}
+
+var (
+	errSSECAlgorithm = &requestError{http.StatusBadRequest, "InvalidArgument",
+		"Requests specifying Server Side Encryption with Customer provided keys must provide a valid encryption algorithm."}
+	errSSECKey = &requestError{http.StatusBadRequest, "InvalidArgument",
+		"The secret key was invalid for the specified algorithm."}
+	errSSECKeyMD5 = &requestError{http.StatusBadRequest, "InvalidArgument",
+		"The calculated MD5 hash of the key did not match the hash that was provided."}
+	errSSECMissing = &requestError{http.StatusBadRequest, "InvalidRequest",
+		"The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object."}
+	errSSECNotApplicable = &requestError{http.StatusBadRequest, "InvalidRequest",
+		"The encryption parameters are not applicable to this object."}
+	errSSECMismatch = &requestError{http.StatusForbidden, "AccessDenied",
+		"Access Denied"}
+	errSSECInsecure = &requestError{http.StatusBadRequest, "InvalidRequest",
+		"Requests specifying Server Side Encryption with Customer provided keys must be made over a secure connection."}
+)
+
+// customerKey is an SSE-C key supplied with a request. It becomes the
+// outermost encryption layer of the object, so neither the backend nor the
+// proxy operator can read the object without it.
+type customerKey struct {
+	layer crypto.Crypt
+	md5   string
+	// fingerprint identifies the key in object metadata without
+	// revealing it.
+	fingerprint string
+}
+
+// parseCustomerKey reads the SSE-C headers of r. It returns nil without an
+// error when the request carries none.
+func parseCustomerKey(r *http.Request) (*customerKey, error) {
+	algorithm := r.Header.Get(sseCustomerAlgorithm)
+	encoded := r.Header.Get(sseCustomerKey)
+	keyMD5 := r.Header.Get(sseCustomerKeyMD5)
+	if algorithm == "" && encoded == "" && keyMD5 == "" {
+		return nil, nil
+	}
+	if algorithm != "AES256" {
+		return nil, errSSECAlgorithm
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errSSECKey
+	}
+	sum := md5.Sum(key)
+	if keyMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, errSSECKeyMD5
+	}
+	layer, err := crypto.NewAESCrypt(encoded)
+	if err != nil {
+		return nil, errSSECKey
+	}
+	fingerprint := sha256.Sum256(append([]byte("s3-proxy sse-c\x00"), key...))
+	return &customerKey{
+		layer:       layer,
+		md5:         keyMD5,
+		fingerprint: base64.StdEncoding.EncodeToString(fingerprint[:]),
+	}, nil
+}
+
+// customerKey is parseCustomerKey for requests that reached the proxy over
+// TLS. A key sent in the clear is refused, as S3 does, rather than used.
+func (p *Proxy) customerKey(r *http.Request) (*customerKey, error) {
+	key, err := parseCustomerKey(r)
+	if err != nil || key == nil {
+		return key, err
+	}
+	if r.TLS == nil && !(p.trustProto && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")) {
+		return nil, errSSECInsecure
+	}
+	return key, nil
+}
+
+// check reports whether k opens an object with the given metadata. k may
+// be nil.
+func (k *customerKey) check(meta map[string]string) error {
+	stored := meta[metaCustomerKey]
+	switch {
+	case stored == "" && k == nil:
+		return nil
+	case stored == "":
+		return errSSECNotApplicable
+	case k == nil:
+		return errSSECMissing
+	case subtle.ConstantTimeCompare([]byte(stored), []byte(k.fingerprint)) != 1:
+		return errSSECMismatch
+	}
+	return nil
+}
+
+// apply returns a copy of backend that adds the customer key as the
+// outermost layer of whichever profile an object uses.
+func (k *customerKey) apply(backend *s3Backend) *s3Backend {
+	if k == nil {
+		return backend
+	}
+	b := *backend
+	b.customer = k.layer
+	return &b
+}
+
+// writeHeaders echoes the SSE-C parameters, as S3 does on every response
+// for such an object.
+func (k *customerKey) writeHeaders(w http.ResponseWriter) {
+	if k == nil {
+		return
+	}
+	w.Header().Set(sseCustomerAlgorithm, "AES256")
+	w.Header().Set(sseCustomerKeyMD5, k.md5)
+}
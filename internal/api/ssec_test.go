@@ -0,0 +1,166 @@
+package api
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func customerKeyHeaders(key []byte) http.Header {
+	sum := md5.Sum(key)
+	h := http.Header{}
+	h.Set(sseCustomerAlgorithm, "AES256")
+	h.Set(sseCustomerKey, base64.StdEncoding.EncodeToString(key))
+	h.Set(sseCustomerKeyMD5, base64.StdEncoding.EncodeToString(sum[:]))
+	return h
+}
+
+func mustCustomerKey(t *testing.T, key []byte) *customerKey {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/b/k", nil)
+	r.Header = customerKeyHeaders(key)
+	k, err := parseCustomerKey(r)
+	if err != nil || k == nil {
+		t.Fatalf("parse: %v, %v", k, err)
+	}
+	return k
+}
+
+func TestParseCustomerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	k := mustCustomerKey(t, key)
+	plain := []byte("customer data")
+	sealed, err := k.layer.Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := mustCustomerKey(t, key).layer.Decrypt(sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("round trip: %q, %v", got, err)
+	}
+	if k.fingerprint == "" || k.fingerprint == mustCustomerKey(t, bytes.Repeat([]byte{2}, 32)).fingerprint {
+		t.Fatal("fingerprint does not identify the key")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/b/k", nil)
+	if k, err := parseCustomerKey(r); k != nil || err != nil {
+		t.Fatalf("no headers: %v, %v", k, err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(http.Header)
+		want   error
+	}{
+		{"algorithm", func(h http.Header) { h.Set(sseCustomerAlgorithm, "AES128") }, errSSECAlgorithm},
+		{"no algorithm", func(h http.Header) { h.Del(sseCustomerAlgorithm) }, errSSECAlgorithm},
+		{"short key", func(h http.Header) {
+			h.Set(sseCustomerKey, base64.StdEncoding.EncodeToString(key[:16]))
+		}, errSSECKey},
+		{"not base64", func(h http.Header) { h.Set(sseCustomerKey, "%%%") }, errSSECKey},
+		{"no key", func(h http.Header) { h.Del(sseCustomerKey) }, errSSECKey},
+		{"md5 mismatch", func(h http.Header) {
+			sum := md5.Sum(bytes.Repeat([]byte{2}, 32))
+			h.Set(sseCustomerKeyMD5, base64.StdEncoding.EncodeToString(sum[:]))
+		}, errSSECKeyMD5},
+		{"no md5", func(h http.Header) { h.Del(sseCustomerKeyMD5) }, errSSECKeyMD5},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/b/k", nil)
+		r.Header = customerKeyHeaders(key)
+		tc.modify(r.Header)
+		if _, err := parseCustomerKey(r); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestCustomerKeyCheck(t *testing.T) {
+	k := mustCustomerKey(t, bytes.Repeat([]byte{1}, 32))
+	other := mustCustomerKey(t, bytes.Repeat([]byte{2}, 32))
+	sealed := map[string]string{metaCustomerKey: k.fingerprint}
+
+	for _, tc := range []struct {
+		name   string
+		key    *customerKey
+		meta   map[string]string
+		status int
+	}{
+		{"plain object, no key", nil, nil, http.StatusOK},
+		{"sealed object, its key", k, sealed, http.StatusOK},
+		{"plain object, a key", k, nil, http.StatusBadRequest},
+		{"sealed object, no key", nil, sealed, http.StatusBadRequest},
+		{"sealed object, another key", other, sealed, http.StatusForbidden},
+	} {
+		status := http.StatusOK
+		if err := tc.key.check(tc.meta); err != nil {
+			re, ok := err.(*requestError)
+			if !ok {
+				t.Fatalf("%s: %v is not a request error", tc.name, err)
+			}
+			status = re.status
+		}
+		if status != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, status, tc.status)
+		}
+	}
+}
+
+func TestCustomerKeyHeaders(t *testing.T) {
+	k := mustCustomerKey(t, bytes.Repeat([]byte{1}, 32))
+	w := httptest.NewRecorder()
+	k.writeHeaders(w)
+	if w.Header().Get(sseCustomerAlgorithm) != "AES256" || w.Header().Get(sseCustomerKeyMD5) != k.md5 {
+		t.Fatalf("headers %v", w.Header())
+	}
+	if w.Header().Get(sseCustomerKey) != "" {
+		t.Fatal("key echoed")
+	}
+
+	backend := &s3Backend{}
+	if (*customerKey)(nil).apply(backend) != backend {
+		t.Fatal("nil key copied the backend")
+	}
+	if got := k.apply(backend); got == backend || got.customer != k.layer || backend.customer != nil {
+		t.Fatal("key not applied to a copy")
+	}
+}
+
+func TestCustomerKeyNeedsTLS(t *testing.T) {
+	fake := newFakeS3(t)
+	p := newTestProxy(t, testConfig(t, fake))
+	header := customerKeyHeaders(bytes.Repeat([]byte{1}, 32))
+	data := randomBody(t, 100)
+
+	w := serve(p, http.MethodPut, "/vb/k", data, header)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "<Code>InvalidRequest</Code>") {
+		t.Fatalf("put over HTTP: %d %s", w.Code, w.Body)
+	}
+	if fake.object("data", "k") != nil {
+		t.Fatal("stored an object under a key sent in the clear")
+	}
+	if w := serve(p, http.MethodPut, "https://proxy/vb/k", data, header); w.Code != http.StatusOK {
+		t.Fatalf("put over HTTPS: %d %s", w.Code, w.Body)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if w := serve(p, method, "/vb/k", nil, header); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s over HTTP: %d", method, w.Code)
+		}
+	}
+
+	// Behind a TLS terminator the forwarded scheme counts, once trusted.
+	header.Set("X-Forwarded-Proto", "https")
+	if w := serve(p, http.MethodGet, "/vb/k", nil, header); w.Code != http.StatusBadRequest {
+		t.Fatalf("untrusted forwarded proto: %d", w.Code)
+	}
+	p.trustProto = true
+	if w := serve(p, http.MethodGet, "/vb/k", nil, header); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("trusted forwarded proto: %d", w.Code)
+	}
+	header.Set("X-Forwarded-Proto", "http")
+	if w := serve(p, http.MethodGet, "/vb/k", nil, header); w.Code != http.StatusBadRequest {
+		t.Fatalf("forwarded plain HTTP: %d", w.Code)
+	}
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"s3-proxy/internal/crypto"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// metaSealed holds the encrypted user metadata of an object, or
+	// sealedSidecar and a nonce when it did not fit and was stored in a
+	// sidecar object.
+	metaSealed    = metaPrefix + "meta"
+	sealedSidecar = "sidecar:"
+	// sidecarPrefix is where sidecar objects are stored on the backend.
+	// Clients cannot write below it and listings hide it.
+	sidecarPrefix = ".s3proxy-meta/"
+	// maxUserMetadata is the S3 limit on user metadata: the summed length
+	// of all names and values.
+	maxUserMetadata = 2048
+)
+
+// sealedMetadata is the plaintext of a sealed metadata blob. The key binds
+// the blob to its object, so it cannot be moved onto another one. A sidecar
+// also carries the nonce written into its object, so a sidecar left by a
+// concurrent PUT of the same key is not taken for this object's.
+type sealedMetadata struct {
+	Key      string            `json:"key"`
+	Nonce    string            `json:"nonce,omitempty"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// metadataSize returns the size S3 counts against maxUserMetadata.
+func metadataSize(meta map[string]string) int {
+	size := 0
+	for name, value := range meta {
+		size += len(name) + len(value)
+	}
+	return size
+}
+
+func sidecarKey(objectKey string) string {
+	return sidecarPrefix + objectKey
+}
+
+// newNonce returns a random value that ties a sidecar to the write of its
+// object.
+func newNonce() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// sidecarPrefixes returns the prefixes the backend keeps sidecar objects
+// under: object info always, user metadata when it is sealed.
+func (b *s3Backend) sidecarPrefixes() []string {
+	if b.sealMetadata {
+		return []string{infoSidecarPrefix, sidecarPrefix}
+	}
+	return []string{infoSidecarPrefix}
+}
+
+// isSidecar reports whether a backend key holds a sidecar object rather
+// than a client object.
+func (b *s3Backend) isSidecar(key string) bool {
+	for _, prefix := range b.sidecarPrefixes() {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sealMetadata moves the user entries of meta into one encrypted entry. If
+// the result does not fit next to the entries already in meta it is written
+// to a sidecar object first, so the object never points at a missing
+// sidecar.
+func sealMetadata(ctx context.Context, backend *s3Backend, objectKey string, meta map[string]string) error {
+	user := make(map[string]string)
+	for name, value := range meta {
+		if !isReservedMeta(name) {
+			user[name] = value
+			delete(meta, name)
+		}
+	}
+	if len(user) == 0 {
+		return nil
+	}
+	seal := func(nonce string) ([]byte, error) {
+		plaintext, err := json.Marshal(sealedMetadata{Key: objectKey, Nonce: nonce, Metadata: user})
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := crypto.EncryptContext(ctx, backend.writeCrypto(), plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("sealing metadata: %w", err)
+		}
+		return sealed, nil
+	}
+	sealed, err := seal("")
+	if err != nil {
+		return err
+	}
+	room := maxUserMetadata - metadataSize(meta) - len(metaSealed)
+	if encoded := base64.StdEncoding.EncodeToString(sealed); len(encoded) <= room {
+		meta[metaSealed] = encoded
+		return nil
+	}
+
+	nonce := newNonce()
+	if sealed, err = seal(nonce); err != nil {
+		return err
+	}
+	_, err = backend.s3Client.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &backend.targetBucketName,
+		Key:           s(sidecarKey(objectKey)),
+		Body:          bytes.NewReader(sealed),
+		ContentLength: aws.Int64(int64(len(sealed))),
+	})
+	if err != nil {
+		return fmt.Errorf("writing metadata sidecar: %w", err)
+	}
+	meta[metaSealed] = sealedSidecar + nonce
+	return nil
+}
+
+// openMetadata returns meta with sealed user metadata decrypted back into
+// it. Objects without sealed metadata are returned as is.
+func openMetadata(ctx context.Context, backend *s3Backend, objectKey string, meta map[string]string) (map[string]string, error) {
+	value, ok := meta[metaSealed]
+	if !ok {
+		return meta, nil
+	}
+	c, err := backend.readCrypto(meta)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("sealed metadata on an unencrypted object")
+	}
+	var sealed []byte
+	nonce, sidecar := strings.CutPrefix(value, sealedSidecar)
+	if sidecar {
+		obj, err := backend.s3Client.Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: &backend.targetBucketName,
+			Key:    s(sidecarKey(objectKey)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading metadata sidecar: %w", err)
+		}
+		defer obj.Body.Close()
+		if sealed, err = io.ReadAll(io.LimitReader(obj.Body, maxListingSize)); err != nil {
+			return nil, fmt.Errorf("reading metadata sidecar: %w", err)
+		}
+	} else {
+		var err error
+		if sealed, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("decoding sealed metadata: %w", err)
+		}
+	}
+	plaintext, err := crypto.DecryptContext(ctx, c, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("opening sealed metadata: %w", err)
+	}
+	var opened sealedMetadata
+	if err := json.Unmarshal(plaintext, &opened); err != nil {
+		return nil, fmt.Errorf("decoding sealed metadata: %w", err)
+	}
+	if opened.Key != objectKey {
+		return nil, errors.New("sealed metadata belongs to another object")
+	}
+	if sidecar && opened.Nonce != nonce {
+		return nil, errors.New("metadata sidecar belongs to another write of the object")
+	}
+
+	result := make(map[string]string, len(meta)+len(opened.Metadata))
+	for name, value := range meta {
+		if name != metaSealed {
+			result[name] = value
+		}
+	}
+	for name, value := range opened.Metadata {
+		result[name] = value
+	}
+	return result, nil
+}
+
+// hideSidecars removes the sidecar objects below prefixes from a
+// ListObjects response.
+func hideSidecars(body []byte, prefixes []string) []byte {
+	encoded := bytes.Contains(body, []byte("<EncodingType>url</EncodingType>"))
+	hidden := 0
+	hide := func(block, name string, match func(string) bool) {
+		body = eachElement(body, block, func(content []byte) []byte {
+			if text, ok := elementText(content, name, encoded); ok && match(text) {
+				hidden++
+				return nil
+			}
+			return content
+		})
+	}
+	hide("Contents", "Key", func(key string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+	hide("CommonPrefixes", "Prefix", func(prefix string) bool { return slices.Contains(prefixes, prefix) })
+	if hidden == 0 {
+		return body
+	}
+	return eachElement(body, "KeyCount", func(content []byte) []byte {
+		count, err := strconv.Atoi(string(content))
+		if err != nil {
+			return content
+		}
+		return []byte(strconv.Itoa(count - hidden))
+	})
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func sealingBackend(t *testing.T) (*s3Backend, *fakeS3) {
+	t.Helper()
+	fake := newFakeS3(t)
+	cfg := testConfig(t, fake)
+	cfg.S3Buckets[0].SealMetadata = true
+	return newTestProxy(t, cfg).buckets["vb"].backends[0], fake
+}
+
+func TestSealMetadataInline(t *testing.T) {
+	backend, fake := sealingBackend(t)
+	ctx := context.Background()
+	meta := map[string]string{metaCrypto: "aes", "owner": "alice"}
+	if err := sealMetadata(ctx, backend, "k", meta); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := meta["owner"]; ok || strings.HasPrefix(meta[metaSealed], sealedSidecar) {
+		t.Fatalf("metadata not sealed inline: %v", meta)
+	}
+	if len(fake.keys("data")) != 0 {
+		t.Fatal("sidecar written for small metadata")
+	}
+	opened, err := openMetadata(ctx, backend, "k", meta)
+	if err != nil || opened["owner"] != "alice" || opened[metaCrypto] != "aes" {
+		t.Fatalf("opened %v, %v", opened, err)
+	}
+	if _, err := openMetadata(ctx, backend, "other", meta); err == nil {
+		t.Fatal("opened metadata sealed for another key")
+	}
+}
+
+func TestSealMetadataSpillsNextToProxyEntries(t *testing.T) {
+	backend, fake := sealingBackend(t)
+	ctx := context.Background()
+	// The same user metadata fits alone, but not next to large proxy
+	// entries such as a sealed long key.
+	user := strings.Repeat("v", 900)
+	alone := map[string]string{metaCrypto: "aes", "note": user}
+	if err := sealMetadata(ctx, backend, "k", alone); err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(alone[metaSealed], sealedSidecar) {
+		t.Fatal("small metadata spilled")
+	}
+
+	meta := map[string]string{metaCrypto: "aes", metaInfo: strings.Repeat("i", 800), "note": user}
+	if err := sealMetadata(ctx, backend, "k", meta); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(meta[metaSealed], sealedSidecar) {
+		t.Fatalf("metadata of %d bytes kept inline", metadataSize(meta))
+	}
+	if metadataSize(meta) > maxUserMetadata {
+		t.Fatalf("metadata of %d bytes", metadataSize(meta))
+	}
+	if fake.object("data", sidecarKey("k")) == nil {
+		t.Fatal("no sidecar")
+	}
+	opened, err := openMetadata(ctx, backend, "k", meta)
+	if err != nil || opened["note"] != user {
+		t.Fatalf("opened %v, %v", opened, err)
+	}
+}
+
+func TestSidecarBoundToItsWrite(t *testing.T) {
+	backend, _ := sealingBackend(t)
+	ctx := context.Background()
+	seal := func(value string) map[string]string {
+		meta := map[string]string{metaCrypto: "aes", "note": strings.Repeat(value, 3000)}
+		if err := sealMetadata(ctx, backend, "k", meta); err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+	// Two PUTs of one key race: the second sidecar replaces the first, while
+	// the first object's metadata wins.
+	first, second := seal("a"), seal("b")
+	if first[metaSealed] == second[metaSealed] {
+		t.Fatal("both writes point at the same sidecar nonce")
+	}
+	if _, err := openMetadata(ctx, backend, "k", first); err == nil {
+		t.Fatal("opened another write's sidecar")
+	}
+	if opened, err := openMetadata(ctx, backend, "k", second); err != nil || opened["note"][0] != 'b' {
+		t.Fatalf("opened %v", err)
+	}
+}
+
+func TestSealedMetadataRoundTrip(t *testing.T) {
+	fake := newFakeS3(t)
+	cfg := testConfig(t, fake)
+	cfg.S3Buckets[0].SealMetadata = true
+	p := newTestProxy(t, cfg)
+
+	large := strings.Repeat("x", 1800)
+	header := http.Header{"X-Amz-Meta-Large": {large}, "X-Amz-Meta-Small": {"s"}}
+	if w := serve(p, http.MethodPut, "/vb/dir/obj", []byte("body"), header); w.Code != http.StatusOK {
+		t.Fatalf("put: %d %s", w.Code, w.Body)
+	}
+	stored := fake.object("data", "dir/obj")
+	if stored == nil || stored.meta["large"] != "" || metadataSize(stored.meta) > maxUserMetadata {
+		t.Fatalf("stored metadata %v", stored)
+	}
+	w := serve(p, http.MethodGet, "/vb/dir/obj", nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "body" ||
+		w.Header().Get("X-Amz-Meta-Large") != large || w.Header().Get("X-Amz-Meta-Small") != "s" {
+		t.Fatalf("get: %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// WithCallObserver returns an S3 option that reports the SDK operation name,
+// duration and result of every call made by the client, retries included.
+func WithCallObserver(observe func(operation string, d time.Duration, err error)) func(*s3.Options) {
+	return func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("S3ProxyCallObserver",
+				func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+					start := time.Now()
+					out, md, err := next.HandleInitialize(ctx, in)
+					observe(awsmiddleware.GetOperationName(ctx), time.Since(start), err)
+					return out, md, err
+				}), middleware.After)
+		})
+	}
+}
@@ -18,7 +18,7 @@ type S3 struct {
 	Endpoint string
 }
 
-func NewS3(endpoint, region, accessKey, secretKey string) (*S3, error) {
+func NewS3(endpoint, region, accessKey, secretKey string, optFns ...func(*s3.Options)) (*S3, error) {
 	opts := []func(*config.LoadOptions) error{
 		config.WithRegion(region),
 	}
@@ -33,21 +33,23 @@ func NewS3(endpoint, region, accessKey, secretKey string) (*S3, error) {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
+	base := func(o *s3.Options) {
+		o.UsePathStyle = true // used for MinIO
+		o.BaseEndpoint = aws.String(endpoint)
+		o.Region = region
+
+		// Disable checksums for HTTP endpoints, Storj, and DigitalOcean
+		if strings.HasPrefix(endpoint, "http://") ||
+			strings.Contains(endpoint, "storjshare.io") ||
+			strings.Contains(endpoint, "digitaloceanspaces.com") {
+			o.EndpointOptions.DisableHTTPS = strings.HasPrefix(endpoint, "http://")
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationUnset
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationUnset
+		}
+	}
+
 	return &S3{
-		Client: s3.NewFromConfig(cfg, func(o *s3.Options) {
-			o.UsePathStyle = true // used for MinIO
-			o.BaseEndpoint = aws.String(endpoint)
-			o.Region = region
-
-			// Disable checksums for HTTP endpoints, Storj, and DigitalOcean
-			if strings.HasPrefix(endpoint, "http://") ||
-				strings.Contains(endpoint, "storjshare.io") ||
-				strings.Contains(endpoint, "digitaloceanspaces.com") {
-				o.EndpointOptions.DisableHTTPS = strings.HasPrefix(endpoint, "http://")
-				o.RequestChecksumCalculation = aws.RequestChecksumCalculationUnset
-				o.ResponseChecksumValidation = aws.ResponseChecksumValidationUnset
-			}
-		}),
+		Client:   s3.NewFromConfig(cfg, append([]func(*s3.Options){base}, optFns...)...),
 		Config:   &cfg,
 		Endpoint: endpoint,
 	}, nil
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracer returns an S3 option that wraps every SDK call in a client span
+// tagged with the backend ID, retries included.
+func WithTracer(tracer trace.Tracer, backend string) func(*s3.Options) {
+	return func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("S3ProxyTracer",
+				func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+					operation := awsmiddleware.GetOperationName(ctx)
+					ctx, span := tracer.Start(ctx, "s3."+operation,
+						trace.WithSpanKind(trace.SpanKindClient),
+						trace.WithAttributes(
+							attribute.String("rpc.system", "aws-api"),
+							attribute.String("rpc.service", "S3"),
+							attribute.String("rpc.method", operation),
+							attribute.String("s3proxy.backend", backend),
+						))
+					defer span.End()
+					out, md, err := next.HandleInitialize(ctx, in)
+					if err != nil {
+						span.RecordError(err)
+						span.SetStatus(codes.Error, err.Error())
+					}
+					return out, md, err
+				}), middleware.After)
+		})
+	}
+}
@@ -1,12 +1,108 @@
 // internal/config/config.go
 package config
 
+import "time"
+
 type Config struct {
-	ListenAddr string           `yaml:"listen_addr"`
+	ListenAddr ConfigListeners  `yaml:"listen_addr"`
 	Crypto     []ConfigCrypto   `yaml:"crypto"`
+	KMS        []ConfigKMS      `yaml:"kms"`
 	S3Clients  []ConfigS3Client `yaml:"s3_clients"`
 	S3Buckets  []ConfigS3Bucket `yaml:"s3_buckets"`
 	Auth       ConfigAuth       `yaml:"auth"`
+	Backfill   ConfigBackfill   `yaml:"backfill"`
+	Journal    ConfigJournal    `yaml:"journal"`
+	Upload     ConfigUpload     `yaml:"upload"`
+	Limits     ConfigLimits     `yaml:"limits"`
+	Tracing    ConfigTracing    `yaml:"tracing"`
+	Logging    ConfigLogging    `yaml:"logging"`
+	Reload     ConfigReload     `yaml:"reload"`
+	Server     ConfigServer     `yaml:"server"`
+	Admin      ConfigAdmin      `yaml:"admin"`
+	// WriteOnly refuses object reads and listings, for ingestion proxies
+	// that hold only public keysets and could not decrypt anyway.
+	WriteOnly bool `yaml:"write_only"`
+}
+
+// ConfigReload controls automatic configuration reloads. SIGHUP always
+// triggers a reload.
+type ConfigReload struct {
+	// Watch polls the config file and reloads when it changes.
+	Watch    bool          `yaml:"watch"`
+	Interval time.Duration `yaml:"interval"`
+	// Secrets reloads the config this often so that rotated file, exec and
+	// Vault secrets take effect. Zero disables it.
+	Secrets time.Duration `yaml:"secrets"`
+}
+
+// ConfigLogging controls the proxy's structured log output.
+type ConfigLogging struct {
+	// Level is one of "debug", "info" (default), "warn" or "error".
+	Level string `yaml:"level"`
+	// Format is "json" (default) or "text".
+	Format string `yaml:"format"`
+	// Debug turns on debug logging for matching requests only, whatever
+	// the global level.
+	Debug ConfigLogDebug `yaml:"debug"`
+}
+
+type ConfigLogDebug struct {
+	Buckets []string `yaml:"buckets"`
+	// Users are matched against ConfigUser.Name.
+	Users []string `yaml:"users"`
+}
+
+// ConfigTracing selects where OpenTelemetry spans are exported.
+type ConfigTracing struct {
+	// Exporter is one of "none" (default), "otlp", "file" or "stdout".
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the OTLP/HTTP collector address, e.g. "localhost:4318".
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+	// File receives JSON spans when Exporter is "file".
+	File        string   `yaml:"file"`
+	ServiceName string   `yaml:"service_name"`
+	SampleRatio *float64 `yaml:"sample_ratio"`
+}
+
+// ConfigLimits bounds the memory the proxy may hold for request payloads.
+// Sizes are in bytes.
+type ConfigLimits struct {
+	// MemoryBudget caps payload memory across all in-flight requests;
+	// requests beyond it get 503 SlowDown.
+	MemoryBudget int64 `yaml:"memory_budget"`
+	// MaxObjectSize is the largest object a PUT may store, unless the
+	// bucket sets its own. Zero means no limit.
+	MaxObjectSize int64 `yaml:"max_object_size"`
+}
+
+// ConfigBackfill controls the background job that records plaintext size and
+// checksums on objects written before the proxy stored them.
+type ConfigBackfill struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// ConfigJournal controls where the repair journal of diverged replicas is
+// kept.
+type ConfigJournal struct {
+	// File persists the journal, so divergences survive a restart. Without
+	// it the journal is held in memory only.
+	File string `yaml:"file"`
+}
+
+// ConfigUpload tunes the streaming PUT pipeline. Sizes are in bytes; zero
+// values fall back to the defaults.
+type ConfigUpload struct {
+	// SegmentSize is the plaintext size of each encrypted stream segment.
+	SegmentSize int `yaml:"segment_size"`
+	// Window is how far a backend may fall behind the fastest one.
+	Window int `yaml:"window"`
+	// StallTimeout is how long the others wait for a backend that has used
+	// up its window before it is dropped from the upload.
+	StallTimeout time.Duration `yaml:"stall_timeout"`
+	// PartSize is the multipart upload part size used for large objects.
+	PartSize int64 `yaml:"part_size"`
 }
 
 type ConfigAuth struct {
@@ -15,12 +111,46 @@ type ConfigAuth struct {
 }
 
 type ConfigUser struct {
+	// Name identifies the user in logs instead of the access key.
+	Name      string            `yaml:"name"`
 	AccessKey MultiSourceString `yaml:"access_key"`
 }
 
 type ConfigS3Bucket struct {
-	BucketName string                  `yaml:"bucket_name"`
-	Backends   []ConfigS3BucketBackend `yaml:"backends"`
+	BucketName    string                  `yaml:"bucket_name"`
+	Backends      []ConfigS3BucketBackend `yaml:"backends"`
+	MaxObjectSize int64                   `yaml:"max_object_size"`
+	// KeyEncryption hides object keys from the backends.
+	KeyEncryption *ConfigKeyEncryption `yaml:"key_encryption"`
+	// SealMetadata stores user metadata encrypted with each backend's
+	// crypto profile instead of as plain x-amz-meta-* entries.
+	SealMetadata bool `yaml:"seal_metadata"`
+	// CryptoRules choose the crypto profile of new objects. The first
+	// matching rule wins; objects matching none use each backend's
+	// crypto_id.
+	CryptoRules []ConfigCryptoRule `yaml:"crypto_rules"`
+}
+
+// ConfigCryptoRule matches objects by key, size and content type. Every set
+// condition must hold. Sizes only match uploads that declare their length,
+// and ContentType may end in "/*" to match a whole media type. CryptoID
+// "none" stores matching objects unencrypted.
+type ConfigCryptoRule struct {
+	Prefix      string `yaml:"prefix"`
+	Suffix      string `yaml:"suffix"`
+	MinSize     int64  `yaml:"min_size"`
+	MaxSize     int64  `yaml:"max_size"`
+	ContentType string `yaml:"content_type"`
+	CryptoID    string `yaml:"crypto_id"`
+}
+
+// ConfigKeyEncryption selects how object keys are stored. In "siv" mode
+// every "/" separated segment is encrypted with AES-SIV and listings decrypt
+// it again. In "hmac" mode segments are replaced by an HMAC and the key is
+// kept sealed in the object metadata. Key is a base64 encoded 64 byte key.
+type ConfigKeyEncryption struct {
+	Mode string            `yaml:"mode"`
+	Key  MultiSourceString `yaml:"key"`
 }
 
 type ConfigS3BucketBackend struct {
@@ -1,13 +1,143 @@
 // internal/config/config_crypto.go
 package config
 
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"s3-proxy/internal/crypto"
+)
+
 type ConfigCrypto struct {
 	ID     string              `yaml:"id"`
 	Layers []ConfigCryptoLayer `yaml:"layers"`
+	// Sealed profiles have no keysets in the config. The proxy starts
+	// sealed and refuses requests until enough Shamir shares of the keys
+	// are submitted through the admin API.
+	Sealed bool `yaml:"sealed"`
 }
 
 type ConfigCryptoLayer struct {
 	Algorithm string             `yaml:"algorithm"`
 	Keyset    *MultiSourceString `yaml:"keyset"`
 	Params    map[string]string `yaml:"params"` 
+	// KMS is the ID of a ConfigKMS. The "kms" algorithm wraps its data keys
+	// with it, and a "tink" keyset is read as encrypted by it.
+	KMS string `yaml:"kms"`
+	// Passphrase derives the key of a layer that takes a raw key from a
+	// passphrase, or opens a keyset wrapped with one.
+	Passphrase *ConfigPassphrase `yaml:"passphrase"`
+}
+
+// ConfigPassphrase is a passphrase stretched with Argon2id. With a Salt
+// the layer's key is derived from the passphrase and the layer has no
+// keyset; without one the layer's keyset was wrapped with the passphrase
+// by "s3-proxy keys wrap" and holds its own parameters.
+type ConfigPassphrase struct {
+	Secret MultiSourceString `yaml:"secret"`
+	// Salt and Check are base64. Check tells a wrong passphrase from the
+	// right one at startup, instead of at the first read.
+	Salt  string `yaml:"salt"`
+	Check string `yaml:"check"`
+	// Time, Memory (in KiB) and Threads are the Argon2id costs. They are
+	// part of the key and must not change once data is written with it.
+	Time    uint32 `yaml:"time"`
+	Memory  uint32 `yaml:"memory"`
+	Threads uint8  `yaml:"threads"`
+}
+
+// Derived reports whether the passphrase derives the key rather than
+// unwrapping a keyset.
+func (p *ConfigPassphrase) Derived() bool {
+	return p != nil && p.Salt != ""
+}
+
+// Key returns the key of a layer as its algorithm takes it: the keyset,
+// the keyset unwrapped with the passphrase, or the key derived from it.
+func (l ConfigCryptoLayer) Key() (string, error) {
+	pp := l.Passphrase
+	if pp.Derived() {
+		if l.Keyset != nil {
+			return "", errors.New("a layer with a passphrase salt derives its key and takes no keyset")
+		}
+		salt, err := base64.StdEncoding.DecodeString(pp.Salt)
+		if err != nil {
+			return "", errors.New("passphrase salt is not valid base64")
+		}
+		check, err := base64.StdEncoding.DecodeString(pp.Check)
+		if err != nil || len(check) == 0 {
+			return "", errors.New("passphrase check is missing or not valid base64")
+		}
+		secret, err := pp.secret()
+		if err != nil {
+			return "", err
+		}
+		return crypto.DeriveKey(secret, salt, check, crypto.Argon2Params{Time: pp.Time, Memory: pp.Memory, Threads: pp.Threads})
+	}
+	if l.Keyset == nil {
+		return "", errors.New("no keyset configured")
+	}
+	keyset, err := l.Keyset.Get()
+	if err != nil {
+		return "", fmt.Errorf("keyset: %w", err)
+	}
+	if pp == nil {
+		return keyset, nil
+	}
+	secret, err := pp.secret()
+	if err != nil {
+		return "", err
+	}
+	return crypto.UnwrapKeyset(keyset, secret)
+}
+
+func (p *ConfigPassphrase) secret() (string, error) {
+	secret, err := p.Secret.Get()
+	if err != nil {
+		return "", fmt.Errorf("passphrase: %w", err)
+	}
+	if secret == "" {
+		return "", errors.New("passphrase is empty")
+	}
+	return secret, nil
+}
+
+// ConfigKMS is an external key management service holding a master key
+// that never leaves it. The proxy only asks it to wrap and unwrap data
+// keys.
+type ConfigKMS struct {
+	ID string `yaml:"id"`
+	// Provider is "aws" (AWS KMS or a compatible API), "vault" (Vault
+	// Transit) or "local" (a key from a file, for development only).
+	Provider string `yaml:"provider"`
+	// KeyID is the AWS KMS key ID or ARN, or the Vault Transit key name.
+	KeyID string `yaml:"key_id"`
+
+	// Region, Endpoint, AccessKey and SecretKey configure "aws". Without
+	// keys the default AWS credential chain is used.
+	Region    string            `yaml:"region"`
+	Endpoint  string            `yaml:"endpoint"`
+	AccessKey MultiSourceString `yaml:"access_key"`
+	SecretKey MultiSourceString `yaml:"secret_key"`
+
+	// Address, Token, Namespace and Mount configure "vault". Address and
+	// Token default to $VAULT_ADDR and $VAULT_TOKEN, Mount to "transit".
+	Address   string            `yaml:"address"`
+	Token     MultiSourceString `yaml:"token"`
+	Namespace string            `yaml:"namespace"`
+	Mount     string            `yaml:"mount"`
+
+	// Key is the base64 AES-256 master key of "local".
+	Key MultiSourceString `yaml:"key"`
+
+	// CacheTTL is how long an unwrapped data key is kept in memory, 1h by
+	// default; CacheSize caps how many are, 1000 by default. A negative
+	// CacheSize disables the cache.
+	CacheTTL  time.Duration `yaml:"cache_ttl"`
+	CacheSize int           `yaml:"cache_size"`
+	// DataKeyTTL is how long the kms layer encrypts with one data key
+	// before asking for a new one, 1h by default.
+	DataKeyTTL time.Duration `yaml:"data_key_ttl"`
 }
@@ -0,0 +1,101 @@
+// internal/config/config_server.go
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigServer sets the HTTP server timeouts. Zero read and write timeouts
+// mean none, which large streaming uploads and downloads rely on.
+type ConfigServer struct {
+	// TrustForwardedProto counts requests with "X-Forwarded-Proto: https"
+	// as made over TLS. Only set it behind a TLS terminator that overwrites
+	// the header, since SSE-C keys are refused over plain HTTP.
+	TrustForwardedProto bool `yaml:"trust_forwarded_proto"`
+
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGTERM before their connections are closed.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// ConfigAdmin describes the admin listener, which serves health checks,
+// metrics and the admin API away from the data port.
+type ConfigAdmin struct {
+	ListenAddr ConfigListeners `yaml:"listen_addr"`
+	// Token is the bearer token for the admin API. Without it only the
+	// health check and metrics are served.
+	Token MultiSourceString `yaml:"token"`
+}
+
+// ConfigListener is one address the proxy accepts connections on.
+type ConfigListener struct {
+	// Type is "tcp" (default), "tls" or "unix".
+	Type    string `yaml:"type"`
+	Address string `yaml:"address"`
+	// CertFile and KeyFile are PEM files for "tls". They are re-read when
+	// they change, so certificates can be rotated without a restart.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Mode sets the permissions of a "unix" socket, e.g. "0660".
+	Mode string `yaml:"mode"`
+}
+
+// UnmarshalYAML accepts either a mapping or a plain address string, where
+// "unix:/path" selects a unix socket and anything else is TCP.
+func (l *ConfigListener) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		if path, ok := strings.CutPrefix(node.Value, "unix:"); ok {
+			*l = ConfigListener{Type: "unix", Address: path}
+		} else {
+			*l = ConfigListener{Type: "tcp", Address: node.Value}
+		}
+		return nil
+	}
+	if err := checkFields(node, l); err != nil {
+		return err
+	}
+	type plain ConfigListener
+	if err := node.Decode((*plain)(l)); err != nil {
+		return err
+	}
+	if l.Type == "" {
+		l.Type = "tcp"
+	}
+	return nil
+}
+
+func (l ConfigListener) String() string {
+	return l.Type + ":" + l.Address
+}
+
+// ConfigListeners is a list of listeners. A single address string, as in
+// older configs, is read as a one-element list.
+type ConfigListeners []ConfigListener
+
+func (ls *ConfigListeners) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		var l ConfigListener
+		if err := node.Decode(&l); err != nil {
+			return err
+		}
+		*ls = ConfigListeners{l}
+		return nil
+	case yaml.SequenceNode:
+		var list []ConfigListener
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		*ls = list
+		return nil
+	}
+	return fmt.Errorf("line %d: listen_addr must be an address or a list of listeners", node.Line)
+}
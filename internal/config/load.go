@@ -2,22 +2,48 @@
 package config
 
 import (
-	"io/ioutil"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 
 	"gopkg.in/yaml.v3"
 )
 
-// Load reads YAML config from a path.
+// Load reads YAML config from a path. Unknown fields are rejected and the
+// result must pass Validate; warnings are ignored.
 func Load(path string) (*Config, error) {
-    abs, _ := filepath.Abs(path)
-    b, err := ioutil.ReadFile(abs)
-    if err != nil {
-        return nil, err
-    }
-    var cfg Config
-    if err := yaml.Unmarshal(b, &cfg); err != nil {
-        return nil, err
-    }
-    return &cfg, nil
+	cfg, problems, err := Check(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := problems.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Check reads YAML config from a path like Load, but returns every problem
+// Validate finds, including warnings, instead of failing on them. The
+// error is only set when the file cannot be read or decoded.
+func Check(path string) (*Config, Problems, error) {
+	abs, _ := filepath.Abs(path)
+	b, err := os.ReadFile(abs)
+	if err != nil {
+		return nil, nil, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	secrets.nextLoad()
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, Validate(&cfg, &root), nil
 }
@@ -0,0 +1,229 @@
+// internal/config/secrets.go
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretTimeout bounds each credential helper run and Vault request.
+const secretTimeout = 10 * time.Second
+
+// secrets caches values read from files, commands and Vault. Entries from
+// the current load are always reused, so a Vault secret referenced by
+// several fields is fetched once; older entries are reused until their TTL
+// runs out.
+var secrets = &secretCache{entries: make(map[string]secretEntry)}
+
+type secretCache struct {
+	mu         sync.Mutex
+	generation int
+	entries    map[string]secretEntry
+	// reads holds the reads in progress, so concurrent lookups of a key
+	// share one read and the lock is not held while a source is read.
+	// Sources may resolve other secrets, such as a Vault token.
+	reads map[string]*secretRead
+}
+
+type secretEntry struct {
+	value      string
+	read       time.Time
+	generation int
+}
+
+type secretRead struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// nextLoad starts a new config load. Values read before it are only reused
+// while their TTL lasts.
+func (c *secretCache) nextLoad() {
+	c.mu.Lock()
+	c.generation++
+	c.mu.Unlock()
+}
+
+func (c *secretCache) get(key string, ttl time.Duration, read func() (string, error)) (string, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && (e.generation == c.generation || time.Since(e.read) < ttl) {
+		c.mu.Unlock()
+		return e.value, nil
+	}
+	if r, ok := c.reads[key]; ok {
+		c.mu.Unlock()
+		<-r.done
+		return r.value, r.err
+	}
+	r := &secretRead{done: make(chan struct{})}
+	if c.reads == nil {
+		c.reads = make(map[string]*secretRead)
+	}
+	c.reads[key] = r
+	generation := c.generation
+	c.mu.Unlock()
+
+	r.value, r.err = read()
+
+	c.mu.Lock()
+	delete(c.reads, key)
+	if r.err != nil {
+		delete(c.entries, key)
+	} else {
+		c.entries[key] = secretEntry{value: r.value, read: time.Now(), generation: generation}
+	}
+	c.mu.Unlock()
+	close(r.done)
+	return r.value, r.err
+}
+
+func runSecretCommand(args []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		if msg != "" {
+			return "", fmt.Errorf("secret command %s failed: %w: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("secret command %s failed: %w", args[0], err)
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+// VaultSource names a field of a secret in a Vault KV version 2 engine, or
+// anything serving the same HTTP API.
+type VaultSource struct {
+	// Address defaults to $VAULT_ADDR.
+	Address string `yaml:"address"`
+	// Token defaults to $VAULT_TOKEN.
+	Token     *MultiSourceString `yaml:"token"`
+	Namespace string             `yaml:"namespace"`
+	// Mount is the KV engine's mount path, "secret" by default.
+	Mount string `yaml:"mount"`
+	Path  string `yaml:"path"`
+	Field string `yaml:"field"`
+	// Version pins a secret version; zero means the latest.
+	Version int `yaml:"version"`
+}
+
+func (v *VaultSource) url() (string, error) {
+	address := v.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return "", fmt.Errorf("vault: no address configured and VAULT_ADDR is not set")
+	}
+	mount := v.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	u := strings.TrimSuffix(address, "/") + "/v1/" + strings.Trim(mount, "/") + "/data/" + strings.TrimPrefix(v.Path, "/")
+	if v.Version > 0 {
+		u += "?" + url.Values{"version": {strconv.Itoa(v.Version)}}.Encode()
+	}
+	return u, nil
+}
+
+func (v *VaultSource) get(ttl time.Duration) (string, error) {
+	if v.Path == "" || v.Field == "" {
+		return "", fmt.Errorf("vault: path and field are required")
+	}
+	u, err := v.url()
+	if err != nil {
+		return "", err
+	}
+	data, err := secrets.getJSON("vault:"+v.Namespace+":"+u, ttl, v.read)
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[v.Field]
+	if !ok {
+		return "", fmt.Errorf("vault: secret %s has no field %s", v.Path, v.Field)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("vault: field %s of secret %s is not a string", v.Field, v.Path)
+	}
+	return s, nil
+}
+
+// read fetches the whole secret, so that other fields of it are served
+// from the cache.
+func (v *VaultSource) read() (string, error) {
+	u, err := v.url()
+	if err != nil {
+		return "", err
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if v.Token != nil && v.Token.IsSet() {
+		if token, err = v.Token.Get(); err != nil {
+			return "", fmt.Errorf("vault token: %w", err)
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("vault: no token configured and VAULT_TOKEN is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("vault: secret %s not found", v.Path)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("vault: reading secret %s: %s", v.Path, resp.Status)
+	}
+	var body struct {
+		Data struct {
+			Data json.RawMessage `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault: decoding secret %s: %w", v.Path, err)
+	}
+	if len(body.Data.Data) == 0 || string(body.Data.Data) == "null" {
+		return "", fmt.Errorf("vault: secret %s has no data, it may be deleted", v.Path)
+	}
+	return string(body.Data.Data), nil
+}
+
+// getJSON is get for sources that return a JSON object of fields.
+func (c *secretCache) getJSON(key string, ttl time.Duration, read func() (string, error)) (map[string]any, error) {
+	raw, err := c.get(key, ttl, read)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	return fields, nil
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeSecret(t *testing.T, path, value string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(value), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustGet(t *testing.T, m MultiSourceString) string {
+	t.Helper()
+	value, err := m.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	writeSecret(t, path, "one\r\n")
+	m := MultiSourceString{File: path}
+	if got := mustGet(t, m); got != "one" {
+		t.Fatalf("got %q", got)
+	}
+	// Within one load a file is read once.
+	writeSecret(t, path, "two")
+	if got := mustGet(t, m); got != "one" {
+		t.Fatalf("re-read within a load: %q", got)
+	}
+	secrets.nextLoad()
+	if got := mustGet(t, m); got != "two" {
+		t.Fatalf("not re-read on the next load: %q", got)
+	}
+
+	if _, err := (MultiSourceString{File: filepath.Join(t.TempDir(), "missing")}).Get(); err == nil {
+		t.Fatal("read a missing file")
+	}
+}
+
+func TestSecretTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	writeSecret(t, path, "one")
+	long := MultiSourceString{File: path, TTL: time.Hour}
+	mustGet(t, long)
+	writeSecret(t, path, "two")
+	secrets.nextLoad()
+	if got := mustGet(t, long); got != "one" {
+		t.Fatalf("value not reused within its TTL: %q", got)
+	}
+
+	short := MultiSourceString{File: path + "-short", TTL: time.Millisecond}
+	writeSecret(t, short.File, "one")
+	mustGet(t, short)
+	writeSecret(t, short.File, "two")
+	time.Sleep(5 * time.Millisecond)
+	secrets.nextLoad()
+	if got := mustGet(t, short); got != "two" {
+		t.Fatalf("value reused after its TTL: %q", got)
+	}
+
+	// A failed read is not cached.
+	os.Remove(short.File)
+	time.Sleep(5 * time.Millisecond)
+	secrets.nextLoad()
+	if _, err := short.Get(); err == nil {
+		t.Fatal("read a removed file")
+	}
+	writeSecret(t, short.File, "three")
+	if got := mustGet(t, short); got != "three" {
+		t.Fatalf("error cached: %q", got)
+	}
+}
+
+func TestSecretExec(t *testing.T) {
+	if got := mustGet(t, MultiSourceString{Exec: []string{"sh", "-c", "echo s3cret"}}); got != "s3cret" {
+		t.Fatalf("got %q", got)
+	}
+	_, err := (MultiSourceString{Exec: []string{"sh", "-c", "echo denied >&2; exit 3"}}).Get()
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("failing command: %v", err)
+	}
+	if _, err := (MultiSourceString{Exec: []string{"/nonexistent/helper"}}).Get(); err == nil {
+		t.Fatal("ran a missing command")
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	t.Setenv("S3_PROXY_TEST_SECRET", "from env")
+	if got := mustGet(t, MultiSourceString{EnvVar: "S3_PROXY_TEST_SECRET"}); got != "from env" {
+		t.Fatalf("got %q", got)
+	}
+	if _, err := (MultiSourceString{EnvVar: "S3_PROXY_TEST_UNSET"}).Get(); err == nil {
+		t.Fatal("read an unset variable")
+	}
+	if got := mustGet(t, MultiSourceString{}); got != "" {
+		t.Fatalf("unset source: %q", got)
+	}
+}
+
+// vaultServer serves KV version 2 secrets to requests with the token.
+func vaultServer(t *testing.T, token string, stored map[string]map[string]any) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var reads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads.Add(1)
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, ok := stored[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": data}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &reads
+}
+
+func TestSecretVault(t *testing.T) {
+	srv, reads := vaultServer(t, "root-token", map[string]map[string]any{
+		"app":   {"user": "alice", "password": "pw", "port": 5432},
+		"token": {"value": "root-token"},
+	})
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeSecret(t, tokenFile, "root-token\n")
+	vault := func(path, field string, token *MultiSourceString) MultiSourceString {
+		return MultiSourceString{Vault: &VaultSource{Address: srv.URL, Token: token, Path: path, Field: field}}
+	}
+
+	// The token comes from a file, itself read through the secret cache.
+	fileToken := &MultiSourceString{File: tokenFile}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if got := mustGet(t, vault("app", "password", fileToken)); got != "pw" {
+			t.Errorf("got %q", got)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("vault secret with a file token never returned")
+	}
+	// Other fields of the secret come from the cache.
+	if got := mustGet(t, vault("app", "user", fileToken)); got != "alice" || reads.Load() != 1 {
+		t.Fatalf("second field: %q after %d reads", got, reads.Load())
+	}
+
+	// The token can itself be a Vault secret.
+	t.Setenv("VAULT_TOKEN", "root-token")
+	vaultToken := &MultiSourceString{Vault: &VaultSource{Address: srv.URL, Path: "token", Field: "value"}}
+	secrets.nextLoad()
+	if got := mustGet(t, vault("app", "password", vaultToken)); got != "pw" {
+		t.Fatalf("vault token: %q", got)
+	}
+
+	for _, tc := range []struct {
+		name string
+		m    MultiSourceString
+		want string
+	}{
+		{"missing secret", vault("nope", "x", fileToken), "not found"},
+		{"missing field", vault("app", "email", fileToken), "no field"},
+		{"not a string", vault("app", "port", fileToken), "not a string"},
+		{"wrong token", vault("app", "user", &MultiSourceString{Data: "guess"}), "403"},
+		{"no path", vault("", "user", fileToken), "required"},
+	} {
+		secrets.nextLoad()
+		if _, err := tc.m.Get(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+
+	t.Setenv("VAULT_TOKEN", "")
+	secrets.nextLoad()
+	if _, err := vault("app", "user", nil).Get(); err == nil || !strings.Contains(err.Error(), "no token") {
+		t.Fatalf("no token: %v", err)
+	}
+}
@@ -1,19 +1,75 @@
 // internal/config/types.go
 package config
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
 
+// MultiSourceString is a config value, usually a secret, that can be given
+// inline or read from the environment, a file, a command or Vault. Exactly
+// one source should be set.
 type MultiSourceString struct {
 	Data   string `yaml:"data"`
 	EnvVar string `yaml:"env_var"`
+	// File is read whole, without a trailing newline. It suits Docker and
+	// Kubernetes secret mounts.
+	File string `yaml:"file"`
+	// Exec runs a credential helper and uses its standard output, without
+	// a trailing newline. The first element is the program.
+	Exec []string `yaml:"exec"`
+	// Vault reads a field of a Vault KV version 2 secret.
+	Vault *VaultSource `yaml:"vault"`
+	// TTL is how long a value read from a file, command or Vault is reused
+	// across config reloads. Zero reads it again on every reload; within
+	// one load each source is read only once.
+	TTL time.Duration `yaml:"ttl"`
 }
 
-func (m MultiSourceString) Get() string {
-	if m.Data != "" {
-		return m.Data
+// IsSet reports whether any source is configured.
+func (m MultiSourceString) IsSet() bool {
+	return m.sources() > 0
+}
+
+func (m MultiSourceString) sources() int {
+	n := 0
+	for _, set := range []bool{m.Data != "", m.EnvVar != "", m.File != "", len(m.Exec) > 0, m.Vault != nil} {
+		if set {
+			n++
+		}
 	}
-	if m.EnvVar != "" {
-		return os.Getenv(m.EnvVar)
+	return n
+}
+
+// Get returns the value. An unset MultiSourceString is "", but a
+// configured source that cannot be read, such as an environment variable
+// that does not exist, is an error.
+func (m MultiSourceString) Get() (string, error) {
+	switch {
+	case m.Data != "":
+		return m.Data, nil
+	case m.EnvVar != "":
+		value, ok := os.LookupEnv(m.EnvVar)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", m.EnvVar)
+		}
+		return value, nil
+	case m.File != "":
+		return secrets.get("file:"+m.File, m.TTL, func() (string, error) {
+			b, err := os.ReadFile(m.File)
+			if err != nil {
+				return "", fmt.Errorf("cannot read secret file: %w", err)
+			}
+			return strings.TrimRight(string(b), "\r\n"), nil
+		})
+	case len(m.Exec) > 0:
+		return secrets.get("exec:"+strings.Join(m.Exec, "\x00"), m.TTL, func() (string, error) {
+			return runSecretCommand(m.Exec)
+		})
+	case m.Vault != nil:
+		return m.Vault.get(m.TTL)
 	}
-	return ""
+	return "", nil
 }
@@ -0,0 +1,689 @@
+// internal/config/validate.go
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"s3-proxy/internal/crypto"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is one thing wrong with a config, located by its YAML path and,
+// when the config was read from a file, its line.
+type Problem struct {
+	Line    int
+	Path    string
+	Message string
+	// Warning problems do not stop the proxy from starting.
+	Warning bool
+}
+
+func (p Problem) String() string {
+	var b strings.Builder
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", p.Line)
+	}
+	if p.Warning {
+		b.WriteString("warning: ")
+	}
+	if p.Path != "" {
+		b.WriteString(p.Path + ": ")
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+type Problems []Problem
+
+// Err returns a *ValidationError holding the problems that are not
+// warnings, or nil if there are none.
+func (ps Problems) Err() error {
+	var errs Problems
+	for _, p := range ps {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: errs}
+}
+
+// ValidationError lists everything that makes a config unusable.
+type ValidationError struct {
+	Problems Problems
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = "  " + p.String()
+	}
+	return "invalid config:\n" + strings.Join(lines, "\n")
+}
+
+// Validate checks cfg for mistakes YAML decoding cannot catch: missing and
+// duplicate IDs, references to undefined clients and crypto, unset secrets
+// and keys of the wrong size. root is the parsed document cfg was decoded
+// from and is only used for line numbers; it may be nil.
+func Validate(cfg *Config, root *yaml.Node) Problems {
+	v := &validator{root: root, writeOnly: cfg.WriteOnly}
+	v.listeners(path{"listen_addr"}, cfg.ListenAddr, true)
+	v.listeners(path{"admin", "listen_addr"}, cfg.Admin.ListenAddr, false)
+	// The admin token is optional: without it the admin API is disabled.
+	if _, err := cfg.Admin.Token.Get(); err != nil {
+		v.warnf(path{"admin", "token"}, "%v, admin API disabled", err)
+	}
+
+	kmsIDs := make(map[string]bool)
+	for i, k := range cfg.KMS {
+		p := path{"kms", i}
+		v.id(p, "id", k.ID, kmsIDs)
+		switch k.Provider {
+		case "aws", "vault":
+			if k.KeyID == "" {
+				v.errorf(p.with("key_id"), "key_id is required")
+			}
+		case "local":
+			v.warnf(p.with("provider"), "the local KMS keeps its master key in memory and is for development only")
+			if key, ok := v.secret(p.with("key"), k.Key); ok {
+				if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 32 {
+					v.errorf(p.with("key"), "key must be a base64 32-byte key")
+				}
+			}
+		default:
+			v.errorf(p.with("provider"), "unsupported KMS provider %q, expected aws, vault or local", k.Provider)
+		}
+		v.secret(p.with("access_key"), k.AccessKey)
+		v.secret(p.with("secret_key"), k.SecretKey)
+		v.secret(p.with("token"), k.Token)
+	}
+
+	cryptoIDs := make(map[string]bool)
+	for i, c := range cfg.Crypto {
+		p := path{"crypto", i}
+		v.id(p, "id", c.ID, cryptoIDs)
+		if c.ID == "none" {
+			v.errorf(p.with("id"), "crypto ID \"none\" is reserved for unencrypted objects")
+		}
+		if len(c.Layers) == 0 {
+			v.errorf(p, "crypto %q has no layers", c.ID)
+		}
+		if c.Sealed {
+			if _, err := cfg.Admin.Token.Get(); err != nil {
+				v.errorf(p.with("sealed"), "sealed crypto needs the admin API to be unsealed, set admin.token")
+			}
+		}
+		encrypted, padded := false, false
+		for j, layer := range c.Layers {
+			lp := p.with("layers", j)
+			v.cryptoLayer(lp, layer, kmsIDs, c.Sealed)
+			switch {
+			case isCompression(layer.Algorithm):
+				if encrypted {
+					v.errorf(lp, "%s must come before the encryption layers, ciphertext does not compress", layer.Algorithm)
+				} else if padded {
+					v.errorf(lp, "%s must come before the pad layer, it would compress the padding away", layer.Algorithm)
+				}
+			case layer.Algorithm == "pad":
+				if encrypted {
+					v.errorf(lp, "pad must come before the encryption layers, which authenticate the real length it records")
+				}
+				if padded {
+					v.errorf(lp, "crypto %q already has a pad layer", c.ID)
+				}
+				padded = true
+			default:
+				encrypted = true
+			}
+		}
+		if padded && !encrypted {
+			v.errorf(p, "crypto %q pads without encrypting; add an encryption layer after pad", c.ID)
+		}
+	}
+
+	clientIDs := make(map[string]bool)
+	for i, c := range cfg.S3Clients {
+		p := path{"s3_clients", i}
+		v.id(p, "id", c.ID, clientIDs)
+		if c.Endpoint == "" {
+			v.errorf(p.with("endpoint"), "endpoint is required")
+		}
+		v.secret(p.with("access_key"), c.AccessKey)
+		v.secret(p.with("secret_key"), c.SecretKey)
+	}
+
+	bucketNames := make(map[string]bool)
+	for i, b := range cfg.S3Buckets {
+		p := path{"s3_buckets", i}
+		v.id(p, "bucket_name", b.BucketName, bucketNames)
+		if len(b.Backends) == 0 {
+			v.errorf(p, "bucket %q has no backends", b.BucketName)
+		}
+		if b.MaxObjectSize < 0 {
+			v.errorf(p.with("max_object_size"), "must not be negative")
+		}
+		if ke := b.KeyEncryption; ke != nil {
+			kp := p.with("key_encryption")
+			if ke.Mode == "" {
+				v.errorf(kp, "mode is required")
+			} else {
+				v.oneOf(kp.with("mode"), ke.Mode, "", "siv", "hmac")
+			}
+			if key, ok := v.secret(kp.with("key"), ke.Key); ok {
+				raw, err := base64.StdEncoding.DecodeString(key)
+				if err != nil {
+					v.errorf(kp.with("key"), "key is not valid base64: %v", err)
+				} else if len(raw) != 64 {
+					v.errorf(kp.with("key"), "key must be 64 bytes, got %d", len(raw))
+				}
+			}
+		}
+		for j, rule := range b.CryptoRules {
+			rp := p.with("crypto_rules", j)
+			switch {
+			case rule.CryptoID == "":
+				v.errorf(rp.with("crypto_id"), "crypto_id is required")
+			case rule.CryptoID != "none" && !cryptoIDs[rule.CryptoID]:
+				v.errorf(rp.with("crypto_id"), "unknown crypto ID %q", rule.CryptoID)
+			}
+			v.nonNegative(rp.with("min_size"), rule.MinSize)
+			v.nonNegative(rp.with("max_size"), rule.MaxSize)
+			if rule.MaxSize > 0 && rule.MinSize > rule.MaxSize {
+				v.errorf(rp, "min_size is larger than max_size")
+			}
+			if rule.Prefix == "" && rule.Suffix == "" && rule.MinSize == 0 && rule.MaxSize == 0 && rule.ContentType == "" && j < len(b.CryptoRules)-1 {
+				v.warnf(rp, "rule matches every object, the rules after it are never used")
+			}
+		}
+		for j, backend := range b.Backends {
+			bp := p.with("backends", j)
+			switch {
+			case backend.S3ClientID == "":
+				v.errorf(bp.with("s3_client_id"), "s3_client_id is required")
+			case !clientIDs[backend.S3ClientID]:
+				v.errorf(bp.with("s3_client_id"), "unknown S3 client ID %q", backend.S3ClientID)
+			}
+			if backend.S3BucketName == "" {
+				v.errorf(bp.with("s3_bucket_name"), "s3_bucket_name is required")
+			}
+			if backend.CryptoID != "" && !cryptoIDs[backend.CryptoID] {
+				v.errorf(bp.with("crypto_id"), "unknown crypto ID %q", backend.CryptoID)
+			}
+			if b.SealMetadata && backend.CryptoID == "" {
+				v.warnf(bp, "backend has no crypto_id, its metadata is stored in clear despite seal_metadata")
+			}
+		}
+	}
+
+	if format, ok := v.secret(path{"auth", "header_format"}, cfg.Auth.HeaderFormat); ok && format == "" {
+		v.warnf(path{"auth", "header_format"}, "no authorization header format, all requests will be rejected")
+	}
+	accessKeys := make(map[string]int)
+	for i, user := range cfg.Auth.Users {
+		p := path{"auth", "users", i, "access_key"}
+		key, ok := v.secret(p, user.AccessKey)
+		if !ok {
+			continue
+		}
+		if key == "" {
+			v.errorf(p, "access key is empty")
+			continue
+		}
+		if first, ok := accessKeys[key]; ok {
+			v.errorf(p, "access key duplicates auth.users[%d]", first)
+			continue
+		}
+		accessKeys[key] = i
+	}
+
+	v.oneOf(path{"logging", "level"}, cfg.Logging.Level, "", "debug", "info", "warn", "warning", "error")
+	v.oneOf(path{"logging", "format"}, cfg.Logging.Format, "", "json", "text")
+	v.oneOf(path{"tracing", "exporter"}, cfg.Tracing.Exporter, "", "none", "otlp", "file", "stdout")
+	if cfg.Tracing.Exporter == "file" && cfg.Tracing.File == "" {
+		v.errorf(path{"tracing", "file"}, "file is required for the file exporter")
+	}
+	if r := cfg.Tracing.SampleRatio; r != nil && (*r < 0 || *r > 1) {
+		v.errorf(path{"tracing", "sample_ratio"}, "must be between 0 and 1")
+	}
+
+	v.nonNegative(path{"limits", "memory_budget"}, cfg.Limits.MemoryBudget)
+	v.nonNegative(path{"limits", "max_object_size"}, cfg.Limits.MaxObjectSize)
+	v.nonNegative(path{"upload", "segment_size"}, int64(cfg.Upload.SegmentSize))
+	if cfg.Upload.SegmentSize > crypto.MaxSegmentSize {
+		v.errorf(path{"upload", "segment_size"}, "must be at most %d bytes", crypto.MaxSegmentSize)
+	}
+	v.nonNegative(path{"upload", "window"}, int64(cfg.Upload.Window))
+	v.nonNegative(path{"upload", "part_size"}, cfg.Upload.PartSize)
+	return v.problems
+}
+
+// path addresses a node in the config document. Elements are mapping keys
+// (string) or sequence indexes (int).
+type path []any
+
+// with returns a copy of p extended by elems.
+func (p path) with(elems ...any) path {
+	return append(p[:len(p):len(p)], elems...)
+}
+
+func (p path) String() string {
+	var b strings.Builder
+	for _, elem := range p {
+		switch e := elem.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", e)
+		case string:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(e)
+		}
+	}
+	return b.String()
+}
+
+type validator struct {
+	root     *yaml.Node
+	problems Problems
+	// writeOnly is set for proxies that never decrypt.
+	writeOnly bool
+}
+
+// line returns the line of the deepest node on p that exists in the
+// document, or 0 without one.
+func (v *validator) line(p path) int {
+	node := v.root
+	if node == nil {
+		return 0
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, elem := range p {
+		next := child(node, elem)
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
+
+func child(node *yaml.Node, elem any) *yaml.Node {
+	switch e := elem.(type) {
+	case string:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == e {
+				return node.Content[i+1]
+			}
+		}
+	case int:
+		if node.Kind == yaml.SequenceNode && e < len(node.Content) {
+			return node.Content[e]
+		}
+	}
+	return nil
+}
+
+func (v *validator) add(p path, warning bool, format string, args ...any) {
+	v.problems = append(v.problems, Problem{
+		Line:    v.line(p),
+		Path:    p.String(),
+		Message: fmt.Sprintf(format, args...),
+		Warning: warning,
+	})
+}
+
+func (v *validator) errorf(p path, format string, args ...any) {
+	v.add(p, false, format, args...)
+}
+
+func (v *validator) warnf(p path, format string, args ...any) {
+	v.add(p, true, format, args...)
+}
+
+// id checks that an identifier is set and not already in seen.
+func (v *validator) id(p path, field, id string, seen map[string]bool) {
+	p = p.with(field)
+	switch {
+	case id == "":
+		v.errorf(p, "%s is required", field)
+	case seen[id]:
+		v.errorf(p, "duplicate %s %q", field, id)
+	}
+	seen[id] = true
+}
+
+// secret resolves s, reporting sources that cannot be read rather than
+// reading them as empty. ok is false if a problem was reported.
+func (v *validator) secret(p path, s MultiSourceString) (value string, ok bool) {
+	if s.sources() > 1 {
+		v.errorf(p, "only one of data, env_var, file, exec and vault may be set")
+		return "", false
+	}
+	value, err := s.Get()
+	if err != nil {
+		v.errorf(p, "%v", err)
+		return "", false
+	}
+	return value, true
+}
+
+func (v *validator) oneOf(p path, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.errorf(p, "unsupported value %q, expected one of %s", value, strings.Join(allowed[1:], ", "))
+}
+
+func (v *validator) nonNegative(p path, n int64) {
+	if n < 0 {
+		v.errorf(p, "must not be negative")
+	}
+}
+
+func (v *validator) listeners(p path, ls ConfigListeners, required bool) {
+	if len(ls) == 0 {
+		if required {
+			v.errorf(p, "at least one listener is required")
+		}
+		return
+	}
+	for i, l := range ls {
+		lp := p.with(i)
+		if l.Address == "" {
+			v.errorf(lp, "address is required")
+		}
+		switch l.Type {
+		case "tcp":
+		case "tls":
+			if l.CertFile == "" || l.KeyFile == "" {
+				v.errorf(lp, "tls listener needs cert_file and key_file")
+			}
+		case "unix":
+			if l.Mode != "" {
+				if _, err := strconv.ParseUint(l.Mode, 8, 32); err != nil {
+					v.errorf(lp.with("mode"), "invalid socket mode %q", l.Mode)
+				}
+			}
+		default:
+			v.errorf(lp.with("type"), "unsupported listener type %q", l.Type)
+		}
+	}
+}
+
+// keySizes are the raw key lengths each base64-keyed algorithm accepts.
+var keySizes = map[string][]int{
+	"aes":               {16, 24, 32},
+	"aes/ctr-hmac":      {16 + 32, 32 + 32},
+	"aes-gcm-siv":       {16, 32},
+	"chacha20poly1305":  {32},
+	"xchacha20poly1305": {32},
+}
+
+// keyKind is the keySizes entry of a layer; the key of AES-CTR+HMAC holds
+// the HMAC key as well.
+func keyKind(layer ConfigCryptoLayer) string {
+	if layer.Algorithm == "aes" && layer.Params["mode"] == "ctr-hmac" {
+		return "aes/ctr-hmac"
+	}
+	return layer.Algorithm
+}
+
+func (v *validator) cryptoLayer(p path, layer ConfigCryptoLayer, kmsIDs map[string]bool, sealed bool) {
+	if layer.KMS != "" && !kmsIDs[layer.KMS] {
+		v.errorf(p.with("kms"), "unknown KMS ID %q", layer.KMS)
+	}
+	if layer.Passphrase != nil && (layer.Algorithm == "kms" || layer.Algorithm == "pad" || isCompression(layer.Algorithm)) {
+		v.errorf(p.with("passphrase"), "passphrase is only used by layers that take a key")
+	}
+	switch layer.Algorithm {
+	case "kms":
+		if layer.KMS == "" {
+			v.errorf(p, "kms is required for the kms algorithm")
+		}
+		return
+	case "gzip", "zstd":
+		if layer.KMS != "" || layer.Keyset != nil {
+			v.errorf(p, "%s is a compression layer and takes no keyset or kms", layer.Algorithm)
+		}
+		for _, name := range []string{"level", "min_size"} {
+			if value, ok := layer.Params[name]; ok {
+				if _, err := strconv.Atoi(value); err != nil {
+					v.errorf(p.with("params", name), "invalid %s %q", name, value)
+				}
+			}
+		}
+		return
+	case "pad":
+		if layer.KMS != "" || layer.Keyset != nil {
+			v.errorf(p, "pad takes no keyset or kms")
+		}
+		scheme := layer.Params["scheme"]
+		switch scheme {
+		case "pow2", "padme", "block":
+		default:
+			v.errorf(p.with("params", "scheme"), "unsupported padding scheme %q, expected pow2, padme or block", scheme)
+		}
+		if value, ok := layer.Params["block_size"]; ok {
+			switch n, err := strconv.Atoi(value); {
+			case err != nil || n <= 0:
+				v.errorf(p.with("params", "block_size"), "invalid block_size %q", value)
+			case scheme != "block":
+				v.warnf(p.with("params", "block_size"), "block_size is only used by the block scheme")
+			}
+		}
+		return
+	case "tink":
+	case "aes", "aes-gcm-siv", "chacha20poly1305", "xchacha20poly1305":
+		if layer.KMS != "" {
+			v.errorf(p.with("kms"), "kms is only used by the kms and tink algorithms")
+		}
+		if mode := layer.Params["mode"]; layer.Algorithm == "aes" && mode != "gcm" && mode != "ctr-hmac" {
+			v.errorf(p.with("params", "mode"), "unsupported AES mode %q, expected gcm or ctr-hmac", mode)
+		}
+	case "":
+		v.errorf(p, "algorithm is required")
+		return
+	default:
+		v.errorf(p.with("algorithm"), "unsupported crypto algorithm %q", layer.Algorithm)
+		return
+	}
+
+	kp := p.with("keyset")
+	if sealed {
+		if layer.Keyset != nil {
+			v.errorf(kp, "keysets of a sealed crypto come from key shares and must not be in the config")
+		}
+		if layer.Passphrase != nil {
+			v.errorf(p.with("passphrase"), "the keys of a sealed crypto come from key shares and take no passphrase")
+		}
+		return
+	}
+	if layer.Passphrase.Derived() {
+		v.derivedKey(p, layer)
+		return
+	}
+	if layer.Keyset == nil {
+		v.errorf(p, "keyset is required")
+		return
+	}
+	key, ok := v.secret(kp, *layer.Keyset)
+	if !ok {
+		return
+	}
+	if layer.Passphrase != nil {
+		if key, ok = v.unwrapKeyset(p.with("passphrase"), key, layer.Passphrase); !ok {
+			return
+		}
+	}
+	if key == "" {
+		v.errorf(kp, "keyset is empty")
+		return
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		v.errorf(kp, "keyset is not valid base64")
+		return
+	}
+	if layer.Algorithm == "tink" {
+		var ks struct {
+			PrimaryKeyID *uint32 `json:"primaryKeyId"`
+			Key          []struct {
+				KeyData struct {
+					KeyMaterialType string `json:"keyMaterialType"`
+				} `json:"keyData"`
+			} `json:"key"`
+			EncryptedKeyset string `json:"encryptedKeyset"`
+		}
+		switch err := json.Unmarshal(raw, &ks); {
+		case err != nil:
+			v.errorf(kp, "keyset is not a Tink JSON keyset")
+		case layer.KMS != "" && ks.EncryptedKeyset == "":
+			v.errorf(kp, "keyset is not encrypted, but kms is set")
+		case layer.KMS == "" && ks.EncryptedKeyset != "":
+			v.errorf(kp, "keyset is encrypted; set kms to the KMS that encrypted it")
+		case layer.KMS == "" && (ks.PrimaryKeyID == nil || len(ks.Key) == 0):
+			v.errorf(kp, "keyset is not a Tink JSON keyset")
+		case !v.writeOnly && len(ks.Key) > 0 && ks.Key[0].KeyData.KeyMaterialType == "ASYMMETRIC_PUBLIC":
+			v.warnf(kp, "keyset holds only a public key, objects written with it cannot be read through this proxy; set write_only to refuse reads")
+		}
+		return
+	}
+	sizes := keySizes[keyKind(layer)]
+	for _, size := range sizes {
+		if len(raw) == size {
+			return
+		}
+	}
+	v.errorf(kp, "%s key is %d bytes, expected %s", keyKind(layer), len(raw), joinInts(sizes))
+}
+
+// derivedKey checks a layer whose key is derived from a passphrase, and
+// that the passphrase matches its check.
+func (v *validator) derivedKey(p path, layer ConfigCryptoLayer) {
+	pp := p.with("passphrase")
+	if layer.Algorithm == "tink" {
+		v.errorf(pp.with("salt"), "a tink keyset cannot be derived from a passphrase; wrap it with \"s3-proxy keys wrap\" and drop the salt")
+		return
+	}
+	if layer.Keyset != nil {
+		v.errorf(p.with("keyset"), "the key is derived from the passphrase, remove the keyset or the passphrase salt")
+		return
+	}
+	if !slices.Contains(keySizes[keyKind(layer)], 32) {
+		v.errorf(pp.with("salt"), "a key derived from a passphrase is 32 bytes, which %s does not take; wrap a generated key instead", keyKind(layer))
+		return
+	}
+	params := crypto.Argon2Params{Time: layer.Passphrase.Time, Memory: layer.Passphrase.Memory, Threads: layer.Passphrase.Threads}
+	if err := params.Check(); err != nil {
+		v.errorf(pp, "%v", err)
+		return
+	}
+	if params.Memory < 19*1024 || params.Time < 2 {
+		v.warnf(pp, "argon2id costs are below 2 passes of 19 MiB, which makes guessing the passphrase cheap")
+	}
+	salt, err := base64.StdEncoding.DecodeString(layer.Passphrase.Salt)
+	if err != nil {
+		v.errorf(pp.with("salt"), "salt is not valid base64")
+		return
+	}
+	if len(salt) < 8 {
+		v.errorf(pp.with("salt"), "salt is %d bytes, expected at least 8", len(salt))
+		return
+	}
+	if layer.Passphrase.Check == "" {
+		v.errorf(pp.with("check"), "check is required to verify the passphrase")
+		return
+	}
+	check, err := base64.StdEncoding.DecodeString(layer.Passphrase.Check)
+	if err != nil {
+		v.errorf(pp.with("check"), "check is not valid base64")
+		return
+	}
+	secret, ok := v.passphrase(pp, layer.Passphrase)
+	if !ok {
+		return
+	}
+	if _, err := crypto.DeriveKey(secret, salt, check, params); err != nil {
+		v.errorf(pp.with("secret"), "%v", err)
+	}
+}
+
+// unwrapKeyset opens a keyset wrapped with a passphrase, so that the
+// keyset checks apply to what it holds.
+func (v *validator) unwrapKeyset(p path, wrapped string, pp *ConfigPassphrase) (string, bool) {
+	secret, ok := v.passphrase(p, pp)
+	if !ok {
+		return "", false
+	}
+	key, err := crypto.UnwrapKeyset(wrapped, secret)
+	if err != nil {
+		v.errorf(p.with("secret"), "%v", err)
+		return "", false
+	}
+	return key, true
+}
+
+func (v *validator) passphrase(p path, pp *ConfigPassphrase) (string, bool) {
+	secret, ok := v.secret(p.with("secret"), pp.Secret)
+	if !ok {
+		return "", false
+	}
+	if secret == "" {
+		v.errorf(p.with("secret"), "passphrase is empty")
+		return "", false
+	}
+	return secret, true
+}
+
+func isCompression(algorithm string) bool {
+	return algorithm == "gzip" || algorithm == "zstd"
+}
+
+func joinInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ", ")
+}
+
+// checkFields rejects keys of a mapping node that no field of v's struct
+// type is tagged with. Node.Decode does not inherit the decoder's
+// KnownFields setting, so custom unmarshalers call this first.
+func checkFields(node *yaml.Node, v any) error {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	t := reflect.TypeOf(v).Elem()
+	known := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		known[name] = true
+	}
+	var unknown []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if key := node.Content[i]; !known[key.Value] {
+			unknown = append(unknown, fmt.Sprintf("line %d: field %s not found in type %s", key.Line, key.Value, t))
+		}
+	}
+	if len(unknown) > 0 {
+		return &yaml.TypeError{Errors: unknown}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validConfig = `
+listen_addr: ":8080"
+crypto:
+  - id: aes
+    layers:
+      - algorithm: aes
+        keyset: {data: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}
+        params: {mode: gcm}
+s3_clients:
+  - id: s3
+    endpoint: "http://127.0.0.1:9000"
+    access_key: {data: access}
+    secret_key: {data: secret}
+s3_buckets:
+  - bucket_name: vb
+    backends:
+      - s3_client_id: s3
+        s3_bucket_name: data
+        crypto_id: aes
+auth:
+  header_format: {data: "AWS4-HMAC-SHA256"}
+  users:
+    - access_key: {data: AK}
+`
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// lineOf returns the line of the first occurrence of s in yaml.
+func lineOf(t *testing.T, yaml, s string) int {
+	t.Helper()
+	i := strings.Index(yaml, s)
+	if i < 0 {
+		t.Fatalf("%q not in config", s)
+	}
+	return strings.Count(yaml[:i], "\n") + 1
+}
+
+func TestValidConfigHasNoProblems(t *testing.T) {
+	cfg, problems, err := Check(writeConfig(t, validConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("problems: %v", problems)
+	}
+	if cfg.S3Buckets[0].Backends[0].CryptoID != "aes" {
+		t.Fatalf("decoded %+v", cfg.S3Buckets)
+	}
+}
+
+func TestValidateReportsProblemsWithLines(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		old, new string
+		// at is the text on the line the problem is reported at.
+		at, path, message string
+	}{
+		{"missing listener", `listen_addr: ":8080"`, "", "", "listen_addr", "at least one listener is required"},
+		{"unknown client", "s3_client_id: s3", "s3_client_id: s4", "s3_client_id: s4", "s3_buckets[0].backends[0].s3_client_id", `unknown S3 client ID "s4"`},
+		{"unknown crypto", "crypto_id: aes", "crypto_id: des", "crypto_id: des", "s3_buckets[0].backends[0].crypto_id", `unknown crypto ID "des"`},
+		{"duplicate client", "s3_buckets:", "  - id: s3\n    endpoint: x\ns3_buckets:", "- id: s3\n    endpoint: x", "s3_clients[1].id", "duplicate"},
+		{"short key", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", "AAAAAAAAAAA=", "AAAAAAAAAAA=", "crypto[0].layers[0].keyset", "aes key is 8 bytes"},
+		{"aes mode", "mode: gcm", "mode: ecb", "mode: ecb", "crypto[0].layers[0].params.mode", `unsupported AES mode "ecb"`},
+		{"reserved crypto ID", "  - id: aes", "  - id: none", "id: none", "crypto[0].id", "reserved"},
+		{"empty access key", "access_key: {data: AK}", "access_key: {data: \"\"}", "access_key: {data: \"\"}", "auth.users[0].access_key", "access key is empty"},
+		{"unset secret", "secret_key: {data: secret}", "secret_key: {env_var: S3_PROXY_TEST_UNSET}", "S3_PROXY_TEST_UNSET", "s3_clients[0].secret_key", "S3_PROXY_TEST_UNSET"},
+		{"log level", "auth:", "logging: {level: loud}\nauth:", "level: loud", "logging.level", `"loud"`},
+		{"segment size", "auth:", "upload: {segment_size: 1073741824}\nauth:", "segment_size", "upload.segment_size", "at most"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			yaml := strings.Replace(validConfig, tc.old, tc.new, 1)
+			_, problems, err := Check(writeConfig(t, yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found *Problem
+			for i, p := range problems {
+				if p.Path == tc.path && strings.Contains(p.Message, tc.message) {
+					found = &problems[i]
+				}
+			}
+			if found == nil {
+				t.Fatalf("no %s problem about %q in %v", tc.path, tc.message, problems)
+			}
+			if found.Warning {
+				t.Fatalf("%v is only a warning", found)
+			}
+			if tc.at != "" {
+				if want := lineOf(t, yaml, tc.at); found.Line != want {
+					t.Fatalf("%v reported at line %d, want %d", found, found.Line, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	yaml := strings.NewReplacer("s3_client_id: s3", "s3_client_id: s4", "mode: gcm", "mode: ecb").Replace(validConfig)
+	_, err := Load(writeConfig(t, yaml))
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("load: %v", err)
+	}
+	if len(invalid.Problems) != 2 {
+		t.Fatalf("problems: %v", invalid.Problems)
+	}
+	for _, want := range []string{"unknown S3 client ID", "unsupported AES mode"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error lacks %q: %v", want, err)
+		}
+	}
+}
+
+func TestLoadIgnoresWarnings(t *testing.T) {
+	yaml := strings.Replace(validConfig, "auth:", "kms:\n  - id: dev\n    provider: local\n    key: {data: \"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\"}\nauth:", 1)
+	_, problems, err := Check(writeConfig(t, yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !problems[0].Warning || problems[0].Line != lineOf(t, yaml, "provider: local") {
+		t.Fatalf("problems: %v", problems)
+	}
+	if _, err := Load(writeConfig(t, yaml)); err != nil {
+		t.Fatalf("a warning failed the load: %v", err)
+	}
+}
+
+func TestCheckRejectsUnknownFields(t *testing.T) {
+	yaml := strings.Replace(validConfig, "    endpoint:", "    endpiont: x\n    endpoint:", 1)
+	if _, _, err := Check(writeConfig(t, yaml)); err == nil || !strings.Contains(err.Error(), "endpiont") {
+		t.Fatalf("unknown field: %v", err)
+	}
+	if _, _, err := Check(writeConfig(t, "s3_buckets: [")); err == nil {
+		t.Fatal("accepted broken YAML")
+	}
+	if _, _, err := Check(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("accepted a missing file")
+	}
+}
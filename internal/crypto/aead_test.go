@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+// Known-answer tests decrypt published vectors in the layers' framing,
+// nonce || ciphertext || tag, so they pin both the cipher and the format
+// objects are stored in.
+
+type knownAnswer struct {
+	name      string
+	key       string
+	sealed    string // nonce || ciphertext || tag
+	plaintext string
+}
+
+func hexBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testKnownAnswers(t *testing.T, newCrypt func(string) (Crypt, error), vectors []knownAnswer) {
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			c, err := newCrypt(base64.StdEncoding.EncodeToString(hexBytes(t, v.key)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sealed := hexBytes(t, v.sealed)
+			want := hexBytes(t, v.plaintext)
+			got, err := c.Decrypt(sealed)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("decrypt = %x, want %x", got, want)
+			}
+
+			sealed[len(sealed)-1] ^= 1
+			if _, err := c.Decrypt(sealed); err == nil {
+				t.Fatal("decrypt accepted a modified tag")
+			}
+
+			again, err := c.Encrypt(want)
+			if err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			if len(again) != len(sealed) {
+				t.Fatalf("encrypt produced %d bytes, want %d", len(again), len(sealed))
+			}
+			if got, err := c.Decrypt(again); err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("round trip = %x, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestAESGCMSIVKnownAnswers(t *testing.T) {
+	// RFC 8452, appendix C.1 and C.2, the vectors without AAD.
+	testKnownAnswers(t, func(key string) (Crypt, error) { return NewAESGCMSIVCrypt(key) }, []knownAnswer{
+		{
+			name:   "aes128 empty",
+			key:    "01000000000000000000000000000000",
+			sealed: "030000000000000000000000" + "dc20e2d83f25705bb49e439eca56de25",
+		},
+		{
+			name:      "aes128 8 bytes",
+			key:       "01000000000000000000000000000000",
+			sealed:    "030000000000000000000000" + "b5d839330ac7b786578782fff6013b815b287c22493a364c",
+			plaintext: "0100000000000000",
+		},
+		{
+			name:      "aes128 12 bytes",
+			key:       "01000000000000000000000000000000",
+			sealed:    "030000000000000000000000" + "7323ea61d05932260047d942a4978db357391a0bc4fdec8b0d106639",
+			plaintext: "010000000000000000000000",
+		},
+		{
+			name:   "aes256 empty",
+			key:    "0100000000000000000000000000000000000000000000000000000000000000",
+			sealed: "030000000000000000000000" + "07f5f4169bbf55a8400cd47ea6fd400f",
+		},
+		{
+			name:      "aes256 8 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			sealed:    "030000000000000000000000" + "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28",
+			plaintext: "0100000000000000",
+		},
+		{
+			name:      "aes256 12 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			sealed:    "030000000000000000000000" + "9aab2aeb3faa0a34aea8e2b18ca50da9ae6559e48fd10f6e5c9ca17e",
+			plaintext: "010000000000000000000000",
+		},
+	})
+}
+
+func TestXChaChaKnownAnswers(t *testing.T) {
+	// Generated with libsodium's crypto_aead_xchacha20poly1305_ietf, without
+	// additional data.
+	testKnownAnswers(t, func(key string) (Crypt, error) { return NewXChaChaCrypt(key) }, []knownAnswer{
+		{
+			name:   "empty",
+			key:    "1f4774fbe6324700d62dd6a104e7b3ca7160cfd958413f2afdb96695475f007e",
+			sealed: "029174e5102710975a8a4a936075eb3e0f470d436884d250" + "" + "f55cf0949af356f977479f1f187d7291",
+		},
+		{
+			name:      "5 bytes",
+			key:       "eb27969c7abf9aff79348e1e77f1fcba7508ceb29a7471961b017aef9ceaf1c2",
+			sealed:    "990009311eab3459c1bee84b5b860bb5bdf93c7bec8767e2" + "66bd484861" + "07e31b4dd0f51f0819a0641c86380f32",
+			plaintext: "e7ec3d4b9f",
+		},
+		{
+			name:      "10 bytes",
+			key:       "4b6d89dbd7d019c0e1683d4c2a497305c778e2089ddb0f383f2c7fa2a5a52153",
+			sealed:    "97525eb02a8d347fcf38c81b1be5c3ba59406241cf251ba6" + "1221898afd6f516f770f" + "75e7182e7d715f5a32ee6733fd324539",
+			plaintext: "074db54ef9fbc680b41a",
+		},
+		{
+			name:      "20 bytes",
+			key:       "6585031b5649fcabd9d4971d4ac5646fc7dca22f991dfa7dac39647001004e20",
+			sealed:    "705ee25d03fec430e24c9c6ccaa633f5b86dd43682778278" + "0a8e6fd4cd1640be77c4c87dde4ae6222c887ed7" + "edc4fbc91dfa07021e74ae0d9d1c98dc",
+			plaintext: "9a4ca0633886a742e0241f132e8f90794c34dfd4",
+		},
+	})
+}
+
+func TestAESCTRHMACKnownAnswers(t *testing.T) {
+	// The AES-CTR part is NIST SP 800-38A F.5.1. The tag is HMAC-SHA256
+	// over IV || ciphertext || the 64-bit length of the empty associated
+	// data, computed independently with Python's hmac module.
+	testKnownAnswers(t, func(key string) (Crypt, error) { return NewAESCTRHMACCrypt(key) }, []knownAnswer{
+		{
+			name: "aes128 nist",
+			key: "2b7e151628aed2a6abf7158809cf4f3c" +
+				"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			sealed: "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff" +
+				"874d6191b620e3261bef6864990db6ce9806f66b7970fdff8617187bb9fffdff" +
+				"5ae4df3edbd5d35e5b4f09020db03eab1e031dda2fbe03d1792170a0f3009cee" +
+				"44c94780653c7b5bbfb7c07b3a8c4da54c00edcde9f0dd2b650a2af92885df72",
+			plaintext: "6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51" +
+				"30c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710",
+		},
+	})
+}
+
+func TestAESCTRHMACRejectsShortKey(t *testing.T) {
+	if _, err := NewAESCTRHMACCrypt(base64.StdEncoding.EncodeToString(make([]byte, 32))); err == nil {
+		t.Fatal("accepted a key without an HMAC key")
+	}
+}
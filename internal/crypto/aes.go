@@ -10,6 +10,10 @@ import (
 	"io"
 )
 
+// AESOverhead is what AESCrypt adds to every plaintext: the nonce and the
+// GCM tag.
+const AESOverhead = 12 + 16
+
 type AESCrypt struct {
 	gcm cipher.AEAD
 }
@@ -26,6 +26,20 @@ func NewChaChaCrypt(base64Key string) (*ChaChaCrypt, error) {
 	return &ChaChaCrypt{aead: aead}, nil
 }
 
+// NewXChaChaCrypt uses XChaCha20-Poly1305, whose 24-byte nonces can be
+// picked at random for any number of objects under one key.
+func NewXChaChaCrypt(base64Key string) (*ChaChaCrypt, error) {
+	key, err := base64.StdEncoding.DecodeString(base64Key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ChaChaCrypt{aead: aead}, nil
+}
+
 func (c *ChaChaCrypt) Encrypt(plaintext []byte) ([]byte, error) {
 	nonce := make([]byte, c.aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
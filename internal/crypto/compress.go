@@ -0,0 +1,164 @@
+// internal/crypto/compress.go
+package crypto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats, stored in the first byte of every compressed block
+// so that blocks stay readable if the layer's algorithm is changed.
+const (
+	compressStored byte = 0
+	compressGzip   byte = 1
+	compressZstd   byte = 2
+)
+
+const (
+	// DefaultCompressMinSize is the smallest block worth compressing.
+	DefaultCompressMinSize = 256
+	// compressSampleSize is how much of a large block is trial-compressed
+	// to decide whether the rest is worth the effort.
+	compressSampleSize = 64 << 10
+	// compressMaxRatio is the compressed/original ratio above which data
+	// is treated as incompressible and stored as is.
+	compressMaxRatio = 0.9
+)
+
+// maxDecompressedSize bounds the output of a single block, so a corrupted
+// or hostile block cannot exhaust memory. Tests lower it.
+var maxDecompressedSize = 1 << 30
+
+// CompressCrypt is a pipeline layer that compresses instead of encrypting.
+// It must run before the encryption layers, because ciphertext does not
+// compress. Blocks smaller than minSize, and blocks whose leading sample
+// barely shrinks, are stored uncompressed.
+type CompressCrypt struct {
+	format  byte
+	minSize int
+	level   int
+	zstdEnc *zstd.Encoder
+	zstdDec *zstd.Decoder
+}
+
+// NewCompressCrypt returns a compression layer. algorithm is "gzip" or
+// "zstd"; level is the gzip level (1-9) or zstd level (1-4), 0 meaning the
+// library default.
+func NewCompressCrypt(algorithm string, level, minSize int) (*CompressCrypt, error) {
+	if minSize <= 0 {
+		minSize = DefaultCompressMinSize
+	}
+	c := &CompressCrypt{minSize: minSize, level: level}
+	switch algorithm {
+	case "gzip":
+		c.format = compressGzip
+		if level == 0 {
+			c.level = gzip.DefaultCompression
+		} else if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return nil, fmt.Errorf("invalid gzip level: %d", level)
+		}
+	case "zstd":
+		c.format = compressZstd
+		zlevel := zstd.SpeedDefault
+		if level != 0 {
+			if level < int(zstd.SpeedFastest) || level > int(zstd.SpeedBestCompression) {
+				return nil, fmt.Errorf("invalid zstd level: %d", level)
+			}
+			zlevel = zstd.EncoderLevel(level)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zlevel))
+		if err != nil {
+			return nil, err
+		}
+		c.zstdEnc = enc
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxDecompressedSize)))
+	if err != nil {
+		return nil, err
+	}
+	c.zstdDec = dec
+	return c, nil
+}
+
+func (c *CompressCrypt) Encrypt(plaintext []byte) ([]byte, error) {
+	if len(plaintext) < c.minSize {
+		return stored(plaintext), nil
+	}
+	if len(plaintext) > 2*compressSampleSize {
+		sample, err := c.compress(plaintext[:compressSampleSize])
+		if err != nil {
+			return nil, err
+		}
+		if float64(len(sample)) > compressMaxRatio*compressSampleSize {
+			return stored(plaintext), nil
+		}
+	}
+	compressed, err := c.compress(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(plaintext) {
+		return stored(plaintext), nil
+	}
+	return append([]byte{c.format}, compressed...), nil
+}
+
+func (c *CompressCrypt) Decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("compressed block is empty")
+	}
+	body := data[1:]
+	switch data[0] {
+	case compressStored:
+		return body, nil
+	case compressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		out, err := io.ReadAll(io.LimitReader(zr, int64(maxDecompressedSize)+1))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		if len(out) > maxDecompressedSize {
+			return nil, errors.New("gzip: decompressed block too large")
+		}
+		return out, nil
+	case compressZstd:
+		out, err := c.zstdDec.DecodeAll(body, nil)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown compression format: %d", data[0])
+}
+
+func (c *CompressCrypt) compress(data []byte) ([]byte, error) {
+	if c.format == compressZstd {
+		return c.zstdEnc.EncodeAll(data, nil), nil
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func stored(data []byte) []byte {
+	return append([]byte{compressStored}, data...)
+}
@@ -0,0 +1,135 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func mustCompress(t *testing.T, algorithm string, level, minSize int) *CompressCrypt {
+	t.Helper()
+	c, err := NewCompressCrypt(algorithm, level, minSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	text := []byte(strings.Repeat("2025-01-01 INFO request completed status=200\n", 5000))
+	random := make([]byte, 3*compressSampleSize)
+	rand.Read(random)
+	// Compressible at the start, so the sample does not skip it.
+	mixed := append(bytes.Clone(text[:2*compressSampleSize]), random...)
+
+	for _, algorithm := range []string{"gzip", "zstd"} {
+		for _, level := range []int{0, 1, 4} {
+			c := mustCompress(t, algorithm, level, 0)
+			for _, tc := range []struct {
+				name   string
+				data   []byte
+				format byte
+			}{
+				{"empty", nil, compressStored},
+				{"under min size", text[:DefaultCompressMinSize-1], compressStored},
+				{"text", text, c.format},
+				{"random", random, compressStored},
+				{"mixed", mixed, c.format},
+			} {
+				block, err := c.Encrypt(tc.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if block[0] != tc.format {
+					t.Errorf("%s/%d %s: format %d, want %d", algorithm, level, tc.name, block[0], tc.format)
+				}
+				if tc.format != compressStored && len(block) >= len(tc.data) {
+					t.Errorf("%s/%d %s: %d bytes compressed to %d", algorithm, level, tc.name, len(tc.data), len(block))
+				}
+				got, err := c.Decrypt(block)
+				if err != nil || !bytes.Equal(got, tc.data) {
+					t.Fatalf("%s/%d %s: round trip: %v", algorithm, level, tc.name, err)
+				}
+			}
+		}
+	}
+}
+
+func TestCompressReadsOtherFormats(t *testing.T) {
+	// A block stays readable after the layer's algorithm changes.
+	text := []byte(strings.Repeat("abcdefgh", 1000))
+	gz, zs := mustCompress(t, "gzip", 0, 0), mustCompress(t, "zstd", 0, 0)
+	for _, pair := range [][2]*CompressCrypt{{gz, zs}, {zs, gz}} {
+		block, err := pair[0].Encrypt(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := pair[1].Decrypt(block); err != nil || !bytes.Equal(got, text) {
+			t.Fatalf("format %d read by format %d: %v", pair[0].format, pair[1].format, err)
+		}
+	}
+}
+
+func TestCompressMinSize(t *testing.T) {
+	c := mustCompress(t, "zstd", 0, 4096)
+	block, _ := c.Encrypt(bytes.Repeat([]byte("a"), 4095))
+	if block[0] != compressStored {
+		t.Fatal("compressed a block under min_size")
+	}
+	block, _ = c.Encrypt(bytes.Repeat([]byte("a"), 4096))
+	if block[0] != compressZstd {
+		t.Fatal("did not compress a block of min_size")
+	}
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	defer func(limit int) { maxDecompressedSize = limit }(maxDecompressedSize)
+	maxDecompressedSize = 1 << 20
+
+	for _, algorithm := range []string{"gzip", "zstd"} {
+		c := mustCompress(t, algorithm, 0, 0)
+		within, err := c.Encrypt(make([]byte, maxDecompressedSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.Decrypt(within); err != nil || len(got) != maxDecompressedSize {
+			t.Fatalf("%s: block at the limit: %d bytes, %v", algorithm, len(got), err)
+		}
+		bomb, err := c.Encrypt(make([]byte, maxDecompressedSize+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Decrypt(bomb); err == nil {
+			t.Fatalf("%s: decompressed a block over the limit", algorithm)
+		}
+	}
+}
+
+func TestCompressRejects(t *testing.T) {
+	for _, tc := range []struct {
+		algorithm string
+		level     int
+	}{
+		{"brotli", 0},
+		{"gzip", 10},
+		{"gzip", -2},
+		{"zstd", 5},
+	} {
+		if _, err := NewCompressCrypt(tc.algorithm, tc.level, 0); err == nil {
+			t.Errorf("accepted %s level %d", tc.algorithm, tc.level)
+		}
+	}
+
+	c := mustCompress(t, "gzip", 0, 0)
+	for _, block := range [][]byte{
+		nil,
+		{9, 1, 2, 3},
+		{compressGzip, 1, 2, 3},
+		{compressZstd, 1, 2, 3},
+	} {
+		if _, err := c.Decrypt(block); err == nil {
+			t.Errorf("decrypted %v", block)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// internal/crypto/envelope.go
+package crypto
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KeyWrapper wraps and unwraps data keys with a master key it does not
+// reveal, usually one held by a KMS.
+type KeyWrapper interface {
+	Wrap(ctx context.Context, key []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+const (
+	envelopeVersion    = 1
+	envelopeHeaderSize = 3 // version + uint16 wrapped key length
+	dataKeySize        = 32
+)
+
+// DefaultDataKeyTTL is how long an EnvelopeCrypt encrypts with one data key
+// when the caller does not choose.
+const DefaultDataKeyTTL = time.Hour
+
+// EnvelopeCrypt encrypts with AES-256-GCM data keys that travel with the
+// ciphertext, wrapped by a KeyWrapper. Only wrapped keys are stored; a data
+// key is reused until its TTL runs out so that writes do not each call the
+// KMS.
+//
+// Format: version | uint16 len | wrapped key | nonce | ciphertext, with
+// everything before the nonce authenticated as associated data.
+type EnvelopeCrypt struct {
+	wrapper KeyWrapper
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	current *dataKey
+}
+
+type dataKey struct {
+	header  []byte
+	gcm     cipher.AEAD
+	expires time.Time
+}
+
+func NewEnvelopeCrypt(wrapper KeyWrapper, dataKeyTTL time.Duration) *EnvelopeCrypt {
+	if dataKeyTTL <= 0 {
+		dataKeyTTL = DefaultDataKeyTTL
+	}
+	return &EnvelopeCrypt{wrapper: wrapper, ttl: dataKeyTTL}
+}
+
+func (e *EnvelopeCrypt) Encrypt(plaintext []byte) ([]byte, error) {
+	return e.EncryptContext(context.Background(), plaintext)
+}
+
+func (e *EnvelopeCrypt) Decrypt(ciphertext []byte) ([]byte, error) {
+	return e.DecryptContext(context.Background(), ciphertext)
+}
+
+func (e *EnvelopeCrypt) EncryptContext(ctx context.Context, plaintext []byte) ([]byte, error) {
+	key, err := e.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, key.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(key.header)+len(nonce)+len(plaintext)+key.gcm.Overhead())
+	out = append(out, key.header...)
+	out = append(out, nonce...)
+	return key.gcm.Seal(out, nonce, plaintext, key.header), nil
+}
+
+func (e *EnvelopeCrypt) DecryptContext(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < envelopeHeaderSize || ciphertext[0] != envelopeVersion {
+		return nil, errors.New("not an envelope ciphertext")
+	}
+	headerSize := envelopeHeaderSize + int(binary.BigEndian.Uint16(ciphertext[1:]))
+	if len(ciphertext) < headerSize {
+		return nil, errors.New("envelope ciphertext too short")
+	}
+	header, rest := ciphertext[:headerSize], ciphertext[headerSize:]
+	key, err := e.wrapper.Unwrap(ctx, header[envelopeHeaderSize:])
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key: %w", err)
+	}
+	gcm, err := newDataKeyGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("envelope ciphertext too short")
+	}
+	return gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], header)
+}
+
+// dataKey returns the data key to encrypt with, generating and wrapping a
+// new one when the current key has expired.
+func (e *EnvelopeCrypt) dataKey(ctx context.Context) (*dataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.current != nil && time.Now().Before(e.current.expires) {
+		return e.current, nil
+	}
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := e.wrapper.Wrap(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot wrap data key: %w", err)
+	}
+	if len(wrapped) > 0xffff {
+		return nil, fmt.Errorf("wrapped data key too long: %d bytes", len(wrapped))
+	}
+	gcm, err := newDataKeyGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(wrapped))
+	header[0] = envelopeVersion
+	binary.BigEndian.PutUint16(header[1:], uint16(len(wrapped)))
+	e.current = &dataKey{
+		header:  append(header, wrapped...),
+		gcm:     gcm,
+		expires: time.Now().Add(e.ttl),
+	}
+	return e.current, nil
+}
+
+func newDataKeyGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("data key is %d bytes, expected %d", len(key), dataKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
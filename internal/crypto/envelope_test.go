@@ -0,0 +1,154 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingWrapper wraps keys with a fixed AES-GCM key and counts its calls.
+type countingWrapper struct {
+	gcm            cipher.AEAD
+	wraps, unwraps atomic.Int32
+	fail           error
+}
+
+func newCountingWrapper(t *testing.T) *countingWrapper {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingWrapper{gcm: gcm}
+}
+
+func (w *countingWrapper) Wrap(_ context.Context, key []byte) ([]byte, error) {
+	w.wraps.Add(1)
+	if w.fail != nil {
+		return nil, w.fail
+	}
+	nonce := make([]byte, w.gcm.NonceSize())
+	rand.Read(nonce)
+	return w.gcm.Seal(nonce, nonce, key, nil), nil
+}
+
+func (w *countingWrapper) Unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	w.unwraps.Add(1)
+	if len(wrapped) < w.gcm.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	return w.gcm.Open(nil, wrapped[:w.gcm.NonceSize()], wrapped[w.gcm.NonceSize():], nil)
+}
+
+// envelopeHeader returns the version and wrapped key of an envelope.
+func envelopeHeader(sealed []byte) []byte {
+	return sealed[:envelopeHeaderSize+int(binary.BigEndian.Uint16(sealed[1:]))]
+}
+
+func TestEnvelopeReusesDataKey(t *testing.T) {
+	w := newCountingWrapper(t)
+	e := NewEnvelopeCrypt(w, time.Hour)
+	var sealed [][]byte
+	for _, plaintext := range []string{"", "one", "two"} {
+		ct, err := e.Encrypt([]byte(plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := e.Decrypt(ct)
+		if err != nil || string(got) != plaintext {
+			t.Fatalf("round trip %q: %q, %v", plaintext, got, err)
+		}
+		sealed = append(sealed, ct)
+	}
+	if n := w.wraps.Load(); n != 1 {
+		t.Fatalf("wrapped %d data keys, want 1", n)
+	}
+	if !bytes.Equal(envelopeHeader(sealed[1]), envelopeHeader(sealed[2])) {
+		t.Fatal("writes within the TTL used different data keys")
+	}
+	if bytes.Equal(sealed[1][len(envelopeHeader(sealed[1])):], sealed[2][len(envelopeHeader(sealed[2])):]) {
+		t.Fatal("nonce reused")
+	}
+}
+
+func TestEnvelopeRotatesDataKeyAfterTTL(t *testing.T) {
+	w := newCountingWrapper(t)
+	ttl := 20 * time.Millisecond
+	e := NewEnvelopeCrypt(w, ttl)
+	first, err := e.Encrypt([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * ttl)
+	second, err := e.Encrypt([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := w.wraps.Load(); n != 2 {
+		t.Fatalf("wrapped %d data keys, want 2", n)
+	}
+	if bytes.Equal(envelopeHeader(first), envelopeHeader(second)) {
+		t.Fatal("data key not rotated after its TTL")
+	}
+	// Objects sealed with an expired data key stay readable.
+	if got, err := e.Decrypt(first); err != nil || string(got) != "first" {
+		t.Fatalf("old data key: %q, %v", got, err)
+	}
+	if NewEnvelopeCrypt(w, 0).ttl != DefaultDataKeyTTL {
+		t.Fatal("zero TTL does not fall back to the default")
+	}
+}
+
+func TestEnvelopeRejectsTampering(t *testing.T) {
+	w := newCountingWrapper(t)
+	e := NewEnvelopeCrypt(w, time.Hour)
+	sealed, err := e.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := len(envelopeHeader(sealed))
+	for name, mutate := range map[string]func([]byte){
+		"version":     func(b []byte) { b[0] = 2 },
+		"wrapped key": func(b []byte) { b[envelopeHeaderSize] ^= 1 },
+		"nonce":       func(b []byte) { b[header] ^= 1 },
+		"ciphertext":  func(b []byte) { b[len(b)-1] ^= 1 },
+	} {
+		tampered := bytes.Clone(sealed)
+		mutate(tampered)
+		if _, err := e.Decrypt(tampered); err == nil {
+			t.Errorf("accepted a changed %s", name)
+		}
+	}
+	for _, short := range [][]byte{nil, sealed[:2], sealed[:header-1], sealed[:header+4]} {
+		if _, err := e.Decrypt(short); err == nil {
+			t.Errorf("accepted %d bytes", len(short))
+		}
+	}
+}
+
+func TestEnvelopeReportsWrapFailure(t *testing.T) {
+	w := newCountingWrapper(t)
+	w.fail = errors.New("kms unavailable")
+	e := NewEnvelopeCrypt(w, time.Hour)
+	if _, err := e.Encrypt([]byte("x")); !errors.Is(err, w.fail) {
+		t.Fatalf("encrypt: %v", err)
+	}
+	// The failure is not cached as a data key.
+	w.fail = nil
+	if _, err := e.Encrypt([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+}
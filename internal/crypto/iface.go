@@ -1,7 +1,32 @@
 // internal/crypto/iface.go
 package crypto
 
+import "context"
+
 type Crypt interface {
 	Encrypt([]byte) ([]byte, error)
 	Decrypt([]byte) ([]byte, error)
 }
+
+// ContextCrypt is implemented by layers that want the request context, for
+// example to record trace spans.
+type ContextCrypt interface {
+	EncryptContext(context.Context, []byte) ([]byte, error)
+	DecryptContext(context.Context, []byte) ([]byte, error)
+}
+
+// EncryptContext encrypts with c, passing ctx along if c accepts it.
+func EncryptContext(ctx context.Context, c Crypt, data []byte) ([]byte, error) {
+	if cc, ok := c.(ContextCrypt); ok {
+		return cc.EncryptContext(ctx, data)
+	}
+	return c.Encrypt(data)
+}
+
+// DecryptContext decrypts with c, passing ctx along if c accepts it.
+func DecryptContext(ctx context.Context, c Crypt, data []byte) ([]byte, error) {
+	if cc, ok := c.(ContextCrypt); ok {
+		return cc.DecryptContext(ctx, data)
+	}
+	return c.Decrypt(data)
+}
@@ -0,0 +1,172 @@
+// internal/crypto/keygen.go
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/daead"
+	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/streamingaead"
+	"github.com/google/tink/go/tink"
+
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+)
+
+// DefaultTinkTemplate is the template a "tink" layer gets unless another one
+// is asked for.
+const DefaultTinkTemplate = "aes256-gcm"
+
+// TinkTemplates are the Tink key templates a "tink" layer can be generated
+// with, by name.
+var TinkTemplates = map[string]func() *tinkpb.KeyTemplate{
+	"aes128-gcm":             aead.AES128GCMKeyTemplate,
+	"aes256-gcm":             aead.AES256GCMKeyTemplate,
+	"aes256-gcm-raw":         aead.AES256GCMNoPrefixKeyTemplate,
+	"aes128-ctr-hmac-sha256": aead.AES128CTRHMACSHA256KeyTemplate,
+	"aes256-ctr-hmac-sha256": aead.AES256CTRHMACSHA256KeyTemplate,
+	"chacha20-poly1305":      aead.ChaCha20Poly1305KeyTemplate,
+	"xchacha20-poly1305":     aead.XChaCha20Poly1305KeyTemplate,
+
+	"aes256-siv": daead.AESSIVKeyTemplate,
+
+	"ecies-p256-aes128-gcm":             hybrid.ECIESHKDFAES128GCMKeyTemplate,
+	"ecies-p256-aes128-ctr-hmac-sha256": hybrid.ECIESHKDFAES128CTRHMACSHA256KeyTemplate,
+	"hpke-x25519-aes128-gcm":            hybrid.DHKEM_X25519_HKDF_SHA256_HKDF_SHA256_AES_128_GCM_Key_Template,
+	"hpke-x25519-aes256-gcm":            hybrid.DHKEM_X25519_HKDF_SHA256_HKDF_SHA256_AES_256_GCM_Key_Template,
+	"hpke-x25519-chacha20-poly1305":     hybrid.DHKEM_X25519_HKDF_SHA256_HKDF_SHA256_CHACHA20_POLY1305_Key_Template,
+
+	"streaming-aes128-gcm-hkdf-4kb":        streamingaead.AES128GCMHKDF4KBKeyTemplate,
+	"streaming-aes128-gcm-hkdf-1mb":        streamingaead.AES128GCMHKDF1MBKeyTemplate,
+	"streaming-aes256-gcm-hkdf-4kb":        streamingaead.AES256GCMHKDF4KBKeyTemplate,
+	"streaming-aes256-gcm-hkdf-1mb":        streamingaead.AES256GCMHKDF1MBKeyTemplate,
+	"streaming-aes128-ctr-hmac-sha256-4kb": streamingaead.AES128CTRHMACSHA256Segment4KBKeyTemplate,
+	"streaming-aes128-ctr-hmac-sha256-1mb": streamingaead.AES128CTRHMACSHA256Segment1MBKeyTemplate,
+	"streaming-aes256-ctr-hmac-sha256-4kb": streamingaead.AES256CTRHMACSHA256Segment4KBKeyTemplate,
+	"streaming-aes256-ctr-hmac-sha256-1mb": streamingaead.AES256CTRHMACSHA256Segment1MBKeyTemplate,
+}
+
+// TinkTemplateNames returns the names of TinkTemplates, sorted.
+func TinkTemplateNames() []string {
+	names := make([]string, 0, len(TinkTemplates))
+	for name := range TinkTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewTinkKeyset generates a base64 JSON keyset from a named template. It is
+// encrypted with master unless master is nil.
+func NewTinkKeyset(template string, master tink.AEAD) (string, error) {
+	newTemplate, ok := TinkTemplates[template]
+	if !ok {
+		return "", fmt.Errorf("unknown Tink template: %s", template)
+	}
+	handle, err := keyset.NewHandle(newTemplate())
+	if err != nil {
+		return "", fmt.Errorf("failed to generate new keyset handle: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	writer := keyset.NewJSONWriter(buf)
+	if master != nil {
+		err = handle.Write(writer, master)
+	} else {
+		err = insecurecleartextkeyset.Write(handle, writer)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write keyset: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// NewRawKey generates a base64 key of size bytes for the layers that take
+// a raw key rather than a Tink keyset.
+func NewRawKey(size int) (string, error) {
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Fingerprint identifies a base64 key or keyset without revealing it: the
+// first 8 bytes of the SHA-256 of the decoded key, in hex.
+func Fingerprint(key string) string {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		raw = []byte(key)
+	}
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// DescribeTinkKeyset lists the keys of a base64 JSON keyset: ID, status and
+// key type, with the primary key marked. master opens encrypted keysets
+// and may be nil for cleartext ones.
+func DescribeTinkKeyset(key string, master tink.AEAD) ([]string, error) {
+	handle, err := readTinkKeyset(key, master)
+	if err != nil {
+		return nil, err
+	}
+
+	info := handle.KeysetInfo()
+	var keys []string
+	for _, k := range info.GetKeyInfo() {
+		primary := ""
+		if k.GetKeyId() == info.GetPrimaryKeyId() {
+			primary = " primary"
+		}
+		keyType := k.GetTypeUrl()[strings.LastIndex(k.GetTypeUrl(), ".")+1:]
+		keys = append(keys, fmt.Sprintf("%d %s %s%s",
+			k.GetKeyId(), strings.ToLower(k.GetStatus().String()), keyType, primary))
+	}
+	return keys, nil
+}
+
+// PublicTinkKeyset returns the public half of a base64 JSON hybrid keyset,
+// also as base64 JSON. It holds no secret and is written in the clear even
+// when the private keyset is encrypted with master.
+func PublicTinkKeyset(key string, master tink.AEAD) (string, error) {
+	handle, err := readTinkKeyset(key, master)
+	if err != nil {
+		return "", err
+	}
+	public, err := handle.Public()
+	if err != nil {
+		return "", fmt.Errorf("keyset has no public key: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := public.WriteWithNoSecrets(keyset.NewJSONWriter(buf)); err != nil {
+		return "", fmt.Errorf("failed to write keyset: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func readTinkKeyset(key string, master tink.AEAD) (*keyset.Handle, error) {
+	keysetJSON, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keyset: %v", err)
+	}
+	reader := keyset.NewJSONReader(bytes.NewReader(keysetJSON))
+	var handle *keyset.Handle
+	if master != nil {
+		handle, err = keyset.Read(reader, master)
+	} else {
+		handle, err = insecurecleartextkeyset.Read(reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyset: %v", err)
+	}
+	return handle, nil
+}
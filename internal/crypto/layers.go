@@ -1,6 +1,8 @@
-// internal/crypto/layers.gointernal/crypto/layers.go
+// internal/crypto/layers.go
 package crypto
 
+import "context"
+
 func NewMultiLayerCrypt(layers ...Crypt) *MultiLayerCrypt {
 	return &MultiLayerCrypt{layers: layers}
 }
@@ -10,9 +12,17 @@ type MultiLayerCrypt struct {
 }
 
 func (c *MultiLayerCrypt) Encrypt(data []byte) ([]byte, error) {
+	return c.EncryptContext(context.Background(), data)
+}
+
+func (c *MultiLayerCrypt) Decrypt(data []byte) ([]byte, error) {
+	return c.DecryptContext(context.Background(), data)
+}
+
+func (c *MultiLayerCrypt) EncryptContext(ctx context.Context, data []byte) ([]byte, error) {
 	var err error
 	for _, layer := range c.layers {
-		data, err = layer.Encrypt(data)
+		data, err = EncryptContext(ctx, layer, data)
 		if err != nil {
 			return nil, err
 		}
@@ -20,10 +30,10 @@ func (c *MultiLayerCrypt) Encrypt(data []byte) ([]byte, error) {
 	return data, nil
 }
 
-func (c *MultiLayerCrypt) Decrypt(data []byte) ([]byte, error) {
+func (c *MultiLayerCrypt) DecryptContext(ctx context.Context, data []byte) ([]byte, error) {
 	var err error
 	for i := len(c.layers) - 1; i >= 0; i-- {
-		data, err = c.layers[i].Decrypt(data)
+		data, err = DecryptContext(ctx, c.layers[i], data)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,146 @@
+// internal/crypto/pad.go
+package crypto
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Padding rounds plaintext lengths up so that ciphertext sizes only reveal
+// a size class, not the exact length of an object.
+type Padding struct {
+	scheme    string
+	blockSize int64
+}
+
+// DefaultPadBlockSize is the block of the "block" scheme when none is set.
+const DefaultPadBlockSize = 4096
+
+// padHeaderSize is the real length that precedes a padded block.
+const padHeaderSize = 8
+
+// NewPadding returns a padding scheme: "pow2" pads to the next power of
+// two, "padme" to a Padmé size class, which wastes at most 12% and leaks
+// O(log log n) bits of the length, and "block" to a multiple of blockSize.
+func NewPadding(scheme string, blockSize int) (*Padding, error) {
+	switch scheme {
+	case "pow2", "padme":
+	case "block":
+		if blockSize == 0 {
+			blockSize = DefaultPadBlockSize
+		}
+		if blockSize < 0 {
+			return nil, fmt.Errorf("invalid padding block size: %d", blockSize)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported padding scheme: %s", scheme)
+	}
+	return &Padding{scheme: scheme, blockSize: int64(blockSize)}, nil
+}
+
+// Size returns the padded length of n bytes.
+func (p *Padding) Size(n int64) int64 {
+	if n <= 1 {
+		return n
+	}
+	switch p.scheme {
+	case "pow2":
+		return 1 << bits.Len64(uint64(n-1))
+	case "padme":
+		// Keep the top log2(log2 n)+1 bits of n, rounding the rest up.
+		e := bits.Len64(uint64(n)) - 1
+		s := bits.Len64(uint64(e))
+		mask := int64(1)<<(e-s) - 1
+		return (n + mask) &^ mask
+	}
+	return (n + p.blockSize - 1) / p.blockSize * p.blockSize
+}
+
+// PadCrypt is a pipeline layer that pads instead of encrypting. It must run
+// before the encryption layers: the real length it records is then
+// encrypted and authenticated along with the data.
+type PadCrypt struct {
+	padding *Padding
+}
+
+func NewPadCrypt(p *Padding) *PadCrypt {
+	return &PadCrypt{padding: p}
+}
+
+func (c *PadCrypt) Padding() *Padding {
+	return c.padding
+}
+
+func (c *PadCrypt) Encrypt(plaintext []byte) ([]byte, error) {
+	return c.EncryptContext(context.Background(), plaintext)
+}
+
+func (c *PadCrypt) Decrypt(ciphertext []byte) ([]byte, error) {
+	return c.DecryptContext(context.Background(), ciphertext)
+}
+
+// EncryptContext pads a block, unless ctx comes from WithoutPadding.
+func (c *PadCrypt) EncryptContext(ctx context.Context, plaintext []byte) ([]byte, error) {
+	size := int64(padHeaderSize + len(plaintext))
+	if ctx.Value(unpaddedKey{}) == nil {
+		size = c.padding.Size(size)
+	}
+	out := make([]byte, size)
+	binary.BigEndian.PutUint64(out, uint64(len(plaintext)))
+	copy(out[padHeaderSize:], plaintext)
+	return out, nil
+}
+
+func (c *PadCrypt) DecryptContext(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < padHeaderSize {
+		return nil, errors.New("padded block too short")
+	}
+	n := binary.BigEndian.Uint64(ciphertext)
+	if n > uint64(len(ciphertext)-padHeaderSize) {
+		return nil, errors.New("padded block shorter than its recorded length")
+	}
+	data, padding := ciphertext[padHeaderSize:padHeaderSize+n], ciphertext[padHeaderSize+n:]
+	if !allZero(padding) {
+		return nil, errors.New("padding is not zero")
+	}
+	return data, nil
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type unpaddedKey struct{}
+
+// WithoutPadding returns a context in which pad layers record the length
+// of a block but do not pad it: stream segments, which StreamWriter pads
+// as a whole, and values whose length gives nothing away.
+func WithoutPadding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unpaddedKey{}, true)
+}
+
+// PaddingOf returns the padding of a crypt, if one of its layers pads.
+func PaddingOf(c Crypt) *Padding {
+	if p, ok := c.(interface{ Padding() *Padding }); ok {
+		return p.Padding()
+	}
+	return nil
+}
+
+// Padding returns the padding of the first layer that pads.
+func (c *MultiLayerCrypt) Padding() *Padding {
+	for _, layer := range c.layers {
+		if p := PaddingOf(layer); p != nil {
+			return p
+		}
+	}
+	return nil
+}
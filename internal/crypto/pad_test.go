@@ -0,0 +1,145 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+func mustPadding(t *testing.T, scheme string, blockSize int) *Padding {
+	t.Helper()
+	p, err := NewPadding(scheme, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPaddingSize(t *testing.T) {
+	for _, tc := range []struct {
+		scheme    string
+		blockSize int
+		n, want   int64
+	}{
+		{"pow2", 0, 0, 0},
+		{"pow2", 0, 1, 1},
+		{"pow2", 0, 2, 2},
+		{"pow2", 0, 3, 4},
+		{"pow2", 0, 5, 8},
+		{"pow2", 0, 1024, 1024},
+		{"pow2", 0, 1025, 2048},
+		{"pow2", 0, 1<<40 + 1, 1 << 41},
+
+		// Padmé keeps the top log2(log2 n)+1 bits of n.
+		{"padme", 0, 1, 1},
+		{"padme", 0, 3, 3},
+		{"padme", 0, 8, 8},
+		{"padme", 0, 9, 10},
+		{"padme", 0, 100, 104},
+		{"padme", 0, 1000, 1024},
+		{"padme", 0, 1024, 1024},
+		{"padme", 0, 1025, 1088},
+		{"padme", 0, 1<<20 + 1, 1<<20 + 1<<15},
+
+		{"block", 0, 1, 1},
+		{"block", 0, 2, 4096},
+		{"block", 0, 4096, 4096},
+		{"block", 0, 4097, 8192},
+		{"block", 100, 150, 200},
+		{"block", 100, 200, 200},
+	} {
+		if got := mustPadding(t, tc.scheme, tc.blockSize).Size(tc.n); got != tc.want {
+			t.Errorf("%s/%d Size(%d) = %d, want %d", tc.scheme, tc.blockSize, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestPaddingSizeBounds(t *testing.T) {
+	pow2, padme := mustPadding(t, "pow2", 0), mustPadding(t, "padme", 0)
+	for n := int64(2); n < 1<<16; n++ {
+		if got := pow2.Size(n); got < n || got&(got-1) != 0 || got/2 >= n {
+			t.Fatalf("pow2 Size(%d) = %d", n, got)
+		}
+		if got := padme.Size(n); got < n || float64(got-n) > 0.12*float64(n) {
+			t.Fatalf("padme Size(%d) = %d", n, got)
+		}
+	}
+}
+
+func TestNewPaddingRejects(t *testing.T) {
+	for _, tc := range []struct {
+		scheme    string
+		blockSize int
+	}{
+		{"", 0},
+		{"pow3", 0},
+		{"block", -1},
+	} {
+		if _, err := NewPadding(tc.scheme, tc.blockSize); err == nil {
+			t.Errorf("accepted %q with block size %d", tc.scheme, tc.blockSize)
+		}
+	}
+}
+
+func TestPadCrypt(t *testing.T) {
+	c := NewPadCrypt(mustPadding(t, "pow2", 0))
+	for _, n := range []int{0, 1, 7, 8, 9, 100, 1000} {
+		data := bytes.Repeat([]byte{0xab}, n)
+		padded, err := c.Encrypt(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := c.Padding().Size(int64(padHeaderSize + n)); int64(len(padded)) != want {
+			t.Fatalf("%d bytes padded to %d, want %d", n, len(padded), want)
+		}
+		if got, err := c.Decrypt(padded); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: round trip %x, %v", n, got, err)
+		}
+		unpadded, _ := c.EncryptContext(WithoutPadding(context.Background()), data)
+		if len(unpadded) != padHeaderSize+n {
+			t.Fatalf("%d bytes without padding: got %d", n, len(unpadded))
+		}
+	}
+
+	padded, _ := c.Encrypt([]byte("hello"))
+	for _, tc := range []struct {
+		name  string
+		block []byte
+	}{
+		{"short", padded[:padHeaderSize-1]},
+		{"non-zero padding", func() []byte {
+			b := bytes.Clone(padded)
+			b[len(b)-1] = 1
+			return b
+		}()},
+		{"length too long", func() []byte {
+			b := bytes.Clone(padded)
+			binary.BigEndian.PutUint64(b, uint64(len(b)-padHeaderSize+1))
+			return b
+		}()},
+		{"length overflows", func() []byte {
+			b := bytes.Clone(padded)
+			binary.BigEndian.PutUint64(b, 1<<63)
+			return b
+		}()},
+	} {
+		if _, err := c.Decrypt(tc.block); err == nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+}
+
+func TestPaddingOf(t *testing.T) {
+	p := mustPadding(t, "padme", 0)
+	aes := testCrypt(t)
+	if PaddingOf(aes) != nil {
+		t.Fatal("AES pads")
+	}
+	if got := PaddingOf(NewMultiLayerCrypt(aes)); got != nil {
+		t.Fatal("a profile without a pad layer pads")
+	}
+	if got := PaddingOf(NewMultiLayerCrypt(NewPadCrypt(p), aes)); got != p {
+		t.Fatal("padding of a padded profile not found")
+	}
+}
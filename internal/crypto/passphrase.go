@@ -0,0 +1,167 @@
+// internal/crypto/passphrase.go
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// ErrWrongPassphrase is returned when a passphrase does not match the
+// verification tag of a derived key or does not open a wrapped keyset.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// Argon2Params are the Argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// DefaultArgon2Params cost about a tenth of a second and 64 MiB per
+// derivation, which the proxy only does at startup and on reloads.
+var DefaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// maxArgon2Memory keeps a mistyped parameter from exhausting memory.
+const maxArgon2Memory = 4 * 1024 * 1024
+
+// Check reports parameters Argon2id cannot run with.
+func (p Argon2Params) Check() error {
+	switch {
+	case p.Time < 1:
+		return errors.New("argon2id time must be at least 1")
+	case p.Threads < 1:
+		return errors.New("argon2id threads must be at least 1")
+	case p.Memory < 8*uint32(p.Threads):
+		return fmt.Errorf("argon2id memory must be at least %d KiB for %d threads", 8*uint32(p.Threads), p.Threads)
+	case p.Memory > maxArgon2Memory:
+		return fmt.Errorf("argon2id memory is over %d KiB", maxArgon2Memory)
+	}
+	return nil
+}
+
+// stretch derives a 32-byte key from a passphrase, and a second,
+// independent 32 bytes that only serve to recognize the passphrase.
+func stretch(passphrase string, salt []byte, p Argon2Params) (key, verifier []byte) {
+	out := argon2.IDKey([]byte(passphrase), salt, p.Time, p.Memory, p.Threads, 64)
+	return out[:32], out[32:]
+}
+
+func checkTag(verifier []byte) []byte {
+	sum := sha256.Sum256(append([]byte("s3-proxy passphrase check\x00"), verifier...))
+	return sum[:16]
+}
+
+// NewDerivedKey picks a salt for a passphrase-derived key and returns it
+// with the verification tag to store next to it, and the key itself as
+// base64.
+func NewDerivedKey(passphrase string, p Argon2Params) (salt, check []byte, key string, err error) {
+	if err := p.Check(); err != nil {
+		return nil, nil, "", err
+	}
+	salt = make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, "", err
+	}
+	k, verifier := stretch(passphrase, salt, p)
+	return salt, checkTag(verifier), base64.StdEncoding.EncodeToString(k), nil
+}
+
+// DeriveKey derives the base64 key of a passphrase. It fails with
+// ErrWrongPassphrase unless the passphrase matches check.
+func DeriveKey(passphrase string, salt, check []byte, p Argon2Params) (string, error) {
+	if err := p.Check(); err != nil {
+		return "", err
+	}
+	k, verifier := stretch(passphrase, salt, p)
+	if subtle.ConstantTimeCompare(checkTag(verifier), check) != 1 {
+		return "", ErrWrongPassphrase
+	}
+	return base64.StdEncoding.EncodeToString(k), nil
+}
+
+// wrappedKeyset is the JSON of a keyset encrypted with a passphrase. It is
+// stored base64 encoded, like the keysets it wraps.
+type wrappedKeyset struct {
+	KDF string `json:"kdf"`
+	Argon2Params
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// WrapKeyset encrypts a keyset, or any key as the config holds it, with a
+// passphrase-derived key.
+func WrapKeyset(keyset, passphrase string, p Argon2Params) (string, error) {
+	if err := p.Check(); err != nil {
+		return "", err
+	}
+	w := wrappedKeyset{KDF: "argon2id", Argon2Params: p, Salt: make([]byte, 16)}
+	if _, err := rand.Read(w.Salt); err != nil {
+		return "", err
+	}
+	key, _ := stretch(passphrase, w.Salt, p)
+	gcm, err := newWrapGCM(key)
+	if err != nil {
+		return "", err
+	}
+	w.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(w.Nonce); err != nil {
+		return "", err
+	}
+	w.Ciphertext = gcm.Seal(nil, w.Nonce, []byte(keyset), []byte(w.KDF))
+	out, err := json.Marshal(w)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// UnwrapKeyset decrypts a keyset wrapped by WrapKeyset. The GCM tag doubles
+// as the verification tag: a wrong passphrase gives ErrWrongPassphrase.
+func UnwrapKeyset(wrapped, passphrase string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return "", errors.New("wrapped keyset is not valid base64")
+	}
+	var w wrappedKeyset
+	if err := json.NewDecoder(bytes.NewReader(raw)).Decode(&w); err != nil || w.KDF == "" {
+		return "", errors.New("keyset is not wrapped with a passphrase")
+	}
+	if w.KDF != "argon2id" {
+		return "", fmt.Errorf("unsupported key derivation %q", w.KDF)
+	}
+	if err := w.Argon2Params.Check(); err != nil {
+		return "", err
+	}
+	key, _ := stretch(passphrase, w.Salt, w.Argon2Params)
+	gcm, err := newWrapGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(w.Nonce) != gcm.NonceSize() {
+		return "", errors.New("wrapped keyset has a malformed nonce")
+	}
+	keyset, err := gcm.Open(nil, w.Nonce, w.Ciphertext, []byte(w.KDF))
+	if err != nil {
+		return "", ErrWrongPassphrase
+	}
+	return string(keyset), nil
+}
+
+func newWrapGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,121 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// cheapArgon2 keeps the tests fast; the parameters are not what matters.
+var cheapArgon2 = Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+func TestDerivedKey(t *testing.T) {
+	salt, check, key, err := NewDerivedKey("correct horse", cheapArgon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 32 {
+		t.Fatalf("key %q is not a base64 32-byte key", key)
+	}
+
+	again, err := DeriveKey("correct horse", salt, check, cheapArgon2)
+	if err != nil || again != key {
+		t.Fatalf("derive = %q, %v, want %q", again, err, key)
+	}
+	if _, err := DeriveKey("correct horse!", salt, check, cheapArgon2); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	otherSalt := append([]byte{}, salt...)
+	otherSalt[0] ^= 1
+	if _, err := DeriveKey("correct horse", otherSalt, check, cheapArgon2); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("wrong salt: %v", err)
+	}
+	if _, err := DeriveKey("correct horse", salt, check, Argon2Params{Time: 2, Memory: 64, Threads: 1}); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("wrong parameters: %v", err)
+	}
+
+	salt2, _, key2, err := NewDerivedKey("correct horse", cheapArgon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(salt2) == string(salt) || key2 == key {
+		t.Fatal("two derivations share a salt or key")
+	}
+}
+
+func TestWrapKeyset(t *testing.T) {
+	const keyset = "c2VjcmV0IGtleXNldCBtYXRlcmlhbA=="
+	wrapped, err := WrapKeyset(keyset, "correct horse", cheapArgon2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnwrapKeyset(wrapped, "correct horse")
+	if err != nil || got != keyset {
+		t.Fatalf("unwrap = %q, %v", got, err)
+	}
+	if _, err := UnwrapKeyset(wrapped, "battery staple"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+
+	tamper := func(fn func(*wrappedKeyset)) string {
+		raw, _ := base64.StdEncoding.DecodeString(wrapped)
+		var w wrappedKeyset
+		if err := json.Unmarshal(raw, &w); err != nil {
+			t.Fatal(err)
+		}
+		fn(&w)
+		out, _ := json.Marshal(w)
+		return base64.StdEncoding.EncodeToString(out)
+	}
+	for _, tc := range []struct {
+		name    string
+		wrapped string
+		wrong   bool
+	}{
+		{"ciphertext", tamper(func(w *wrappedKeyset) { w.Ciphertext[0] ^= 1 }), true},
+		{"tag", tamper(func(w *wrappedKeyset) { w.Ciphertext[len(w.Ciphertext)-1] ^= 1 }), true},
+		{"salt", tamper(func(w *wrappedKeyset) { w.Salt[0] ^= 1 }), true},
+		{"params", tamper(func(w *wrappedKeyset) { w.Time++ }), true},
+		{"nonce length", tamper(func(w *wrappedKeyset) { w.Nonce = w.Nonce[1:] }), false},
+		{"kdf", tamper(func(w *wrappedKeyset) { w.KDF = "scrypt" }), false},
+		{"bad params", tamper(func(w *wrappedKeyset) { w.Threads = 0 }), false},
+		{"plain keyset", keyset, false},
+		{"not base64", "%%%", false},
+	} {
+		_, err := UnwrapKeyset(tc.wrapped, "correct horse")
+		if err == nil {
+			t.Errorf("%s: tampered keyset unwrapped", tc.name)
+		} else if errors.Is(err, ErrWrongPassphrase) != tc.wrong {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+func TestArgon2ParamsCheck(t *testing.T) {
+	for _, tc := range []struct {
+		p  Argon2Params
+		ok bool
+	}{
+		{DefaultArgon2Params, true},
+		{cheapArgon2, true},
+		{Argon2Params{Time: 1, Memory: 8, Threads: 1}, true},
+		{Argon2Params{Time: 1, Memory: 32, Threads: 4}, true},
+		{Argon2Params{Time: 1, Memory: maxArgon2Memory, Threads: 1}, true},
+		{Argon2Params{Time: 0, Memory: 64, Threads: 1}, false},
+		{Argon2Params{Time: 1, Memory: 64, Threads: 0}, false},
+		{Argon2Params{Time: 1, Memory: 7, Threads: 1}, false},
+		{Argon2Params{Time: 1, Memory: 31, Threads: 4}, false},
+		{Argon2Params{Time: 1, Memory: maxArgon2Memory + 1, Threads: 1}, false},
+	} {
+		if err := tc.p.Check(); (err == nil) != tc.ok {
+			t.Errorf("%+v: got %v", tc.p, err)
+		}
+	}
+	if _, _, _, err := NewDerivedKey("x", Argon2Params{}); err == nil {
+		t.Error("derived a key with zero parameters")
+	}
+	if _, err := WrapKeyset("k", "x", Argon2Params{}); err == nil {
+		t.Error("wrapped a keyset with zero parameters")
+	}
+}
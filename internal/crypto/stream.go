@@ -0,0 +1,329 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StreamMagic starts every object written in the segmented stream format.
+// The header that follows it holds a random stream ID, which every frame
+// repeats inside its ciphertext, so segments cannot be moved between
+// objects sealed with the same key. Frames also record how much of the
+// segment is data; the rest is zero padding.
+var StreamMagic = []byte("S3PXSTR3")
+
+// DefaultSegmentSize is the plaintext size of each stream segment when the
+// caller does not choose one.
+const DefaultSegmentSize = 1 << 20
+
+// MaxSegmentSize bounds the segment size a stream header may declare, and
+// so what reading one segment allocates.
+const MaxSegmentSize = 64 << 20
+
+// A frame header is a uint64 sequence number, a final flag, the uint32
+// data length and the stream ID.
+const (
+	streamHeaderSize = 12 // magic + uint32 segment size
+	streamIDSize     = 16
+	frameLengthAt    = 9
+	frameIDAt        = frameLengthAt + 4
+	frameHeaderSize  = frameIDAt + streamIDSize
+)
+
+// IsStream reports whether data starts with the stream format header.
+func IsStream(data []byte) bool {
+	return bytes.HasPrefix(data, StreamMagic)
+}
+
+// StreamPlaintextSize returns the plaintext size of a stream that starts
+// with header and is storedSize bytes long, without decrypting it. It holds
+// for streams sealed by a single layer that adds overhead bytes to every
+// segment and does not pad, such as AESCrypt alone. header must hold at
+// least the stream header.
+func StreamPlaintextSize(header []byte, storedSize int64, overhead int) (int64, error) {
+	if len(header) < streamHeaderSize || !bytes.HasPrefix(header, StreamMagic) {
+		return 0, errors.New("not a stream-format object")
+	}
+	segmentSize := int64(binary.BigEndian.Uint32(header[len(StreamMagic):]))
+	if segmentSize <= 0 || segmentSize > MaxSegmentSize {
+		return 0, fmt.Errorf("invalid stream segment size: %d", segmentSize)
+	}
+	// Every frame but the last holds a full segment, and the last one
+	// between nothing and a full segment.
+	frame := int64(4 + overhead + frameHeaderSize)
+	rest := storedSize - streamHeaderSize - streamIDSize - frame
+	if rest < 0 {
+		return 0, errors.New("stream truncated before final segment")
+	}
+	full := rest / (frame + segmentSize)
+	return full*segmentSize + rest - full*(frame+segmentSize), nil
+}
+
+// StreamWriter encrypts a plaintext stream as a sequence of independently
+// sealed segments so that neither side has to hold the whole object. Each
+// segment carries its sequence number and a final flag inside the
+// ciphertext, so reordering, truncation and extension are all detected.
+type StreamWriter struct {
+	ctx         context.Context
+	crypt       Crypt
+	w           io.Writer
+	segmentSize int
+	buf         []byte
+	seq         uint64
+	wroteHeader bool
+	closed      bool
+	id          [streamIDSize]byte
+	// padding, when the crypt pads, pads the whole stream: the last data
+	// segment is filled with zeros and zero segments follow, so the
+	// object's size only depends on its padded length.
+	padding *Padding
+	size    int64
+}
+
+func NewStreamWriter(c Crypt, w io.Writer, segmentSize int) *StreamWriter {
+	return NewStreamWriterContext(context.Background(), c, w, segmentSize)
+}
+
+// NewStreamWriterContext is like NewStreamWriter but passes ctx to every
+// segment encryption.
+func NewStreamWriterContext(ctx context.Context, c Crypt, w io.Writer, segmentSize int) *StreamWriter {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	segmentSize = min(segmentSize, MaxSegmentSize)
+	s := &StreamWriter{
+		ctx:         ctx,
+		crypt:       c,
+		w:           w,
+		segmentSize: segmentSize,
+		padding:     PaddingOf(c),
+	}
+	if s.padding != nil {
+		s.ctx = WithoutPadding(ctx)
+	}
+	rand.Read(s.id[:])
+	s.buf = make([]byte, frameHeaderSize, frameHeaderSize+segmentSize)
+	return s
+}
+
+func (s *StreamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, because the
+		// last segment has to be flagged as final.
+		if len(s.buf)-frameHeaderSize == s.segmentSize {
+			if err := s.flush(false, s.segmentSize); err != nil {
+				return written, err
+			}
+		}
+		n := s.segmentSize - (len(s.buf) - frameHeaderSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+		s.size += int64(n)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final segment, after padding the stream if the crypt
+// pads. It does not close the underlying writer.
+func (s *StreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.padding == nil {
+		return s.flush(true, len(s.buf)-frameHeaderSize)
+	}
+	pad := s.padding.Size(s.size) - s.size
+	data := len(s.buf) - frameHeaderSize
+	for {
+		n := int(min(int64(s.segmentSize-(len(s.buf)-frameHeaderSize)), pad))
+		s.buf = append(s.buf, make([]byte, n)...)
+		pad -= int64(n)
+		if err := s.flush(pad == 0, data); err != nil {
+			return err
+		}
+		if pad == 0 {
+			return nil
+		}
+		data = 0
+	}
+}
+
+func (s *StreamWriter) flush(final bool, data int) error {
+	if !s.wroteHeader {
+		header := make([]byte, streamHeaderSize, streamHeaderSize+streamIDSize)
+		copy(header, StreamMagic)
+		binary.BigEndian.PutUint32(header[len(StreamMagic):], uint32(s.segmentSize))
+		header = append(header, s.id[:]...)
+		if _, err := s.w.Write(header); err != nil {
+			return err
+		}
+		s.wroteHeader = true
+	}
+
+	binary.BigEndian.PutUint64(s.buf, s.seq)
+	s.buf[8] = 0
+	if final {
+		s.buf[8] = 1
+	}
+	binary.BigEndian.PutUint32(s.buf[frameLengthAt:], uint32(data))
+	copy(s.buf[frameIDAt:], s.id[:])
+	ciphertext, err := EncryptContext(s.ctx, s.crypt, s.buf)
+	if err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(ciphertext)))
+	if _, err := s.w.Write(length); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(ciphertext); err != nil {
+		return err
+	}
+	s.seq++
+	s.buf = s.buf[:frameHeaderSize]
+	return nil
+}
+
+// StreamReader decrypts an object written by StreamWriter.
+type StreamReader struct {
+	ctx         context.Context
+	crypt       Crypt
+	r           io.Reader
+	segmentSize int
+	seq         uint64
+	plain       []byte
+	final       bool
+	err         error
+	// inTail is set once a frame held padding after its data; the stream
+	// is read to its end to check that only padding follows.
+	inTail bool
+	// id is the stream ID every frame must carry.
+	id []byte
+}
+
+// NewStreamReader reads the stream header and decrypts the first segment, so
+// a wrong key or a foreign object is reported before any plaintext is
+// returned.
+func NewStreamReader(c Crypt, r io.Reader) (*StreamReader, error) {
+	return NewStreamReaderContext(context.Background(), c, r)
+}
+
+// NewStreamReaderContext is like NewStreamReader but passes ctx to every
+// segment decryption.
+func NewStreamReaderContext(ctx context.Context, c Crypt, r io.Reader) (*StreamReader, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading stream header: %w", err)
+	}
+	if !IsStream(header) {
+		return nil, errors.New("not a stream-format object")
+	}
+	s := &StreamReader{
+		ctx:         ctx,
+		crypt:       c,
+		r:           r,
+		segmentSize: int(binary.BigEndian.Uint32(header[len(StreamMagic):])),
+		id:          make([]byte, streamIDSize),
+	}
+	if s.segmentSize <= 0 || s.segmentSize > MaxSegmentSize {
+		return nil, fmt.Errorf("invalid stream segment size: %d", s.segmentSize)
+	}
+	if _, err := io.ReadFull(r, s.id); err != nil {
+		return nil, fmt.Errorf("reading stream header: %w", err)
+	}
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *StreamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.final {
+			s.err = s.checkTrailing()
+			continue
+		}
+		if err := s.next(); err != nil {
+			s.err = err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *StreamReader) next() error {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(s.r, length); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("stream truncated before final segment")
+		}
+		return err
+	}
+	// Layers may expand a segment (padding, incompressible data), but never
+	// by more than this.
+	n := int(binary.BigEndian.Uint32(length))
+	if n > 4*s.segmentSize+1<<16 {
+		return fmt.Errorf("stream segment too large: %d bytes", n)
+	}
+	ciphertext := make([]byte, n)
+	if _, err := io.ReadFull(s.r, ciphertext); err != nil {
+		return err
+	}
+	frame, err := DecryptContext(s.ctx, s.crypt, ciphertext)
+	if err != nil {
+		return err
+	}
+	if len(frame) < frameHeaderSize {
+		return errors.New("stream segment too short")
+	}
+	if len(frame) > frameHeaderSize+s.segmentSize {
+		return fmt.Errorf("stream segment too large: %d bytes", len(frame))
+	}
+	if seq := binary.BigEndian.Uint64(frame); seq != s.seq {
+		return fmt.Errorf("stream segment out of order: got %d, want %d", seq, s.seq)
+	}
+	if !bytes.Equal(frame[frameIDAt:frameHeaderSize], s.id) {
+		return errors.New("stream segment belongs to another object")
+	}
+	s.seq++
+	s.final = frame[8] == 1
+	s.plain = frame[frameHeaderSize:]
+	data := int(binary.BigEndian.Uint32(frame[frameLengthAt:]))
+	switch {
+	case data > len(s.plain):
+		return errors.New("stream segment shorter than its data")
+	case s.inTail && data > 0:
+		return errors.New("stream data after padding")
+	case !allZero(s.plain[data:]):
+		return errors.New("stream padding is not zero")
+	}
+	s.inTail = s.inTail || data < len(s.plain)
+	s.plain = s.plain[:data]
+	return nil
+}
+
+func (s *StreamReader) checkTrailing() error {
+	var b [1]byte
+	if _, err := io.ReadFull(s.r, b[:]); err == nil {
+		return errors.New("unexpected data after final stream segment")
+	}
+	return io.EOF
+}
@@ -0,0 +1,251 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func testCrypt(t *testing.T) Crypt {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	c, err := NewAESCrypt(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func writeStream(t *testing.T, c Crypt, data []byte, segmentSize int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewStreamWriter(c, &buf, segmentSize)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readStream(c Crypt, stored []byte) ([]byte, error) {
+	r, err := NewStreamReader(c, bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// streamFrames splits a stored stream into its header and its frames,
+// length prefixes included.
+func streamFrames(t *testing.T, stored []byte) ([]byte, [][]byte) {
+	t.Helper()
+	header := streamHeaderSize
+	if bytes.HasPrefix(stored, StreamMagic) {
+		header += streamIDSize
+	}
+	var frames [][]byte
+	for rest := stored[header:]; len(rest) > 0; {
+		n := 4 + int(binary.BigEndian.Uint32(rest))
+		frames = append(frames, rest[:n])
+		rest = rest[n:]
+	}
+	return stored[:header], frames
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	c := testCrypt(t)
+	for _, size := range []int{0, 1, 99, 100, 101, 1000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		got, err := readStream(c, writeStream(t, c, data, 100))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestStreamRejectsSegmentSize(t *testing.T) {
+	c := testCrypt(t)
+	for _, size := range []uint32{0, MaxSegmentSize + 1, 1<<32 - 1} {
+		stored := writeStream(t, c, []byte("hello"), 100)
+		binary.BigEndian.PutUint32(stored[len(StreamMagic):], size)
+		if _, err := readStream(c, stored); err == nil {
+			t.Fatalf("accepted segment size %d", size)
+		}
+	}
+}
+
+func TestStreamRejectsSplicedSegments(t *testing.T) {
+	c := testCrypt(t)
+	a := writeStream(t, c, bytes.Repeat([]byte("a"), 300), 100)
+	b := writeStream(t, c, bytes.Repeat([]byte("b"), 300), 100)
+	headerA, framesA := streamFrames(t, a)
+	_, framesB := streamFrames(t, b)
+
+	spliced := append([]byte{}, headerA...)
+	spliced = append(spliced, framesA[0]...)
+	spliced = append(spliced, framesB[1]...)
+	spliced = append(spliced, framesA[2]...)
+	if _, err := readStream(c, spliced); err == nil {
+		t.Fatal("accepted a segment of another object")
+	}
+}
+
+func TestPaddedStreamRoundTrip(t *testing.T) {
+	aes := testCrypt(t)
+	for _, scheme := range []string{"pow2", "padme", "block"} {
+		c := NewMultiLayerCrypt(NewPadCrypt(mustPadding(t, scheme, 256)), aes)
+		for _, size := range []int{0, 1, 99, 100, 101, 250, 300, 1000} {
+			data := make([]byte, size)
+			rand.Read(data)
+			stored := writeStream(t, c, data, 100)
+			got, err := readStream(c, stored)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s size %d: %v", scheme, size, err)
+			}
+		}
+	}
+
+	// Sizes in one class are stored the same.
+	c := NewMultiLayerCrypt(NewPadCrypt(mustPadding(t, "pow2", 0)), aes)
+	a := writeStream(t, c, make([]byte, 300), 100)
+	b := writeStream(t, c, make([]byte, 500), 100)
+	if len(a) != len(b) {
+		t.Fatalf("300 and 500 bytes stored as %d and %d", len(a), len(b))
+	}
+	if d := writeStream(t, c, make([]byte, 513), 100); len(d) <= len(a) {
+		t.Fatalf("513 bytes stored as %d, like 512", len(d))
+	}
+}
+
+// testFrame is a segment of a stream built by hand.
+type testFrame struct {
+	data  string
+	pad   int
+	fill  byte
+	final bool
+}
+
+// sealStream builds a stream in the current format from explicit frames,
+// to produce streams StreamWriter never writes.
+func sealStream(t *testing.T, c Crypt, segmentSize int, frames []testFrame) []byte {
+	t.Helper()
+	id := make([]byte, streamIDSize)
+	rand.Read(id)
+	stored := append([]byte{}, StreamMagic...)
+	stored = binary.BigEndian.AppendUint32(stored, uint32(segmentSize))
+	stored = append(stored, id...)
+	for i, f := range frames {
+		frame := binary.BigEndian.AppendUint64(nil, uint64(i))
+		if f.final {
+			frame = append(frame, 1)
+		} else {
+			frame = append(frame, 0)
+		}
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(f.data)))
+		frame = append(frame, id...)
+		frame = append(frame, f.data...)
+		frame = append(frame, bytes.Repeat([]byte{f.fill}, f.pad)...)
+		sealed, err := c.Encrypt(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = binary.BigEndian.AppendUint32(stored, uint32(len(sealed)))
+		stored = append(stored, sealed...)
+	}
+	return stored
+}
+
+func TestStreamRejects(t *testing.T) {
+	c := testCrypt(t)
+	for _, tc := range []struct {
+		name   string
+		frames []testFrame
+	}{
+		{"data after padding", []testFrame{{data: "ab", pad: 2}, {data: "cd", final: true}}},
+		{"data after zero segment", []testFrame{{data: "abcd"}, {pad: 4}, {data: "e", final: true}}},
+		{"segment over segment size", []testFrame{{data: "abcdef", final: true}}},
+		{"no final segment", []testFrame{{data: "abcd"}, {data: "ef", pad: 2}}},
+		{"non-zero padding", []testFrame{{data: "ab", pad: 2, fill: 1, final: true}}},
+	} {
+		stored := sealStream(t, c, 4, tc.frames)
+		if _, err := readStream(c, stored); err == nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+
+	stored := sealStream(t, c, 4, []testFrame{{data: "abcd"}, {data: "e", pad: 3}, {pad: 4, final: true}})
+	if got, err := readStream(c, stored); err != nil || string(got) != "abcde" {
+		t.Fatalf("padded stream built by hand: %q, %v", got, err)
+	}
+}
+
+func TestStreamDetectsTampering(t *testing.T) {
+	c := testCrypt(t)
+	stored := writeStream(t, c, bytes.Repeat([]byte("x"), 350), 100)
+	header, frames := streamFrames(t, stored)
+	if len(frames) != 4 {
+		t.Fatalf("got %d frames, want 4", len(frames))
+	}
+	join := func(order ...int) []byte {
+		out := bytes.Clone(header)
+		for _, i := range order {
+			out = append(out, frames[i]...)
+		}
+		return out
+	}
+	flipped := bytes.Clone(stored)
+	flipped[len(header)+10] ^= 1
+
+	for _, tc := range []struct {
+		name   string
+		stored []byte
+	}{
+		{"header only", header},
+		{"truncated header", stored[:streamHeaderSize+streamIDSize/2]},
+		{"last segment dropped", join(0, 1, 2)},
+		{"cut mid segment", stored[:len(stored)-5]},
+		{"cut in length prefix", stored[:len(join(0, 1, 2))+2]},
+		{"segments swapped", join(0, 2, 1, 3)},
+		{"segment repeated", join(0, 1, 1, 2, 3)},
+		{"first segment dropped", join(1, 2, 3)},
+		{"data after final segment", append(join(0, 1, 2, 3), 0)},
+		{"final segment repeated", join(0, 1, 2, 3, 3)},
+		{"flipped bit", flipped},
+		{"not a stream", []byte("S3PXSTR9 definitely not a stream")},
+	} {
+		if _, err := readStream(c, tc.stored); err == nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+	if got, err := readStream(c, join(0, 1, 2, 3)); err != nil || len(got) != 350 {
+		t.Fatalf("untouched stream: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestStreamPlaintextSize(t *testing.T) {
+	c := testCrypt(t)
+	for _, size := range []int{0, 1, 99, 100, 101, 250, 1000} {
+		stored := writeStream(t, c, make([]byte, size), 100)
+		got, err := StreamPlaintextSize(stored[:64], int64(len(stored)), AESOverhead)
+		if err != nil || got != int64(size) {
+			t.Errorf("%d bytes: got %d, %v", size, got, err)
+		}
+	}
+	if _, err := StreamPlaintextSize([]byte("not a stream"), 100, AESOverhead); err == nil {
+		t.Error("sized a foreign object")
+	}
+	stored := writeStream(t, c, nil, 100)
+	if _, err := StreamPlaintextSize(stored, int64(len(stored)-1), AESOverhead); err == nil {
+		t.Error("sized a truncated stream")
+	}
+}
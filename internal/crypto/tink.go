@@ -6,14 +6,20 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 
 	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/daead"
 	"github.com/google/tink/go/hybrid"
 	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/streamingaead"
 	"github.com/google/tink/go/tink"
 )
 
+// ErrWriteOnly is returned when decrypting with a public-only keyset.
+var ErrWriteOnly = errors.New("keyset holds only a public key and cannot decrypt")
+
 type TinkCrypt struct {
 	encryptor tink.HybridEncrypt
 	decryptor tink.HybridDecrypt
@@ -31,7 +37,26 @@ func NewTinkCrypt(keysetStr string) (*TinkCrypt, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read keyset: %v", err)
 	}
+	return newTinkCryptFromHandle(handle)
+}
+
+// NewEncryptedTinkCrypt is like NewTinkCrypt for a keyset encrypted with
+// masterKey, usually a KMS key, so that the keyset is never stored in the
+// clear.
+func NewEncryptedTinkCrypt(keysetStr string, masterKey tink.AEAD) (*TinkCrypt, error) {
+	keysetJSON, err := base64.StdEncoding.DecodeString(keysetStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keyset: %v", err)
+	}
+
+	handle, err := keyset.Read(keyset.NewJSONReader(bytes.NewReader(keysetJSON)), masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted keyset: %v", err)
+	}
+	return newTinkCryptFromHandle(handle)
+}
 
+func newTinkCryptFromHandle(handle *keyset.Handle) (*TinkCrypt, error) {
 	if a, err := aead.New(handle); err == nil {
 		return &TinkCrypt{
 			encryptor: a,
@@ -39,8 +64,28 @@ func NewTinkCrypt(keysetStr string) (*TinkCrypt, error) {
 		}, nil
 	}
 
-	enc, errEnc := hybrid.NewHybridEncrypt(handle)
+	if d, err := daead.New(handle); err == nil {
+		return &TinkCrypt{
+			encryptor: deterministicCrypt{d},
+			decryptor: deterministicCrypt{d},
+		}, nil
+	}
+
+	if s, err := streamingaead.New(handle); err == nil {
+		return &TinkCrypt{
+			encryptor: streamingCrypt{s},
+			decryptor: streamingCrypt{s},
+		}, nil
+	}
+
+	// A hybrid keyset holds the private key; encryption needs the public
+	// half of it.
 	dec, errDec := hybrid.NewHybridDecrypt(handle)
+	public, errEnc := handle.Public()
+	var enc tink.HybridEncrypt
+	if errEnc == nil {
+		enc, errEnc = hybrid.NewHybridEncrypt(public)
+	}
 	if errEnc == nil && errDec == nil {
 		return &TinkCrypt{
 			encryptor: enc,
@@ -48,6 +93,15 @@ func NewTinkCrypt(keysetStr string) (*TinkCrypt, error) {
 		}, nil
 	}
 
+	// A public keyset can only encrypt, for proxies that must never read
+	// what they write.
+	if enc, err := hybrid.NewHybridEncrypt(handle); err == nil {
+		return &TinkCrypt{
+			encryptor: enc,
+			decryptor: writeOnlyDecrypt{},
+		}, nil
+	}
+
 	return nil, errors.New("unsupported keyset type")
 }
 
@@ -58,3 +112,53 @@ func (t *TinkCrypt) Encrypt(plaintext []byte) ([]byte, error) {
 func (t *TinkCrypt) Decrypt(ciphertext []byte) ([]byte, error) {
 	return t.decryptor.Decrypt(ciphertext, nil)
 }
+
+type writeOnlyDecrypt struct{}
+
+func (writeOnlyDecrypt) Decrypt(ciphertext, contextInfo []byte) ([]byte, error) {
+	return nil, ErrWriteOnly
+}
+
+// deterministicCrypt adapts a Tink deterministic AEAD, such as AES-SIV. The
+// same plaintext always gives the same ciphertext, which suits layers under
+// a randomized one or content that is deduplicated on purpose.
+type deterministicCrypt struct {
+	d tink.DeterministicAEAD
+}
+
+func (c deterministicCrypt) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	return c.d.EncryptDeterministically(plaintext, associatedData)
+}
+
+func (c deterministicCrypt) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	return c.d.DecryptDeterministically(ciphertext, associatedData)
+}
+
+// streamingCrypt adapts a Tink streaming AEAD. Each block of an object is
+// encrypted as a stream of its own.
+type streamingCrypt struct {
+	s tink.StreamingAEAD
+}
+
+func (c streamingCrypt) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := c.s.NewEncryptingWriter(buf, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c streamingCrypt) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	r, err := c.s.NewDecryptingReader(bytes.NewReader(ciphertext), associatedData)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,217 @@
+// internal/escrow/escrow.go
+package escrow
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"sync"
+)
+
+// Bundle is the key material of one crypto profile: the keyset of every
+// layer that has one, as the config would hold it.
+type Bundle struct {
+	CryptoID string `json:"crypto_id"`
+	Keys     []Key  `json:"keys"`
+}
+
+type Key struct {
+	Layer     int    `json:"layer"`
+	Algorithm string `json:"algorithm"`
+	// KMS is set for Tink keysets encrypted by a KMS, which is still
+	// needed to use them.
+	KMS string `json:"kms,omitempty"`
+	// EnvVar and File are where the config read the keyset from, so that
+	// it can be put back there.
+	EnvVar string `json:"env_var,omitempty"`
+	File   string `json:"file,omitempty"`
+	Keyset string `json:"keyset"`
+}
+
+// sharePrefix starts every encoded share, with the format version.
+const sharePrefix = "s3proxy-share-v1:"
+
+// Share is one of the shares a Bundle was split into.
+type Share struct {
+	// SplitID is shared by the shares of one split, so shares of different
+	// splits are never combined.
+	SplitID   [8]byte
+	Threshold int
+	X         byte
+	Y         []byte
+}
+
+// ID identifies the split a share belongs to.
+func (s *Share) ID() string {
+	return hex.EncodeToString(s.SplitID[:])
+}
+
+// String encodes the share as one line of text, with a checksum that
+// catches typos when it is entered by hand.
+func (s *Share) String() string {
+	raw := make([]byte, 0, len(s.SplitID)+2+len(s.Y)+4)
+	raw = append(raw, s.SplitID[:]...)
+	raw = append(raw, byte(s.Threshold), s.X)
+	raw = append(raw, s.Y...)
+	raw = binary.BigEndian.AppendUint32(raw, crc32.ChecksumIEEE(raw))
+	return sharePrefix + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// ParseShare decodes a share encoded with String.
+func ParseShare(text string) (*Share, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(text), sharePrefix)
+	if !ok {
+		return nil, errors.New("not a key share")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(raw) < 8+2+1+4 {
+		return nil, errors.New("malformed key share")
+	}
+	body, sum := raw[:len(raw)-4], raw[len(raw)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, errors.New("key share checksum mismatch, check for typos")
+	}
+	s := &Share{Threshold: int(body[8]), X: body[9], Y: body[10:]}
+	copy(s.SplitID[:], body[:8])
+	if s.X == 0 || s.Threshold < 2 {
+		return nil, errors.New("malformed key share")
+	}
+	return s, nil
+}
+
+// Split splits a bundle into n shares, any threshold of which rebuild it.
+func Split(b *Bundle, n, threshold int) ([]*Share, error) {
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	// The checksum tells a correct recovery from garbage, which is what
+	// mismatched or corrupt shares interpolate to.
+	sum := sha256.Sum256(payload)
+	secret := append(sum[:], payload...)
+	defer clear(secret)
+
+	ys, err := splitSecret(secret, n, threshold)
+	if err != nil {
+		return nil, err
+	}
+	var splitID [8]byte
+	if _, err := rand.Read(splitID[:]); err != nil {
+		return nil, err
+	}
+	shares := make([]*Share, n)
+	for i, y := range ys {
+		shares[i] = &Share{SplitID: splitID, Threshold: threshold, X: byte(i + 1), Y: y}
+	}
+	return shares, nil
+}
+
+// Combine rebuilds a bundle from at least threshold shares of one split.
+func Combine(shares []*Share) (*Bundle, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no key shares")
+	}
+	first := shares[0]
+	var xs []byte
+	var ys [][]byte
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		switch {
+		case s.SplitID != first.SplitID:
+			return nil, fmt.Errorf("key shares come from different splits (%s and %s)", first.ID(), s.ID())
+		case s.Threshold != first.Threshold || len(s.Y) != len(first.Y):
+			return nil, errors.New("key shares do not match")
+		case seen[s.X]:
+			continue
+		}
+		seen[s.X] = true
+		xs = append(xs, s.X)
+		ys = append(ys, s.Y)
+	}
+	if len(xs) < first.Threshold {
+		return nil, fmt.Errorf("only %d of the %d key shares needed", len(xs), first.Threshold)
+	}
+	xs, ys = xs[:first.Threshold], ys[:first.Threshold]
+
+	secret := combineShares(xs, ys)
+	defer clear(secret)
+	if len(secret) < sha256.Size {
+		return nil, errors.New("key shares do not rebuild a key bundle")
+	}
+	sum, payload := secret[:sha256.Size], secret[sha256.Size:]
+	if check := sha256.Sum256(payload); !bytes.Equal(sum, check[:]) {
+		return nil, errors.New("key shares do not rebuild a key bundle, one of them is wrong")
+	}
+	var b Bundle
+	if err := json.Unmarshal(payload, &b); err != nil {
+		return nil, fmt.Errorf("decoding key bundle: %w", err)
+	}
+	return &b, nil
+}
+
+// Collector gathers shares submitted one at a time, for example by
+// several key holders, until a split can be combined.
+type Collector struct {
+	mu     sync.Mutex
+	splits map[[8]byte][]*Share
+}
+
+// SplitStatus is the progress of one split.
+type SplitStatus struct {
+	ID        string `json:"id"`
+	Shares    int    `json:"shares"`
+	Threshold int    `json:"threshold"`
+}
+
+func NewCollector() *Collector {
+	return &Collector{splits: make(map[[8]byte][]*Share)}
+}
+
+// Add records a share and returns the bundle once its split has enough.
+// The split's shares are then forgotten, also when they failed to combine,
+// so that a wrong share can be replaced by submitting the split again. A
+// share already submitted is ignored; one that has the same x coordinate
+// but differs is rejected.
+func (c *Collector) Add(s *Share) (*Bundle, SplitStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shares := c.splits[s.SplitID]
+	for _, have := range shares {
+		if have.X != s.X {
+			continue
+		}
+		status := SplitStatus{s.ID(), len(shares), s.Threshold}
+		if !bytes.Equal(have.Y, s.Y) || have.Threshold != s.Threshold {
+			return nil, status, fmt.Errorf("a different share %d was already submitted", s.X)
+		}
+		return nil, status, nil
+	}
+	shares = append(shares, s)
+	status := SplitStatus{s.ID(), len(shares), s.Threshold}
+	if len(shares) < s.Threshold {
+		c.splits[s.SplitID] = shares
+		return nil, status, nil
+	}
+	delete(c.splits, s.SplitID)
+	b, err := Combine(shares)
+	return b, status, err
+}
+
+// Pending returns the splits that have some but not enough shares.
+func (c *Collector) Pending() []SplitStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := make([]SplitStatus, 0, len(c.splits))
+	for _, shares := range c.splits {
+		status = append(status, SplitStatus{shares[0].ID(), len(shares), shares[0].Threshold})
+	}
+	return status
+}
@@ -0,0 +1,156 @@
+package escrow
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testBundle = &Bundle{
+	CryptoID: "default",
+	Keys: []Key{
+		{Layer: 0, Algorithm: "chacha20poly1305", EnvVar: "CHACHA_KEY", Keyset: "c2VjcmV0IGtleSBvbmU="},
+		{Layer: 1, Algorithm: "tink", KMS: "vault", File: "keys/default-1.json", Keyset: `{"encryptedKeyset":"..."}`},
+	},
+}
+
+func split(t *testing.T, n, threshold int) []*Share {
+	t.Helper()
+	shares, err := Split(testBundle, n, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shares
+}
+
+func TestSplitCombine(t *testing.T) {
+	for _, tc := range []struct {
+		n, threshold int
+		use          []int
+	}{
+		{2, 2, []int{0, 1}},
+		{3, 2, []int{2, 0}},
+		{5, 3, []int{4, 1, 3}},
+		{5, 3, []int{0, 1, 2, 3, 4}},
+		{5, 3, []int{0, 0, 2, 4}},
+	} {
+		shares := split(t, tc.n, tc.threshold)
+		var use []*Share
+		for _, i := range tc.use {
+			use = append(use, shares[i])
+		}
+		b, err := Combine(use)
+		if err != nil {
+			t.Fatalf("%d of %d, shares %v: %v", tc.threshold, tc.n, tc.use, err)
+		}
+		if !reflect.DeepEqual(b, testBundle) {
+			t.Fatalf("%d of %d: got %+v", tc.threshold, tc.n, b)
+		}
+	}
+}
+
+func TestCombineRejects(t *testing.T) {
+	shares := split(t, 5, 3)
+	other := split(t, 5, 3)
+	corrupt := *shares[1]
+	corrupt.Y = append([]byte{}, corrupt.Y...)
+	corrupt.Y[len(corrupt.Y)/2] ^= 1
+	truncated := *shares[1]
+	truncated.Y = truncated.Y[:len(truncated.Y)-1]
+
+	for _, tc := range []struct {
+		name   string
+		shares []*Share
+		want   string
+	}{
+		{"none", nil, "no key shares"},
+		{"below threshold", shares[:2], "only 2 of the 3"},
+		{"duplicates below threshold", []*Share{shares[0], shares[0], shares[1]}, "only 2 of the 3"},
+		{"different splits", []*Share{shares[0], shares[1], other[2]}, "different splits"},
+		{"corrupt y", []*Share{shares[0], &corrupt, shares[2]}, "one of them is wrong"},
+		{"length mismatch", []*Share{shares[0], &truncated, shares[2]}, "do not match"},
+	} {
+		_, err := Combine(tc.shares)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestShareEncoding(t *testing.T) {
+	share := split(t, 3, 2)[1]
+	parsed, err := ParseShare("  " + share.String() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, share) {
+		t.Fatalf("got %+v, want %+v", parsed, share)
+	}
+
+	text := share.String()
+	i := len(sharePrefix) + 20
+	typo := text[:i] + "A" + text[i+1:]
+	if text[i] == 'A' {
+		typo = text[:i] + "B" + text[i+1:]
+	}
+	for _, tc := range []struct{ name, text, want string }{
+		{"typo", typo, "checksum mismatch"},
+		{"no prefix", strings.TrimPrefix(text, sharePrefix), "not a key share"},
+		{"not base64", sharePrefix + "!!!!", "malformed"},
+		{"too short", sharePrefix + "AAAA", "malformed"},
+	} {
+		_, err := ParseShare(tc.text)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	shares := split(t, 3, 2)
+	c := NewCollector()
+
+	b, status, err := c.Add(shares[0])
+	if b != nil || err != nil || status.Shares != 1 || status.Threshold != 2 {
+		t.Fatalf("first share: %v %+v %v", b, status, err)
+	}
+	// The same share again changes nothing.
+	if b, status, err = c.Add(shares[0]); b != nil || err != nil || status.Shares != 1 {
+		t.Fatalf("repeated share: %v %+v %v", b, status, err)
+	}
+	// A share with the same x but another y is a mistake worth reporting.
+	conflicting := *shares[0]
+	conflicting.Y = append([]byte{}, conflicting.Y...)
+	conflicting.Y[0] ^= 1
+	if _, _, err = c.Add(&conflicting); err == nil {
+		t.Fatal("accepted a conflicting share")
+	}
+	if pending := c.Pending(); len(pending) != 1 || pending[0].Shares != 1 {
+		t.Fatalf("pending %+v", pending)
+	}
+
+	b, status, err = c.Add(shares[2])
+	if err != nil || !reflect.DeepEqual(b, testBundle) || status.Shares != 2 {
+		t.Fatalf("completing share: %v %+v %v", b, status, err)
+	}
+	if pending := c.Pending(); len(pending) != 0 {
+		t.Fatalf("split still pending: %+v", pending)
+	}
+}
+
+func TestCollectorForgetsFailedSplit(t *testing.T) {
+	shares := split(t, 3, 2)
+	corrupt := *shares[1]
+	corrupt.Y = append([]byte{}, corrupt.Y...)
+	corrupt.Y[3] ^= 1
+
+	c := NewCollector()
+	c.Add(shares[0])
+	if _, _, err := c.Add(&corrupt); err == nil {
+		t.Fatal("combined a corrupt share")
+	}
+	c.Add(shares[0])
+	if b, _, err := c.Add(shares[1]); err != nil || b == nil {
+		t.Fatalf("resubmitted split: %v %v", b, err)
+	}
+}
@@ -0,0 +1,95 @@
+// internal/escrow/shamir.go
+package escrow
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Shamir's secret sharing over GF(2^8), one polynomial per secret byte. A
+// share is the value of every polynomial at the share's x coordinate; any
+// threshold of them determine the polynomials and so their constant terms,
+// the secret. Fewer reveal nothing about it.
+
+// exp and log tables of GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1 and
+// generator 3.
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = x, x
+		log[x] = byte(i)
+		// x *= 3, i.e. x ^ x*2
+		x2 := x << 1
+		if x&0x80 != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// splitSecret returns n shares of secret, any threshold of which recover
+// it. Share i has x coordinate i+1.
+func splitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("need 2 <= threshold <= shares <= 255, got threshold %d of %d", threshold, n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coeffs := make([]byte, threshold-1)
+	for j, s := range secret {
+		if _, err := rand.Read(coeffs); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			// Horner's rule, highest coefficient first.
+			x := byte(i + 1)
+			y := byte(0)
+			for k := len(coeffs) - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coeffs[k]
+			}
+			shares[i][j] = gfMul(y, x) ^ s
+		}
+	}
+	clear(coeffs)
+	return shares, nil
+}
+
+// combineShares interpolates the polynomials at x = 0 from shares of equal
+// length at distinct, non-zero x coordinates.
+func combineShares(xs []byte, ys [][]byte) []byte {
+	secret := make([]byte, len(ys[0]))
+	for i, xi := range xs {
+		// Lagrange basis polynomial of share i at 0. Subtraction is XOR.
+		basis := byte(1)
+		for j, xj := range xs {
+			if i != j {
+				basis = gfMul(basis, gfDiv(xj, xj^xi))
+			}
+		}
+		for k, y := range ys[i] {
+			secret[k] ^= gfMul(y, basis)
+		}
+	}
+	return secret
+}
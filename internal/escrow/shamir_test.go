@@ -0,0 +1,81 @@
+package escrow
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfDiv(1, byte(a))); got != 1 {
+			t.Fatalf("%d * 1/%d = %d", a, a, got)
+		}
+	}
+}
+
+// subsets calls fn with every subset of k of the indexes 0..n-1.
+func subsets(n, k int, fn func([]int)) {
+	var walk func(start int, picked []int)
+	walk = func(start int, picked []int) {
+		if len(picked) == k {
+			fn(picked)
+			return
+		}
+		for i := start; i < n; i++ {
+			walk(i+1, append(picked, i))
+		}
+	}
+	walk(0, nil)
+}
+
+func TestSplitCombineSecret(t *testing.T) {
+	secret := []byte("the quick brown fox jumps over the lazy dog")
+	for _, tc := range []struct{ n, threshold int }{
+		{2, 2}, {3, 2}, {5, 3}, {6, 6}, {7, 4},
+	} {
+		ys, err := splitSecret(secret, tc.n, tc.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subsets(tc.n, tc.threshold, func(picked []int) {
+			xs := make([]byte, len(picked))
+			sub := make([][]byte, len(picked))
+			for i, p := range picked {
+				xs[i], sub[i] = byte(p+1), ys[p]
+			}
+			if got := combineShares(xs, sub); !bytes.Equal(got, secret) {
+				t.Fatalf("%d of %d, shares %v: got %q", tc.threshold, tc.n, picked, got)
+			}
+		})
+	}
+}
+
+func TestSplitSecretMaxShares(t *testing.T) {
+	secret := []byte{0, 1, 254, 255}
+	ys, err := splitSecret(secret, 255, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xs := []byte{1, 128, 255}
+	got := combineShares(xs, [][]byte{ys[0], ys[127], ys[254]})
+	if !bytes.Equal(got, secret) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestSplitSecretRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		secret       []byte
+		n, threshold int
+	}{
+		{"threshold 1", []byte("s"), 3, 1},
+		{"threshold above shares", []byte("s"), 3, 4},
+		{"too many shares", []byte("s"), 256, 2},
+		{"empty secret", nil, 3, 2},
+	} {
+		if _, err := splitSecret(tc.secret, tc.n, tc.threshold); err == nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// internal/kms/aws.go
+package kms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"s3-proxy/internal/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// awsKMS wraps keys with a symmetric key in AWS KMS or a service speaking
+// its API.
+type awsKMS struct {
+	client *kms.Client
+	keyID  string
+}
+
+func newAWS(cfg config.ConfigKMS) (*awsKMS, error) {
+	if cfg.KeyID == "" {
+		return nil, errors.New("key_id is required")
+	}
+	accessKey, err := cfg.AccessKey.Get()
+	if err != nil {
+		return nil, fmt.Errorf("access key: %w", err)
+	}
+	secretKey, err := cfg.SecretKey.Get()
+	if err != nil {
+		return nil, fmt.Errorf("secret key: %w", err)
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{}
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	if accessKey != "" && secretKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	client := kms.NewFromConfig(awsCfg, func(o *kms.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+	return &awsKMS{client: client, keyID: cfg.KeyID}, nil
+}
+
+func (k *awsKMS) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	out, err := k.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(k.keyID),
+		Plaintext: key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms encrypt: %w", err)
+	}
+	return out.CiphertextBlob, nil
+}
+
+func (k *awsKMS) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := k.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(k.keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt: %w", err)
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,100 @@
+// internal/kms/cache.go
+package kms
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// cached remembers unwrapped keys by their wrapped form, evicting the least
+// recently used once it holds size keys. A negative size disables it.
+// Returned keys are shared and must not be modified.
+type cached struct {
+	KMS
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	wrapped string
+	key     []byte
+	expires time.Time
+}
+
+func newCached(k KMS, ttl time.Duration, size int) *cached {
+	return &cached{
+		KMS:     k,
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *cached) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	wrapped, err := c.KMS.Wrap(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	c.put(string(wrapped), key)
+	return wrapped, nil
+}
+
+func (c *cached) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	if key, ok := c.get(string(wrapped)); ok {
+		return key, nil
+	}
+	key, err := c.KMS.Unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	c.put(string(wrapped), key)
+	return key, nil
+}
+
+func (c *cached) get(wrapped string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[wrapped]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.key, true
+}
+
+func (c *cached) put(wrapped string, key []byte) {
+	if c.size < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[wrapped]; ok {
+		c.remove(el)
+	}
+	c.entries[wrapped] = c.lru.PushFront(&cacheEntry{
+		wrapped: wrapped,
+		key:     bytes.Clone(key),
+		expires: time.Now().Add(c.ttl),
+	})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *cached) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.wrapped)
+}
@@ -0,0 +1,51 @@
+// internal/kms/kms.go
+package kms
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"s3-proxy/internal/config"
+)
+
+// KMS wraps and unwraps data keys with a master key that stays in the key
+// management service.
+type KMS interface {
+	Wrap(ctx context.Context, key []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+const (
+	defaultCacheTTL  = time.Hour
+	defaultCacheSize = 1000
+)
+
+// New connects to the KMS described by cfg. Unwrapped keys are cached as
+// configured, so repeated reads of the same data key do not call the KMS.
+func New(cfg config.ConfigKMS) (KMS, error) {
+	var k KMS
+	var err error
+	switch cfg.Provider {
+	case "aws":
+		k, err = newAWS(cfg)
+	case "vault":
+		k, err = newVault(cfg)
+	case "local":
+		k, err = newLocal(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported KMS provider: %s", cfg.Provider)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kms %s: %w", cfg.ID, err)
+	}
+	ttl := cfg.CacheTTL
+	if ttl == 0 {
+		ttl = defaultCacheTTL
+	}
+	size := cfg.CacheSize
+	if size == 0 {
+		size = defaultCacheSize
+	}
+	return newCached(k, ttl, size), nil
+}
@@ -0,0 +1,148 @@
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"s3-proxy/internal/config"
+)
+
+func localConfig(t *testing.T) config.ConfigKMS {
+	t.Helper()
+	return config.ConfigKMS{
+		ID:       "dev",
+		Provider: "local",
+		Key:      config.MultiSourceString{Data: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))},
+	}
+}
+
+// counting counts the unwraps that reach the KMS behind a cache.
+type counting struct {
+	KMS
+	unwraps atomic.Int32
+}
+
+func (c *counting) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	c.unwraps.Add(1)
+	return c.KMS.Unwrap(ctx, wrapped)
+}
+
+func newCounting(t *testing.T) *counting {
+	t.Helper()
+	l, err := newLocal(localConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &counting{KMS: l}
+}
+
+func TestLocalWrapsKeys(t *testing.T) {
+	k, err := New(localConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, err := k.Wrap(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(wrapped, key) {
+		t.Fatal("key stored in the clear")
+	}
+	if got, err := k.Unwrap(ctx, wrapped); err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("unwrap: %v", err)
+	}
+
+	other := localConfig(t)
+	other.Key.Data = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))
+	k2, err := New(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k2.Unwrap(ctx, wrapped); err == nil {
+		t.Fatal("unwrapped with another master key")
+	}
+
+	short := localConfig(t)
+	short.Key.Data = base64.StdEncoding.EncodeToString(make([]byte, 16))
+	if _, err := New(short); err == nil {
+		t.Fatal("accepted a 16-byte master key")
+	}
+	if _, err := New(config.ConfigKMS{ID: "x", Provider: "gcp"}); err == nil {
+		t.Fatal("accepted an unknown provider")
+	}
+}
+
+func TestCacheSkipsKMSForKnownKeys(t *testing.T) {
+	inner := newCounting(t)
+	c := newCached(inner, time.Hour, 10)
+	ctx := context.Background()
+	key := bytes.Repeat([]byte{1}, 32)
+	wrapped, err := c.Wrap(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if got, err := c.Unwrap(ctx, wrapped); err != nil || !bytes.Equal(got, key) {
+			t.Fatalf("unwrap: %v", err)
+		}
+	}
+	if n := inner.unwraps.Load(); n != 0 {
+		t.Fatalf("a key this cache wrapped was unwrapped by the KMS %d times", n)
+	}
+	// The cache keeps its own copy.
+	key[0] = 9
+	if got, _ := c.Unwrap(ctx, wrapped); got[0] != 1 {
+		t.Fatal("cache shares the caller's key")
+	}
+}
+
+func TestCacheExpiresAndEvicts(t *testing.T) {
+	ctx := context.Background()
+	wrap := func(t *testing.T, k KMS, b byte) []byte {
+		wrapped, err := k.Wrap(ctx, bytes.Repeat([]byte{b}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wrapped
+	}
+
+	inner := newCounting(t)
+	ttl := 20 * time.Millisecond
+	c := newCached(inner, ttl, 10)
+	wrapped := wrap(t, c, 1)
+	time.Sleep(2 * ttl)
+	c.Unwrap(ctx, wrapped)
+	c.Unwrap(ctx, wrapped)
+	if n := inner.unwraps.Load(); n != 1 {
+		t.Fatalf("expired key unwrapped %d times, want 1", n)
+	}
+
+	inner = newCounting(t)
+	c = newCached(inner, time.Hour, 2)
+	a, b := wrap(t, c, 1), wrap(t, c, 2)
+	c.Unwrap(ctx, a) // a is now the most recently used.
+	wrap(t, c, 3)
+	c.Unwrap(ctx, a)
+	if n := inner.unwraps.Load(); n != 0 {
+		t.Fatalf("recently used key evicted")
+	}
+	c.Unwrap(ctx, b)
+	if n := inner.unwraps.Load(); n != 1 {
+		t.Fatalf("least recently used key not evicted")
+	}
+
+	inner = newCounting(t)
+	c = newCached(inner, time.Hour, -1)
+	wrapped = wrap(t, c, 1)
+	c.Unwrap(ctx, wrapped)
+	c.Unwrap(ctx, wrapped)
+	if n := inner.unwraps.Load(); n != 2 {
+		t.Fatalf("disabled cache unwrapped %d times, want 2", n)
+	}
+}
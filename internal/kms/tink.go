@@ -0,0 +1,33 @@
+// internal/kms/tink.go
+package kms
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/tink/go/tink"
+)
+
+// AEAD adapts k to Tink's AEAD interface, for reading and writing Tink
+// keysets encrypted by the KMS.
+func AEAD(k KMS) tink.AEAD {
+	return tinkAEAD{k}
+}
+
+type tinkAEAD struct {
+	kms KMS
+}
+
+func (a tinkAEAD) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	if len(associatedData) > 0 {
+		return nil, errors.New("kms: associated data is not supported")
+	}
+	return a.kms.Wrap(context.Background(), plaintext)
+}
+
+func (a tinkAEAD) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	if len(associatedData) > 0 {
+		return nil, errors.New("kms: associated data is not supported")
+	}
+	return a.kms.Unwrap(context.Background(), ciphertext)
+}
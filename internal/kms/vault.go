@@ -0,0 +1,135 @@
+// internal/kms/vault.go
+package kms
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"s3-proxy/internal/config"
+)
+
+// vaultTimeout bounds each Vault Transit request.
+const vaultTimeout = 10 * time.Second
+
+// vaultTransit wraps keys with a Vault Transit encryption key. Wrapped keys
+// are Transit ciphertexts ("vault:v1:...").
+type vaultTransit struct {
+	client    *http.Client
+	baseURL   string
+	keyID     string
+	token     string
+	namespace string
+}
+
+func newVault(cfg config.ConfigKMS) (*vaultTransit, error) {
+	if cfg.KeyID == "" {
+		return nil, errors.New("key_id is required")
+	}
+	address := cfg.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, errors.New("no address configured and VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if cfg.Token.IsSet() {
+		var err error
+		if token, err = cfg.Token.Get(); err != nil {
+			return nil, fmt.Errorf("token: %w", err)
+		}
+	}
+	if token == "" {
+		return nil, errors.New("no token configured and VAULT_TOKEN is not set")
+	}
+	mount := cfg.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+	return &vaultTransit{
+		client:    &http.Client{Timeout: vaultTimeout},
+		baseURL:   strings.TrimSuffix(address, "/") + "/v1/" + strings.Trim(mount, "/"),
+		keyID:     cfg.KeyID,
+		token:     token,
+		namespace: cfg.Namespace,
+	}, nil
+}
+
+func (v *vaultTransit) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	in := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}
+	if err := v.call(ctx, v.keyURL("encrypt"), in, &out); err != nil {
+		return nil, fmt.Errorf("vault transit encrypt: %w", err)
+	}
+	if out.Data.Ciphertext == "" {
+		return nil, errors.New("vault transit encrypt: empty ciphertext")
+	}
+	return []byte(out.Data.Ciphertext), nil
+}
+
+func (v *vaultTransit) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	in := map[string]string{"ciphertext": string(wrapped)}
+	if err := v.call(ctx, v.keyURL("decrypt"), in, &out); err != nil {
+		return nil, fmt.Errorf("vault transit decrypt: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(out.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("vault transit decrypt: %w", err)
+	}
+	return key, nil
+}
+
+func (v *vaultTransit) keyURL(op string) string {
+	return v.baseURL + "/" + op + "/" + url.PathEscape(v.keyID)
+}
+
+func (v *vaultTransit) call(ctx context.Context, u string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var verr struct {
+			Errors []string `json:"errors"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &verr) == nil && len(verr.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(verr.Errors, "; "))
+		}
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
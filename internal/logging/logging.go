@@ -0,0 +1,201 @@
+// internal/logging/logging.go
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"s3-proxy/internal/config"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup installs the process-wide logger described by cfg. Output from the
+// standard log package is routed through it as well, so nothing bypasses
+// redaction.
+func Setup(cfg config.ConfigLogging) error {
+	logger, err := New(os.Stderr, cfg)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// New returns a logger writing to w that redacts secrets, tags records with
+// the request they belong to and applies per-bucket and per-user debug.
+func New(w io.Writer, cfg config.ConfigLogging) (*slog.Logger, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	// The inner handler accepts everything; Handler.Enabled decides.
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var inner slog.Handler
+	switch cfg.Format {
+	case "", "json":
+		inner = slog.NewJSONHandler(w, opts)
+	case "text":
+		inner = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unsupported log format: %s", cfg.Format)
+	}
+	return slog.New(&Handler{
+		inner:   inner,
+		level:   level,
+		buckets: toSet(cfg.Debug.Buckets),
+		users:   toSet(cfg.Debug.Users),
+	}), nil
+}
+
+// ParseLevel maps a config level name to a slog level. Empty means info.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unsupported log level: %s", name)
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// Handler is the slog handler installed by New.
+type Handler struct {
+	inner   slog.Handler
+	level   slog.Level
+	buckets map[string]bool
+	users   map[string]bool
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= h.level {
+		return true
+	}
+	req := fromContext(ctx)
+	if req == nil {
+		return false
+	}
+	bucket, user := req.get()
+	return h.buckets[bucket] || h.users[user]
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	out := slog.NewRecord(record.Time, record.Level, Redact(record.Message), record.PC)
+	if req := fromContext(ctx); req != nil {
+		out.AddAttrs(slog.String("request_id", req.id))
+		bucket, user := req.get()
+		if bucket != "" {
+			out.AddAttrs(slog.String("bucket", bucket))
+		}
+		if user != "" {
+			out.AddAttrs(slog.String("user", user))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		out.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.inner.Handle(ctx, out)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	clone := *h
+	clone.inner = h.inner.WithAttrs(redacted)
+	return &clone
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.inner = h.inner.WithGroup(name)
+	return &clone
+}
+
+// requestInfo is what the handler knows about the request a record belongs
+// to. Bucket and user are filled in as the request is parsed.
+type requestInfo struct {
+	id     string
+	mu     sync.Mutex
+	bucket string
+	user   string
+}
+
+func (r *requestInfo) get() (string, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bucket, r.user
+}
+
+type contextKey struct{}
+
+func fromContext(ctx context.Context) *requestInfo {
+	if ctx == nil {
+		return nil
+	}
+	req, _ := ctx.Value(contextKey{}).(*requestInfo)
+	return req
+}
+
+// WithRequest starts tracking a request under id.
+func WithRequest(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, &requestInfo{id: id})
+}
+
+// RequestID returns the ID set by WithRequest, or "".
+func RequestID(ctx context.Context) string {
+	if req := fromContext(ctx); req != nil {
+		return req.id
+	}
+	return ""
+}
+
+// SetBucket records the bucket a request addresses.
+func SetBucket(ctx context.Context, bucket string) {
+	if req := fromContext(ctx); req != nil {
+		req.mu.Lock()
+		req.bucket = bucket
+		req.mu.Unlock()
+	}
+}
+
+// SetUser records who made a request. It must be a display name, never a
+// credential.
+func SetUser(ctx context.Context, user string) {
+	if req := fromContext(ctx); req != nil {
+		req.mu.Lock()
+		req.user = user
+		req.mu.Unlock()
+	}
+}
+
+// NewRequestID returns a random ID in the style of S3's x-amz-request-id.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
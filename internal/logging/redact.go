@@ -0,0 +1,128 @@
+// internal/logging/redact.go
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are substrings of attribute, header and query parameter
+// names whose values are never logged.
+var sensitiveKeys = []string{
+	"authorization",
+	"secret",
+	"password",
+	"passphrase",
+	"keyset",
+	"token",
+	"signature",
+	"credential",
+	"access_key",
+	"accesskey",
+	"private",
+}
+
+// sensitivePatterns catch secrets embedded in free text such as error
+// messages and raw URLs.
+var sensitivePatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Presigned URL parameters
+	{regexp.MustCompile(`(?i)(X-Amz-(?:Signature|Credential|Security-Token)=)[^&\s"']+`), "${1}" + redacted},
+	// SigV4 Authorization header fields
+	{regexp.MustCompile(`(?i)(Credential=)[^,\s"']+`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)(Signature=)[0-9a-f]+`), "${1}" + redacted},
+	// Tink JSON keysets
+	{regexp.MustCompile(`\{[^{}]*"primaryKeyId"(?s:.*)`), redacted},
+}
+
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, key := range sensitiveKeys {
+		if strings.Contains(name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact removes credentials, signatures and keysets from free text.
+func Redact(s string) string {
+	for _, p := range sensitivePatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// RedactURL returns u as a string with signed query parameters removed.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	clean := *u
+	clean.User = nil
+	query := u.Query()
+	for name := range query {
+		if isSensitive(name) {
+			query.Set(name, redacted)
+		}
+	}
+	clean.RawQuery = query.Encode()
+	return Redact(clean.String())
+}
+
+// RedactHeader returns the header as a log value with sensitive fields
+// masked.
+func RedactHeader(h http.Header) slog.Value {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attrs := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		value := redacted
+		if !isSensitive(name) {
+			value = Redact(strings.Join(h[name], ","))
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if isSensitive(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(Redact(a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		attrs := make([]slog.Attr, len(group))
+		for i, g := range group {
+			attrs[i] = redactAttr(g)
+		}
+		a.Value = slog.GroupValue(attrs...)
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case http.Header:
+			a.Value = RedactHeader(v)
+		case *url.URL:
+			a.Value = slog.StringValue(RedactURL(v))
+		case url.Values:
+			a.Value = slog.StringValue(RedactURL(&url.URL{RawQuery: v.Encode()}))
+		case error:
+			a.Value = slog.StringValue(Redact(v.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,104 @@
+// internal/metrics/metrics.go
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_requests_total",
+		Help: "Client requests handled by the proxy, by operation and HTTP status.",
+	}, []string{"operation", "status"})
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s3proxy_request_duration_seconds",
+		Help:    "Time to handle a client request, by operation and HTTP status.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"operation", "status"})
+	BytesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_client_bytes_received_total",
+		Help: "Object payload bytes received from clients.",
+	}, []string{"bucket"})
+	BytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_client_bytes_sent_total",
+		Help: "Object payload bytes sent to clients.",
+	}, []string{"bucket"})
+
+	BackendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s3proxy_backend_request_duration_seconds",
+		Help:    "Latency of calls to backend S3 services, by backend and SDK operation.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"backend", "operation"})
+	BackendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_backend_errors_total",
+		Help: "Failed calls to backend S3 services, by backend and SDK operation.",
+	}, []string{"backend", "operation"})
+
+	CryptoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s3proxy_crypto_duration_seconds",
+		Help:    "Time spent in a single crypto layer call, by algorithm and direction.",
+		Buckets: prometheus.ExponentialBuckets(0.00005, 2, 16),
+	}, []string{"algorithm", "operation"})
+
+	PartialWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_partial_writes_total",
+		Help: "Writes that reached some but not all backends of a bucket.",
+	}, []string{"bucket"})
+	ReplicationBacklog = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_replication_backlog",
+		Help: "Objects whose replicas are known to have diverged and await repair.",
+	})
+	ReplicationBacklogOldest = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_replication_backlog_oldest_timestamp_seconds",
+		Help: "Unix time of the oldest unrepaired divergence, or 0 when there is none.",
+	})
+	JournalWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3proxy_journal_write_errors_total",
+		Help: "Failed writes of the repair journal file.",
+	})
+
+	MemoryBudget = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_memory_budget_bytes",
+		Help: "Configured byte budget for in-flight payload memory.",
+	})
+	MemoryInUse = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_memory_in_use_bytes",
+		Help: "Payload memory currently reserved by in-flight requests.",
+	})
+	MemoryRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_memory_rejections_total",
+		Help: "Requests answered with SlowDown because the memory budget was exhausted.",
+	}, []string{"operation"})
+
+	ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_config_reloads_total",
+		Help: "Configuration reload attempts, by result (success or failure).",
+	}, []string{"result"})
+	ConfigLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt succeeded (1) or failed (0).",
+	})
+	ConfigLastReloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_config_last_reload_success_timestamp_seconds",
+		Help: "Unix time the running configuration was loaded.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Requests, RequestDuration, BytesReceived, BytesSent,
+		BackendDuration, BackendErrors,
+		CryptoDuration,
+		PartialWrites, ReplicationBacklog, ReplicationBacklogOldest, JournalWriteErrors,
+		MemoryBudget, MemoryInUse, MemoryRejections,
+		ConfigReloads, ConfigLastReloadSuccess, ConfigLastReloadTimestamp,
+	)
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
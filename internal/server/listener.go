@@ -0,0 +1,131 @@
+// internal/server/listener.go
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"s3-proxy/internal/config"
+)
+
+// certCheckInterval bounds how often the certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// Listen opens the listener described by cfg.
+func Listen(cfg config.ConfigListener) (net.Listener, error) {
+	switch cfg.Type {
+	case "", "tcp":
+		return net.Listen("tcp", cfg.Address)
+	case "tls":
+		certs, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("tcp", cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(l, &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.get,
+		}), nil
+	case "unix":
+		// A socket left behind by a previous run would make Listen fail.
+		if info, err := os.Lstat(cfg.Address); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			os.Remove(cfg.Address)
+		}
+		l, err := net.Listen("unix", cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Mode != "" {
+			mode, err := strconv.ParseUint(cfg.Mode, 8, 32)
+			if err != nil {
+				l.Close()
+				return nil, fmt.Errorf("invalid socket mode %q: %w", cfg.Mode, err)
+			}
+			if err := os.Chmod(cfg.Address, fs.FileMode(mode)); err != nil {
+				l.Close()
+				return nil, err
+			}
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("unsupported listener type: %s", cfg.Type)
+}
+
+// certReloader serves a certificate from disk and picks up replacements of
+// the certificate or key file. A replacement that fails to load is logged
+// and the previous certificate stays in use.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls listener needs cert_file and key_file")
+	}
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastCheck) >= certCheckInterval {
+		c.lastCheck = time.Now()
+		if modTime, err := c.latestModTime(); err == nil && !modTime.Equal(c.modTime) {
+			if err := c.reload(); err != nil {
+				slog.Error("TLS certificate reload failed, keeping the previous one", "cert_file", c.certFile, "error", err)
+			} else {
+				slog.Info("TLS certificate reloaded", "cert_file", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
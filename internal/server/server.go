@@ -0,0 +1,124 @@
+// internal/server/server.go
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"s3-proxy/internal/config"
+)
+
+// Defaults for server timeouts left at zero in the config. Read and write
+// timeouts stay unlimited so long transfers are not cut off.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultShutdownTimeout   = 30 * time.Second
+)
+
+// Site is a handler and the listeners it is served on.
+type Site struct {
+	Name      string
+	Listeners config.ConfigListeners
+	Handler   http.Handler
+}
+
+// Run serves every site until ctx is done or one of them fails, then shuts
+// all of them down, letting in-flight requests finish for up to the
+// configured shutdown timeout before closing their connections.
+func Run(ctx context.Context, cfg config.ConfigServer, sites ...Site) error {
+	type bound struct {
+		site     Site
+		server   *http.Server
+		listener net.Listener
+	}
+	var all []bound
+	closeAll := func() {
+		for _, b := range all {
+			b.listener.Close()
+		}
+	}
+	for _, site := range sites {
+		srv := newHTTPServer(cfg, site.Handler)
+		for _, lc := range site.Listeners {
+			l, err := Listen(lc)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			all = append(all, bound{site: site, server: srv, listener: l})
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, len(all))
+	var wg sync.WaitGroup
+	for _, b := range all {
+		wg.Add(1)
+		go func(b bound) {
+			defer wg.Done()
+			slog.Info("listening", "site", b.site.Name, "listener", b.listener.Addr().Network()+":"+b.listener.Addr().String())
+			if err := b.server.Serve(b.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+				cancel()
+			}
+		}(b)
+	}
+	<-ctx.Done()
+
+	timeout := cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	slog.Info("shutting down, draining connections", "timeout", timeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+	defer cancelShutdown()
+	servers := map[*http.Server]bool{}
+	for _, b := range all {
+		servers[b.server] = true
+	}
+	var shutdownWG sync.WaitGroup
+	for srv := range servers {
+		shutdownWG.Add(1)
+		go func(srv *http.Server) {
+			defer shutdownWG.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Warn("drain deadline exceeded, closing remaining connections", "error", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	shutdownWG.Wait()
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+func newHTTPServer(cfg config.ConfigServer, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	if srv.ReadHeaderTimeout <= 0 {
+		srv.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if srv.IdleTimeout <= 0 {
+		srv.IdleTimeout = defaultIdleTimeout
+	}
+	return srv
+}
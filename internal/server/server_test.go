@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"s3-proxy/internal/config"
+)
+
+func unixClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+func TestRunServesEverySite(t *testing.T) {
+	dir := t.TempDir()
+	data, admin := filepath.Join(dir, "data.sock"), filepath.Join(dir, "admin.sock")
+	text := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, body) })
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, config.ConfigServer{ShutdownTimeout: time.Second},
+			Site{Name: "data", Listeners: config.ConfigListeners{{Type: "unix", Address: data}}, Handler: text("data")},
+			Site{Name: "admin", Listeners: config.ConfigListeners{{Type: "unix", Address: admin}}, Handler: text("admin")},
+		)
+	}()
+
+	for socket, want := range map[string]string{data: "data", admin: "admin"} {
+		var got []byte
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := unixClient(socket).Get("http://proxy/")
+			if err == nil {
+				got, _ = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %v", want, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if string(got) != want {
+			t.Fatalf("%s listener answered %q", want, got)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+	if _, err := unixClient(data).Get("http://proxy/"); err == nil {
+		t.Fatal("data listener still open after shutdown")
+	}
+}
+
+func TestRunFailsOnUnusableListener(t *testing.T) {
+	err := Run(context.Background(), config.ConfigServer{},
+		Site{Name: "data", Listeners: config.ConfigListeners{{Type: "quic", Address: ":0"}}, Handler: http.NotFoundHandler()},
+	)
+	if err == nil {
+		t.Fatal("served on an unsupported listener")
+	}
+}
@@ -19,7 +19,7 @@ import (
 
 // Helper function to load configuration and set up the proxy handler for tests
 // In a real-world scenario, you might have different config files for different test setups.
-func setupProxy(t *testing.T) http.Handler {
+func setupProxy(t *testing.T) *api.Proxy {
 	// Attempt to load .env file from the project root.
 	// Adjust path if your test execution directory is different.
 	// This is to ensure environment variables used in main.yaml are available.
@@ -47,7 +47,7 @@ func setupProxy(t *testing.T) http.Handler {
 
 func TestHealthCheck(t *testing.T) {
 	proxyHandler := setupProxy(t)
-	server := httptest.NewServer(proxyHandler)
+	server := httptest.NewServer(proxyHandler.AdminHandler())
 	defer server.Close()
 
 	resp, err := http.Get(server.URL + "/healthz")
@@ -402,3 +402,75 @@ func TestGetAndDeleteObject_ValidAuth(t *testing.T) {
 		t.Fatalf("Verification GET after DELETE returned status %d (expected 404). Body: %s", resp.StatusCode, string(body))
 	}
 }
+
+// TestGetObject_PreservesHeaders PUTs an object with standard headers and user
+// metadata, then checks they come back on GET and HEAD, and that the
+// response-* query parameters override the stored values.
+func TestGetObject_PreservesHeaders(t *testing.T) {
+	proxyHandler := setupProxy(t)
+	server := httptest.NewServer(proxyHandler)
+	defer server.Close()
+
+	authHeaderValue := os.Getenv("AUTH_HEADER_FORMAT") + " Credential=" + os.Getenv("ALLOWED_ACCESS_KEY1") + "/20250516/us-east-1/s3/aws4_request"
+	targetUrl := server.URL + "/test-bucket/e2e-headers-test.json"
+
+	putReq, err := http.NewRequest("PUT", targetUrl, strings.NewReader(`{"hello":"world"}`))
+	if err != nil {
+		t.Fatalf("Failed to create PUT request: %v", err)
+	}
+	putReq.Header.Set("Authorization", authHeaderValue)
+	putReq.Header.Set("Content-Type", "application/json")
+	putReq.Header.Set("Content-Disposition", `attachment; filename="hello.json"`)
+	putReq.Header.Set("Cache-Control", "no-cache")
+	putReq.Header.Set("X-Amz-Meta-Owner", "e2e")
+
+	putResp, err := http.DefaultClient.Do(putReq)
+	if err != nil {
+		t.Fatalf("PUT request failed: %v", err)
+	}
+	defer putResp.Body.Close()
+	if putResp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(putResp.Body)
+		t.Fatalf("All PUT operations failed with status %d. Body: %s", putResp.StatusCode, string(bodyBytes))
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req, err := http.NewRequest(method, targetUrl, nil)
+		if err != nil {
+			t.Fatalf("Failed to create %s request: %v", method, err)
+		}
+		req.Header.Set("Authorization", authHeaderValue)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %v", method, err)
+		}
+		resp.Body.Close()
+
+		expected := map[string]string{
+			"Content-Type":        "application/json",
+			"Content-Disposition": `attachment; filename="hello.json"`,
+			"Cache-Control":       "no-cache",
+			"X-Amz-Meta-Owner":    "e2e",
+		}
+		for name, want := range expected {
+			if got := resp.Header.Get(name); got != want {
+				t.Errorf("%s: expected %s '%s', got '%s'", method, name, want, got)
+			}
+		}
+	}
+
+	req, err := http.NewRequest("GET", targetUrl+"?response-content-type=text/plain", nil)
+	if err != nil {
+		t.Fatalf("Failed to create GET request: %v", err)
+	}
+	req.Header.Set("Authorization", authHeaderValue)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET request failed: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Expected overridden Content-Type 'text/plain', got '%s'", got)
+	}
+}